@@ -14,6 +14,17 @@
  *   This is useful if you want to have multiple identities
  *   or want to keep a token around that has the sysadmin bit set
  *
+ * - Log in by approving it in a browser instead of entering
+ *   a password on this machine (eg a shared or headless server):
+ *     tcli login --device [--client <client_id>]
+ *   The client (default 'tcli') has to be registered as a public
+ *   OAuth2 client that is allowed the 'session' scope.
+ *
+ * - For automation (eg cron jobs) store a personal access token,
+ *   created with 'user token create', in the token file.
+ *   Unlike session tokens these do not expire after a few minutes
+ *   and are not removed when they are refused.
+ *
  * - Enable verbosity with:
  *     ${env_verbose}=<anything>
  *
@@ -32,6 +43,7 @@ import (
 	"net/http"
 	"os"
 	"os/user"
+	"strings"
 
 	"golang.org/x/crypto/ssh/terminal"
 	cc "trident.li/pitchfork/cmd/cli/cmd"
@@ -76,6 +88,37 @@ func http_redir(req *http.Request, via []*http.Request) error {
 	return errors.New("I don't want to be redirected!")
 }
 
+/* 'tcli login --device' */
+func device_login(args []string, server string, tokenfile string) (rc int) {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	device := fs.Bool("device", false, "Log in by approving the login in a browser")
+	client_id := fs.String("client", "tcli", "OAuth2 client_id")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return 1
+	}
+
+	if !*device {
+		terr("Use 'system login <username> <password> [<twofactor>]' or 'login --device'")
+		return 1
+	}
+
+	token, err := cc.DeviceLogin(server, *client_id, verb, output)
+	if err != nil {
+		terr("Error: " + err.Error())
+		return 1
+	}
+
+	verb("Storing new token")
+	token_store(tokenfile, token)
+	output("Logged in\n")
+	return 0
+}
+
+/* Keep in sync with USER_TOKEN_PREFIX in lib/user_token.go */
+const pat_prefix = "pat_"
+
 func CLI(token_name string, env_token string, env_verbose string, env_server string, default_server string) {
 	var tokenfile string
 	var server string
@@ -131,6 +174,10 @@ func CLI(token_name string, env_token string, env_verbose string, env_server str
 
 	args := flag.Args()
 
+	if len(args) > 0 && args[0] == "login" {
+		os.Exit(device_login(args[1:], server, tokenfile))
+	}
+
 	/*
 	 * Read an argument from the CLI,
 	 * useful for passwords that should
@@ -168,8 +215,12 @@ func CLI(token_name string, env_token string, env_verbose string, env_server str
 	} else {
 		/* Unauthorized? Then kill the token */
 		if newtoken == "" && token != "" {
-			verb("Unauthorized, destroy old token")
-			os.Remove(tokenfile)
+			if strings.HasPrefix(token, pat_prefix) {
+				terr("Personal access token refused, it might be expired or revoked")
+			} else {
+				verb("Unauthorized, destroy old token")
+				os.Remove(tokenfile)
+			}
 		} else if newtoken != "" && newtoken != token {
 			verb("Storing new token")
 			token_store(tokenfile, newtoken)
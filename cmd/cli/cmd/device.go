@@ -0,0 +1,164 @@
+package pfclicmd
+
+/*
+ * OAuth2 Device Authorization Grant (RFC8628)
+ *
+ * Logs in without entering a password on this machine:
+ * the user approves the login in their browser, where
+ * they are logged in already, using the shown code.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const device_grant = "urn:ietf:params:oauth:grant-type:device_code"
+
+/* Give up when the server does not tell us how long to wait */
+const device_expires = 600
+
+func device_post(client *http.Client, server string, path string, vals url.Values, out interface{}) (status int, err error) {
+	req, err := http.NewRequest("POST", server+path, strings.NewReader(vals.Encode()))
+	if err != nil {
+		err = errors.New("Request creation failed: " + err.Error())
+		return
+	}
+
+	req.Header.Set("User-Agent", "Trident/Tickly (https://trident.li)")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := client.Do(req)
+	if err != nil {
+		err = errors.New("Request Failed: " + err.Error())
+		return
+	}
+
+	defer res.Body.Close()
+
+	status = res.StatusCode
+
+	err = json.NewDecoder(res.Body).Decode(out)
+	if err != nil {
+		err = errors.New("Invalid response (" + res.Status + "): " + err.Error())
+	}
+
+	return
+}
+
+/* Returns a session token, as a 'system login' would */
+func DeviceLogin(server string, client_id string, verb CLIOutputI, output CLIOutputI) (token string, err error) {
+	var da struct {
+		Device_code               string `json:"device_code"`
+		User_code                 string `json:"user_code"`
+		Verification_uri          string `json:"verification_uri"`
+		Verification_uri_complete string `json:"verification_uri_complete"`
+		Expires_in                int    `json:"expires_in"`
+		Interval                  int    `json:"interval"`
+		Error                     string `json:"error"`
+		Description               string `json:"error_description"`
+	}
+
+	server = strings.TrimRight(server, "/")
+
+	client := &http.Client{
+		CheckRedirect: http_redir,
+	}
+
+	vals := url.Values{}
+	vals.Set("client_id", client_id)
+	vals.Set("scope", "session")
+
+	if verb != nil {
+		verb("Requesting device authorization for client " + client_id)
+	}
+
+	_, err = device_post(client, server, "/oauth2/device_authorization", vals, &da)
+	if err != nil {
+		return
+	}
+
+	if da.Error != "" {
+		err = errors.New("Device authorization failed: " + da.Error + " " + da.Description)
+		return
+	}
+
+	output("To log in, open:\n\n\t" + da.Verification_uri + "\n\nand enter the code:\n\n\t" + da.User_code + "\n\n")
+	if da.Verification_uri_complete != "" {
+		output("Or open directly:\n\n\t" + da.Verification_uri_complete + "\n\n")
+	}
+	output("Waiting for approval...\n")
+
+	interval := da.Interval
+	if interval <= 0 {
+		interval = 5
+	}
+
+	expires_in := da.Expires_in
+	if expires_in <= 0 {
+		expires_in = device_expires
+	}
+
+	deadline := time.Now().Add(time.Duration(expires_in) * time.Second)
+
+	vals = url.Values{}
+	vals.Set("grant_type", device_grant)
+	vals.Set("device_code", da.Device_code)
+	vals.Set("client_id", client_id)
+
+	for time.Now().Before(deadline) {
+		var at struct {
+			Access_token string `json:"access_token"`
+			Error        string `json:"error"`
+			Description  string `json:"error_description"`
+		}
+
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		_, err = device_post(client, server, "/oauth2/token", vals, &at)
+		if err != nil {
+			return
+		}
+
+		switch at.Error {
+		case "":
+			if at.Access_token == "" {
+				err = errors.New("No token received")
+				return
+			}
+
+			token = at.Access_token
+			return
+
+		case "authorization_pending":
+			if verb != nil {
+				verb("Authorization pending")
+			}
+			break
+
+		case "slow_down":
+			/* RFC8628 3.5 */
+			interval += 5
+			break
+
+		case "access_denied":
+			err = errors.New("Login was denied")
+			return
+
+		case "expired_token":
+			err = errors.New("Code expired before it was used")
+			return
+
+		default:
+			err = errors.New("Login failed: " + at.Error + " " + at.Description)
+			return
+		}
+	}
+
+	err = errors.New("Code expired before it was used")
+	return
+}
@@ -98,6 +98,10 @@ func Setup(tname string, ldname string, appname string, version string, copyrigh
 	switch cmd {
 	case "setup_db":
 		err = pf.System_db_setup()
+		if err != nil {
+			break
+		}
+		err = pf.Mail_PGPSetup()
 		break
 
 	case "setup_test_db":
@@ -133,6 +137,7 @@ func Setup(tname string, ldname string, appname string, version string, copyrigh
 			fmt.Println("Error: " + err.Error())
 			return
 		}
+		err = pf.Mail_PGPSetup()
 		break
 
 	case "cleanup_db":
@@ -0,0 +1,427 @@
+package pitchfork
+
+/*
+ * Two-person approval (dual control) of sensitive commands
+ *
+ * Commands listed in approval_commands (eg "user delete", "system set")
+ * do not run directly: Menu() records them as a pending request, with
+ * the complete command line, and mails the other SysAdmins.
+ *
+ * Once a different SysAdmin approves it ('system approval approve <id>')
+ * the command runs with the stored arguments through the normal Cmd()
+ * path, thus with the permission checks of the approver. Requests that
+ * are not decided within approval_hours expire.
+ *
+ * The output of the command is not for the approver: it is kept for
+ * the requester, who can see it once ('system approval output <id>').
+ *
+ * Arguments marked #password are stored, as they are needed to run the
+ * command, but masked when the request is shown or mailed.
+ *
+ * Every step is in the audit log.
+ */
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type PfApproval struct {
+	Id        int
+	Command   string
+	Args      []string
+	Requester string
+	State     string
+	Entered   time.Time
+	Expires   time.Time
+	Approver  string
+	Result    string
+	HasOutput bool
+	Masked    string
+}
+
+/* The command line, with passwords masked */
+func (a PfApproval) CmdLine() string {
+	if a.Masked != "" {
+		return a.Masked
+	}
+
+	return strings.Join(a.Args, " ")
+}
+
+/* The command line of cmd with its arguments, masking #password ones */
+func approval_cmdline(cmd string, argdefs []string, args []string) string {
+	out := []string{cmd}
+
+	for i, arg := range args {
+		if i < len(argdefs) && strings.Contains(argdefs[i], "#password") {
+			arg = "********"
+		}
+
+		out = append(out, arg)
+	}
+
+	return strings.Join(out, " ")
+}
+
+/* Does the command at menu location loc need approval? */
+func approval_needed(loc string) bool {
+	for _, c := range Config.Approval_cmds {
+		if strings.ToLower(strings.TrimSpace(c)) == loc {
+			return true
+		}
+	}
+
+	return false
+}
+
+/* Record the request and tell the other SysAdmins, argdefs are those of the menu entry */
+func approval_request(ctx PfCtx, cmd string, argdefs []string, nargs []string) (err error) {
+	var a PfApproval
+
+	args := append(strings.Split(cmd, " "), nargs...)
+	masked := approval_cmdline(cmd, argdefs, nargs)
+
+	if !ctx.IsLoggedIn() {
+		return errors.New("Not authenticated")
+	}
+
+	username := ctx.TheUser().GetUserName()
+
+	q := "INSERT INTO approval " +
+		"(command, args, requester, expires, cmdline) " +
+		"VALUES($1, $2, $3, NOW() + INTERVAL '" + strconv.Itoa(Config.Approval_hours) + " hours', $4) " +
+		"RETURNING id, expires"
+	err = DB.QueryRowA(ctx,
+		"Requested approval for '$1' by $3",
+		q, cmd, pq.Array(args), username, masked).Scan(&a.Id, &a.Expires)
+	if err != nil {
+		return
+	}
+
+	a.Command = cmd
+	a.Args = args
+	a.Requester = username
+	a.Masked = masked
+
+	approval_notify(ctx, a)
+
+	return errors.New("Command '" + cmd + "' requires approval by a second SysAdmin, pending as request " + strconv.Itoa(a.Id))
+}
+
+/* Mail the SysAdmins, except the requester */
+func approval_notify(ctx PfCtx, a PfApproval) {
+	q := "SELECT ident " +
+		"FROM member " +
+		"WHERE sysadmin " +
+		"AND ident <> $1 " +
+		"ORDER BY ident"
+	rows, err := DB.Query(q, a.Requester)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	var admins []string
+
+	for rows.Next() {
+		var ident string
+
+		err = rows.Scan(&ident)
+		if err != nil {
+			return
+		}
+
+		admins = append(admins, ident)
+	}
+
+	data := map[string]interface{}{
+		"Approval": a,
+		"URL":      System_Get().PublicURL + "/system/approval/",
+	}
+
+	for _, ident := range admins {
+		user := ctx.NewUser()
+		user.SetUserName(ident)
+
+		email, err := user.GetPriEmail(ctx, false)
+		if err != nil {
+			continue
+		}
+
+		Mail_Template(ctx, email, "approval_request", "Approval requested: "+a.Command, data)
+	}
+}
+
+/* Tell the requester about the decision */
+func approval_decided(ctx PfCtx, a PfApproval) {
+	user := ctx.NewUser()
+	user.SetUserName(a.Requester)
+
+	email, err := user.GetPriEmail(ctx, false)
+	if err != nil {
+		return
+	}
+
+	data := map[string]interface{}{
+		"Approval": a,
+	}
+
+	Mail_Template(ctx, email, "approval_decided", "Approval "+a.State+": "+a.Command, data)
+}
+
+func approval_get(id int) (a PfApproval, err error) {
+	var args pq.StringArray
+
+	q := "SELECT id, command, args, requester, " +
+		"CASE WHEN state = 'pending' AND expires <= NOW() THEN 'expired' ELSE state END, " +
+		"entered, expires, COALESCE(approver, ''), result, output <> '', cmdline " +
+		"FROM approval " +
+		"WHERE id = $1"
+	err = DB.QueryRow(q, id).Scan(&a.Id, &a.Command, &args, &a.Requester, &a.State, &a.Entered, &a.Expires, &a.Approver, &a.Result, &a.HasOutput, &a.Masked)
+	if err != nil {
+		return
+	}
+
+	a.Args = args
+	return
+}
+
+/* Pending requests, or all of them */
+func Approval_List(all bool) (approvals []PfApproval, err error) {
+	q := "SELECT id, command, args, requester, " +
+		"CASE WHEN state = 'pending' AND expires <= NOW() THEN 'expired' ELSE state END, " +
+		"entered, expires, COALESCE(approver, ''), result, output <> '', cmdline " +
+		"FROM approval "
+
+	if !all {
+		q += "WHERE state = 'pending' " +
+			"AND expires > NOW() "
+	}
+
+	q += "ORDER BY id DESC"
+
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var a PfApproval
+		var args pq.StringArray
+
+		err = rows.Scan(&a.Id, &a.Command, &args, &a.Requester, &a.State, &a.Entered, &a.Expires, &a.Approver, &a.Result, &a.HasOutput, &a.Masked)
+		if err != nil {
+			return
+		}
+
+		a.Args = args
+		approvals = append(approvals, a)
+	}
+
+	return
+}
+
+/*
+ * Run an approved command, skipping the approval for it
+ *
+ * The output is returned, it is for the requester, not the approver.
+ */
+func (ctx *PfCtxS) approval_run(cmd string, run func() error) (output string, err error) {
+	prev := ctx.Buffered()
+	buffered := ctx.mode_buffered
+	ctx.mode_buffered = true
+
+	ctx.approved = cmd
+	err = run()
+	ctx.approved = ""
+
+	output = ctx.Buffered()
+	ctx.mode_buffered = buffered
+	ctx.output = prev
+	return
+}
+
+/*
+ * Approve a request of another SysAdmin and run it
+ *
+ * The error is that of the command when it failed.
+ */
+func (ctx *PfCtxS) RunApproved(id int) (err error) {
+	if !ctx.IsSysAdmin() {
+		return errors.New("Only a SysAdmin can approve requests")
+	}
+
+	username := ctx.TheUser().GetUserName()
+
+	/* Claim it, so that it only runs once */
+	q := "UPDATE approval " +
+		"SET state = 'approved', approver = $2, decided = NOW() " +
+		"WHERE id = $1 " +
+		"AND state = 'pending' " +
+		"AND expires > NOW() " +
+		"AND requester <> $2"
+	err = DB.Exec(ctx,
+		"Approved request $1",
+		1, q, id, username)
+	if err == ErrNoRows {
+		return errors.New("No such pending request, or it is your own")
+	} else if err != nil {
+		return
+	}
+
+	a, err := approval_get(id)
+	if err != nil {
+		return
+	}
+
+	output, runerr := ctx.approval_run(a.Command, func() error { return ctx.Cmd(a.Args) })
+	a.HasOutput = output != ""
+
+	a.State = "executed"
+	if runerr != nil {
+		a.State = "failed"
+		a.Result = runerr.Error()
+	}
+
+	q = "UPDATE approval " +
+		"SET state = $2, result = $3, output = $4 " +
+		"WHERE id = $1"
+	err = DB.Exec(ctx,
+		"Request $1 $2",
+		1, q, id, a.State, a.Result, output)
+	if err != nil {
+		return
+	}
+
+	approval_decided(ctx, a)
+
+	return runerr
+}
+
+/* The output of an approved request, only for the requester and only once */
+func Approval_Output(ctx PfCtx, id int) (output string, err error) {
+	q := "UPDATE approval a " +
+		"SET output = '' " +
+		"FROM (SELECT id, output FROM approval WHERE id = $1 FOR UPDATE) o " +
+		"WHERE a.id = o.id " +
+		"AND a.requester = $2 " +
+		"AND o.output <> '' " +
+		"RETURNING o.output"
+	err = DB.QueryRowA(ctx,
+		"Retrieved the output of request $1",
+		q, id, ctx.TheUser().GetUserName()).Scan(&output)
+	if err == ErrNoRows {
+		err = errors.New("No output for this request, it is not yours or was already shown")
+	}
+
+	return
+}
+
+/* Reject a request, also for withdrawing one's own */
+func Approval_Reject(ctx PfCtx, id int) (err error) {
+	q := "UPDATE approval " +
+		"SET state = 'rejected', approver = $2, decided = NOW() " +
+		"WHERE id = $1 " +
+		"AND state = 'pending'"
+	err = DB.Exec(ctx,
+		"Rejected request $1",
+		1, q, id, ctx.TheUser().GetUserName())
+	if err == ErrNoRows {
+		return errors.New("No such pending request")
+	} else if err != nil {
+		return
+	}
+
+	a, err := approval_get(id)
+	if err != nil {
+		return
+	}
+
+	approval_decided(ctx, a)
+	return
+}
+
+func approval_list(ctx PfCtx, args []string) (err error) {
+	all := len(args) == 1 && IsTrue(args[0])
+
+	approvals, err := Approval_List(all)
+	if err != nil {
+		return
+	}
+
+	if len(approvals) == 0 {
+		ctx.OutLn("No requests")
+		return
+	}
+
+	for _, a := range approvals {
+		ctx.OutLn("%d %s %s %s: %s", a.Id, a.State, a.Expires.Format(Config.TimeFormat), a.Requester, a.CmdLine())
+	}
+
+	return
+}
+
+func approval_approve(ctx PfCtx, args []string) (err error) {
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errors.New("Invalid request id")
+	}
+
+	err = ctx.RunApproved(id)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Request %d approved and executed", id)
+	return
+}
+
+func approval_output(ctx PfCtx, args []string) (err error) {
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errors.New("Invalid request id")
+	}
+
+	output, err := Approval_Output(ctx, id)
+	if err != nil {
+		return
+	}
+
+	ctx.Out(output)
+	return
+}
+
+func approval_reject(ctx PfCtx, args []string) (err error) {
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return errors.New("Invalid request id")
+	}
+
+	err = Approval_Reject(ctx, id)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Request %d rejected", id)
+	return
+}
+
+func system_approval_menu(ctx PfCtx, args []string) (err error) {
+	menu := NewPfMenu([]PfMEntry{
+		{"list", approval_list, 0, 1, []string{"all#bool"}, PERM_SYS_ADMIN, "List the pending requests, or all of them"},
+		{"approve", approval_approve, 1, 1, []string{"id#int"}, PERM_SYS_ADMIN, "Approve a request of another sysadmin, running it"},
+		{"reject", approval_reject, 1, 1, []string{"id#int"}, PERM_SYS_ADMIN, "Reject a request, or withdraw your own"},
+		{"output", approval_output, 1, 1, []string{"id#int"}, PERM_SYS_ADMIN, "Show the output of your approved request, only once"},
+	})
+
+	err = ctx.Menu(args, menu)
+	return
+}
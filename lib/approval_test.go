@@ -0,0 +1,120 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run Approval -v
+ */
+
+import (
+	"testing"
+)
+
+func TestApproval_Needed(t *testing.T) {
+	Config.Approval_cmds = []string{"user delete", " System Set "}
+	defer func() {
+		Config.Approval_cmds = nil
+	}()
+
+	tsts := map[string]bool{
+		"user delete":     true,
+		"system set":      true,
+		"user":            false,
+		"user delete_all": false,
+		"group remove":    false,
+	}
+
+	for loc, exp := range tsts {
+		if approval_needed(loc) != exp {
+			t.Errorf("approval_needed(%q) != %v", loc, exp)
+		}
+	}
+}
+
+func TestApproval_Menu(t *testing.T) {
+	Config.Approval_cmds = []string{"test run"}
+	defer func() {
+		Config.Approval_cmds = nil
+	}()
+
+	ran := false
+	run := func(ctx PfCtx, args []string) (err error) {
+		ran = true
+		return
+	}
+
+	sub := NewPfMenu([]PfMEntry{
+		{"run", run, 0, 1, []string{"what"}, PERM_NONE, "Run it"},
+	})
+
+	menu := NewPfMenu([]PfMEntry{
+		{"test", func(ctx PfCtx, args []string) error { return ctx.Menu(args, sub) }, 0, -1, nil, PERM_NONE, "Test"},
+	})
+
+	/* Not run, and without a user not recorded either */
+	ctx := &PfCtxS{}
+	err := ctx.Menu([]string{"test", "run", "now"}, menu)
+	if err == nil || ran {
+		t.Errorf("Command ran without approval")
+	}
+
+	/* Approved */
+	ctx = &PfCtxS{approved: "test run"}
+	err = ctx.Menu([]string{"test", "run", "now"}, menu)
+	if err != nil || !ran {
+		t.Errorf("Approved command did not run: %v", err)
+	}
+}
+
+func TestApproval_Output(t *testing.T) {
+	Config.Approval_cmds = []string{"test key"}
+	defer func() {
+		Config.Approval_cmds = nil
+	}()
+
+	key := func(ctx PfCtx, args []string) (err error) {
+		ctx.OutLn("secret")
+		return
+	}
+
+	sub := NewPfMenu([]PfMEntry{
+		{"key", key, 0, 0, nil, PERM_NONE, "Show a key"},
+	})
+
+	menu := NewPfMenu([]PfMEntry{
+		{"test", func(ctx PfCtx, args []string) error { return ctx.Menu(args, sub) }, 0, -1, nil, PERM_NONE, "Test"},
+	})
+
+	/* The approver has output of their own */
+	ctx := &PfCtxS{mode_buffered: true}
+	ctx.OutLn("approver")
+
+	output, err := ctx.approval_run("test key", func() error { return ctx.Menu([]string{"test", "key"}, menu) })
+	if err != nil {
+		t.Fatalf("Approved command failed: %s", err.Error())
+	}
+
+	if output != "secret\n" {
+		t.Errorf("Unexpected output for the requester %q", output)
+	}
+
+	if ctx.Buffered() != "approver\n" {
+		t.Errorf("Output of the command reached the approver")
+	}
+
+	if ctx.approved != "" {
+		t.Errorf("Approval not cleared")
+	}
+}
+
+func TestApproval_CmdLine(t *testing.T) {
+	argdefs := []string{"pwtype", "username", "newpassword#password", "curpassword#password"}
+
+	cl := approval_cmdline("user password set", argdefs, []string{"portal", "alice", "s3cret", "old"})
+	if cl != "user password set portal alice ******** ********" {
+		t.Errorf("Unexpected command line %q", cl)
+	}
+
+	cl = approval_cmdline("user delete", []string{"username"}, []string{"alice"})
+	if cl != "user delete alice" {
+		t.Errorf("Unexpected command line %q", cl)
+	}
+}
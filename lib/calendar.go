@@ -0,0 +1,524 @@
+package pitchfork
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"trident.li/keyval"
+)
+
+type PfCalendarEvent struct {
+	Id         int
+	GroupName  string
+	UID        string
+	Revision   int
+	Title      string
+	Descr      string
+	Location   string
+	Starts     time.Time
+	Ends       time.Time
+	Recurrence string
+	Entered    time.Time
+	UserName   string
+	FullName   string
+	ChangeMsg  string
+}
+
+type PfCalendarRev struct {
+	Revision  int
+	Entered   time.Time
+	UserName  string
+	FullName  string
+	ChangeMsg string
+}
+
+/* Recurrence types, must match the CHECK constraint on calendar_event_rev */
+func Calendar_RecurrenceTypes() (types keyval.KeyVals) {
+	types.Add("none", "Does not repeat")
+	types.Add("daily", "Daily")
+	types.Add("weekly", "Weekly")
+	types.Add("monthly", "Monthly")
+	types.Add("yearly", "Yearly")
+	return
+}
+
+func calendar_chk_recurrence(recurrence string) (out string, err error) {
+	out = strings.ToLower(strings.TrimSpace(recurrence))
+	if out == "" {
+		out = "none"
+	}
+
+	for _, kv := range Calendar_RecurrenceTypes() {
+		if ToString(kv.Key) == out {
+			return
+		}
+	}
+
+	err = errors.New("Unknown recurrence '" + recurrence + "'")
+	return
+}
+
+/*
+ * Parse a time as provided on the CLI (Config.TimeFormat)
+ * or by a HTML datetime-local input, all in UTC
+ */
+func Calendar_ParseTime(what string, val string) (t time.Time, err error) {
+	fmts := []string{Config.TimeFormat, "2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02"}
+
+	val = strings.TrimSpace(val)
+
+	for _, f := range fmts {
+		t, err = time.Parse(f, val)
+		if err == nil {
+			return
+		}
+	}
+
+	err = errors.New("Invalid " + what + " time '" + val + "', expected format " + Config.TimeFormat)
+	return
+}
+
+/* Advance a time by one recurrence step */
+func calendar_step(t time.Time, recurrence string) time.Time {
+	switch recurrence {
+	case "daily":
+		return t.AddDate(0, 0, 1)
+	case "weekly":
+		return t.AddDate(0, 0, 7)
+	case "monthly":
+		return t.AddDate(0, 1, 0)
+	case "yearly":
+		return t.AddDate(1, 0, 0)
+	}
+
+	return t
+}
+
+/*
+ * Return the first occurrence of the event that has not ended yet at 'after'
+ * For non-recurring events this is simply the event itself
+ */
+func (ev *PfCalendarEvent) Next(after time.Time) (starts time.Time, ends time.Time) {
+	starts = ev.Starts
+	ends = ev.Ends
+
+	if ev.Recurrence == "none" || ev.Recurrence == "" {
+		return
+	}
+
+	for ends.Before(after) {
+		starts = calendar_step(starts, ev.Recurrence)
+		ends = calendar_step(ends, ev.Recurrence)
+	}
+
+	return
+}
+
+func (ev *PfCalendarEvent) IsRecurring() bool {
+	return ev.Recurrence != "none" && ev.Recurrence != ""
+}
+
+func (ev *PfCalendarEvent) String() (out string) {
+	out = "Event: " + strconv.Itoa(ev.Id) + "\n"
+	out += "Title: " + ev.Title + "\n"
+	out += "Starts: " + Fmt_Time(ev.Starts) + "\n"
+	out += "Ends: " + Fmt_Time(ev.Ends) + "\n"
+	out += "Location: " + ev.Location + "\n"
+	out += "Recurrence: " + ev.Recurrence + "\n"
+	out += "Revision: " + strconv.Itoa(ev.Revision) + "\n"
+	out += "Updated: " + Fmt_Time(ev.Entered) + " by " + ev.UserName + "\n"
+	out += "\n"
+	out += ev.Descr + "\n"
+	return
+}
+
+func calendar_selectq() string {
+	return "SELECT e.id, e.trustgroup, COALESCE(e.uid, ''), r.revision, r.title, r.descr, r.location, " +
+		"r.starts, r.ends, r.recurrence, r.entered, r.member, member.descr, r.changemsg " +
+		"FROM calendar_event e " +
+		"INNER JOIN calendar_event_rev r ON r.event_id = e.id " +
+		"INNER JOIN member ON r.member = member.ident "
+}
+
+func (ev *PfCalendarEvent) scan(s interface {
+	Scan(dest ...interface{}) error
+}) error {
+	return s.Scan(&ev.Id, &ev.GroupName, &ev.UID, &ev.Revision, &ev.Title, &ev.Descr, &ev.Location,
+		&ev.Starts, &ev.Ends, &ev.Recurrence, &ev.Entered, &ev.UserName, &ev.FullName, &ev.ChangeMsg)
+}
+
+/* Fetch an event of the selected group, the latest revision unless 'rev' is given */
+func (ev *PfCalendarEvent) Fetch(ctx PfCtx, id string, rev string) (err error) {
+	grp := ctx.SelectedGroup()
+
+	event_id, err := strconv.Atoi(id)
+	if err != nil {
+		err = errors.New("Invalid event ID")
+		return
+	}
+
+	q := calendar_selectq() +
+		"WHERE e.trustgroup = $1 " +
+		"AND e.id = $2 "
+
+	var row *Row
+
+	if rev != "" {
+		var revision int
+		revision, err = strconv.Atoi(rev)
+		if err != nil {
+			err = errors.New("Invalid revision")
+			return
+		}
+
+		q += "AND r.revision = $3"
+		row = DB.QueryRow(q, grp.GetGroupName(), event_id, revision)
+	} else {
+		q += "ORDER BY r.revision DESC " +
+			"LIMIT 1"
+		row = DB.QueryRow(q, grp.GetGroupName(), event_id)
+	}
+
+	err = ev.scan(row)
+	if err == ErrNoRows {
+		err = errors.New("No such event")
+	}
+
+	return
+}
+
+/* All events of the selected group, latest revision only, ordered by start */
+func Calendar_List(ctx PfCtx) (events []PfCalendarEvent, err error) {
+	grp := ctx.SelectedGroup()
+
+	events = nil
+
+	q := calendar_selectq() +
+		"WHERE e.trustgroup = $1 " +
+		"AND r.revision = (" +
+		"SELECT MAX(revision) " +
+		"FROM calendar_event_rev " +
+		"WHERE event_id = e.id) " +
+		"ORDER BY r.starts, e.id"
+
+	rows, err := DB.Query(q, grp.GetGroupName())
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var ev PfCalendarEvent
+
+		err = ev.scan(rows)
+		if err != nil {
+			events = nil
+			return
+		}
+
+		events = append(events, ev)
+	}
+
+	return
+}
+
+/* Events that still have an occurrence that did not end yet */
+func Calendar_Upcoming(ctx PfCtx) (events []PfCalendarEvent, err error) {
+	all, err := Calendar_List(ctx)
+	if err != nil {
+		return
+	}
+
+	now := time.Now().UTC()
+
+	for _, ev := range all {
+		if !ev.IsRecurring() && ev.Ends.Before(now) {
+			continue
+		}
+
+		ev.Starts, ev.Ends = ev.Next(now)
+		events = append(events, ev)
+	}
+
+	return
+}
+
+func Calendar_RevisionList(ctx PfCtx, id string) (revs []PfCalendarRev, err error) {
+	grp := ctx.SelectedGroup()
+
+	revs = nil
+
+	event_id, err := strconv.Atoi(id)
+	if err != nil {
+		err = errors.New("Invalid event ID")
+		return
+	}
+
+	q := "SELECT r.revision, r.entered, r.member, member.descr, r.changemsg " +
+		"FROM calendar_event_rev r " +
+		"INNER JOIN calendar_event e ON r.event_id = e.id " +
+		"INNER JOIN member ON r.member = member.ident " +
+		"WHERE e.trustgroup = $1 " +
+		"AND e.id = $2 " +
+		"ORDER BY r.revision DESC"
+
+	rows, err := DB.Query(q, grp.GetGroupName(), event_id)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var r PfCalendarRev
+
+		err = rows.Scan(&r.Revision, &r.Entered, &r.UserName, &r.FullName, &r.ChangeMsg)
+		if err != nil {
+			revs = nil
+			return
+		}
+
+		revs = append(revs, r)
+	}
+
+	return
+}
+
+/* Store a new revision of an event */
+func calendar_revA(ctx PfCtx, event_id int, message string, title string, starts string, ends string, location string, recurrence string, descr string) (err error) {
+	user := ctx.TheUser().GetUserName()
+
+	title = strings.TrimSpace(title)
+	if title == "" {
+		err = errors.New("A title is required")
+		return
+	}
+
+	s, err := Calendar_ParseTime("start", starts)
+	if err != nil {
+		return
+	}
+
+	e, err := Calendar_ParseTime("end", ends)
+	if err != nil {
+		return
+	}
+
+	if e.Before(s) {
+		err = errors.New("Event ends before it starts")
+		return
+	}
+
+	recurrence, err = calendar_chk_recurrence(recurrence)
+	if err != nil {
+		return
+	}
+
+	q := "INSERT INTO calendar_event_rev " +
+		"(event_id, revision, title, descr, location, starts, ends, recurrence, member, changemsg) " +
+		"SELECT $1, (COALESCE(MAX(revision), 0) + 1), $2, $3, $4, $5, $6, $7, $8, $9 " +
+		"FROM calendar_event_rev " +
+		"WHERE event_id = $1"
+	err = DB.Exec(ctx,
+		"Updated Calendar event $1: $2",
+		1, q,
+		event_id, title, descr, location, s, e, recurrence, user, message)
+
+	return
+}
+
+/* The uid is optional, it is only set for imported events */
+func calendar_addA(ctx PfCtx, uid string, title string, starts string, ends string, location string, recurrence string, descr string) (event_id int, err error) {
+	grp := ctx.SelectedGroup()
+
+	var dbuid interface{}
+	if uid != "" {
+		dbuid = uid
+	}
+
+	/* Transaction already in progress? (calendar_import) */
+	local_tx := false
+	if ctx.GetTx() == nil {
+		local_tx = true
+		err = DB.TxBegin(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	q := "INSERT INTO calendar_event " +
+		"(trustgroup, uid) " +
+		"VALUES($1, $2) " +
+		"RETURNING id"
+	err = DB.QueryRowScanA(ctx,
+		"Created Calendar event in $1",
+		[]interface{}{&event_id},
+		q, grp.GetGroupName(), dbuid)
+	if err == nil {
+		err = calendar_revA(ctx, event_id, "Created", title, starts, ends, location, recurrence, descr)
+	}
+
+	if !local_tx {
+		return
+	}
+
+	if err != nil {
+		DB.TxRollback(ctx)
+		return
+	}
+
+	err = DB.TxCommit(ctx)
+	return
+}
+
+func calendar_add(ctx PfCtx, args []string) (err error) {
+	title := args[0]
+	starts := args[1]
+	ends := args[2]
+	location := ""
+	recurrence := ""
+	descr := ""
+
+	if len(args) > 3 {
+		location = args[3]
+	}
+
+	if len(args) > 4 {
+		recurrence = args[4]
+	}
+
+	if len(args) > 5 {
+		descr = args[5]
+	}
+
+	event_id, err := calendar_addA(ctx, "", title, starts, ends, location, recurrence, descr)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Event %d added", event_id)
+	return
+}
+
+func calendar_list(ctx PfCtx, args []string) (err error) {
+	events, err := Calendar_Upcoming(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, ev := range events {
+		ctx.OutLn("%d\t%s\t%s\t%s\t%s", ev.Id, Fmt_Time(ev.Starts), Fmt_Time(ev.Ends), ev.Recurrence, ev.Title)
+	}
+
+	return
+}
+
+func calendar_get(ctx PfCtx, args []string) (err error) {
+	rev := ""
+	if len(args) == 2 {
+		rev = args[1]
+	}
+
+	var ev PfCalendarEvent
+	err = ev.Fetch(ctx, args[0], rev)
+	if err != nil {
+		return
+	}
+
+	ctx.Out(ev.String())
+	return
+}
+
+func calendar_history(ctx PfCtx, args []string) (err error) {
+	revs, err := Calendar_RevisionList(ctx, args[0])
+	if err != nil {
+		return
+	}
+
+	for _, r := range revs {
+		ctx.OutLn("%d\t%s\t%s\t%s", r.Revision, Fmt_Time(r.Entered), r.UserName, r.ChangeMsg)
+	}
+
+	return
+}
+
+func calendar_update(ctx PfCtx, args []string) (err error) {
+	var ev PfCalendarEvent
+
+	/* Ensures the event belongs to the selected group */
+	err = ev.Fetch(ctx, args[0], "")
+	if err != nil {
+		return
+	}
+
+	message := args[1]
+	title := args[2]
+	starts := args[3]
+	ends := args[4]
+	location := args[5]
+	recurrence := args[6]
+	descr := args[7]
+
+	/* Did it change? */
+	s, _ := Calendar_ParseTime("start", starts)
+	e, _ := Calendar_ParseTime("end", ends)
+	r, _ := calendar_chk_recurrence(recurrence)
+
+	if ev.Title == title && ev.Descr == descr && ev.Location == location &&
+		ev.Starts.Equal(s) && ev.Ends.Equal(e) && ev.Recurrence == r {
+		ctx.OutLn("Event did not change")
+		return
+	}
+
+	err = calendar_revA(ctx, ev.Id, message, title, starts, ends, location, recurrence, descr)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Event updated")
+	return
+}
+
+func calendar_delete(ctx PfCtx, args []string) (err error) {
+	var ev PfCalendarEvent
+
+	err = ev.Fetch(ctx, args[0], "")
+	if err != nil {
+		return
+	}
+
+	q := "DELETE FROM calendar_event " +
+		"WHERE id = $1 " +
+		"AND trustgroup = $2"
+	err = DB.Exec(ctx,
+		"Deleted Calendar event $1",
+		1, q,
+		ev.Id, ev.GroupName)
+	if err != nil {
+		err = errors.New("Could not delete the event")
+		return
+	}
+
+	ctx.OutLn("Event deleted")
+	return
+}
+
+func Calendar_menu(ctx PfCtx, args []string) (err error) {
+	menu := NewPfMenu([]PfMEntry{
+		{"add", calendar_add, 3, 6, []string{"title", "starts", "ends", "location", "recurrence", "descr"}, PERM_GROUP_CALENDAR, "Add a Calendar event"},
+		{"list", calendar_list, 0, 0, nil, PERM_GROUP_CALENDAR, "List upcoming Calendar events"},
+		{"get", calendar_get, 1, 2, []string{"eventid#int", "revision#int"}, PERM_GROUP_CALENDAR, "Get a Calendar event, optionally a specific revision"},
+		{"history", calendar_history, 1, 1, []string{"eventid#int"}, PERM_GROUP_CALENDAR, "List the revisions of a Calendar event"},
+		{"update", calendar_update, 8, 8, []string{"eventid#int", "message", "title", "starts", "ends", "location", "recurrence", "descr"}, PERM_GROUP_CALENDAR, "Update a Calendar event"},
+		{"delete", calendar_delete, 1, 1, []string{"eventid#int"}, PERM_GROUP_CALENDAR, "Delete a Calendar event"},
+		{"import", calendar_import, 1, 1, []string{"ics#file"}, PERM_GROUP_ADMIN, "Import events from an iCalendar (.ics) file"},
+		{"feed", calendar_feed, 0, 0, nil, PERM_GROUP_CALENDAR, "Create a personal iCalendar feed URL, revoking the previous one"},
+		{"feed_revoke", calendar_feed_revoke, 0, 0, nil, PERM_GROUP_CALENDAR, "Revoke your personal iCalendar feed URL"},
+	})
+
+	err = ctx.Menu(args, menu)
+	return
+}
@@ -0,0 +1,149 @@
+package pitchfork
+
+/*
+ * Per-user ICS feeds of a group calendar
+ *
+ * The feed URL carries a JWT referencing a calendar_feed row,
+ * deleting that row revokes the feed. Membership is checked on
+ * every fetch, thus blocked members lose access immediately.
+ */
+
+import (
+	"errors"
+	"strconv"
+)
+
+/* Feed tokens are valid for a year, but can be revoked at any time */
+const CALENDAR_FEED_EXPIRATIONMINUTES = 365 * 24 * 60
+
+type CalendarFeedClaims struct {
+	JWTClaims
+	GroupName string `json:"cf_group"`
+	FeedID    int    `json:"cf_id"`
+}
+
+func Calendar_FeedURL(tok string) string {
+	return System_Get().PublicURL + "/ical/" + tok + ".ics"
+}
+
+/* Create (or replace) the feed of the current user for the selected group */
+func Calendar_FeedNew(ctx PfCtx) (tok string, err error) {
+	grp := ctx.SelectedGroup()
+	username := ctx.TheUser().GetUserName()
+
+	/* Revoke any old one */
+	err = Calendar_FeedRevoke(ctx)
+	if err != nil {
+		return
+	}
+
+	feed_id := 0
+	q := "INSERT INTO calendar_feed " +
+		"(member, trustgroup) " +
+		"VALUES($1, $2) " +
+		"RETURNING id"
+	err = DB.QueryRowA(ctx,
+		"Created Calendar feed for $1 in $2",
+		q, username, grp.GetGroupName()).Scan(&feed_id)
+	if err != nil {
+		return
+	}
+
+	claims := &CalendarFeedClaims{}
+	claims.GroupName = grp.GetGroupName()
+	claims.FeedID = feed_id
+
+	token := Token_New("calfeed", username, CALENDAR_FEED_EXPIRATIONMINUTES, claims)
+	tok, err = token.Sign()
+	return
+}
+
+func Calendar_FeedRevoke(ctx PfCtx) (err error) {
+	grp := ctx.SelectedGroup()
+	username := ctx.TheUser().GetUserName()
+
+	q := "DELETE FROM calendar_feed " +
+		"WHERE member = $1 " +
+		"AND trustgroup = $2"
+	err = DB.Exec(ctx,
+		"Revoked Calendar feed for $1 in $2",
+		-1, q,
+		username, grp.GetGroupName())
+	return
+}
+
+/*
+ * Verify a feed token and select the group it is for
+ *
+ * No user is logged in when a calendar client fetches the feed,
+ * thus the membership checks are done here explicitly.
+ */
+func Calendar_FeedSelect(ctx PfCtx, tok string) (err error) {
+	claims := &CalendarFeedClaims{}
+
+	_, err = Token_Parse(tok, "calfeed", claims)
+	if err != nil {
+		return
+	}
+
+	username := claims.Subject
+
+	/* Not revoked? */
+	q := "UPDATE calendar_feed " +
+		"SET last_used = NOW() " +
+		"WHERE id = $1 " +
+		"AND member = $2 " +
+		"AND trustgroup = $3"
+	err = DB.ExecNActx(ctx, 1, q, claims.FeedID, username, claims.GroupName)
+	if err == ErrReadOnly {
+		return
+	} else if err != nil {
+		err = errors.New("Calendar feed " + strconv.Itoa(claims.FeedID) + " has been revoked")
+		return
+	}
+
+	err = ctx.SelectGroup(claims.GroupName, PERM_NONE)
+	if err != nil {
+		return
+	}
+
+	grp := ctx.SelectedGroup()
+
+	if !grp.HasCalendar() {
+		err = errors.New("Group does not have a Calendar")
+		return
+	}
+
+	ismember, _, state, err := grp.IsMember(username)
+	if err != nil {
+		return
+	}
+
+	if !ismember || !state.can_see || state.blocked {
+		err = errors.New("User " + username + " has no access to group " + claims.GroupName)
+		return
+	}
+
+	return
+}
+
+func calendar_feed(ctx PfCtx, args []string) (err error) {
+	tok, err := Calendar_FeedNew(ctx)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Calendar feed URL (any previous URL has been revoked):")
+	ctx.OutLn("%s", Calendar_FeedURL(tok))
+	return
+}
+
+func calendar_feed_revoke(ctx PfCtx, args []string) (err error) {
+	err = Calendar_FeedRevoke(ctx)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Calendar feed revoked")
+	return
+}
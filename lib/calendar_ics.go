@@ -0,0 +1,492 @@
+package pitchfork
+
+/* iCalendar (RFC5545) export and import of group calendars */
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ICS_TIMEFORMAT = "20060102T150405Z"
+
+/* Escape a TEXT value (RFC5545 3.3.11) */
+func ics_escape(val string) string {
+	val = strings.Replace(val, "\\", "\\\\", -1)
+	val = strings.Replace(val, ";", "\\;", -1)
+	val = strings.Replace(val, ",", "\\,", -1)
+	val = strings.Replace(val, "\r\n", "\\n", -1)
+	val = strings.Replace(val, "\n", "\\n", -1)
+	return val
+}
+
+func ics_unescape(val string) string {
+	out := ""
+
+	for i := 0; i < len(val); i++ {
+		if val[i] != '\\' || i == len(val)-1 {
+			out += string(val[i])
+			continue
+		}
+
+		i++
+		switch val[i] {
+		case 'n', 'N':
+			out += "\n"
+		default:
+			out += string(val[i])
+		}
+	}
+
+	return out
+}
+
+/* Fold content lines at 75 octets (RFC5545 3.1) */
+func ics_line(name string, val string) (out string) {
+	line := name + ":" + val
+
+	for len(line) > 75 {
+		/* Do not split UTF-8 sequences */
+		n := 75
+		for n > 0 && (line[n]&0xC0) == 0x80 {
+			n--
+		}
+
+		out += line[:n] + CRLF
+		line = " " + line[n:]
+	}
+
+	out += line + CRLF
+	return
+}
+
+/* The UID of an event, imported events keep their original UID */
+func (ev *PfCalendarEvent) ICS_UID() string {
+	if ev.UID != "" {
+		return ev.UID
+	}
+
+	return strconv.Itoa(ev.Id) + "-" + ev.GroupName + "@" + System_Get().EmailDomain
+}
+
+func (ev *PfCalendarEvent) ICS() (out string) {
+	out += ics_line("BEGIN", "VEVENT")
+	out += ics_line("UID", ev.ICS_UID())
+	out += ics_line("DTSTAMP", ev.Entered.UTC().Format(ICS_TIMEFORMAT))
+	out += ics_line("LAST-MODIFIED", ev.Entered.UTC().Format(ICS_TIMEFORMAT))
+	out += ics_line("SEQUENCE", strconv.Itoa(ev.Revision-1))
+	out += ics_line("DTSTART", ev.Starts.UTC().Format(ICS_TIMEFORMAT))
+	out += ics_line("DTEND", ev.Ends.UTC().Format(ICS_TIMEFORMAT))
+	out += ics_line("SUMMARY", ics_escape(ev.Title))
+
+	if ev.Location != "" {
+		out += ics_line("LOCATION", ics_escape(ev.Location))
+	}
+
+	if ev.Descr != "" {
+		out += ics_line("DESCRIPTION", ics_escape(ev.Descr))
+	}
+
+	if ev.IsRecurring() {
+		out += ics_line("RRULE", "FREQ="+strings.ToUpper(ev.Recurrence))
+	}
+
+	out += ics_line("END", "VEVENT")
+	return
+}
+
+/* Render all events of the selected group as a VCALENDAR */
+func Calendar_ICS(ctx PfCtx) (out string, err error) {
+	grp := ctx.SelectedGroup()
+
+	events, err := Calendar_List(ctx)
+	if err != nil {
+		return
+	}
+
+	out += ics_line("BEGIN", "VCALENDAR")
+	out += ics_line("VERSION", "2.0")
+	out += ics_line("PRODID", "-//"+ics_escape(AppName)+"//Calendar//EN")
+	out += ics_line("CALSCALE", "GREGORIAN")
+	out += ics_line("X-WR-CALNAME", ics_escape(grp.GetGroupName()))
+
+	for _, ev := range events {
+		out += ev.ICS()
+	}
+
+	out += ics_line("END", "VCALENDAR")
+	return
+}
+
+/* A parsed content line: NAME;PARAM=VAL:value */
+type ics_prop struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+func ics_parseline(line string) (p ics_prop, err error) {
+	p.Params = make(map[string]string)
+
+	/* The value starts at the first colon outside of a quoted param */
+	quoted := false
+	c := -1
+	for i := 0; i < len(line); i++ {
+		if line[i] == '"' {
+			quoted = !quoted
+		} else if line[i] == ':' && !quoted {
+			c = i
+			break
+		}
+	}
+
+	if c == -1 {
+		err = errors.New("Invalid content line: " + line)
+		return
+	}
+
+	p.Value = line[c+1:]
+
+	parts := strings.Split(line[:c], ";")
+	p.Name = strings.ToUpper(parts[0])
+
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+
+		p.Params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], "\"")
+	}
+
+	return
+}
+
+/* Parse DATE / DATE-TIME values, honoring TZID and the UTC 'Z' suffix */
+func ics_parsetime(p ics_prop) (t time.Time, err error) {
+	if p.Params["VALUE"] == "DATE" || len(p.Value) == 8 {
+		return time.Parse("20060102", p.Value)
+	}
+
+	if strings.HasSuffix(p.Value, "Z") {
+		return time.Parse(ICS_TIMEFORMAT, p.Value)
+	}
+
+	loc := time.UTC
+	tzid, ok := p.Params["TZID"]
+	if ok {
+		loc, err = time.LoadLocation(tzid)
+		if err != nil {
+			err = errors.New("Unknown TZID " + tzid)
+			return
+		}
+	}
+
+	t, err = time.ParseInLocation("20060102T150405", p.Value, loc)
+	if err != nil {
+		return
+	}
+
+	t = t.UTC()
+	return
+}
+
+/* RFC5545 3.3.10 weekdays, in time.Weekday order */
+var ics_weekdays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+/*
+ * Only simple RRULEs are supported: a FREQ, optionally with INTERVAL=1,
+ * WKST, or for weekly events a BYDAY of the day the event starts.
+ *
+ * Anything else (eg every other week, COUNT or UNTIL) becomes a single
+ * event, better than repeating it forever on the wrong days.
+ */
+func ics_parserrule(val string, starts time.Time) string {
+	freq := ""
+	byday := ""
+
+	for _, part := range strings.Split(val, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return "none"
+		}
+
+		v := strings.ToUpper(kv[1])
+
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			freq = v
+
+		case "INTERVAL":
+			if v != "1" {
+				return "none"
+			}
+
+		case "WKST":
+			/* Only matters for intervals and multiple BYDAYs */
+
+		case "BYDAY":
+			byday = v
+
+		default:
+			return "none"
+		}
+	}
+
+	r, err := calendar_chk_recurrence(freq)
+	if err != nil || freq == "" {
+		return "none"
+	}
+
+	if byday != "" && (r != "weekly" || byday != ics_weekdays[starts.Weekday()]) {
+		return "none"
+	}
+
+	return r
+}
+
+/* Unfold the content lines (RFC5545 3.1) */
+func ics_unfold(data string) (lines []string) {
+	data = strings.Replace(data, "\r\n", "\n", -1)
+
+	for _, l := range strings.Split(data, "\n") {
+		if len(l) > 0 && (l[0] == ' ' || l[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += l[1:]
+			continue
+		}
+
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+
+		lines = append(lines, l)
+	}
+
+	return
+}
+
+/* Parse the VEVENTs out of a VCALENDAR */
+func Calendar_ICS_Parse(data string) (events []PfCalendarEvent, err error) {
+	var ev *PfCalendarEvent
+	var duration time.Duration
+	allday := false
+	rrule := ""
+	depth := 0
+
+	for _, line := range ics_unfold(data) {
+		var p ics_prop
+
+		p, err = ics_parseline(line)
+		if err != nil {
+			return
+		}
+
+		switch p.Name {
+		case "BEGIN":
+			if strings.ToUpper(p.Value) == "VEVENT" {
+				ev = &PfCalendarEvent{Recurrence: "none"}
+				duration = 0
+				allday = false
+				rrule = ""
+			} else if ev != nil {
+				/* Nested component, eg VALARM */
+				depth++
+			}
+			continue
+
+		case "END":
+			if ev == nil {
+				continue
+			}
+
+			if depth > 0 {
+				depth--
+				continue
+			}
+
+			if strings.ToUpper(p.Value) != "VEVENT" {
+				continue
+			}
+
+			if ev.Starts.IsZero() {
+				err = errors.New("Event '" + ev.Title + "' has no DTSTART")
+				return
+			}
+
+			if ev.Ends.IsZero() {
+				/* All day events without an end last a day */
+				if allday && duration == 0 {
+					duration = 24 * time.Hour
+				}
+
+				ev.Ends = ev.Starts.Add(duration)
+			}
+
+			/* BYDAY is checked against DTSTART, which can come later */
+			if rrule != "" {
+				ev.Recurrence = ics_parserrule(rrule, ev.Starts)
+			}
+
+			events = append(events, *ev)
+			ev = nil
+			continue
+		}
+
+		/* Properties of nested components or the calendar itself */
+		if ev == nil || depth > 0 {
+			continue
+		}
+
+		switch p.Name {
+		case "UID":
+			ev.UID = p.Value
+
+		case "SUMMARY":
+			ev.Title = ics_unescape(p.Value)
+
+		case "DESCRIPTION":
+			ev.Descr = ics_unescape(p.Value)
+
+		case "LOCATION":
+			ev.Location = ics_unescape(p.Value)
+
+		case "DTSTART":
+			ev.Starts, err = ics_parsetime(p)
+			allday = len(p.Value) == 8
+
+		case "DTEND":
+			ev.Ends, err = ics_parsetime(p)
+
+		case "DURATION":
+			duration, err = ics_parseduration(p.Value)
+
+		case "RRULE":
+			rrule = p.Value
+		}
+
+		if err != nil {
+			err = errors.New("Invalid " + p.Name + " '" + p.Value + "': " + err.Error())
+			return
+		}
+	}
+
+	return
+}
+
+/* Durations (RFC5545 3.3.6), eg P1D, PT1H30M, P2W */
+func ics_parseduration(val string) (d time.Duration, err error) {
+	neg := false
+
+	if strings.HasPrefix(val, "-") {
+		neg = true
+	}
+
+	val = strings.TrimLeft(val, "+-")
+	if !strings.HasPrefix(val, "P") {
+		err = errors.New("Not a duration")
+		return
+	}
+
+	num := ""
+	for _, c := range val[1:] {
+		if c >= '0' && c <= '9' {
+			num += string(c)
+			continue
+		}
+
+		if c == 'T' {
+			continue
+		}
+
+		n, _ := strconv.Atoi(num)
+		num = ""
+
+		switch c {
+		case 'W':
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case 'D':
+			d += time.Duration(n) * 24 * time.Hour
+		case 'H':
+			d += time.Duration(n) * time.Hour
+		case 'M':
+			d += time.Duration(n) * time.Minute
+		case 'S':
+			d += time.Duration(n) * time.Second
+		default:
+			err = errors.New("Unknown duration unit " + string(c))
+			return
+		}
+	}
+
+	if neg {
+		d = -d
+	}
+
+	return
+}
+
+func calendar_import(ctx PfCtx, args []string) (err error) {
+	events, err := Calendar_ICS_Parse(args[0])
+	if err != nil {
+		return
+	}
+
+	added := 0
+	updated := 0
+
+	/* Events added by this import, not visible outside the transaction yet */
+	imported := make(map[string]int)
+
+	/* All events or none, a failure halfway leaves nothing behind */
+	err = DB.TxBegin(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, ev := range events {
+		starts := ev.Starts.Format("2006-01-02T15:04:05")
+		ends := ev.Ends.Format("2006-01-02T15:04:05")
+
+		/* Already imported before? Then add a revision */
+		event_id := imported[ev.UID]
+		if ev.UID != "" && event_id == 0 {
+			q := "SELECT id " +
+				"FROM calendar_event " +
+				"WHERE trustgroup = $1 " +
+				"AND uid = $2"
+			err = DB.QueryRow(q, ctx.SelectedGroup().GetGroupName(), ev.UID).Scan(&event_id)
+			if err == ErrNoRows {
+				err = nil
+			} else if err != nil {
+				DB.TxRollback(ctx)
+				return
+			}
+		}
+
+		if event_id != 0 {
+			err = calendar_revA(ctx, event_id, "Imported", ev.Title, starts, ends, ev.Location, ev.Recurrence, ev.Descr)
+			updated++
+		} else {
+			event_id, err = calendar_addA(ctx, ev.UID, ev.Title, starts, ends, ev.Location, ev.Recurrence, ev.Descr)
+			if err == nil && ev.UID != "" {
+				imported[ev.UID] = event_id
+			}
+			added++
+		}
+
+		if err != nil {
+			DB.TxRollback(ctx)
+			err = errors.New("Importing '" + ev.Title + "' failed: " + err.Error())
+			return
+		}
+	}
+
+	err = DB.TxCommit(ctx)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Imported %d events (%d new, %d updated)", added+updated, added, updated)
+	return
+}
@@ -0,0 +1,250 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run CalendarICS -v
+ *
+ * The Import test requires the database.
+ */
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const test_ics = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Test//Test//EN\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:one@example.net\r\n" +
+	"DTSTART:20170301T090000Z\r\n" +
+	"DTEND:20170301T100000Z\r\n" +
+	"SUMMARY:Weekly call\\, all welcome\r\n" +
+	"DESCRIPTION:Line one\\nLine two with a long text that will need to be fol\r\n" +
+	" ded by the sender\r\n" +
+	"RRULE:FREQ=WEEKLY;BYDAY=WE\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"ACTION:DISPLAY\r\n" +
+	"DESCRIPTION:Not the event description\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:two@example.net\r\n" +
+	"DTSTART;TZID=Europe/Amsterdam:20170615T140000\r\n" +
+	"DURATION:PT1H30M\r\n" +
+	"SUMMARY:Meeting\r\n" +
+	"LOCATION:Room 1\\; Floor 2\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:three@example.net\r\n" +
+	"DTSTART;VALUE=DATE:20171225\r\n" +
+	"SUMMARY:Holiday\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestCalendarICS_Parse(t *testing.T) {
+	events, err := Calendar_ICS_Parse(test_ics)
+	if err != nil {
+		t.Fatalf("Parsing failed: %s", err.Error())
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+
+	ev := events[0]
+	if ev.Title != "Weekly call, all welcome" {
+		t.Errorf("Unescaped title wrong: %q", ev.Title)
+	}
+
+	if ev.Descr != "Line one\nLine two with a long text that will need to be folded by the sender" {
+		t.Errorf("Unfolded description wrong: %q", ev.Descr)
+	}
+
+	if ev.Recurrence != "weekly" {
+		t.Errorf("Expected weekly recurrence, got %q", ev.Recurrence)
+	}
+
+	if !ev.Starts.Equal(time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("Wrong start %s", ev.Starts)
+	}
+
+	/* 14:00 CEST == 12:00 UTC, plus the duration */
+	ev = events[1]
+	if !ev.Starts.Equal(time.Date(2017, 6, 15, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("TZID not applied, start %s", ev.Starts)
+	}
+
+	if ev.Ends.Sub(ev.Starts) != 90*time.Minute {
+		t.Errorf("DURATION not applied, end %s", ev.Ends)
+	}
+
+	if ev.Location != "Room 1; Floor 2" {
+		t.Errorf("Unescaped location wrong: %q", ev.Location)
+	}
+
+	ev = events[2]
+	if ev.Ends.Sub(ev.Starts) != 24*time.Hour {
+		t.Errorf("All day event should last a day, got %s", ev.Ends.Sub(ev.Starts))
+	}
+}
+
+func TestCalendarICS_RRule(t *testing.T) {
+	/* A Wednesday */
+	wed := time.Date(2017, 3, 1, 9, 0, 0, 0, time.UTC)
+
+	tsts := []struct {
+		rrule string
+		rec   string
+	}{
+		{"FREQ=WEEKLY", "weekly"},
+		{"FREQ=WEEKLY;BYDAY=WE", "weekly"},
+		{"FREQ=WEEKLY;INTERVAL=1;WKST=MO", "weekly"},
+		{"freq=daily", "daily"},
+		{"FREQ=MONTHLY", "monthly"},
+		{"FREQ=WEEKLY;INTERVAL=2", "none"},
+		{"FREQ=WEEKLY;COUNT=10", "none"},
+		{"FREQ=WEEKLY;UNTIL=20171231T000000Z", "none"},
+		{"FREQ=WEEKLY;BYDAY=MO", "none"},
+		{"FREQ=WEEKLY;BYDAY=MO,WE", "none"},
+		{"FREQ=MONTHLY;BYDAY=1WE", "none"},
+		{"FREQ=MONTHLY;BYMONTHDAY=1", "none"},
+		{"FREQ=HOURLY", "none"},
+		{"INTERVAL=1", "none"},
+	}
+
+	for _, tst := range tsts {
+		r := ics_parserrule(tst.rrule, wed)
+		if r != tst.rec {
+			t.Errorf("RRULE %q gave %q, expected %q", tst.rrule, r, tst.rec)
+		}
+	}
+}
+
+func TestCalendarICS_RoundTrip(t *testing.T) {
+	ev := PfCalendarEvent{
+		Id:         1,
+		UID:        "roundtrip@example.net",
+		Revision:   2,
+		Title:      "Title; with, special \\ characters",
+		Descr:      strings.Repeat("Long description ", 10) + "\nwith a newline",
+		Location:   "Amsterdam",
+		Starts:     time.Date(2017, 1, 2, 3, 4, 0, 0, time.UTC),
+		Ends:       time.Date(2017, 1, 2, 5, 4, 0, 0, time.UTC),
+		Recurrence: "monthly",
+		Entered:    time.Now().UTC(),
+	}
+
+	ics := "BEGIN:VCALENDAR" + CRLF + ev.ICS() + "END:VCALENDAR" + CRLF
+
+	for _, l := range strings.Split(ics, CRLF) {
+		if len(l) > 75 {
+			t.Errorf("Line not folded: %q", l)
+		}
+	}
+
+	events, err := Calendar_ICS_Parse(ics)
+	if err != nil {
+		t.Fatalf("Parsing failed: %s", err.Error())
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("Expected 1 event, got %d", len(events))
+	}
+
+	p := events[0]
+	if p.UID != ev.UID || p.Title != ev.Title || p.Descr != ev.Descr ||
+		p.Location != ev.Location || p.Recurrence != ev.Recurrence ||
+		!p.Starts.Equal(ev.Starts) || !p.Ends.Equal(ev.Ends) {
+		t.Errorf("Round trip mismatch:\n%#v\n%#v", ev, p)
+	}
+}
+
+/* Events created inside a transaction disappear with its rollback */
+func TestCalendarICS_Import(t *testing.T) {
+	username := "caltest"
+	group := "caltest"
+
+	cleanup := func() {
+		DB.ExecNA(-1, "DELETE FROM calendar_event WHERE trustgroup = $1", group)
+		DB.ExecNA(-1, "DELETE FROM trustgroup WHERE ident = $1", group)
+		DB.ExecNA(-1, "DELETE FROM member WHERE ident = $1", username)
+	}
+
+	cleanup()
+	defer cleanup()
+
+	err := DB.ExecNA(1, "INSERT INTO member (ident, descr, uuid) VALUES($1, 'Cal Test', '00000000-0000-4000-8000-0000000ca1e0')", username)
+	if err != nil {
+		t.Fatalf("Member fixture failed: %s", err.Error())
+	}
+
+	err = DB.ExecNA(1, "INSERT INTO trustgroup (ident, descr, shortname, pgp_required, has_wiki) VALUES($1, $1, $1, false, false)", group)
+	if err != nil {
+		t.Fatalf("Group fixture failed: %s", err.Error())
+	}
+
+	ctx := testingctx()
+
+	user := ctx.NewUser()
+	err = user.fetch(ctx, username)
+	if err != nil {
+		t.Fatalf("Fetching user failed: %s", err.Error())
+	}
+	ctx.Become(user)
+
+	err = ctx.SelectGroup(group, PERM_NONE)
+	if err != nil {
+		t.Fatalf("Selecting group failed: %s", err.Error())
+	}
+
+	count := func() (cnt int) {
+		err := DB.QueryRow("SELECT COUNT(*) FROM calendar_event WHERE trustgroup = $1", group).Scan(&cnt)
+		if err != nil {
+			t.Fatalf("Counting events failed: %s", err.Error())
+		}
+		return
+	}
+
+	/* Rolled back: the event and its revision are gone */
+	err = DB.TxBegin(ctx)
+	if err != nil {
+		t.Fatalf("TxBegin failed: %s", err.Error())
+	}
+
+	id, err := calendar_addA(ctx, "", "Rolled back", "2017-03-01T09:00", "2017-03-01T10:00", "", "none", "")
+	if err != nil || id == 0 {
+		t.Fatalf("Adding event in transaction failed: %v", err)
+	}
+
+	DB.TxRollback(ctx)
+
+	if count() != 0 {
+		t.Errorf("Event remained after rollback")
+	}
+
+	/* The import commits all events, a UID twice in one file is an update */
+	ics := "BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:dup@example.net\r\n" +
+		"DTSTART:20170301T090000Z\r\n" +
+		"DTEND:20170301T100000Z\r\n" +
+		"SUMMARY:First\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:dup@example.net\r\n" +
+		"DTSTART:20170308T090000Z\r\n" +
+		"DTEND:20170308T100000Z\r\n" +
+		"SUMMARY:Second\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	err = calendar_import(ctx, []string{ics})
+	if err != nil {
+		t.Fatalf("Import failed: %s", err.Error())
+	}
+
+	if count() != 1 {
+		t.Errorf("Expected one imported event, got %d", count())
+	}
+}
@@ -0,0 +1,204 @@
+package pitchfork
+
+/*
+ * Minimal CBOR (RFC7049) decoder
+ *
+ * Enough for WebAuthn attestation objects and COSE keys:
+ * integers, byte and text strings, arrays, maps, tags and
+ * simple values. Indefinite lengths are not supported.
+ *
+ * Maps are returned as map[interface{}]interface{}, integers
+ * as int64 and byte strings as []byte.
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+/* Nesting limit, protects against malicious input */
+const CBOR_MAXDEPTH = 16
+
+var ErrCBORShort = errors.New("CBOR: truncated data")
+
+/* Decode the first item, returning the remaining data */
+func cbor_decode(data []byte) (v interface{}, rest []byte, err error) {
+	return cbor_item(data, 0)
+}
+
+/* The argument of an item, following the initial byte */
+func cbor_arg(data []byte, info byte) (arg uint64, rest []byte, err error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+
+	case info == 24:
+		if len(data) < 1 {
+			err = ErrCBORShort
+			return
+		}
+		return uint64(data[0]), data[1:], nil
+
+	case info == 25:
+		if len(data) < 2 {
+			err = ErrCBORShort
+			return
+		}
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+
+	case info == 26:
+		if len(data) < 4 {
+			err = ErrCBORShort
+			return
+		}
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+
+	case info == 27:
+		if len(data) < 8 {
+			err = ErrCBORShort
+			return
+		}
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	}
+
+	err = errors.New("CBOR: unsupported length encoding")
+	return
+}
+
+func cbor_item(data []byte, depth int) (v interface{}, rest []byte, err error) {
+	if depth > CBOR_MAXDEPTH {
+		err = errors.New("CBOR: nested too deep")
+		return
+	}
+
+	if len(data) < 1 {
+		err = ErrCBORShort
+		return
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+
+	/* Floats carry their value, not a length */
+	if major == 7 && info >= 25 && info <= 27 {
+		var bits uint64
+
+		bits, rest, err = cbor_arg(data[1:], info)
+		if err != nil {
+			return
+		}
+
+		switch info {
+		case 25:
+			/* Half precision is not used by WebAuthn */
+			v = float64(0)
+		case 26:
+			v = float64(math.Float32frombits(uint32(bits)))
+		case 27:
+			v = math.Float64frombits(bits)
+		}
+		return
+	}
+
+	arg, rest, err := cbor_arg(data[1:], info)
+	if err != nil {
+		return
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			err = errors.New("CBOR: integer out of range")
+			return
+		}
+		v = int64(arg)
+
+	case 1:
+		if arg > math.MaxInt64 {
+			err = errors.New("CBOR: integer out of range")
+			return
+		}
+		v = -1 - int64(arg)
+
+	case 2, 3:
+		if uint64(len(rest)) < arg {
+			err = ErrCBORShort
+			return
+		}
+
+		if major == 2 {
+			v = rest[:arg]
+		} else {
+			v = string(rest[:arg])
+		}
+
+		rest = rest[arg:]
+
+	case 4:
+		/* Each item takes at least a byte */
+		if uint64(len(rest)) < arg {
+			err = ErrCBORShort
+			return
+		}
+
+		a := make([]interface{}, arg)
+		for i := range a {
+			a[i], rest, err = cbor_item(rest, depth+1)
+			if err != nil {
+				return
+			}
+		}
+		v = a
+
+	case 5:
+		if uint64(len(rest)) < arg*2 {
+			err = ErrCBORShort
+			return
+		}
+
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, val interface{}
+
+			key, rest, err = cbor_item(rest, depth+1)
+			if err != nil {
+				return
+			}
+
+			/* Keys need to be usable in a map */
+			switch key.(type) {
+			case int64, string:
+			default:
+				err = errors.New("CBOR: unsupported map key")
+				return
+			}
+
+			val, rest, err = cbor_item(rest, depth+1)
+			if err != nil {
+				return
+			}
+
+			m[key] = val
+		}
+		v = m
+
+	case 6:
+		/* Tags are ignored, the tagged item is returned */
+		v, rest, err = cbor_item(rest, depth+1)
+
+	case 7:
+		switch arg {
+		case 20:
+			v = false
+		case 21:
+			v = true
+		case 22, 23:
+			v = nil
+		default:
+			err = errors.New("CBOR: unsupported simple value")
+		}
+	}
+
+	return
+}
@@ -6,52 +6,75 @@ import (
 	"errors"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
 type PfConfig struct {
-	Conf_root       string       ``                  /* From command line option or default setting */
-	File_roots      []string     `json:"file_roots"` /* Where we look for files */
-	Var_root        string       `json:"var_root"`   /* Where variable files are stored */
-	Tmp_roots       []string     `json:"tmp_roots"`  /* Templates */
-	LogFile         string       `json:"logfile"`    /* Where to write our log file (with logrotate support) */
-	Token_prv       interface{}  ``
-	Token_pub       interface{}  ``
-	UserAgent       string       `json:"useragent"`
-	CSS             []string     `json:"css"`
-	Javascript      []string     `json:"javascript"`
-	CSP             string       `json:"csp"`
-	XFF             []string     `json:"xff_trusted_cidr"`
-	XFFc            []*net.IPNet ``
-	Db_host         string       `json:"db_host"`
-	Db_port         string       `json:"db_port"`
-	Db_name         string       `json:"db_name"`
-	Db_user         string       `json:"db_user"`
-	Db_pass         string       `json:"db_pass"`
-	Db_ssl_mode     string       `json:"db_ssl_mode"`
-	Db_admin_db     string       `json:"db_admin_db"`
-	Db_admin_user   string       `json:"db_admin_user"`
-	Db_admin_pass   string       `json:"db_admin_pass"`
-	Nodename        string       `json:"nodename"`
-	Http_host       string       `json:"http_host"`
-	Http_port       string       `json:"http_port"`
-	JWT_prv         string       `json:"jwt_key_prv"`
-	JWT_pub         string       `json:"jwt_key_pub"`
-	Application     interface{}  `json:"application"`
-	Username_regexp string       `json:"username_regexp"`
-	UserHomeLinks   bool         `json:"user_home_links"`
-	SMTP_host       string       `json:"smtp_host"`
-	SMTP_port       string       `json:"smtp_port"`
-	SMTP_SSL        string       `json:"smtp_ssl"`
-	Msg_mon_from    string       `json:"msg_monitor_from"`
-	Msg_mon_to      string       `json:"msg_monitor_to"`
-	TimeFormat      string       `json:"timeformat"`
-	DateFormat      string       `json:"dateformat"`
-	PW_WeakDicts    []string     `json:"pw_weakdicts"`
-	CFG_UserMinLen  string       `json:"username_min_length"`
-	CFG_UserExample string       `json:"username_example"`
-	TransDefault    string       `json:"translation_default"`
-	TransLanguages  []string     `json:"translation_languages"`
+	Conf_root       string         ``                  /* From command line option or default setting */
+	File_roots      []string       `json:"file_roots"` /* Where we look for files */
+	Var_root        string         `json:"var_root"`   /* Where variable files are stored */
+	Tmp_roots       []string       `json:"tmp_roots"`  /* Templates */
+	LogFile         string         `json:"logfile"`    /* Where to write our log file (with logrotate support) */
+	Token_prv       interface{}    ``
+	Token_pub       interface{}    ``
+	UserAgent       string         `json:"useragent"`
+	CSS             []string       `json:"css"`
+	Javascript      []string       `json:"javascript"`
+	CSP             string         `json:"csp"`
+	XFF             []string       `json:"xff_trusted_cidr"`
+	XFFc            []*net.IPNet   ``
+	Db_host         string         `json:"db_host"`
+	Db_port         string         `json:"db_port"`
+	Db_name         string         `json:"db_name"`
+	Db_user         string         `json:"db_user"`
+	Db_pass         string         `json:"db_pass"`
+	Db_ssl_mode     string         `json:"db_ssl_mode"`
+	Db_admin_db     string         `json:"db_admin_db"`
+	Db_admin_user   string         `json:"db_admin_user"`
+	Db_admin_pass   string         `json:"db_admin_pass"`
+	Nodename        string         `json:"nodename"`
+	Http_host       string         `json:"http_host"`
+	Http_port       string         `json:"http_port"`
+	JWT_prv         string         `json:"jwt_key_prv"`
+	JWT_pub         string         `json:"jwt_key_pub"`
+	JWT_kek         string         `json:"jwt_key_kek"`
+	Application     interface{}    `json:"application"`
+	Username_regexp string         `json:"username_regexp"`
+	UserHomeLinks   bool           `json:"user_home_links"`
+	SMTP_host       string         `json:"smtp_host"`
+	SMTP_port       string         `json:"smtp_port"`
+	SMTP_SSL        string         `json:"smtp_ssl"`
+	ML_listen       string         `json:"ml_listen"`  /* host:port for inbound Mailing List mail, empty to disable */
+	ML_lmtp         bool           `json:"ml_lmtp"`    /* Speak LMTP instead of SMTP on ml_listen */
+	ML_maxsize      int            `json:"ml_maxsize"` /* Maximum size of a Mailing List message */
+	Bounce_max      int            `json:"bounce_max"` /* Bounces after which list delivery to an address is disabled */
+	Msg_mon_from    string         `json:"msg_monitor_from"`
+	Msg_mon_to      string         `json:"msg_monitor_to"`
+	TimeFormat      string         `json:"timeformat"`
+	DateFormat      string         `json:"dateformat"`
+	PW_WeakDicts    []string       `json:"pw_weakdicts"`
+	PW_Argon2_Mem   int            `json:"pw_argon2_memory"`     /* Argon2id memory cost in KiB */
+	PW_Argon2_Time  int            `json:"pw_argon2_time"`       /* Argon2id iterations */
+	PW_Argon2_Par   int            `json:"pw_argon2_threads"`    /* Argon2id parallelism */
+	Lockout_delay   int            `json:"lockout_delay"`        /* Failed logins after which every attempt has to wait longer */
+	Lockout_max     int            `json:"lockout_max"`          /* Failed logins after which an account is locked */
+	Lockout_minutes int            `json:"lockout_minutes"`      /* How long an account stays locked */
+	LoginAlertAdmin bool           `json:"login_alert_admin"`    /* Also tell group admins about logins from new devices */
+	SysAdmin_mins   int            `json:"sysadmin_minutes"`     /* How long a SysAdmin elevation lasts */
+	Approval_cmds   []string       `json:"approval_commands"`    /* Commands that a second SysAdmin has to approve, eg "user delete" */
+	Approval_hours  int            `json:"approval_hours"`       /* How long an approval request stays pending */
+	IPtrk_prefix4   []int          `json:"iptrk_prefix_v4"`      /* IPv4 prefix lengths that IPtrk counts, most specific first */
+	IPtrk_prefix6   []int          `json:"iptrk_prefix_v6"`      /* IPv6 prefix lengths that IPtrk counts, most specific first */
+	IPtrk_factor    int            `json:"iptrk_prefix_factor"`  /* Each wider prefix allows this many times more hits */
+	IPtrk_max       map[string]int `json:"iptrk_max"`            /* Hits per bucket (login, recover, api) before an IP is blocked */
+	IPtrk_minutes   int            `json:"iptrk_expire_minutes"` /* How long IPtrk remembers hits */
+	IPtrk_allow     []string       `json:"iptrk_allow_cidr"`     /* Networks that IPtrk never blocks */
+	IPtrk_allowc    []*net.IPNet   ``
+	CFG_UserMinLen  string         `json:"username_min_length"`
+	CFG_UserExample string         `json:"username_example"`
+	TransDefault    string         `json:"translation_default"`
+	TransLanguages  []string       `json:"translation_languages"`
 }
 
 /* SMTP_SSL = ignore | require */
@@ -196,6 +219,10 @@ func (cfg *PfConfig) Load(toolname string, confroot string) (err error) {
 		Config.JWT_pub = "jwt.pub"
 	}
 
+	if Config.JWT_kek == "" {
+		Config.JWT_kek = "jwt.kek"
+	}
+
 	if len(Config.CSS) == 0 {
 		Config.CSS = []string{"style", "form"}
 	}
@@ -218,6 +245,50 @@ func (cfg *PfConfig) Load(toolname string, confroot string) (err error) {
 		return
 	}
 
+	if Config.ML_maxsize == 0 {
+		Config.ML_maxsize = 10 * 1024 * 1024
+	}
+
+	if Config.Bounce_max == 0 {
+		Config.Bounce_max = 5
+	}
+
+	if Config.Lockout_delay == 0 {
+		Config.Lockout_delay = 2
+	}
+
+	if Config.Lockout_max == 0 {
+		Config.Lockout_max = 5
+	}
+
+	if Config.Lockout_minutes == 0 {
+		Config.Lockout_minutes = 30
+	}
+
+	if Config.SysAdmin_mins == 0 {
+		Config.SysAdmin_mins = 15
+	}
+
+	if Config.Approval_hours == 0 {
+		Config.Approval_hours = 24
+	}
+
+	if len(Config.IPtrk_prefix4) == 0 {
+		Config.IPtrk_prefix4 = []int{32, 24}
+	}
+
+	if len(Config.IPtrk_prefix6) == 0 {
+		Config.IPtrk_prefix6 = []int{128, 64, 48}
+	}
+
+	if Config.IPtrk_factor == 0 {
+		Config.IPtrk_factor = 4
+	}
+
+	if Config.IPtrk_minutes == 0 {
+		Config.IPtrk_minutes = 60
+	}
+
 	if Config.TimeFormat == "" {
 		Config.TimeFormat = "2006-01-02 15:04"
 	}
@@ -240,6 +311,50 @@ func (cfg *PfConfig) Load(toolname string, confroot string) (err error) {
 		Config.XFFc = append(Config.XFFc, xc)
 	}
 
+	for _, x := range Config.IPtrk_allow {
+		var xc *net.IPNet
+
+		_, xc, err = net.ParseCIDR(x)
+		if err != nil {
+			err = errors.New("IPtrk allowed network " + x + " is invalid: " + err.Error())
+			return
+		}
+
+		/* Add it to the pre-parsed list */
+		Config.IPtrk_allowc = append(Config.IPtrk_allowc, xc)
+	}
+
+	for _, l := range Config.IPtrk_prefix4 {
+		if l < 1 || l > 32 {
+			err = errors.New("IPtrk IPv4 prefix length " + strconv.Itoa(l) + " is invalid")
+			return
+		}
+	}
+
+	for _, l := range Config.IPtrk_prefix6 {
+		if l < 1 || l > 128 {
+			err = errors.New("IPtrk IPv6 prefix length " + strconv.Itoa(l) + " is invalid")
+			return
+		}
+	}
+
+	/* argon2 panics on parameters out of range */
+	err = pw_argon2_cfgcheck()
+	if err != nil {
+		return
+	}
+
+	/* Buckets that are not configured use the default */
+	if Config.IPtrk_max == nil {
+		Config.IPtrk_max = make(map[string]int)
+	}
+
+	for b, max := range iptrk_max_default {
+		if Config.IPtrk_max[b] == 0 {
+			Config.IPtrk_max[b] = max
+		}
+	}
+
 	err = cfg.Token_LoadPrv()
 	if err != nil {
 		return
@@ -7,6 +7,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	useragent "github.com/mssola/user_agent"
 	i18n "github.com/nicksnyder/go-i18n/i18n"
@@ -78,8 +79,12 @@ type PfCtx interface {
 	GetLastPart() string
 	Become(user PfUser)
 	GetToken() (tok string)
+	GetSession() (id string)
 	NewToken() (err error)
 	LoginToken(tok string) (expsoon bool, err error)
+	LoginOAuth(tok string) (err error)
+	LoginPAT(tok string) (err error)
+	GetScope() (scope string, scoped bool)
 	Login(username string, password string, twofactor string) (err error)
 	Logout()
 	IsLoggedIn() bool
@@ -91,7 +96,13 @@ type PfCtx interface {
 	GroupHasCalendar() bool
 	CanBeSysAdmin() bool
 	SwapSysAdmin() bool
+	ElevateSysAdmin(password string, twofactor string) (err error)
+	SysAdminUntil() time.Time
 	IsSysAdmin() bool
+	Impersonate(username string, write bool, reason string) (err error)
+	StopImpersonate() (err error)
+	Impersonator() (admin string, write bool)
+	IsReadOnly() bool
 	ConvertPerms(str string) (perm Perm, err error)
 	IsPerm(perms Perm, perm Perm) bool
 	IsPermSet(perms Perm, perm Perm) bool
@@ -148,6 +159,7 @@ type PfCtx interface {
 	Cmd(args []string) (err error)
 	CmdOut(cmd string, args []string) (msg string, err error)
 	Batch(filename string) (err error)
+	RunApproved(id int) (err error)
 
 	/* appdata */
 	SetAppData(data interface{})
@@ -156,8 +168,12 @@ type PfCtx interface {
 
 type SessionClaims struct {
 	JWTClaims
-	UserDesc   string `json:"userdesc"`
-	IsSysAdmin bool   `json:"issysadmin"`
+	UserDesc         string `json:"userdesc"`
+	IsSysAdmin       bool   `json:"issysadmin"`
+	SysAdminUntil    int64  `json:"sysadmin_until,omitempty"`    /* End of the SysAdmin elevation (Unix time) */
+	Impersonator     string `json:"impersonator,omitempty"`      /* SysAdmin impersonating the user (impersonate.go) */
+	Impersonation    int    `json:"impersonation,omitempty"`     /* Id of the impersonation */
+	ImpersonateWrite bool   `json:"impersonate_write,omitempty"` /* Impersonation may make changes */
 }
 
 type PfCtxS struct {
@@ -170,6 +186,8 @@ type PfCtxS struct {
 	user           PfUser             /* Authenticated User */
 	token          string             /* The authentication token */
 	token_claims   SessionClaims      /* Parsed Token Claims */
+	scope          string             /* OAuth2 scope of the token */
+	scoped         bool               /* Access is limited to the scope */
 	remote         string             /* The address of the client, including X-Forwarded-For */
 	client_ip      net.IP             /* Client's IP addresses */
 	ua_full        string             /* The HTTP User Agent */
@@ -201,6 +219,7 @@ type PfCtxS struct {
 	menu_walkonly bool
 	menu_args     []string
 	menu_menu     *PfMEntry
+	approved      string /* Command approved by a second SysAdmin (approval.go) */
 
 	/* Application Data */
 	appdata interface{}
@@ -453,6 +472,7 @@ func init() {
 const (
 	StatusOK           = 200
 	StatusUnauthorized = 401
+	StatusForbidden    = 403
 )
 
 var Debug = false
@@ -510,6 +530,15 @@ func (ctx *PfCtxS) GetToken() (tok string) {
 	return ctx.token
 }
 
+/* The session (jti) of the request, empty when not a session */
+func (ctx *PfCtxS) GetSession() (id string) {
+	if ctx.scoped {
+		return ""
+	}
+
+	return ctx.token_claims.Id
+}
+
 func (ctx *PfCtxS) NewToken() (err error) {
 	if !ctx.IsLoggedIn() {
 		return errors.New("Not authenticated")
@@ -523,6 +552,18 @@ func (ctx *PfCtxS) NewToken() (err error) {
 
 	username := theuser.GetUserName()
 
+	/* A new session, or a renewal retaining the session */
+	if ctx.token_claims.Id == "" {
+		ctx.token_claims.Id, err = session_new(ctx, username)
+	} else {
+		err = session_seen(ctx, ctx.token_claims.Id)
+	}
+
+	if err != nil {
+		ctx.token = ""
+		return
+	}
+
 	/* Create the token */
 	token := Token_New("websession", username, TOKEN_EXPIRATIONMINUTES, &ctx.token_claims)
 
@@ -546,6 +587,19 @@ func (ctx *PfCtxS) LoginToken(tok string) (expsoon bool, err error) {
 		return expsoon, err
 	}
 
+	/* Tokens from before the session registry get a session on renewal */
+	if ctx.token_claims.Id != "" && session_revoked(ctx.token_claims.Id) {
+		return false, errors.New("Session has been revoked")
+	}
+
+	/* Impersonation stopped or expired? */
+	if ctx.token_claims.Impersonation != 0 {
+		err = impersonate_seen(ctx.token_claims.Impersonation)
+		if err != nil {
+			return false, err
+		}
+	}
+
 	/* Who they claim they are */
 	user := ctx.NewUser()
 	user.SetUserName(ctx.token_claims.Subject)
@@ -568,9 +622,60 @@ func (ctx *PfCtxS) LoginToken(tok string) (expsoon bool, err error) {
 	/* Valid Token */
 	ctx.token = tok
 
+	/* Elevation ran out: drop it, which issues a new token */
+	if user.IsSysAdmin() && ctx.sysadmin_expired() {
+		ctx.sysadmin_stop("sysadmin_expired")
+	}
+
 	return expsoon, nil
 }
 
+/*
+ * Become the user of a token that is limited to a scope
+ *
+ * The commands that can be run are limited to those
+ * that the scope allows (see scope.go).
+ */
+func (ctx *PfCtxS) login_scoped(username string, scope string, tok string) (err error) {
+	user := ctx.NewUser()
+	user.SetUserName(username)
+
+	/* Not a SysAdmin, SwapSysAdmin() refuses for scoped access */
+	err = user.Refresh(ctx)
+	if err == ErrNoRows {
+		ctx.Dbgf("No such user %q", username)
+		return errors.New("No such user")
+	} else if err != nil {
+		ctx.Dbgf("Fetch of user %q failed: %s", username, err.Error())
+		return
+	}
+
+	ctx.scope = scope
+	ctx.scoped = true
+
+	ctx.Become(user)
+
+	/* Retained, thus no session token gets issued */
+	ctx.token = tok
+	return
+}
+
+/* Authenticate using an OAuth2 access token */
+func (ctx *PfCtxS) LoginOAuth(tok string) (err error) {
+	ctx.token = ""
+
+	claims, err := OAuth2_AccessToken_Check(tok)
+	if err != nil {
+		return
+	}
+
+	return ctx.login_scoped(claims.Subject, claims.Scope, tok)
+}
+
+func (ctx *PfCtxS) GetScope() (scope string, scoped bool) {
+	return ctx.scope, ctx.scoped
+}
+
 func (ctx *PfCtxS) Login(username string, password string, twofactor string) (err error) {
 	user := ctx.NewUser()
 
@@ -584,24 +689,40 @@ func (ctx *PfCtxS) Login(username string, password string, twofactor string) (er
 		return
 	}
 
-	/* Force generation of a new token */
+	/* Force generation of a new token, for a new session */
 	ctx.token = ""
+	ctx.token_claims = SessionClaims{}
 
 	ctx.Become(user)
 
+	/* Before recording this login, as it compares with the earlier ones */
+	login_alert_check(ctx, username)
+
 	userevent(ctx, "login")
 	return nil
 }
 
 func (ctx *PfCtxS) Logout() {
-	if ctx.token != "" {
+	/* The SysAdmin is done with the user */
+	if ctx.token_claims.Impersonation != 0 {
+		impersonate_end(ctx, ctx.token_claims.Impersonation)
+	}
+
+	/* Scoped tokens are not sessions, they are revoked explicitly */
+	if ctx.token != "" && !ctx.scoped {
 		Jwt_invalidate(ctx.token, &ctx.token_claims)
+
+		if ctx.token_claims.Id != "" {
+			session_end(ctx.token_claims.Id)
+		}
 	}
 
 	/* Invalidate user + token */
 	ctx.user = nil
 	ctx.token = ""
 	ctx.token_claims = SessionClaims{}
+	ctx.scope = ""
+	ctx.scoped = false
 }
 
 func (ctx *PfCtxS) IsLoggedIn() bool {
@@ -714,24 +835,96 @@ func (ctx *PfCtxS) CanBeSysAdmin() bool {
 	return true
 }
 
+/*
+ * Swap from SysAdmin back to Regular
+ *
+ * Becoming a SysAdmin requires re-authentication,
+ * see ElevateSysAdmin(), thus that way is refused.
+ */
 func (ctx *PfCtxS) SwapSysAdmin() bool {
 	/* Not logged, can't be SysAdmin */
 	if !ctx.IsLoggedIn() {
 		return false
 	}
 
-	/* If they cannot be one, then do not toggle either */
-	if !ctx.user.CanBeSysAdmin() {
+	/* Not a SysAdmin, elevation is needed */
+	if !ctx.user.IsSysAdmin() {
 		return false
 	}
 
-	/* Toggle state: SysAdmin <> Regular */
-	ctx.user.SetSysAdmin(!ctx.user.IsSysAdmin())
+	ctx.sysadmin_stop("sysadmin_stop")
+	return true
+}
+
+/*
+ * Become a SysAdmin for Config.SysAdmin_mins
+ *
+ * Requires the password and 2FA code again, so that a stolen
+ * session token alone does not suffice. The elevation is
+ * recorded in the session token, which expires it.
+ */
+func (ctx *PfCtxS) ElevateSysAdmin(password string, twofactor string) (err error) {
+	if !ctx.IsLoggedIn() {
+		return errors.New("Not authenticated")
+	}
+
+	/* If they cannot be one, then do not elevate either */
+	if !ctx.user.CanBeSysAdmin() {
+		return errors.New("Can't become SysAdmin")
+	}
+
+	/* OAuth2 tokens are never SysAdmin */
+	if ctx.scoped {
+		return errors.New("Can't become SysAdmin")
+	}
+
+	username := ctx.user.GetUserName()
+
+	/* A fresh check, counting failures as a login does */
+	user := ctx.NewUser()
+	err = user.CheckAuth(ctx, username, password, twofactor)
+	if err != nil {
+		ctx.Errf("SysAdmin elevation CheckAuth(%s): %s", username, err)
+		userevent(ctx, "sysadmin_failed")
+		return ErrLoginIncorrect
+	}
+
+	mins := Config.SysAdmin_mins
+
+	ctx.user.SetSysAdmin(true)
+	ctx.token_claims.SysAdminUntil = time.Now().Add(time.Duration(mins) * time.Minute).Unix()
 
 	/* Force generation of a new token */
 	ctx.token = ""
 
-	return true
+	DB.audit(ctx, "SysAdmin elevation of $1 started for $2 minutes", "", username, mins)
+	userevent(ctx, "sysadmin_start")
+	return
+}
+
+/* When the SysAdmin elevation ends, zero when not elevated */
+func (ctx *PfCtxS) SysAdminUntil() time.Time {
+	if !ctx.IsSysAdmin() {
+		return time.Time{}
+	}
+
+	return time.Unix(ctx.token_claims.SysAdminUntil, 0)
+}
+
+func (ctx *PfCtxS) sysadmin_expired() bool {
+	return time.Now().Unix() >= ctx.token_claims.SysAdminUntil
+}
+
+/* Drop the SysAdmin bit, event tells why */
+func (ctx *PfCtxS) sysadmin_stop(event string) {
+	ctx.user.SetSysAdmin(false)
+	ctx.token_claims.SysAdminUntil = 0
+
+	/* Force generation of a new token */
+	ctx.token = ""
+
+	DB.audit(ctx, "SysAdmin elevation of $1 ended: $2", "", ctx.user.GetUserName(), event)
+	userevent(ctx, event)
 }
 
 func (ctx *PfCtxS) IsSysAdmin() bool {
@@ -744,6 +937,11 @@ func (ctx *PfCtxS) IsSysAdmin() bool {
 		return false
 	}
 
+	/* Elevation ran out */
+	if ctx.sysadmin_expired() {
+		return false
+	}
+
 	sys := System_Get()
 
 	/*
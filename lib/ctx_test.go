@@ -0,0 +1,44 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run Ctx_ -v
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCtx_SysAdminExpiry(t *testing.T) {
+	/* Avoid fetching the system settings from the database */
+	system_cached.Name = "test"
+	defer func() {
+		system_cached = PfSys{}
+	}()
+
+	user := &PfUserS{UserName: "jdoe", IsSysadmin: true, CanBeSysadmin: true}
+	ctx := &PfCtxS{user: user}
+
+	/* Tokens from before elevation expiry */
+	if ctx.IsSysAdmin() {
+		t.Errorf("SysAdmin without an elevation end")
+	}
+
+	ctx.token_claims.SysAdminUntil = time.Now().Add(time.Minute).Unix()
+	if !ctx.IsSysAdmin() {
+		t.Errorf("Not a SysAdmin during the elevation")
+	}
+
+	if ctx.SysAdminUntil().Unix() != ctx.token_claims.SysAdminUntil {
+		t.Errorf("Unexpected elevation end %s", ctx.SysAdminUntil())
+	}
+
+	ctx.token_claims.SysAdminUntil = time.Now().Add(-time.Second).Unix()
+	if ctx.IsSysAdmin() {
+		t.Errorf("Still a SysAdmin after the elevation ended")
+	}
+
+	if !ctx.SysAdminUntil().IsZero() {
+		t.Errorf("Elevation end set while not a SysAdmin")
+	}
+}
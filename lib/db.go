@@ -64,6 +64,7 @@ type Row struct {
 	p   []interface{}
 	row *sql.Row
 	db  *PfDB
+	err error /* Query was refused, returned by Scan() */
 }
 
 /* Global database variable - there can only be one */
@@ -101,7 +102,7 @@ func (db *PfDB) Init(verbosity bool) {
 	db.sql = nil
 
 	/* Current portal_schema_version -- must match schema.sql! */
-	db.version = 21
+	db.version = 43
 
 	/* No configured App DB */
 	db.appversion = -1
@@ -387,6 +388,11 @@ func (db *PfDB) Query(query string, args ...interface{}) (trows *Rows, err error
 func (db *PfDB) queryrow(ctx PfCtx, audittxt string, query string, args ...interface{}) (trow *Row) {
 	var row *sql.Row
 
+	/* Read-only impersonation (impersonate.go) */
+	if ctx != nil && ctx.IsReadOnly() && (audittxt != "" || !db.IsSelect(query)) {
+		return &Row{query, args, nil, db, ErrReadOnly}
+	}
+
 	err := db.Connect_def()
 	if err != nil {
 		/* Does not report error */
@@ -423,7 +429,7 @@ func (db *PfDB) queryrow(ctx PfCtx, audittxt string, query string, args ...inter
 		}
 	}
 
-	return &Row{query, args, row, db}
+	return &Row{query, args, row, db, nil}
 }
 
 /* Query for a Row, without Audittxt; use with care */
@@ -442,6 +448,60 @@ func (db *PfDB) QueryRowA(ctx PfCtx, audittxt string, query string, args ...inte
 	return db.queryrow(ctx, audittxt, query, args...)
 }
 
+/*
+ * INSERT/UPDATE with RETURNING, scanned into dest, in a transaction
+ *
+ * Uses the transaction of the caller when one is open, thus the row
+ * is rolled back with it. The row is scanned before the audit, as the
+ * connection can't run the audit while the row is still pending.
+ */
+func (db *PfDB) QueryRowScanA(ctx PfCtx, audittxt string, dest []interface{}, query string, args ...interface{}) (err error) {
+	if audittxt == "" {
+		/* Software mistake -- crash and burn */
+		panic("QueryRowScanA requires an audit message")
+	}
+
+	/* Read-only impersonation (impersonate.go) */
+	if ctx.IsReadOnly() {
+		return ErrReadOnly
+	}
+
+	/* Transaction already in progress? */
+	local_tx := false
+	if ctx.GetTx() == nil {
+		/* Create a local one */
+		local_tx = true
+		err = db.TxBegin(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	if db.verbosity && !db.silence {
+		db.Verbf("QueryRowScan: %s [%v]", query, args)
+	}
+
+	err = ctx.GetTx().QueryRow(query, args...).Scan(dest...)
+	if err != nil && err != ErrNoRows {
+		db.Errf("QueryRowScan(%s)[%v] error: %s", query, args, err.Error())
+	}
+
+	if err == nil {
+		err = db.audit(ctx, audittxt, query, args...)
+	}
+
+	/* Commit the Tx if we opened it */
+	if local_tx {
+		if err != nil {
+			db.TxRollback(ctx)
+		} else {
+			err = db.TxCommit(ctx)
+		}
+	}
+
+	return
+}
+
 /* Query for a Row, SELECT() only; thus no audittxt needed as nothing changes */
 func (db *PfDB) QueryRow(query string, args ...interface{}) (trow *Row) {
 	return db.QueryRowA(nil, "", query, args...)
@@ -477,6 +537,10 @@ func (rows *Rows) Close() {
 }
 
 func (row *Row) Scan(args ...interface{}) (err error) {
+	if row.err != nil {
+		return row.err
+	}
+
 	if row.row == nil {
 		return ErrNoRows
 	}
@@ -622,6 +686,11 @@ func (db *PfDB) exec(ctx PfCtx, report bool, affected int64, query string, args
 
 /* Exec that does not require audittxt */
 func (db *PfDB) execA(ctx PfCtx, audittxt string, affected int64, query string, args ...interface{}) (err error) {
+	/* Read-only impersonation (impersonate.go) */
+	if ctx != nil && ctx.IsReadOnly() {
+		return ErrReadOnly
+	}
+
 	/* Transaction already in progress? */
 	local_tx := false
 
@@ -661,10 +730,31 @@ func (db *PfDB) execA(ctx PfCtx, audittxt string, affected int64, query string,
 	return
 }
 
+/*
+ * Exec without audittxt and without ctx
+ *
+ * Thus also not refused during read-only impersonation, only
+ * use it for bookkeeping that is not a change by the user:
+ *  - userevents, audit of impersonated requests, impersonation state
+ *  - sessions (user_session.go), logins and their alerts
+ *  - IPtrk, JWT invalidation and encrypting stored JWT keys
+ *  - the mail queue and bounces
+ *  - distributed list messages (ml_deliver.go)
+ *  - the system secret, generated on first use
+ *  - OAuth2 clients (devices, refresh tokens, consent use), these
+ *    are authenticated by client or bearer token, never a session
+ *
+ * Other changes go through Exec() or ExecNActx() with the ctx.
+ */
 func (db *PfDB) ExecNA(affected int64, query string, args ...interface{}) (err error) {
 	return db.execA(nil, "", affected, query, args...)
 }
 
+/* Exec without audittxt, on behalf of ctx; refused during read-only impersonation */
+func (db *PfDB) ExecNActx(ctx PfCtx, affected int64, query string, args ...interface{}) (err error) {
+	return db.execA(ctx, "", affected, query, args...)
+}
+
 /* Exec() with forced requirement for audit message */
 func (db *PfDB) Exec(ctx PfCtx, audittxt string, affected int64, query string, args ...interface{}) (err error) {
 	if audittxt == "" {
@@ -871,6 +871,17 @@ func group_wiki(ctx PfCtx, args []string) (err error) {
 	return Wiki_menu(ctx, args[1:])
 }
 
+func group_calendar(ctx PfCtx, args []string) (err error) {
+	grname := args[0]
+
+	err = ctx.SelectGroup(grname, PERM_GROUP_CALENDAR)
+	if err != nil {
+		return
+	}
+
+	return Calendar_menu(ctx, args[1:])
+}
+
 func group_vcards(ctx PfCtx, args []string) (err error) {
 	grname := args[0]
 
@@ -901,6 +912,7 @@ func group_menu(ctx PfCtx, args []string) (err error) {
 		{"member", group_member, 0, -1, nil, PERM_USER, "Member commands"},
 		{"file", group_file, 1, -1, []string{"group"}, PERM_USER, "File"},
 		{"wiki", group_wiki, 1, -1, []string{"group"}, PERM_USER, "Wiki"},
+		{"calendar", group_calendar, 1, -1, []string{"group"}, PERM_USER, "Calendar"},
 		{"vcards", group_vcards, 1, 1, []string{"group"}, PERM_USER, "Vcards"},
 	})
 
@@ -0,0 +1,379 @@
+package pitchfork
+
+/*
+ * SysAdmin impersonation ("view as user")
+ *
+ * To debug permission problems a SysAdmin can see the system as
+ * a user sees it. The session then is that of the user, flagged
+ * with the SysAdmin in the token claims:
+ *  - every page shows a banner
+ *  - read-only, unless write mode was asked for: database changes
+ *    are refused, except bookkeeping (see PfDB.ExecNA)
+ *  - every request is in the audit log (Impersonate_Audit)
+ *  - the user is mailed when it ends, by stopping, logging out or
+ *    the session expiring (impersonate_rtn)
+ *
+ * Other SysAdmins can't be impersonated.
+ */
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrReadOnly = errors.New("Read-only impersonation, changes are not allowed")
+
+type PfImpersonation struct {
+	Id       int
+	Admin    string
+	Member   string
+	Write    bool
+	Reason   string
+	Started  time.Time
+	LastSeen time.Time
+	Ended    time.Time
+}
+
+var impersonate_exit chan bool
+var impersonate_done chan bool
+var impersonate_running bool
+
+/* Become the user, the SysAdmin is remembered in the session */
+func (ctx *PfCtxS) Impersonate(username string, write bool, reason string) (err error) {
+	var id int
+
+	if !ctx.IsSysAdmin() {
+		return errors.New("Only a SysAdmin can impersonate")
+	}
+
+	admin := ctx.TheUser().GetUserName()
+
+	user := ctx.NewUser()
+	user.SetUserName(username)
+
+	err = user.Refresh(ctx)
+	if err == ErrNoRows {
+		return errors.New("No such user")
+	} else if err != nil {
+		return
+	}
+
+	if user.GetUserName() == admin || user.CanBeSysAdmin() {
+		return errors.New("SysAdmins can't be impersonated")
+	}
+
+	q := "INSERT INTO impersonation " +
+		"(admin, member, writable, reason) " +
+		"VALUES($1, $2, $3, $4) " +
+		"RETURNING id"
+	err = DB.QueryRowA(ctx,
+		"Impersonation of $2 by $1 started (write: $3, reason: $4)",
+		q, admin, user.GetUserName(), write, reason).Scan(&id)
+	if err != nil {
+		return
+	}
+
+	userevent(ctx, "impersonate_start")
+
+	ctx.token_claims.Impersonator = admin
+	ctx.token_claims.Impersonation = id
+	ctx.token_claims.ImpersonateWrite = write
+	ctx.token_claims.SysAdminUntil = 0
+
+	ctx.Become(user)
+
+	/* Force generation of a new token */
+	ctx.token = ""
+	return
+}
+
+/* Back to the SysAdmin, as a Regular user */
+func (ctx *PfCtxS) StopImpersonate() (err error) {
+	admin := ctx.token_claims.Impersonator
+	id := ctx.token_claims.Impersonation
+
+	if admin == "" {
+		return errors.New("Not impersonating")
+	}
+
+	user := ctx.NewUser()
+	user.SetUserName(admin)
+
+	err = user.Refresh(ctx)
+	if err != nil {
+		return
+	}
+
+	ctx.token_claims.Impersonator = ""
+	ctx.token_claims.Impersonation = 0
+	ctx.token_claims.ImpersonateWrite = false
+
+	ctx.Become(user)
+
+	/* Force generation of a new token */
+	ctx.token = ""
+
+	impersonate_end(ctx, id)
+	userevent(ctx, "impersonate_stop")
+	return
+}
+
+/* The impersonating SysAdmin, empty when not impersonating */
+func (ctx *PfCtxS) Impersonator() (admin string, write bool) {
+	return ctx.token_claims.Impersonator, ctx.token_claims.ImpersonateWrite
+}
+
+/* Changes are not allowed */
+func (ctx *PfCtxS) IsReadOnly() bool {
+	return ctx.token_claims.Impersonator != "" && !ctx.token_claims.ImpersonateWrite
+}
+
+/* The impersonation is still going on, called for every request */
+func impersonate_seen(id int) (err error) {
+	q := "UPDATE impersonation " +
+		"SET last_seen = NOW() " +
+		"WHERE id = $1 " +
+		"AND ended IS NULL"
+	err = DB.ExecNA(1, q, id)
+	if err == ErrNoRows {
+		err = errors.New("Impersonation has ended")
+	}
+
+	return
+}
+
+/* Record a request made during impersonation */
+func Impersonate_Audit(ctx PfCtx, request string) {
+	admin, _ := ctx.Impersonator()
+	if admin == "" {
+		return
+	}
+
+	DB.audit(ctx, "Impersonation of $1 by $2: $3", "", ctx.TheUser().GetUserName(), admin, request)
+}
+
+/* Mark the impersonation as ended and tell the user */
+func impersonate_end(ctx PfCtx, id int) {
+	q := "UPDATE impersonation " +
+		"SET ended = NOW() " +
+		"WHERE id = $1 " +
+		"AND ended IS NULL"
+	err := DB.ExecNA(1, q, id)
+	if err != nil {
+		return
+	}
+
+	DB.audit(ctx, "Impersonation $1 ended", "", id)
+
+	impersonate_notify(ctx, id)
+}
+
+func impersonate_notify(ctx PfCtx, id int) {
+	var im PfImpersonation
+
+	q := "SELECT id, admin, member, writable, reason, started, last_seen, ended " +
+		"FROM impersonation " +
+		"WHERE id = $1"
+	err := DB.QueryRow(q, id).Scan(&im.Id, &im.Admin, &im.Member, &im.Write, &im.Reason, &im.Started, &im.LastSeen, &im.Ended)
+	if err != nil {
+		return
+	}
+
+	user := ctx.NewUser()
+	user.SetUserName(im.Member)
+
+	email, err := user.GetPriEmail(ctx, false)
+	if err != nil {
+		return
+	}
+
+	data := map[string]interface{}{
+		"Impersonation": im,
+	}
+
+	Mail_Template(ctx, email, "impersonated", "A SysAdmin viewed your account", data)
+}
+
+/* Impersonations, most recent first */
+func Impersonate_List() (ims []PfImpersonation, err error) {
+	q := "SELECT id, admin, member, writable, reason, started, last_seen, ended " +
+		"FROM impersonation " +
+		"ORDER BY id DESC " +
+		"LIMIT 100"
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var im PfImpersonation
+		var ended pq.NullTime
+
+		err = rows.Scan(&im.Id, &im.Admin, &im.Member, &im.Write, &im.Reason, &im.Started, &im.LastSeen, &ended)
+		if err != nil {
+			return
+		}
+
+		if ended.Valid {
+			im.Ended = ended.Time
+		}
+
+		ims = append(ims, im)
+	}
+
+	return
+}
+
+/* End impersonations whose session expired */
+func impersonate_expire() {
+	var ids []int
+
+	q := "SELECT id " +
+		"FROM impersonation " +
+		"WHERE ended IS NULL " +
+		"AND last_seen < NOW() - INTERVAL '" + strconv.Itoa(TOKEN_EXPIRATIONMINUTES) + " minutes'"
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	for rows.Next() {
+		var id int
+
+		err = rows.Scan(&id)
+		if err != nil {
+			break
+		}
+
+		ids = append(ids, id)
+	}
+
+	rows.Close()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	ctx := NewPfCtx(nil, nil, nil, nil, nil)
+
+	for _, id := range ids {
+		impersonate_end(ctx, id)
+	}
+}
+
+func impersonate_rtn(timeoutchk time.Duration) {
+	impersonate_running = true
+
+	/* Timer for expiring impersonations */
+	tmr_exp := time.NewTimer(timeoutchk)
+
+	for impersonate_running {
+		select {
+		case _, ok := <-impersonate_exit:
+			if !ok {
+				impersonate_running = false
+				break
+			}
+			break
+
+		case <-tmr_exp.C:
+			impersonate_expire()
+
+			/* Restart timer */
+			tmr_exp = time.NewTimer(timeoutchk)
+			break
+		}
+	}
+
+	impersonate_done <- true
+}
+
+func Impersonate_start(timeoutchk time.Duration) {
+	impersonate_exit = make(chan bool)
+	impersonate_done = make(chan bool)
+
+	go impersonate_rtn(timeoutchk)
+}
+
+func Impersonate_stop() {
+	if !impersonate_running {
+		return
+	}
+
+	/* Close the channel */
+	close(impersonate_exit)
+
+	/* Wait for it to finish */
+	<-impersonate_done
+}
+
+func impersonate_start(ctx PfCtx, args []string) (err error) {
+	write := len(args) >= 2 && IsTrue(args[1])
+
+	reason := ""
+	if len(args) == 3 {
+		reason = args[2]
+	}
+
+	err = ctx.Impersonate(args[0], write, reason)
+	if err != nil {
+		return
+	}
+
+	mode := "read-only"
+	if write {
+		mode = "write"
+	}
+
+	ctx.OutLn("Now impersonating %s (%s)", args[0], mode)
+	return
+}
+
+func impersonate_stop(ctx PfCtx, args []string) (err error) {
+	err = ctx.StopImpersonate()
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Impersonation ended, now %s again", ctx.TheUser().GetUserName())
+	return
+}
+
+func impersonate_list(ctx PfCtx, args []string) (err error) {
+	ims, err := Impersonate_List()
+	if err != nil {
+		return
+	}
+
+	for _, im := range ims {
+		mode := "read-only"
+		if im.Write {
+			mode = "write"
+		}
+
+		ended := "ongoing"
+		if !im.Ended.IsZero() {
+			ended = im.Ended.Format(Config.TimeFormat)
+		}
+
+		ctx.OutLn("%d %s %s %s %s - %s: %s", im.Id, im.Admin, im.Member, mode, im.Started.Format(Config.TimeFormat), ended, im.Reason)
+	}
+
+	return
+}
+
+func system_impersonate_menu(ctx PfCtx, args []string) (err error) {
+	menu := NewPfMenu([]PfMEntry{
+		{"start", impersonate_start, 1, 3, []string{"username", "write#bool", "reason"}, PERM_SYS_ADMIN, "View the system as the user, read-only unless write is given"},
+		{"stop", impersonate_stop, 0, 0, nil, PERM_USER, "Stop impersonating"},
+		{"list", impersonate_list, 0, 0, nil, PERM_SYS_ADMIN, "List the recent impersonations"},
+	})
+
+	err = ctx.Menu(args, menu)
+	return
+}
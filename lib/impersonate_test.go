@@ -0,0 +1,53 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run Impersonate -v
+ */
+
+import (
+	"testing"
+)
+
+func TestImpersonate_ReadOnly(t *testing.T) {
+	ctx := &PfCtxS{}
+
+	if ctx.IsReadOnly() {
+		t.Errorf("Read-only while not impersonating")
+	}
+
+	ctx.token_claims.Impersonator = "admin"
+
+	admin, write := ctx.Impersonator()
+	if admin != "admin" || write {
+		t.Errorf("Impersonator() = %q, %v", admin, write)
+	}
+
+	if !ctx.IsReadOnly() {
+		t.Errorf("Not read-only while impersonating")
+	}
+
+	/* Refused before touching the database */
+	err := DB.Exec(ctx, "Test", 1, "UPDATE member SET descr = 'x'")
+	if err != ErrReadOnly {
+		t.Errorf("Exec while read-only returned %v", err)
+	}
+
+	/* Also the unaudited changes made for the user */
+	err = DB.ExecNActx(ctx, 1, "UPDATE user_token SET last_used = NOW()")
+	if err != ErrReadOnly {
+		t.Errorf("ExecNActx while read-only returned %v", err)
+	}
+
+	/* Also for INSERT/UPDATE ... RETURNING */
+	var id int
+	err = DB.QueryRowA(ctx, "Test", "UPDATE member SET descr = 'x' RETURNING 1").Scan(&id)
+	if err != ErrReadOnly {
+		t.Errorf("QueryRowA while read-only returned %v", err)
+	}
+
+	ctx.token_claims.ImpersonateWrite = true
+
+	if ctx.IsReadOnly() {
+		t.Errorf("Read-only while write mode was asked for")
+	}
+}
@@ -4,25 +4,62 @@ package pitchfork
  * Note: iptrk uses non-audit versions of DB queries, otherwise we would generate double traffic
  *
  * IP tracking is done in a DB so that it is distributed between nodes
+ *
+ * Hits are counted per bucket (login, recover, api), each with its own
+ * threshold (iptrk_max), and per prefix: an address counts for every
+ * prefix length in iptrk_prefix_v4/iptrk_prefix_v6 (eg the /128, /64
+ * and /48 of an IPv6 address), thus rotating addresses inside a
+ * network does not help. Each wider prefix allows iptrk_prefix_factor
+ * times more hits than the previous one.
+ *
+ * Networks in iptrk_allow_cidr and the iptrk_allow table are never
+ * counted.
  */
 
 import (
 	"errors"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 )
 
+/* Buckets */
+const (
+	IPTRK_LOGIN   = "login"
+	IPTRK_RECOVER = "recover"
+	IPTRK_API     = "api"
+)
+
+/* Thresholds for buckets that are not in iptrk_max */
+var iptrk_max_default = map[string]int{
+	IPTRK_LOGIN:   5,
+	IPTRK_RECOVER: 5,
+	IPTRK_API:     1000,
+}
+
 type IPtrkEntry struct {
 	Blocked bool
+	Bucket  string
 	IP      string
 	Count   int
+	Max     int
 	Entered time.Time
 	Last    time.Time
 }
 
+type IPtrkAllow struct {
+	CIDR    string
+	Descr   string
+	Config  bool
+	Entered time.Time
+}
+
 type IPtrkS struct {
-	cmd string
-	ip  string
-	chn chan bool
+	cmd    string
+	bucket string
+	ip     string
+	chn    chan bool
 }
 
 var IPtrk_Max int
@@ -30,57 +67,166 @@ var IPtrk chan IPtrkS
 var IPtrk_done chan bool
 var IPtrk_running bool
 
-func iptrk_add(ip string) (ret bool) {
-	ret = true
+/* The prefix lengths that are counted for an address */
+func iptrk_prefixlens(ip net.IP) (lens []int, bits int) {
+	if ip.To4() != nil {
+		return Config.IPtrk_prefix4, 32
+	}
+
+	return Config.IPtrk_prefix6, 128
+}
+
+/* The prefixes an address is counted in, most specific first */
+func iptrk_prefixes(ip net.IP) (pfxs []string) {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	lens, bits := iptrk_prefixlens(ip)
+
+	for _, l := range lens {
+		mask := net.CIDRMask(l, bits)
+		pfxs = append(pfxs, (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String())
+	}
+
+	return
+}
+
+/* The number of hits allowed for the n-th prefix of a bucket */
+func iptrk_threshold(bucket string, n int) (max int) {
+	max = Config.IPtrk_max[bucket]
+	if max == 0 {
+		max = IPtrk_Max
+	}
+
+	factor := Config.IPtrk_factor
+	if factor < 1 {
+		factor = 1
+	}
+
+	for i := 0; i < n; i++ {
+		max *= factor
+	}
+
+	return
+}
+
+/* The threshold of a stored entry, which is an address or prefix */
+func iptrk_entry_threshold(bucket string, entry string) int {
+	var ip net.IP
+
+	l := -1
+
+	i := strings.IndexByte(entry, '/')
+	if i == -1 {
+		ip = net.ParseIP(entry)
+	} else {
+		ip = net.ParseIP(entry[:i])
+		l, _ = strconv.Atoi(entry[i+1:])
+	}
 
-	cnt := 0
+	if ip == nil {
+		return iptrk_threshold(bucket, 0)
+	}
 
-	/* Add a new hit */
+	lens, bits := iptrk_prefixlens(ip)
+	if l == -1 {
+		l = bits
+	}
 
+	for n, pl := range lens {
+		if pl == l {
+			return iptrk_threshold(bucket, n)
+		}
+	}
+
+	/* Not configured (anymore) */
+	return iptrk_threshold(bucket, 0)
+}
+
+/* Is the address in an allowed network? */
+func iptrk_allowed(ip net.IP) bool {
+	var cnt int
+
+	for _, n := range Config.IPtrk_allowc {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	q := "SELECT COUNT(*) " +
+		"FROM iptrk_allow " +
+		"WHERE $1::INET <<= cidr"
+	err := DB.QueryRow(q, ip.String()).Scan(&cnt)
+	if err != nil {
+		Errf("Chk: %q %v %q", q, ip, err.Error())
+		return false
+	}
+
+	return cnt > 0
+}
+
+/* Count a hit for an address or prefix, returning the new count */
+func iptrk_hit(bucket string, ip string) (cnt int, err error) {
 	/*
 	 * TODO: Postgres 9.5+
 	 *
-	 * q := "INSERT INTO iptrk (ip) VALUES($1) " +
-	 *	"ON CONFLICT (ip) " +
+	 * q := "INSERT INTO iptrk (bucket, ip) VALUES($1, $2) " +
+	 *	"ON CONFLICT (bucket, ip) " +
 	 *	"DO UPDATE SET count = iptrk.count + EXCLUDED.count, last = NOW() " +
 	 *	"RETURNING count"
-	 * err := DB.QueryRowNA(q, ip).Scan(&cnt)
+	 * err := DB.QueryRowNA(q, bucket, ip).Scan(&cnt)
 	 */
 
 	q := "INSERT INTO iptrk " +
-		"(ip) " +
-		"VALUES($1) " +
+		"(bucket, ip) " +
+		"VALUES($1, $2) " +
 		"RETURNING count"
-	err := DB.QueryRowNA(q, ip).Scan(&cnt)
+	err = DB.QueryRowNA(q, bucket, ip).Scan(&cnt)
 	if err != nil && DB_IsPQErrorConstraint(err) {
 		q = "UPDATE iptrk " +
-			"SET count = count + 1 " +
-			"WHERE ip = $1 " +
+			"SET count = count + 1, last = NOW() " +
+			"WHERE bucket = $1 " +
+			"AND ip = $2 " +
 			"RETURNING count"
-		err = DB.QueryRowNA(q, ip).Scan(&cnt)
+		err = DB.QueryRowNA(q, bucket, ip).Scan(&cnt)
 	}
 
 	if err != nil {
-		Errf("Chk: %q %v %q", q, ip, err.Error())
-		return
+		Errf("Chk: %q %v %v %q", q, bucket, ip, err.Error())
 	}
 
-	q = "SELECT count " +
-		"FROM iptrk " +
-		"WHERE ip = $1"
-	err = DB.QueryRow(q, ip).Scan(&cnt)
+	return
+}
 
-	if err != nil {
-		Errf("Chk: %q %v %q", q, ip, err.Error())
+func iptrk_add(bucket string, ip string) (ret bool) {
+	ret = true
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		Errf("Chk: invalid IP %q", ip)
 		return
 	}
 
-	/* Below the limit? */
-	if cnt <= IPtrk_Max {
-		/* Not blocked */
-		ret = false
+	if iptrk_allowed(addr) {
+		return false
 	}
 
+	/* Add a new hit to every prefix, blocked when any is above the limit */
+	limited := false
+
+	for n, pfx := range iptrk_prefixes(addr) {
+		cnt, err := iptrk_hit(bucket, pfx)
+		if err != nil {
+			return
+		}
+
+		if cnt > iptrk_threshold(bucket, n) {
+			limited = true
+		}
+	}
+
+	ret = limited
 	return
 }
 
@@ -97,19 +243,34 @@ func iptrk_expire(t string) bool {
 	return true
 }
 
-func iptrk_flush(ip string) bool {
+/*
+ * Flush a bucket, or all of them when empty
+ *
+ * With an IP (or prefix) only the entries that contain it
+ * or that are inside it are flushed.
+ */
+func iptrk_flush(bucket string, ip string) bool {
 	var err error
 
-	if ip == "" {
-		/* Flush the whole IP Tracking table */
-		q := "DELETE FROM iptrk"
-		err = DB.ExecNA(-1, q)
-	} else {
-		/* Flush only a single IP */
-		q := "DELETE FROM iptrk WHERE ip = $1"
-		err = DB.ExecNA(-1, q, ip)
+	q := "DELETE FROM iptrk "
+	var args []interface{}
+
+	if ip != "" {
+		args = append(args, ip)
+		q += "WHERE (ip >>= $1::INET OR ip <<= $1::INET) "
 	}
 
+	if bucket != "" {
+		args = append(args, bucket)
+		if len(args) == 1 {
+			q += "WHERE "
+		} else {
+			q += "AND "
+		}
+		q += "bucket = $" + strconv.Itoa(len(args))
+	}
+
+	err = DB.ExecNA(-1, q, args...)
 	if err != nil {
 		Errf("iptrk_flush() failed: %s", err.Error())
 		return false
@@ -118,6 +279,25 @@ func iptrk_flush(ip string) bool {
 	return true
 }
 
+/*
+ * Clear the count of a single address in a bucket
+ *
+ * The prefixes it is in are kept, otherwise a login on
+ * an account of their own would reset a whole network.
+ */
+func iptrk_clear(bucket string, ip string) bool {
+	q := "DELETE FROM iptrk " +
+		"WHERE bucket = $1 " +
+		"AND ip = $2::INET"
+	err := DB.ExecNA(-1, q, bucket, ip)
+	if err != nil {
+		Errf("iptrk_clear() failed: %s", err.Error())
+		return false
+	}
+
+	return true
+}
+
 /* Go routine that manages the ip tracking */
 func iptrk_rtn(timeoutchk time.Duration, expire string) {
 	IPtrk_running = true
@@ -137,7 +317,7 @@ func iptrk_rtn(timeoutchk time.Duration, expire string) {
 
 			switch s.cmd {
 			case "add":
-				ret = iptrk_add(s.ip)
+				ret = iptrk_add(s.bucket, s.ip)
 				break
 
 			case "wipe":
@@ -145,7 +325,11 @@ func iptrk_rtn(timeoutchk time.Duration, expire string) {
 				break
 
 			case "flush":
-				ret = iptrk_flush(s.ip)
+				ret = iptrk_flush(s.bucket, s.ip)
+				break
+
+			case "clear":
+				ret = iptrk_clear(s.bucket, s.ip)
 				break
 
 			default:
@@ -170,27 +354,34 @@ func iptrk_rtn(timeoutchk time.Duration, expire string) {
 	IPtrk_done <- true
 }
 
-func iptrk_cmd(cmd string, ip string) (ret bool) {
+func iptrk_cmd(cmd string, bucket string, ip string) (ret bool) {
 	/* Create result channel */
 	chn := make(chan bool)
 
-	IPtrk <- IPtrkS{cmd, ip, chn}
+	IPtrk <- IPtrkS{cmd, bucket, ip, chn}
 
 	/* Wait for result */
 	ret = <-chn
 	return
 }
 
-func Iptrk_count(ip string) (limited bool) {
+/* Count a hit in a bucket, returns if the IP is limited */
+func Iptrk_hit(bucket string, ip string) (limited bool) {
 	if IPtrk_running {
-		limited = iptrk_cmd("add", ip)
+		limited = iptrk_cmd("add", bucket, ip)
 	} else {
-		limited = iptrk_add(ip)
+		limited = iptrk_add(bucket, ip)
 	}
 
 	return
 }
 
+/* Count a login attempt */
+func Iptrk_count(ip string) (limited bool) {
+	return Iptrk_hit(IPTRK_LOGIN, ip)
+}
+
+/* max is the threshold for buckets that are not configured */
 func Iptrk_start(max int, timeoutchk time.Duration, expire string) {
 	IPtrk = make(chan IPtrkS, 1000)
 	IPtrk_done = make(chan bool)
@@ -211,21 +402,45 @@ func Iptrk_stop() {
 	<-IPtrk_done
 }
 
-func Iptrk_reset(ip string) (ret bool) {
+/* Remove an IP (or prefix) from a bucket, or from all when empty */
+func Iptrk_remove(bucket string, ip string) (ret bool) {
+	if IPtrk_running {
+		ret = iptrk_cmd("flush", bucket, ip)
+	} else {
+		ret = iptrk_flush(bucket, ip)
+	}
+	return
+}
+
+/* Clear the login count of an address, after a successful login */
+func Iptrk_login_ok(ip string) (ret bool) {
 	if IPtrk_running {
-		ret = iptrk_cmd("flush", ip)
+		ret = iptrk_cmd("clear", IPTRK_LOGIN, ip)
 	} else {
-		ret = iptrk_flush(ip)
+		ret = iptrk_clear(IPTRK_LOGIN, ip)
 	}
 	return
 }
 
-func IPtrk_List(ctx PfCtx) (ts []IPtrkEntry, err error) {
+func Iptrk_reset(ip string) (ret bool) {
+	return Iptrk_remove("", ip)
+}
+
+func IPtrk_List(ctx PfCtx, bucket string) (ts []IPtrkEntry, err error) {
 	q := "SELECT " +
-		"ip, count, entered, last " +
-		"FROM iptrk " +
-		"ORDER BY ip"
-	rows, err := DB.Query(q)
+		"bucket, ip, count, entered, last " +
+		"FROM iptrk "
+
+	var args []interface{}
+
+	if bucket != "" {
+		q += "WHERE bucket = $1 "
+		args = append(args, bucket)
+	}
+
+	q += "ORDER BY bucket, ip"
+
+	rows, err := DB.Query(q, args...)
 	if err != nil {
 		return
 	}
@@ -235,12 +450,13 @@ func IPtrk_List(ctx PfCtx) (ts []IPtrkEntry, err error) {
 	for rows.Next() {
 		var t IPtrkEntry
 
-		err = rows.Scan(&t.IP, &t.Count, &t.Entered, &t.Last)
+		err = rows.Scan(&t.Bucket, &t.IP, &t.Count, &t.Entered, &t.Last)
 		if err != nil {
 			return
 		}
 
-		t.Blocked = t.Count > IPtrk_Max
+		t.Max = iptrk_entry_threshold(t.Bucket, t.IP)
+		t.Blocked = t.Count > t.Max
 
 		ts = append(ts, t)
 	}
@@ -252,8 +468,103 @@ func IPtrk_List(ctx PfCtx) (ts []IPtrkEntry, err error) {
 	return
 }
 
+/* The allowed networks, configured ones first */
+func IPtrk_AllowList() (allows []IPtrkAllow, err error) {
+	for _, n := range Config.IPtrk_allowc {
+		allows = append(allows, IPtrkAllow{CIDR: n.String(), Descr: "Configured in iptrk_allow_cidr", Config: true})
+	}
+
+	q := "SELECT cidr, descr, entered " +
+		"FROM iptrk_allow " +
+		"ORDER BY cidr"
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var a IPtrkAllow
+
+		err = rows.Scan(&a.CIDR, &a.Descr, &a.Entered)
+		if err != nil {
+			return
+		}
+
+		allows = append(allows, a)
+	}
+
+	return
+}
+
+/* Never track a network, what is already tracked in it is removed */
+func IPtrk_AllowAdd(ctx PfCtx, cidr string, descr string) (err error) {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return errors.New("Invalid network, expecting eg 192.0.2.0/24")
+	}
+
+	cidr = n.String()
+
+	q := "INSERT INTO iptrk_allow " +
+		"(cidr, descr) " +
+		"VALUES($1, $2)"
+	err = DB.Exec(ctx,
+		"Added $1 to the IPtrk allowlist ($2)",
+		1, q, cidr, descr)
+	if err != nil {
+		if DB_IsPQErrorConstraint(err) {
+			err = errors.New("Network is already allowed")
+		}
+		return
+	}
+
+	q = "DELETE FROM iptrk " +
+		"WHERE ip <<= $1::INET"
+	err = DB.ExecNA(-1, q, cidr)
+	return
+}
+
+func IPtrk_AllowRemove(ctx PfCtx, cidr string) (err error) {
+	q := "DELETE FROM iptrk_allow " +
+		"WHERE cidr = $1::CIDR"
+	err = DB.Exec(ctx,
+		"Removed $1 from the IPtrk allowlist",
+		1, q, cidr)
+	if err == ErrNoRows {
+		err = errors.New("No such network in the allowlist")
+	}
+
+	return
+}
+
+/* The name of a bucket, or an error when it does not exist */
+func iptrk_bucket(bucket string) (string, error) {
+	bucket = strings.ToLower(bucket)
+
+	if bucket == "" {
+		return "", nil
+	}
+
+	_, ok := iptrk_max_default[bucket]
+	if !ok {
+		return "", errors.New("Unknown bucket, expecting " + IPTRK_LOGIN + ", " + IPTRK_RECOVER + " or " + IPTRK_API)
+	}
+
+	return bucket, nil
+}
+
 func iptrk_list(ctx PfCtx, args []string) (err error) {
-	ts, err := IPtrk_List(ctx)
+	bucket := ""
+	if len(args) == 1 {
+		bucket, err = iptrk_bucket(args[0])
+		if err != nil {
+			return
+		}
+	}
+
+	ts, err := IPtrk_List(ctx, bucket)
 
 	if err == ErrNoRows {
 		ctx.OutLn("There are currently no entries")
@@ -265,7 +576,7 @@ func iptrk_list(ctx PfCtx, args []string) (err error) {
 		return
 	}
 
-	ctx.Outf("%16s %16s %7s %10s %s\n", "Entered", "Last", "Status", "Count", "IP")
+	ctx.Outf("%16s %16s %7s %7s %10s %s\n", "Entered", "Last", "Bucket", "Status", "Count", "IP")
 
 	for _, t := range ts {
 		s := "okay"
@@ -273,14 +584,22 @@ func iptrk_list(ctx PfCtx, args []string) (err error) {
 			s = "blocked"
 		}
 
-		ctx.Outf("%16s %16s %7s %10d %s\n", Fmt_Time(t.Entered), Fmt_Time(t.Last), s, t.Count, t.IP)
+		ctx.Outf("%16s %16s %7s %7s %5d/%-4d %s\n", Fmt_Time(t.Entered), Fmt_Time(t.Last), t.Bucket, s, t.Count, t.Max, t.IP)
 	}
 
 	return
 }
 
 func iptrk_flushcmd(ctx PfCtx, args []string) (err error) {
-	Iptrk_reset("")
+	bucket := ""
+	if len(args) == 1 {
+		bucket, err = iptrk_bucket(args[0])
+		if err != nil {
+			return
+		}
+	}
+
+	Iptrk_remove(bucket, "")
 	ctx.OutLn("IPtrk flushed")
 	return
 }
@@ -293,7 +612,15 @@ func iptrk_remove(ctx PfCtx, args []string) (err error) {
 		return
 	}
 
-	ret := Iptrk_reset(ip)
+	bucket := ""
+	if len(args) == 2 {
+		bucket, err = iptrk_bucket(args[1])
+		if err != nil {
+			return
+		}
+	}
+
+	ret := Iptrk_remove(bucket, ip)
 	if ret {
 		ctx.OutLn("IP removed from IPtrk table")
 	} else {
@@ -303,11 +630,111 @@ func iptrk_remove(ctx PfCtx, args []string) (err error) {
 	return
 }
 
+/* The thresholds of a bucket per prefix length */
+func iptrk_thresholds(bucket string, lens []int) string {
+	var ths []string
+
+	for n, l := range lens {
+		ths = append(ths, "/"+strconv.Itoa(l)+": "+strconv.Itoa(iptrk_threshold(bucket, n)))
+	}
+
+	return strings.Join(ths, " ")
+}
+
+/* The effective configuration */
+func iptrk_config(ctx PfCtx, args []string) (err error) {
+	ctx.OutLn("Expiry: %d minutes", Config.IPtrk_minutes)
+
+	for _, b := range []string{IPTRK_LOGIN, IPTRK_RECOVER, IPTRK_API} {
+		ctx.OutLn("Bucket %s: IPv4 %s, IPv6 %s", b, iptrk_thresholds(b, Config.IPtrk_prefix4), iptrk_thresholds(b, Config.IPtrk_prefix6))
+	}
+
+	return
+}
+
+func iptrk_allow_list(ctx PfCtx, args []string) (err error) {
+	allows, err := IPtrk_AllowList()
+	if err != nil {
+		return
+	}
+
+	if len(allows) == 0 {
+		ctx.OutLn("No networks are allowed")
+		return
+	}
+
+	for _, a := range allows {
+		ctx.OutLn("%s %s", a.CIDR, a.Descr)
+	}
+
+	return
+}
+
+func iptrk_allow_add(ctx PfCtx, args []string) (err error) {
+	descr := ""
+	if len(args) == 2 {
+		descr = args[1]
+	}
+
+	err = IPtrk_AllowAdd(ctx, args[0], descr)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Network added to the allowlist")
+	return
+}
+
+func iptrk_allow_remove(ctx PfCtx, args []string) (err error) {
+	err = IPtrk_AllowRemove(ctx, args[0])
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Network removed from the allowlist")
+	return
+}
+
+func iptrk_allow_menu(ctx PfCtx, args []string) (err error) {
+	menu := NewPfMenu([]PfMEntry{
+		{"list", iptrk_allow_list, 0, 0, nil, PERM_SYS_ADMIN, "List the networks that are never tracked"},
+		{"add", iptrk_allow_add, 1, 2, []string{"cidr", "descr"}, PERM_SYS_ADMIN, "Never track a network"},
+		{"remove", iptrk_allow_remove, 1, 1, []string{"cidr"}, PERM_SYS_ADMIN, "Track a network again"},
+	})
+
+	err = ctx.Menu(args, menu)
+	return
+}
+
+/* The per-account side of IPtrk, see user_lockout.go */
+func iptrk_accounts(ctx PfCtx, args []string) (err error) {
+	users, err := User_LockedList()
+	if err != nil {
+		return
+	}
+
+	if len(users) == 0 {
+		ctx.OutLn("There are currently no accounts with failed logins")
+		return
+	}
+
+	ctx.Outf("%16s %10s %s\n", "Locked until", "Count", "Username")
+
+	for _, u := range users {
+		ctx.Outf("%16s %10d %s\n", Fmt_Time(u.LockedUntil), u.Attempts, u.UserName)
+	}
+
+	return
+}
+
 func iptrk_menu(ctx PfCtx, args []string) (err error) {
 	menu := NewPfMenu([]PfMEntry{
-		{"list", iptrk_list, 0, 0, nil, PERM_SYS_ADMIN, "List the contents of the IPtrk tables"},
-		{"flush", iptrk_flushcmd, 0, 0, nil, PERM_SYS_ADMIN, "Flush all entries from the IPtrk table"},
-		{"remove", iptrk_remove, 1, 1, []string{"ip"}, PERM_SYS_ADMIN, "Remove an entry from IPtrk"},
+		{"list", iptrk_list, 0, 1, []string{"bucket"}, PERM_SYS_ADMIN, "List the contents of the IPtrk tables, optionally of one bucket (login, recover, api)"},
+		{"accounts", iptrk_accounts, 0, 0, nil, PERM_SYS_ADMIN, "List accounts with failed logins and their lockout"},
+		{"config", iptrk_config, 0, 0, nil, PERM_SYS_ADMIN, "Show the expiry and the thresholds per bucket and prefix"},
+		{"allow", iptrk_allow_menu, 0, -1, nil, PERM_SYS_ADMIN, "Networks that are never tracked"},
+		{"flush", iptrk_flushcmd, 0, 1, []string{"bucket"}, PERM_SYS_ADMIN, "Flush all entries from the IPtrk table, or of one bucket"},
+		{"remove", iptrk_remove, 1, 2, []string{"ip", "bucket"}, PERM_SYS_ADMIN, "Remove an IP or prefix, and the prefixes containing it, from IPtrk"},
 	})
 
 	err = ctx.Menu(args, menu)
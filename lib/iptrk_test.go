@@ -8,6 +8,8 @@ package pitchfork
  */
 
 import (
+	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -113,6 +115,46 @@ func TestIPtrkFlush(t *testing.T) {
 	addip(t, ip6, true)
 }
 
+func TestIPtrkLoginOk(t *testing.T) {
+	max := 5
+	ip6 := "2001:db8::6"
+
+	/* Start the IP Tracker */
+	Iptrk_reset("")
+	Iptrk_start(max, 10*time.Hour, "1 day")
+	defer Iptrk_reset("")
+	defer Iptrk_stop()
+
+	for i := 0; i < max; i++ {
+		addip(t, ip6, true)
+	}
+
+	/* A successful login only clears the address itself */
+	if !Iptrk_login_ok(ip6) {
+		t.Fatalf("Clearing failed")
+	}
+
+	addip(t, ip6, true)
+
+	ts, err := IPtrk_List(nil, IPTRK_LOGIN)
+	if err != nil {
+		t.Fatalf("Listing failed: %s", err.Error())
+	}
+
+	cnts := make(map[string]int)
+	for _, e := range ts {
+		cnts[e.IP] = e.Count
+	}
+
+	if cnts["2001:db8::6"] != 1 {
+		t.Errorf("Address not cleared: %v", cnts)
+	}
+
+	if cnts["2001:db8::/64"] != max+1 || cnts["2001:db8::/48"] != max+1 {
+		t.Errorf("Prefixes cleared: %v", cnts)
+	}
+}
+
 func TestIPtrkExpire(t *testing.T) {
 	max := 5
 	ip6 := "2001:db8::6"
@@ -139,3 +181,63 @@ func TestIPtrkExpire(t *testing.T) {
 	/* Should have expired */
 	addip(t, ip6, true)
 }
+
+func TestIPtrkPrefixes(t *testing.T) {
+	cfg := Config
+	defer func() {
+		Config = cfg
+	}()
+
+	Config.IPtrk_prefix4 = []int{32, 24}
+	Config.IPtrk_prefix6 = []int{128, 64, 48}
+
+	tsts := map[string]string{
+		"192.0.2.4":         "192.0.2.4/32 192.0.2.0/24",
+		"2001:db8:1:2::6":   "2001:db8:1:2::6/128 2001:db8:1:2::/64 2001:db8:1::/48",
+		"::ffff:198.51.1.9": "198.51.1.9/32 198.51.1.0/24",
+	}
+
+	for ip, exp := range tsts {
+		pfxs := strings.Join(iptrk_prefixes(net.ParseIP(ip)), " ")
+		if pfxs != exp {
+			t.Errorf("iptrk_prefixes(%q) = %q, expected %q", ip, pfxs, exp)
+		}
+	}
+}
+
+func TestIPtrkThreshold(t *testing.T) {
+	cfg := Config
+	max := IPtrk_Max
+	defer func() {
+		Config = cfg
+		IPtrk_Max = max
+	}()
+
+	Config.IPtrk_prefix4 = []int{32, 24}
+	Config.IPtrk_prefix6 = []int{128, 64, 48}
+	Config.IPtrk_factor = 4
+	Config.IPtrk_max = map[string]int{IPTRK_API: 100}
+	IPtrk_Max = 5
+
+	tsts := []struct {
+		bucket string
+		entry  string
+		max    int
+	}{
+		{IPTRK_LOGIN, "192.0.2.4", 5},
+		{IPTRK_LOGIN, "192.0.2.0/24", 20},
+		{IPTRK_LOGIN, "2001:db8::6", 5},
+		{IPTRK_LOGIN, "2001:db8::/64", 20},
+		{IPTRK_LOGIN, "2001:db8::/48", 80},
+		{IPTRK_API, "2001:db8::/64", 400},
+		/* Prefix that is not configured */
+		{IPTRK_LOGIN, "2001:db8::/56", 5},
+	}
+
+	for _, tst := range tsts {
+		max := iptrk_entry_threshold(tst.bucket, tst.entry)
+		if max != tst.max {
+			t.Errorf("iptrk_entry_threshold(%q, %q) = %d, expected %d", tst.bucket, tst.entry, max, tst.max)
+		}
+	}
+}
@@ -50,8 +50,15 @@ func Token_New(ttype string, username string, expmins time.Duration, claims JWTC
 	return
 }
 
+/* Signs with the active key of the keyring (jwt_key.go) */
 func (token *Token) Sign() (tok string, err error) {
-	tok, err = token.SignedString(Config.Token_prv)
+	key, err := jwtkey_active()
+	if err != nil {
+		return
+	}
+
+	token.Header["kid"] = key.kid
+	tok, err = token.SignedString(key.prv)
 	return
 }
 
@@ -63,7 +70,10 @@ func Token_Parse(tok string, ttype string, claims JWTClaimI) (expsoon bool, err
 		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
-		return Config.Token_pub, nil
+
+		/* Tokens from before the keyring have no kid */
+		kid, _ := token.Header["kid"].(string)
+		return jwtkey_find(kid)
 	})
 
 	if err != nil || jtoken == nil || !jtoken.Valid {
@@ -95,8 +105,8 @@ func Token_Parse(tok string, ttype string, claims JWTClaimI) (expsoon bool, err
 
 	jwtc := claims.GetJWTClaims()
 
-	/* Avoid type checking */
-	if ttype == "" {
+	/* Avoid type checking when no type is requested */
+	if ttype != "" {
 		/* Check that it is the right type of token */
 		if jwtc.Audience != ttype {
 			err = errors.New("Token is not a ttype token")
@@ -11,6 +11,7 @@ package pitchfork
 
 import (
 	"container/list"
+	"errors"
 	"sync"
 	"time"
 )
@@ -180,6 +181,35 @@ func Jwt_invalidate(tok string, claims JWTClaimI) {
 	jwtinv_cache_add(tok, false, claims)
 }
 
+/*
+ * Invalidate a single-use token, the invalidation is the check
+ *
+ * The insert conflicts when it was used before, also when
+ * another request or node uses it at the same time.
+ */
+func Jwt_invalidate_once(tok string, claims JWTClaimI) (err error) {
+	jwtc := claims.GetJWTClaims()
+
+	jwtinv_mutex.Lock()
+	defer jwtinv_mutex.Unlock()
+
+	jwtinv_cache_del(tok)
+
+	q := "INSERT INTO jwt_invalidated (token, expires) VALUES($1, TO_TIMESTAMP($2))"
+	err = DB.ExecNA(1, q, tok, jwtc.ExpiresAt)
+	if err != nil {
+		if DB_IsPQErrorConstraint(err) {
+			err = errors.New("Token already used")
+		} else {
+			Errf("Insert token_invalid(%q %s %v): %s", q, tok, jwtc.ExpiresAt, err.Error())
+			err = errors.New("Token could not be invalidated")
+		}
+	}
+
+	jwtinv_cache_add(tok, false, claims)
+	return
+}
+
 func Jwt_isinvalidated(tok string, claims JWTClaimI) (invalid bool) {
 	/* Invalid by default */
 	invalid = true
@@ -119,3 +119,21 @@ func TestJWTInvalidate(t *testing.T) {
 
 	t.Logf("Done")
 }
+
+func TestJWTInvalidateOnce(t *testing.T) {
+	tok, claims := jwtinv_test(t, 1000, 10)
+
+	err := Jwt_invalidate_once(tok, claims)
+	if err != nil {
+		t.Fatalf("First use failed: %s", err.Error())
+	}
+
+	err = Jwt_invalidate_once(tok, claims)
+	if err == nil {
+		t.Errorf("Second use was accepted")
+	}
+
+	if !Jwt_isinvalidated(tok, claims) {
+		t.Errorf("Token should be invalid")
+	}
+}
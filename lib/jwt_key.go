@@ -0,0 +1,727 @@
+package pitchfork
+
+/*
+ * JWT signing keyring
+ *
+ * Tokens carry the kid (RFC7638 thumbprint) of the key that signed them,
+ * thus the key can be rotated without invalidating the outstanding
+ * session and CSRF tokens:
+ *  - 'system jwtkey rotate' generates a new ES512 key and makes it active
+ *  - the previously active key keeps verifying tokens
+ *  - once its tokens have expired, it can be retired
+ *
+ * Keys are stored in SQL (jwt_key) so that all nodes share them.
+ * The key from the configuration (jwt_key_prv/jwt_key_pub) remains
+ * part of the keyring and is the active key till another is activated.
+ * Tokens without a kid (from before the keyring) are verified with it.
+ *
+ * The keyring is cached, nodes pick up changes when they
+ * see an unknown kid or after JWTKEY_REFRESH.
+ *
+ * Private keys are stored encrypted (AES-256-GCM) with the key from
+ * the file jwt_key_kek (default: jwt.kek, 32+ random bytes, the same
+ * on all nodes), thus read access to SQL does not allow forging tokens.
+ * Keys stored in plain by earlier versions are encrypted on load.
+ */
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+)
+
+/* How long the cached keyring is used before checking SQL again */
+const JWTKEY_REFRESH = 5 * time.Minute
+
+/* Minimum time between refreshes triggered by an unknown kid */
+const JWTKEY_UNKNOWN = 10 * time.Second
+
+type PfJWTKey struct {
+	Kid     string
+	State   string /* active, verify or retired */
+	File    bool   /* The key from the configuration */
+	Entered time.Time
+}
+
+type jwtkey struct {
+	kid    string
+	prv    *ecdsa.PrivateKey /* nil when we can't sign with it */
+	pub    *ecdsa.PublicKey
+	active bool
+}
+
+var jwtkeys []jwtkey
+var jwtkeys_loaded time.Time
+var jwtkeys_mutex = &sync.Mutex{}
+
+/* The key ID, the RFC7638 thumbprint of the public key */
+func jwtkey_kid(pub *ecdsa.PublicKey) string {
+	return oidc_jwk(pub).Kid
+}
+
+/* The key from the configuration */
+func jwtkey_file() (k jwtkey, ok bool) {
+	k.pub, ok = Config.Token_pub.(*ecdsa.PublicKey)
+	if !ok {
+		return
+	}
+
+	k.prv, _ = Config.Token_prv.(*ecdsa.PrivateKey)
+	k.kid = jwtkey_kid(k.pub)
+	return
+}
+
+/* Prefix of encrypted private keys in SQL */
+const JWTKEY_SEALED = "sealed:"
+
+/* The key encrypting the private keys in SQL */
+func jwtkey_kek() (kek []byte, err error) {
+	fn := Config.Conf_root + Config.JWT_kek
+
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		err = errors.New("Could not load JWT key encryption key from " + fn + ": " + err.Error())
+		return
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) < 32 {
+		err = errors.New("JWT key encryption key in " + fn + " is too short, it requires 32 or more random bytes")
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	kek = sum[:]
+	return
+}
+
+func jwtkey_aead(kek []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return
+	}
+
+	aead, err = cipher.NewGCM(block)
+	return
+}
+
+/* Encrypt a private key for storage, the kid is bound to it */
+func jwtkey_seal(kek []byte, kid string, prv string) (sealed string, err error) {
+	aead, err := jwtkey_aead(kek)
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return
+	}
+
+	ct := aead.Seal(nonce, nonce, []byte(prv), []byte(kid))
+	sealed = JWTKEY_SEALED + base64.StdEncoding.EncodeToString(ct)
+	return
+}
+
+func jwtkey_open(kek []byte, kid string, sealed string) (prv string, err error) {
+	aead, err := jwtkey_aead(kek)
+	if err != nil {
+		return
+	}
+
+	ct, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, JWTKEY_SEALED))
+	if err != nil || len(ct) < aead.NonceSize() {
+		err = errors.New("Invalid encrypted private key")
+		return
+	}
+
+	pt, err := aead.Open(nil, ct[:aead.NonceSize()], ct[aead.NonceSize():], []byte(kid))
+	if err != nil {
+		err = errors.New("Could not decrypt private key, wrong jwt_key_kek?")
+		return
+	}
+
+	prv = string(pt)
+	return
+}
+
+/* The private key of a keyring entry, encrypting it when stored in plain */
+func jwtkey_prv_load(kek []byte, kekerr error, kid string, stored string) (prv *ecdsa.PrivateKey, err error) {
+	if kekerr != nil {
+		err = kekerr
+		return
+	}
+
+	pemstr := stored
+
+	if strings.HasPrefix(stored, JWTKEY_SEALED) {
+		pemstr, err = jwtkey_open(kek, kid, stored)
+		if err != nil {
+			return
+		}
+	} else {
+		var sealed string
+
+		sealed, err = jwtkey_seal(kek, kid, stored)
+		if err != nil {
+			return
+		}
+
+		q := "UPDATE jwt_key " +
+			"SET prv = $2 " +
+			"WHERE kid = $1 " +
+			"AND prv = $3"
+		err = DB.ExecNA(-1, q, kid, sealed, stored)
+		if err != nil {
+			return
+		}
+
+		Logf("JWT key %s: private key is now stored encrypted", kid)
+	}
+
+	prv, err = jwt.ParseECPrivateKeyFromPEM([]byte(pemstr))
+	return
+}
+
+/* Reload the keyring from SQL */
+func JWTKey_Refresh() (err error) {
+	ring := []jwtkey{}
+	factive := true
+
+	file, fok := jwtkey_file()
+	kek, kekerr := jwtkey_kek()
+
+	q := "SELECT kid, prv, pub, state " +
+		"FROM jwt_key " +
+		"ORDER BY entered DESC"
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var k jwtkey
+		var kid, pub, state string
+		var prv sql.NullString
+
+		err = rows.Scan(&kid, &prv, &pub, &state)
+		if err != nil {
+			return
+		}
+
+		if fok && kid == file.kid {
+			/* Recorded, thus SQL determines the state */
+			fok = false
+			k.prv = file.prv
+		}
+
+		if state == "active" {
+			factive = false
+		}
+
+		if state == "retired" {
+			continue
+		}
+
+		k.kid = kid
+		k.active = state == "active"
+
+		k.pub, err = jwt.ParseECPublicKeyFromPEM([]byte(pub))
+		if err != nil {
+			err = errors.New("JWT key " + kid + ": " + err.Error())
+			return
+		}
+
+		if prv.Valid {
+			/* Without it, the key still verifies, but it can't sign */
+			var e error
+
+			k.prv, e = jwtkey_prv_load(kek, kekerr, kid, prv.String)
+			if e != nil {
+				Errf("JWT key %s: %s", kid, e.Error())
+				k.prv = nil
+			}
+		}
+
+		ring = append(ring, k)
+	}
+
+	if fok {
+		file.active = factive
+		ring = append(ring, file)
+	}
+
+	jwtkeys_mutex.Lock()
+	jwtkeys = ring
+	jwtkeys_loaded = time.Now()
+	jwtkeys_mutex.Unlock()
+	return
+}
+
+/*
+ * The current keyring
+ *
+ * Till the keyring is loaded (JWTKey_start) only the key
+ * from the configuration is used, eg for the tools.
+ */
+func jwtkey_ring() (ring []jwtkey) {
+	jwtkeys_mutex.Lock()
+	loaded := jwtkeys_loaded
+	ring = jwtkeys
+	jwtkeys_mutex.Unlock()
+
+	if loaded.IsZero() {
+		file, ok := jwtkey_file()
+		if ok {
+			file.active = true
+			ring = []jwtkey{file}
+		}
+		return
+	}
+
+	if time.Since(loaded) > JWTKEY_REFRESH {
+		err := JWTKey_Refresh()
+		if err != nil {
+			Errf("JWT keyring refresh: %s", err.Error())
+			return
+		}
+
+		jwtkeys_mutex.Lock()
+		ring = jwtkeys
+		jwtkeys_mutex.Unlock()
+	}
+
+	return
+}
+
+/* The key to sign with */
+func jwtkey_active() (k jwtkey, err error) {
+	for _, k = range jwtkey_ring() {
+		if !k.active {
+			continue
+		}
+
+		if k.prv == nil {
+			err = errors.New("Private key of active JWT key " + k.kid + " is not available")
+		}
+
+		return
+	}
+
+	err = errors.New("No active JWT signing key")
+	return
+}
+
+/* The key to verify with, kid is empty for tokens from before the keyring */
+func jwtkey_find(kid string) (pub *ecdsa.PublicKey, err error) {
+	if kid == "" {
+		file, ok := jwtkey_file()
+		if !ok {
+			err = errors.New("No JWT key configured")
+			return
+		}
+
+		kid = file.kid
+	}
+
+	for _, k := range jwtkey_ring() {
+		if k.kid == kid {
+			pub = k.pub
+			return
+		}
+	}
+
+	/* Might be rotated on another node */
+	jwtkeys_mutex.Lock()
+	loaded := jwtkeys_loaded
+	jwtkeys_mutex.Unlock()
+
+	if !loaded.IsZero() && time.Since(loaded) > JWTKEY_UNKNOWN {
+		err = JWTKey_Refresh()
+		if err != nil {
+			return
+		}
+
+		return jwtkey_find(kid)
+	}
+
+	err = errors.New("Unknown JWT key")
+	return
+}
+
+/* Public keys of the non-retired keys, for the JWKS */
+func jwtkey_pubs() (pubs []*ecdsa.PublicKey) {
+	for _, k := range jwtkey_ring() {
+		pubs = append(pubs, k.pub)
+	}
+
+	return
+}
+
+/* Load the keyring, for the server */
+func JWTKey_start() {
+	err := JWTKey_Refresh()
+	if err != nil {
+		Errf("Loading JWT keyring failed, using the configured key: %s", err.Error())
+	}
+}
+
+func jwtkey_pem_prv(prv *ecdsa.PrivateKey) (str string, err error) {
+	der, err := x509.MarshalECPrivateKey(prv)
+	if err != nil {
+		return
+	}
+
+	str = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	return
+}
+
+func jwtkey_pem_pub(pub *ecdsa.PublicKey) (str string, err error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return
+	}
+
+	str = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return
+}
+
+/* Record the configured key, so that its state can be changed */
+func jwtkey_file_record(ctx PfCtx) (err error) {
+	file, ok := jwtkey_file()
+	if !ok {
+		return
+	}
+
+	cnt := 0
+	q := "SELECT COUNT(*) " +
+		"FROM jwt_key " +
+		"WHERE kid = $1"
+	err = DB.QueryRow(q, file.kid).Scan(&cnt)
+	if err != nil || cnt != 0 {
+		return
+	}
+
+	pub, err := jwtkey_pem_pub(file.pub)
+	if err != nil {
+		return
+	}
+
+	/* It is active while no other key is */
+	state := "active"
+
+	q = "SELECT COUNT(*) " +
+		"FROM jwt_key " +
+		"WHERE state = 'active'"
+	err = DB.QueryRow(q).Scan(&cnt)
+	if err != nil {
+		return
+	}
+
+	if cnt != 0 {
+		state = "verify"
+	}
+
+	q = "INSERT INTO jwt_key " +
+		"(kid, pub, state) " +
+		"VALUES($1, $2, $3)"
+	err = DB.Exec(ctx,
+		"Recorded configured JWT key $1",
+		1, q, file.kid, pub, state)
+	return
+}
+
+func JWTKey_List() (keys []PfJWTKey, err error) {
+	file, fok := jwtkey_file()
+	factive := true
+
+	q := "SELECT kid, state, entered " +
+		"FROM jwt_key " +
+		"ORDER BY entered DESC"
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var k PfJWTKey
+
+		err = rows.Scan(&k.Kid, &k.State, &k.Entered)
+		if err != nil {
+			return
+		}
+
+		if fok && k.Kid == file.kid {
+			k.File = true
+			fok = false
+		}
+
+		if k.State == "active" {
+			factive = false
+		}
+
+		keys = append(keys, k)
+	}
+
+	if fok {
+		k := PfJWTKey{Kid: file.kid, State: "verify", File: true}
+		if factive {
+			k.State = "active"
+		}
+		keys = append(keys, k)
+	}
+
+	return
+}
+
+/* Generate a new ES512 key and make it the active one */
+func JWTKey_Rotate(ctx PfCtx) (kid string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		return
+	}
+
+	prv, err := jwtkey_pem_prv(key)
+	if err != nil {
+		return
+	}
+
+	pub, err := jwtkey_pem_pub(&key.PublicKey)
+	if err != nil {
+		return
+	}
+
+	kid = jwtkey_kid(&key.PublicKey)
+
+	/* Only stored encrypted */
+	kek, err := jwtkey_kek()
+	if err != nil {
+		return
+	}
+
+	prv, err = jwtkey_seal(kek, kid, prv)
+	if err != nil {
+		return
+	}
+
+	err = jwtkey_file_record(ctx)
+	if err != nil {
+		return
+	}
+
+	err = DB.TxBegin(ctx)
+	if err != nil {
+		return
+	}
+
+	q := "UPDATE jwt_key " +
+		"SET state = 'verify' " +
+		"WHERE state = 'active'"
+	err = DB.Exec(ctx,
+		"Deactivated JWT key",
+		-1, q)
+	if err != nil {
+		DB.TxRollback(ctx)
+		return
+	}
+
+	q = "INSERT INTO jwt_key " +
+		"(kid, prv, pub, state) " +
+		"VALUES($1, $2, $3, 'active')"
+	err = DB.Exec(ctx,
+		"Created JWT key $1",
+		1, q, kid, prv, pub)
+	if err != nil {
+		DB.TxRollback(ctx)
+		return
+	}
+
+	err = DB.TxCommit(ctx)
+	if err != nil {
+		return
+	}
+
+	err = JWTKey_Refresh()
+	return
+}
+
+/* Sign with another (non-retired) key */
+func JWTKey_Activate(ctx PfCtx, kid string) (err error) {
+	var state string
+	var prv sql.NullString
+
+	err = jwtkey_file_record(ctx)
+	if err != nil {
+		return
+	}
+
+	err = DB.TxBegin(ctx)
+	if err != nil {
+		return
+	}
+
+	q := "SELECT state, prv " +
+		"FROM jwt_key " +
+		"WHERE kid = $1"
+	err = DB.QueryRow(q, kid).Scan(&state, &prv)
+	if err == ErrNoRows {
+		err = errors.New("Unknown JWT key")
+	}
+
+	if err == nil && state == "retired" {
+		err = errors.New("JWT key is retired")
+	}
+
+	if err == nil && state == "active" {
+		err = errors.New("JWT key is already active")
+	}
+
+	/* Without a private key, it can only be the configured key */
+	if err == nil && !prv.Valid {
+		file, ok := jwtkey_file()
+		if !ok || file.kid != kid || file.prv == nil {
+			err = errors.New("Private key of JWT key is not available")
+		}
+	}
+
+	if err != nil {
+		DB.TxRollback(ctx)
+		return
+	}
+
+	q = "UPDATE jwt_key " +
+		"SET state = 'verify' " +
+		"WHERE state = 'active'"
+	err = DB.Exec(ctx,
+		"Deactivated JWT key",
+		-1, q)
+	if err != nil {
+		DB.TxRollback(ctx)
+		return
+	}
+
+	q = "UPDATE jwt_key " +
+		"SET state = 'active' " +
+		"WHERE kid = $1"
+	err = DB.Exec(ctx,
+		"Activated JWT key $1",
+		1, q, kid)
+	if err != nil {
+		DB.TxRollback(ctx)
+		return
+	}
+
+	err = DB.TxCommit(ctx)
+	if err != nil {
+		return
+	}
+
+	err = JWTKey_Refresh()
+	return
+}
+
+/* Stop accepting tokens signed by the key */
+func JWTKey_Retire(ctx PfCtx, kid string) (err error) {
+	err = jwtkey_file_record(ctx)
+	if err != nil {
+		return
+	}
+
+	q := "UPDATE jwt_key " +
+		"SET state = 'retired' " +
+		"WHERE kid = $1 " +
+		"AND state = 'verify'"
+	err = DB.Exec(ctx,
+		"Retired JWT key $1",
+		1, q, kid)
+	if err == ErrNoRows {
+		err = errors.New("Unknown, active or already retired JWT key")
+	}
+
+	if err != nil {
+		return
+	}
+
+	err = JWTKey_Refresh()
+	return
+}
+
+func system_jwtkey_list(ctx PfCtx, args []string) (err error) {
+	keys, err := JWTKey_List()
+	if err != nil {
+		return
+	}
+
+	for _, k := range keys {
+		file := ""
+		if k.File {
+			file = " [configured]"
+		}
+
+		ctx.OutLn("%s %s %s%s", k.Kid, k.State, Fmt_Time(k.Entered), file)
+	}
+
+	return
+}
+
+func system_jwtkey_rotate(ctx PfCtx, args []string) (err error) {
+	kid, err := JWTKey_Rotate(ctx)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("JWT key %s created and active", kid)
+	ctx.OutLn("Retire the previous key once its tokens have expired (%d minutes)", TOKEN_EXPIRATIONMINUTES)
+	return
+}
+
+func system_jwtkey_activate(ctx PfCtx, args []string) (err error) {
+	err = JWTKey_Activate(ctx, args[0])
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("JWT key %s active", args[0])
+	return
+}
+
+func system_jwtkey_retire(ctx PfCtx, args []string) (err error) {
+	err = JWTKey_Retire(ctx, args[0])
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("JWT key %s retired", args[0])
+	return
+}
+
+func system_jwtkey_menu(ctx PfCtx, args []string) (err error) {
+	menu := NewPfMenu([]PfMEntry{
+		{"list", system_jwtkey_list, 0, 0, nil, PERM_SYS_ADMIN, "List the JWT signing keys"},
+		{"rotate", system_jwtkey_rotate, 0, 0, nil, PERM_SYS_ADMIN, "Generate a new ES512 key and sign with it"},
+		{"activate", system_jwtkey_activate, 1, 1, []string{"kid"}, PERM_SYS_ADMIN, "Sign with the given key"},
+		{"retire", system_jwtkey_retire, 1, 1, []string{"kid"}, PERM_SYS_ADMIN, "Stop accepting tokens signed by the given key"},
+	})
+
+	err = ctx.Menu(args, menu)
+	return
+}
@@ -0,0 +1,181 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run JWTKey -v
+ */
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+)
+
+func jwtkey_test_key(t *testing.T) *ecdsa.PrivateKey {
+	k, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Key generation failed: %s", err.Error())
+	}
+
+	return k
+}
+
+/* Verify as Token_Parse does, without the invalidation check */
+func jwtkey_test_verify(tok string) error {
+	_, err := jwt.Parse(tok, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return jwtkey_find(kid)
+	})
+	return err
+}
+
+func jwtkey_test_sign(t *testing.T) string {
+	claims := &JWTClaims{}
+	tok, err := Token_New("test", "jdoe", TOKEN_EXPIRATIONMINUTES, claims).Sign()
+	if err != nil {
+		t.Fatalf("Signing failed: %s", err.Error())
+	}
+
+	return tok
+}
+
+func TestJWTKey_Rotation(t *testing.T) {
+	file := jwtkey_test_key(t)
+	Config.Token_prv = file
+	Config.Token_pub = &file.PublicKey
+
+	defer func() {
+		jwtkeys = nil
+		jwtkeys_loaded = time.Time{}
+	}()
+
+	/* Not loaded: only the configured key */
+	old := jwtkey_test_sign(t)
+
+	parsed, _, _ := new(jwt.Parser).ParseUnverified(old, &JWTClaims{})
+	if parsed == nil || parsed.Header["kid"] != jwtkey_kid(&file.PublicKey) {
+		t.Fatalf("Token lacks the kid of the configured key")
+	}
+
+	/* Legacy token, from before the keyring */
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodES512, &JWTClaims{}).SignedString(file)
+	if err != nil {
+		t.Fatalf("Signing failed: %s", err.Error())
+	}
+
+	/* Rotated: a new active key, the configured one still verifies */
+	next := jwtkey_test_key(t)
+	jwtkeys = []jwtkey{
+		{jwtkey_kid(&next.PublicKey), next, &next.PublicKey, true},
+		{jwtkey_kid(&file.PublicKey), file, &file.PublicKey, false},
+	}
+	jwtkeys_loaded = time.Now()
+
+	cur := jwtkey_test_sign(t)
+
+	for name, tok := range map[string]string{"old": old, "legacy": legacy, "current": cur} {
+		err = jwtkey_test_verify(tok)
+		if err != nil {
+			t.Errorf("Token %s does not verify: %s", name, err.Error())
+		}
+	}
+
+	parsed, _, _ = new(jwt.Parser).ParseUnverified(cur, &JWTClaims{})
+	if parsed == nil || parsed.Header["kid"] != jwtkey_kid(&next.PublicKey) {
+		t.Errorf("Token not signed by the active key")
+	}
+
+	if len(OIDC_GetJWKS()) != 2 {
+		t.Errorf("JWKS should contain both keys")
+	}
+
+	/* Retired: tokens of the configured key are refused */
+	jwtkeys = jwtkeys[:1]
+
+	if jwtkey_test_verify(old) == nil || jwtkey_test_verify(legacy) == nil {
+		t.Errorf("Token of a retired key verifies")
+	}
+
+	if jwtkey_test_verify(cur) != nil {
+		t.Errorf("Token of the active key does not verify")
+	}
+}
+
+func TestJWTKey_Seal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwtkek")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	root, kekfn := Config.Conf_root, Config.JWT_kek
+	defer func() {
+		Config.Conf_root, Config.JWT_kek = root, kekfn
+	}()
+
+	Config.Conf_root = dir + "/"
+	Config.JWT_kek = "jwt.kek"
+
+	_, err = jwtkey_kek()
+	if err == nil {
+		t.Errorf("Missing key encryption key accepted")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "jwt.kek"), []byte("short\n"), 0600)
+	_, err = jwtkey_kek()
+	if err == nil {
+		t.Errorf("Short key encryption key accepted")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "jwt.kek"), []byte(strings.Repeat("k", 44)+"\n"), 0600)
+	kek, err := jwtkey_kek()
+	if err != nil {
+		t.Fatalf("Loading key encryption key failed: %s", err.Error())
+	}
+
+	key := jwtkey_test_key(t)
+	prv, err := jwtkey_pem_prv(key)
+	if err != nil {
+		t.Fatalf("PEM encoding failed: %s", err.Error())
+	}
+
+	kid := jwtkey_kid(&key.PublicKey)
+
+	sealed, err := jwtkey_seal(kek, kid, prv)
+	if err != nil {
+		t.Fatalf("Sealing failed: %s", err.Error())
+	}
+
+	if !strings.HasPrefix(sealed, JWTKEY_SEALED) || strings.Contains(sealed, "PRIVATE KEY") {
+		t.Errorf("Private key not encrypted: %q", sealed)
+	}
+
+	out, err := jwtkey_open(kek, kid, sealed)
+	if err != nil || out != prv {
+		t.Errorf("Opening failed: %v", err)
+	}
+
+	/* Another kek, another kid, or a changed ciphertext */
+	other := make([]byte, len(kek))
+	copy(other, kek)
+	other[0] ^= 1
+
+	if _, err = jwtkey_open(other, kid, sealed); err == nil {
+		t.Errorf("Opened with the wrong key encryption key")
+	}
+
+	if _, err = jwtkey_open(kek, "otherkid", sealed); err == nil {
+		t.Errorf("Opened for another kid")
+	}
+
+	if _, err = jwtkey_open(kek, kid, sealed[:len(sealed)-4]+"AAAA"); err == nil {
+		t.Errorf("Opened a tampered key")
+	}
+}
@@ -1,14 +1,22 @@
 package pitchfork
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
 )
 
 const CRLF = "\r\n"
 
-/* TODO: Simple version, replace with internally queued edition later */
+/* Compose a message and queue it for delivery, see mailqueue.go */
 func mailA(ctx PfCtx, src_name string, src string, dst_name []string, dst []string, prefix bool, subject string, body string, regards bool, footer string, sysfooter bool) (err error) {
 	if len(dst) != len(dst_name) {
 		err = errors.New("Mismatch length in dst_name and dst options")
@@ -17,31 +25,6 @@ func mailA(ctx PfCtx, src_name string, src string, dst_name []string, dst []stri
 
 	sys := System_Get()
 
-	server_host := Config.SMTP_host
-	server_port := Config.SMTP_port
-	server_ssl := Config.SMTP_SSL
-
-	/* Default source? */
-	if src_name == "" {
-		src_name = sys.Name
-	}
-
-	/* Default source? */
-	if src == "" {
-		/*
-		 * TODO: Special bounce address (bounce+flat_email@<mx>)
-		 * then when mail returns status can be shown in the system
-		 */
-		src = "bounce@" + sys.EmailDomain
-	}
-
-	/* Apply <> to src + dst */
-	src = "<" + src + ">"
-
-	for d := range dst {
-		dst[d] = "<" + dst[d] + ">"
-	}
-
 	/* Prefix Subject with Name? */
 	if prefix {
 		subject = "[" + sys.Name + "] " + subject
@@ -73,6 +56,120 @@ func mailA(ctx PfCtx, src_name string, src string, dst_name []string, dst []stri
 		body += footer
 	}
 
+	err = mail_compose(src_name, src, dst_name, dst, subject, body, "")
+	return
+}
+
+/* Quoted-printable encode, with \n line endings */
+func mail_qp(text string) []byte {
+	var buf bytes.Buffer
+
+	qw := quotedprintable.NewWriter(&buf)
+	qw.Write([]byte(text))
+	qw.Close()
+
+	return bytes.Replace(buf.Bytes(), []byte(CRLF), []byte("\n"), -1)
+}
+
+/*
+ * Add the headers and queue the message
+ *
+ * When html is provided the message becomes a multipart/alternative
+ * with both the text and the HTML version.
+ *
+ * Messages are signed with the system PGP key and, when enabled,
+ * encrypted to the key of a single recipient, see mail_pgp.go.
+ */
+func mail_compose(src_name string, src string, dst_name []string, dst []string, subject string, text string, html string) (err error) {
+	sys := System_Get()
+
+	/* Default source? */
+	if src_name == "" {
+		src_name = sys.Name
+	}
+
+	/* Envelope sender, VERP encoded when there is a single recipient */
+	env_src := src
+
+	/* Default source? */
+	if src == "" {
+		src = Mail_BounceAddr()
+
+		if len(dst) == 1 {
+			env_src = Mail_VERP(dst[0])
+		} else {
+			env_src = src
+		}
+	}
+
+	hdr := []string{"From: " + "\"" + src_name + "\" <" + src + ">"}
+
+	for d := range dst {
+		hdr = append(hdr, "To: "+"\""+dst_name[d]+"\" <"+dst[d]+">")
+	}
+
+	hdr = append(hdr,
+		"Date: "+time.Now().Format(time.RFC1123Z),
+		"User-Agent: "+Config.UserAgent,
+		"Subject: "+mime.QEncoding.Encode("utf-8", subject),
+		"MIME-Version: 1.0")
+
+	/* Internally messages use \n, the SMTP DATA writer adds the \r */
+	text = strings.Replace(text, CRLF, "\n", -1)
+	html = strings.Replace(html, CRLF, "\n", -1)
+
+	var body []byte
+
+	if html == "" {
+		hdr = append(hdr,
+			"Content-Type: text/plain; charset=utf-8",
+			"Content-Transfer-Encoding: quoted-printable")
+		body = mail_qp(text)
+	} else {
+		var buf bytes.Buffer
+
+		mw := multipart.NewWriter(&buf)
+
+		/* Least preferred version first */
+		for _, p := range []struct{ ct, content string }{{"text/plain", text}, {"text/html", html}} {
+			h := textproto.MIMEHeader{}
+			h.Set("Content-Type", p.ct+"; charset=utf-8")
+			h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+			var pw io.Writer
+
+			pw, err = mw.CreatePart(h)
+			if err != nil {
+				return
+			}
+
+			pw.Write(mail_qp(p.content))
+		}
+
+		err = mw.Close()
+		if err != nil {
+			return
+		}
+
+		hdr = append(hdr, "Content-Type: multipart/alternative; boundary=\""+mw.Boundary()+"\"")
+		body = bytes.Replace(buf.Bytes(), []byte(CRLF), []byte("\n"), -1)
+	}
+
+	msg, err := mail_protect(hdr, body, dst)
+	if err != nil {
+		return
+	}
+
+	err = Mail_Queue(env_src, dst, msg)
+	return
+}
+
+/* Hand a complete message to the configured SMTP server */
+func mail_smtp(src string, dst []string, msg []byte) (err error) {
+	server_host := Config.SMTP_host
+	server_port := Config.SMTP_port
+	server_ssl := Config.SMTP_SSL
+
 	/* Connect to the local SMTP server */
 	c, err := smtp.Dial(server_host + ":" + server_port)
 	if err != nil {
@@ -105,7 +202,7 @@ func mailA(ctx PfCtx, src_name string, src string, dst_name []string, dst []stri
 		}
 	}
 
-	/* Set the sender and recipient */
+	/* Set the sender and recipient, net/smtp adds the <> */
 	err = c.Mail(src)
 	if err != nil {
 		return
@@ -123,22 +220,13 @@ func mailA(ctx PfCtx, src_name string, src string, dst_name []string, dst []stri
 	if err != nil {
 		return
 	}
-	defer w.Close()
 
-	headers := "From: " + "\"" + src_name + "\" " + src + CRLF
-
-	for d := range dst {
-		headers += "To: " + "\"" + dst_name[d] + "\" " + dst[d] + CRLF
+	_, err = w.Write(msg)
+	if err != nil {
+		w.Close()
+		return
 	}
 
-	headers +=
-		"User-Agent: " + Config.UserAgent + CRLF +
-			"Subject: " + subject + CRLF +
-			CRLF
-
-	w.Write([]byte(headers))
-	w.Write([]byte(body))
-
 	err = w.Close()
 	if err != nil {
 		return
@@ -176,69 +264,20 @@ func MailM(ctx PfCtx, src_name string, src string, dst_name []string, dst []stri
 
 func Mail_VerifyEmail(ctx PfCtx, email PfUserEmail, verifycode string) (err error) {
 	sys := System_Get()
-	subject := "Email Verification Request"
-
-	body := "Dear " + email.FullName + "," + CRLF +
-		CRLF +
-		"Somebody (probably you) has requested the email address:" + CRLF +
-		"  " + email.Email + CRLF +
-		"to be verified for " + sys.Name + " at " + sys.PublicURL + "." + CRLF +
-		CRLF +
-		"If you feel that this mail was sent to you without your consent, please" + CRLF +
-		"reply to the administrator at:" + CRLF +
-		"   " + sys.AdminName + " <" + sys.AdminEmail + ">" + CRLF +
-		"and we will try to figure out what went wrong." + CRLF +
-		CRLF +
-		"To verify that this address is really yours, please visit the URL below" + CRLF +
-		"and enter the token. This will ensure that you have read this mail and" + CRLF +
-		"that your email address is valid." + CRLF +
-		CRLF +
-		"  " + sys.PublicURL +
-		"/user/" + email.Member +
-		"/email/" + email.Email +
-		"/confirm/?verifycode=" + verifycode + CRLF +
-		CRLF +
-		"Or enter the verification code:" + CRLF +
-		"  " + verifycode + CRLF +
-		"in the interface for the email address " + email.Email + CRLF +
-		CRLF +
-		"If you do not verify this email address the request will be canceled." + CRLF
-
-	err = Mail(ctx,
-		"", "",
-		email.FullName, email.Email,
-		true,
-		subject,
-		body,
-		true,
-		"",
-		true)
 
+	data := map[string]string{
+		"VerifyCode": verifycode,
+		"URL": sys.PublicURL +
+			"/user/" + email.Member +
+			"/email/" + email.Email +
+			"/confirm/?verifycode=" + verifycode,
+	}
+
+	err = Mail_Template(ctx, email, "verify_email", "Email Verification Request", data)
 	return
 }
 
 func Mail_PasswordChanged(ctx PfCtx, email PfUserEmail) (err error) {
-	sys := System_Get()
-	subject := "Password changed"
-
-	body := "Dear " + email.FullName + "," + CRLF +
-		CRLF +
-		"Somebody (probably you) has changed the password associated to your account:" + CRLF +
-		"  " + email.Email + CRLF +
-		CRLF +
-		"If you did not change your password, please reply to the administrator at:" + CRLF +
-		"   " + sys.AdminName + " <" + sys.AdminEmail + ">" + CRLF +
-		"and we will try to figure out what went wrong." + CRLF
-
-	err = Mail(ctx,
-		"", "",
-		email.FullName, email.Email,
-		true,
-		subject,
-		body,
-		true,
-		"",
-		true)
-
+	err = Mail_Template(ctx, email, "password_changed", "Password changed", nil)
 	return
 }
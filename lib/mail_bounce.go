@@ -0,0 +1,361 @@
+package pitchfork
+
+/*
+ * Bounce handling
+ *
+ * Mail is sent with a VERP (Variable Envelope Return Path) sender:
+ *   bounce+<day>-<tag>+<local>=<domain>@<EmailDomain>
+ * thus bounces identify the address that failed, even when the
+ * remote MTA does not return a useful DSN.
+ *
+ * The tag is a HMAC over the day and the recipient, thus only we
+ * can create these addresses, otherwise anybody could disable list
+ * delivery for a member by sending forged DSNs.
+ *
+ * Bounces are received by the Mailing List server (ml_server.go),
+ * failed deliveries of DSNs (RFC3464) to a VERP address are counted
+ * per address; list delivery is disabled once Config.Bounce_max
+ * is reached. DSNs to the plain bounce address are only logged.
+ *
+ * Note: bounce processing uses non-audit versions of DB queries.
+ */
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MAIL_BOUNCE_LHS = "bounce"
+
+/* Bounces older than this do not count anymore */
+const MAIL_BOUNCE_WINDOW = "30 days"
+
+/* VERP addresses are accepted this many days, DSNs can take a while */
+const MAIL_VERP_DAYS = 14
+
+type PfDSNRecipient struct {
+	FinalRecipient string
+	Action         string
+	Status         string
+	Diagnostic     string
+}
+
+/* The plain bounce address */
+func Mail_BounceAddr() string {
+	return MAIL_BOUNCE_LHS + "@" + System_Get().EmailDomain
+}
+
+/* The day number used in VERP addresses */
+func mail_verp_day(t time.Time) int64 {
+	return t.Unix() / (24 * 60 * 60)
+}
+
+/* The tag of the VERP address of a recipient on a day */
+func mail_verp_tag(day int64, dst string) (tag string, err error) {
+	mac, err := System_HMAC("verp", strconv.FormatInt(day, 10)+":"+strings.ToLower(dst))
+	if err != nil {
+		return
+	}
+
+	tag = hex.EncodeToString(mac[:8])
+	return
+}
+
+/* The VERP bounce address for a recipient */
+func Mail_VERP(dst string) string {
+	at := strings.LastIndex(dst, "@")
+	if at == -1 {
+		return Mail_BounceAddr()
+	}
+
+	day := mail_verp_day(time.Now())
+
+	tag, err := mail_verp_tag(day, dst)
+	if err != nil {
+		Errf("VERP tag for %s: %s", dst, err.Error())
+		return Mail_BounceAddr()
+	}
+
+	return MAIL_BOUNCE_LHS + "+" + strconv.FormatInt(day, 10) + "-" + tag + "+" + dst[:at] + "=" + dst[at+1:] + "@" + System_Get().EmailDomain
+}
+
+/*
+ * Decode a bounce address
+ *
+ * isbounce indicates that the address is a bounce address,
+ * email is the original recipient when it was a VERP one.
+ * VERP addresses with a tag that does not verify, or that
+ * are too old, are not bounce addresses.
+ */
+func Mail_UnVERP(addr string) (email string, isbounce bool) {
+	at := strings.LastIndex(addr, "@")
+	if at == -1 || !strings.EqualFold(addr[at+1:], System_Get().EmailDomain) {
+		return
+	}
+
+	lhs := addr[:at]
+	if strings.EqualFold(lhs, MAIL_BOUNCE_LHS) {
+		isbounce = true
+		return
+	}
+
+	if len(lhs) <= len(MAIL_BOUNCE_LHS)+1 || !strings.EqualFold(lhs[:len(MAIL_BOUNCE_LHS)+1], MAIL_BOUNCE_LHS+"+") {
+		return
+	}
+
+	/* <day>-<tag>, the recipient can contain a '+' */
+	flat := lhs[len(MAIL_BOUNCE_LHS)+1:]
+	plus := strings.Index(flat, "+")
+	if plus == -1 {
+		return
+	}
+
+	stamp := strings.SplitN(flat[:plus], "-", 2)
+	flat = flat[plus+1:]
+
+	if len(stamp) != 2 {
+		return
+	}
+
+	day, err := strconv.ParseInt(stamp[0], 10, 64)
+	if err != nil {
+		return
+	}
+
+	age := mail_verp_day(time.Now()) - day
+	if age < 0 || age > MAIL_VERP_DAYS {
+		return
+	}
+
+	/* The domain can not contain a '=', the local part can */
+	eq := strings.LastIndex(flat, "=")
+	if eq < 1 || eq == len(flat)-1 {
+		return
+	}
+
+	dst := flat[:eq] + "@" + flat[eq+1:]
+
+	tag, err := mail_verp_tag(day, dst)
+	if err != nil {
+		Errf("VERP tag for %s: %s", dst, err.Error())
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(tag), []byte(strings.ToLower(stamp[1]))) != 1 {
+		Logf("VERP address with invalid tag: %s", addr)
+		return
+	}
+
+	email = dst
+	isbounce = true
+	return
+}
+
+/* Parse the "Name: value" fields of a delivery-status block */
+func mail_dsn_fields(block string) (fields map[string]string) {
+	fields = make(map[string]string)
+	last := ""
+
+	for _, l := range strings.Split(block, "\n") {
+		if len(l) > 0 && (l[0] == ' ' || l[0] == '\t') && last != "" {
+			fields[last] += " " + strings.TrimSpace(l)
+			continue
+		}
+
+		c := strings.Index(l, ":")
+		if c == -1 {
+			continue
+		}
+
+		last = strings.ToLower(strings.TrimSpace(l[:c]))
+		fields[last] = strings.TrimSpace(l[c+1:])
+	}
+
+	return
+}
+
+/* Strip the address type, eg "rfc822; user@example.net" */
+func mail_dsn_addr(val string) string {
+	sc := strings.Index(val, ";")
+	if sc != -1 {
+		val = val[sc+1:]
+	}
+
+	return strings.Trim(strings.TrimSpace(val), "<>")
+}
+
+/* Parse the per-recipient fields of a RFC3464 Delivery Status Notification */
+func Mail_ParseDSN(data []byte) (rcpts []PfDSNRecipient, err error) {
+	hdr, body := ml_splitmsg(data)
+
+	mt, params, err := mime.ParseMediaType(ml_hdr_get(hdr, "Content-Type"))
+	if err != nil || mt != "multipart/report" {
+		err = errors.New("Not a Delivery Status Notification")
+		return
+	}
+
+	var status []byte
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		var p *multipart.Part
+
+		p, err = mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+
+		pt, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if pt == "message/delivery-status" {
+			status, err = ioutil.ReadAll(p)
+			if err != nil {
+				return
+			}
+			break
+		}
+	}
+
+	if status == nil {
+		err = errors.New("No delivery-status part found")
+		return
+	}
+
+	blocks := strings.Split(strings.Replace(string(status), "\r\n", "\n", -1), "\n\n")
+
+	/* The first block has the per-message fields */
+	for _, block := range blocks[1:] {
+		f := mail_dsn_fields(block)
+
+		if f["final-recipient"] == "" {
+			continue
+		}
+
+		rcpts = append(rcpts, PfDSNRecipient{
+			FinalRecipient: mail_dsn_addr(f["final-recipient"]),
+			Action:         strings.ToLower(f["action"]),
+			Status:         f["status"],
+			Diagnostic:     f["diagnostic-code"],
+		})
+	}
+
+	if len(rcpts) == 0 {
+		err = errors.New("No recipients in Delivery Status Notification")
+	}
+
+	return
+}
+
+/* Count a failed delivery for an address */
+func mail_bounce_count(email string, status string) (err error) {
+	var count int
+	var disabled bool
+
+	q := "UPDATE member_email " +
+		"SET bounce_count = CASE WHEN bounce_last < NOW()::TIMESTAMP - INTERVAL '" + MAIL_BOUNCE_WINDOW + "' " +
+		"THEN 1 ELSE bounce_count + 1 END, " +
+		"bounce_last = NOW()::TIMESTAMP, " +
+		"bounce_status = $2 " +
+		"WHERE LOWER(email) = LOWER($1) " +
+		"RETURNING bounce_count, ml_disabled"
+	err = DB.QueryRowNA(q, email, status).Scan(&count, &disabled)
+	if err == ErrNoRows {
+		Logf("Bounce for unknown address %s: %s", email, status)
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	Logf("Bounce %d for %s: %s", count, email, status)
+
+	if disabled || count < Config.Bounce_max {
+		return
+	}
+
+	q = "UPDATE member_email " +
+		"SET ml_disabled = TRUE " +
+		"WHERE LOWER(email) = LOWER($1)"
+	err = DB.ExecNA(-1, q, email)
+	if err != nil {
+		return
+	}
+
+	Logf("Disabled list delivery to %s after %d bounces", email, count)
+	return
+}
+
+/*
+ * Process a message sent to a bounce address
+ *
+ * verp is the recipient encoded in the VERP address, if any.
+ * Messages that are not DSNs (eg auto-replies) are ignored,
+ * as are DSNs to the plain bounce address: their recipients
+ * are not authenticated.
+ */
+func Mail_Bounce(verp string, data []byte) (err error) {
+	rcpts, err := Mail_ParseDSN(data)
+	if err != nil {
+		Logf("Ignoring message for bounce address %q: %s", verp, err.Error())
+		err = nil
+		return
+	}
+
+	for _, r := range rcpts {
+		if r.Action != "failed" {
+			continue
+		}
+
+		status := strings.TrimSpace(r.Status + " " + r.Diagnostic)
+
+		if verp == "" {
+			Logf("Not counting bounce without VERP for %s: %s", r.FinalRecipient, status)
+			continue
+		}
+
+		/* The VERP address is authoritative, forwarding can change the final recipient */
+		err = mail_bounce_count(verp, status)
+
+		/* With VERP only one address is involved */
+		return
+	}
+
+	return
+}
+
+/* Addresses that have bounced, for the sysadmin report */
+func Mail_BounceList() (emails []PfUserEmail, err error) {
+	q := "SELECT member, email, bounce_count, bounce_last, bounce_status, ml_disabled " +
+		"FROM member_email " +
+		"WHERE bounce_count > 0 " +
+		"ORDER BY bounce_count DESC, bounce_last DESC"
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var em PfUserEmail
+
+		err = rows.Scan(&em.Member, &em.Email, &em.BounceCount, &em.BounceLast, &em.BounceStatus, &em.MLDisabled)
+		if err != nil {
+			return
+		}
+
+		emails = append(emails, em)
+	}
+
+	return
+}
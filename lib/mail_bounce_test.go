@@ -0,0 +1,115 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run Mail_ -v
+ */
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const test_dsn = "From: MAILER-DAEMON@mx.example.org\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status;\r\n" +
+	"\tboundary=\"B1\"\r\n" +
+	"\r\n" +
+	"--B1\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"The mail system could not deliver your message.\r\n" +
+	"--B1\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.org\r\n" +
+	"Arrival-Date: Mon, 6 Mar 2017 10:00:00 +0100\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; gone@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 <gone@example.org>:\r\n" +
+	"    Recipient address rejected: User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; <slow@example.org>\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1\r\n" +
+	"\r\n" +
+	"--B1--\r\n"
+
+func TestMail_VERP(t *testing.T) {
+	system_cached.Name = "Test"
+	system_cached.EmailDomain = "lists.example.net"
+	system_cached.Secret = "verp-test-secret"
+
+	verp := Mail_VERP("user+x=y@example.org")
+	if !strings.HasPrefix(verp, "bounce+") || !strings.HasSuffix(verp, "+user+x=y=example.org@lists.example.net") {
+		t.Errorf("Unexpected VERP address %q", verp)
+	}
+
+	email, isbounce := Mail_UnVERP(verp)
+	if !isbounce || email != "user+x=y@example.org" {
+		t.Errorf("Decoding failed: %q %v", email, isbounce)
+	}
+
+	email, isbounce = Mail_UnVERP(strings.ToUpper(verp[:1]) + verp[1:])
+	if !isbounce || email != "user+x=y@example.org" {
+		t.Errorf("Decoding with a different case failed: %q %v", email, isbounce)
+	}
+
+	email, isbounce = Mail_UnVERP("BOUNCE@lists.example.net")
+	if !isbounce || email != "" {
+		t.Errorf("Plain bounce address not recognized: %q %v", email, isbounce)
+	}
+
+	/* Tampered: another recipient, another tag, an old day */
+	at := strings.Index(verp, "+user")
+	stamp := strings.SplitN(verp[len("bounce+"):at], "-", 2)
+	day, _ := strconv.ParseInt(stamp[0], 10, 64)
+	oldtag, _ := mail_verp_tag(day-MAIL_VERP_DAYS-1, "user+x=y@example.org")
+
+	for _, addr := range []string{
+		verp[:at] + "+other=example.org@lists.example.net",
+		"bounce+" + stamp[0] + "-0000000000000000+user+x=y=example.org@lists.example.net",
+		"bounce+" + strconv.FormatInt(day-MAIL_VERP_DAYS-1, 10) + "-" + oldtag + "+user+x=y=example.org@lists.example.net",
+		"bounce+user=example.org@lists.example.net",
+		"bounce+user=example.org@other.example.net",
+		"grp-list@lists.example.net",
+		"bounce+nodomain@lists.example.net",
+	} {
+		email, isbounce = Mail_UnVERP(addr)
+		if isbounce || email != "" {
+			t.Errorf("%s accepted as %q", addr, email)
+		}
+	}
+}
+
+func TestMail_ParseDSN(t *testing.T) {
+	rcpts, err := Mail_ParseDSN([]byte(test_dsn))
+	if err != nil {
+		t.Fatalf("Parsing failed: %s", err.Error())
+	}
+
+	if len(rcpts) != 2 {
+		t.Fatalf("Expected 2 recipients, got %d", len(rcpts))
+	}
+
+	r := rcpts[0]
+	if r.FinalRecipient != "gone@example.org" || r.Action != "failed" || r.Status != "5.1.1" {
+		t.Errorf("Unexpected first recipient %#v", r)
+	}
+
+	if r.Diagnostic != "smtp; 550 5.1.1 <gone@example.org>: Recipient address rejected: User unknown" {
+		t.Errorf("Continuation not handled: %q", r.Diagnostic)
+	}
+
+	if rcpts[1].FinalRecipient != "slow@example.org" || rcpts[1].Action != "delayed" {
+		t.Errorf("Unexpected second recipient %#v", rcpts[1])
+	}
+
+	_, err = Mail_ParseDSN([]byte("Subject: Out of office\r\n\r\nI am away\r\n"))
+	if err == nil {
+		t.Errorf("Auto-reply parsed as DSN")
+	}
+}
@@ -0,0 +1,158 @@
+package pitchfork
+
+/*
+ * PGP protection of system email
+ *
+ * Messages composed by mailA() are PGP/MIME (RFC3156) signed with
+ * the system key, which is generated by setup. When the sysadmin
+ * enables MailEncrypt, messages to a single recipient are also
+ * encrypted to the key of that address, when one is on file.
+ */
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+
+	pfpgp "trident.li/pitchfork/lib/pgp"
+)
+
+/* Sign a message, the signed entity is wrapped in a multipart/signed */
+func mail_sign(hdr []string, body []byte, seckey string) (ohdr []string, obody []byte, err error) {
+	outer, inner := ml_hdr_split(hdr)
+
+	/* The signature covers the canonical form of the entity */
+	entity := ml_joinmsg(inner, body)
+
+	sig, err := pfpgp.Sign(seckey, bytes.Replace(entity, []byte("\n"), []byte(CRLF), -1))
+	if err != nil {
+		return
+	}
+
+	boundary := multipart.NewWriter(ioutil.Discard).Boundary()
+
+	var buf bytes.Buffer
+
+	/* The newline before a boundary belongs to the boundary, not to the signed entity */
+	buf.WriteString("--" + boundary + "\n")
+	buf.Write(entity)
+	buf.WriteString("\n--" + boundary + "\n" +
+		"Content-Type: application/pgp-signature; name=\"signature.asc\"\n" +
+		"Content-Description: OpenPGP digital signature\n" +
+		"Content-Disposition: attachment; filename=\"signature.asc\"\n" +
+		"\n")
+	buf.Write(sig)
+	buf.WriteString("\n--" + boundary + "--\n")
+
+	ohdr = append(outer,
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/signed; micalg=pgp-sha256; protocol=\"application/pgp-signature\"; boundary=\""+boundary+"\"")
+	obody = buf.Bytes()
+	return
+}
+
+/* The keyring on file for an address, if any */
+func mail_keyring(email string) (keyring string) {
+	q := "SELECT keyring " +
+		"FROM member_email " +
+		"WHERE LOWER(email) = LOWER($1)"
+	err := DB.QueryRow(q, email).Scan(&keyring)
+	if err != nil {
+		keyring = ""
+	}
+
+	return
+}
+
+/* Sign and optionally encrypt a message, returns the complete message */
+func mail_protect(hdr []string, body []byte, dst []string) (msg []byte, err error) {
+	sys := System_Get()
+
+	if sys.PGPSeckey != "" {
+		hdr, body, err = mail_sign(hdr, body, sys.PGPSeckey)
+		if err != nil {
+			err = errors.New("Signing failed: " + err.Error())
+			return
+		}
+	}
+
+	if sys.MailEncrypt && len(dst) == 1 {
+		keyring := mail_keyring(dst[0])
+		if keyring != "" {
+			msg, err = ml_encrypt(hdr, body, keyring, dst[0])
+			if err == nil {
+				return
+			}
+
+			/* Unusable key, the signed version still goes out */
+			Logf("Mail to %s not encrypted: %s", dst[0], err.Error())
+			err = nil
+		}
+	}
+
+	msg = ml_joinmsg(hdr, body)
+	return
+}
+
+/* (Re)generate the system PGP key */
+func mail_pgp_create(ctx PfCtx) (err error) {
+	sys := System_Get()
+
+	seckey, pubkey, err := pfpgp.CreateKey(Mail_BounceAddr(), sys.Name, "System Email")
+	if err != nil {
+		return
+	}
+
+	q := "UPDATE config " +
+		"SET value = CASE key WHEN 'pgp_seckey' THEN $1 ELSE $2 END " +
+		"WHERE key IN ('pgp_seckey', 'pgp_pubkey')"
+	err = DB.Exec(ctx,
+		"Created system PGP key",
+		2, q,
+		seckey, pubkey)
+	if err != nil {
+		return
+	}
+
+	system_cached.Refresh()
+	return
+}
+
+/* setup only -- creates the system PGP key when there is none yet */
+func Mail_PGPSetup() (err error) {
+	/* Connect to the *tool* database using the postgres account */
+	err = DB.connect_pg(Config.Db_name)
+	if err != nil {
+		return
+	}
+
+	if System_Get().PGPSeckey != "" {
+		return
+	}
+
+	err = mail_pgp_create(nil)
+	return
+}
+
+func system_pgp_key(ctx PfCtx, args []string) (err error) {
+	sys := System_Get()
+
+	if sys.PGPPubkey == "" {
+		err = errors.New("No system PGP key has been created")
+		return
+	}
+
+	ctx.OutLn("%s", sys.PGPPubkey)
+	return
+}
+
+func system_pgp_create(ctx PfCtx, args []string) (err error) {
+	err = mail_pgp_create(ctx)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("System PGP key created, distribute the new public key to the users")
+	return
+}
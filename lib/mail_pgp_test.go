@@ -0,0 +1,89 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run Mail_PGP -v
+ */
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	pfpgp "trident.li/pitchfork/lib/pgp"
+)
+
+func TestMail_PGPSign(t *testing.T) {
+	seckey, pubkey, err := pfpgp.CreateKey("bounce@example.net", "Test", "System Email")
+	if err != nil {
+		t.Fatalf("Creating key failed: %s", err.Error())
+	}
+
+	hdr := []string{
+		"From: \"Test\" <bounce@example.net>",
+		"Subject: test",
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+	}
+	body := mail_qp("Trailing space \nDear user,\n")
+
+	hdr, out, err := mail_sign(hdr, body, seckey)
+	if err != nil {
+		t.Fatalf("Signing failed: %s", err.Error())
+	}
+
+	if ml_hdr_get(hdr, "Subject") != "test" {
+		t.Errorf("Outer headers lost: %v", hdr)
+	}
+
+	mt, params, err := mime.ParseMediaType(ml_hdr_get(hdr, "Content-Type"))
+	if err != nil || mt != "multipart/signed" || params["micalg"] != "pgp-sha256" {
+		t.Fatalf("Not signed: %v", hdr)
+	}
+
+	/* The signed entity, exactly as it sits between the boundaries */
+	b := "--" + params["boundary"]
+	parts := strings.Split(string(out), "\n"+b)
+	if len(parts) != 3 || !strings.HasPrefix(parts[0], b+"\n") {
+		t.Fatalf("Unexpected structure: %q", out)
+	}
+
+	entity := strings.TrimPrefix(parts[0], b+"\n")
+	if !strings.HasPrefix(entity, "Content-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: quoted-printable\n\n") {
+		t.Errorf("Unexpected entity %q", entity)
+	}
+
+	sig := parts[1][strings.Index(parts[1], "\n\n")+2:]
+
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(pubkey))
+	if err != nil {
+		t.Fatalf("Reading public key failed: %s", err.Error())
+	}
+
+	canon := strings.Replace(entity, "\n", CRLF, -1)
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, strings.NewReader(canon), strings.NewReader(sig))
+	if err != nil {
+		t.Errorf("Signature does not verify: %s", err.Error())
+	}
+
+	/* Modifications are detected */
+	canon = strings.Replace(canon, "Dear", "Hi", 1)
+	_, err = openpgp.CheckArmoredDetachedSignature(keyring, strings.NewReader(canon), strings.NewReader(sig))
+	if err == nil {
+		t.Errorf("Modified entity verified")
+	}
+}
+
+func TestMail_PGPQP(t *testing.T) {
+	out := mail_qp("a = b \nline\n")
+
+	if bytes.Contains(out, []byte("\r")) {
+		t.Errorf("CR left in %q", out)
+	}
+
+	if string(out) != "a =3D b=20\nline\n" {
+		t.Errorf("Unexpected encoding %q", out)
+	}
+}
@@ -0,0 +1,143 @@
+package pitchfork
+
+/*
+ * Templated mail
+ *
+ * The body of a message comes from share/templates/mail/<name>.txt.tmpl,
+ * when mail/<name>.html.tmpl exists it is added as an HTML alternative.
+ *
+ * Templates get a PfMailData and translate with {{.T "text"}} into
+ * the language of the recipient; untranslated text is used as-is.
+ */
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/nicksnyder/go-i18n/i18n"
+)
+
+type PfMailData struct {
+	Sys      *PfSys
+	UserName string
+	FullName string
+	Email    string
+	Data     interface{} /* Mail specific details */
+	tfunc    i18n.TranslateFunc
+}
+
+/* Translate a string for the recipient, used from inside the templates */
+func (md PfMailData) T(id string, args ...interface{}) string {
+	if md.tfunc == nil {
+		return id
+	}
+
+	return md.tfunc(id, args...)
+}
+
+/* Translation function for the languages a user knows, best known first */
+func mail_tfunc(username string) (tfunc i18n.TranslateFunc) {
+	var langs []string
+
+	q := "SELECT mls.language " +
+		"FROM member_language_skill mls " +
+		"INNER JOIN language_skill ls ON mls.skill = ls.skill " +
+		"WHERE mls.member = $1 " +
+		"ORDER BY ls.seq DESC"
+	rows, err := DB.Query(q, username)
+	if err == nil {
+		for rows.Next() {
+			var lang string
+
+			err = rows.Scan(&lang)
+			if err != nil {
+				break
+			}
+
+			langs = append(langs, lang)
+		}
+
+		rows.Close()
+	}
+
+	/* The first one that has translations wins */
+	langs = append(langs, Config.TransDefault)
+
+	tfunc, err = i18n.Tfunc(langs[0], langs[1:]...)
+	if err != nil {
+		tfunc = i18n.IdentityTfunc()
+	}
+
+	return
+}
+
+/* Render the text and, if available, HTML version of a mail */
+func mail_render(name string, md PfMailData) (text string, html string, err error) {
+	ttmp := Template_GetText()
+	htmp := Template_Get()
+	if ttmp == nil || htmp == nil {
+		err = errors.New("Templates have not been loaded")
+		return
+	}
+
+	tname := "mail/" + name + ".txt.tmpl"
+	if ttmp.Lookup(tname) == nil {
+		err = errors.New("Unknown mail template " + tname)
+		return
+	}
+
+	var buf bytes.Buffer
+
+	err = ttmp.ExecuteTemplate(&buf, tname, md)
+	if err != nil {
+		return
+	}
+
+	/* Messages are sent with CRLF line endings */
+	text = strings.Replace(buf.String(), "\r\n", "\n", -1)
+	text = strings.Replace(text, "\n", CRLF, -1)
+
+	/* The HTML version is optional */
+	hname := "mail/" + name + ".html.tmpl"
+	if htmp.Lookup(hname) == nil {
+		return
+	}
+
+	buf.Reset()
+
+	err = htmp.ExecuteTemplate(&buf, hname, md)
+	if err != nil {
+		return
+	}
+
+	html = buf.String()
+	return
+}
+
+/* Send a templated mail to a user, the subject gets translated too */
+func Mail_Template(ctx PfCtx, email PfUserEmail, name string, subject string, data interface{}) (err error) {
+	sys := System_Get()
+
+	md := PfMailData{
+		Sys:      sys,
+		UserName: email.Member,
+		FullName: email.FullName,
+		Email:    email.Email,
+		Data:     data,
+		tfunc:    mail_tfunc(email.Member),
+	}
+
+	text, html, err := mail_render(name, md)
+	if err == nil {
+		subject = "[" + sys.Name + "] " + md.T(subject)
+		err = mail_compose("", "", []string{email.FullName}, []string{email.Email}, subject, text, html)
+	}
+
+	if err != nil {
+		ctx.Err("Sending email to " + email.Email + " failed: " + err.Error())
+		err = errors.New("Sending email failed")
+	}
+
+	return
+}
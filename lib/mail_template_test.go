@@ -0,0 +1,98 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run Mail_Template -v
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/* Load only the mail templates, the others need functions from the UI */
+func mail_test_templates(t *testing.T) (root string) {
+	root, err := ioutil.TempDir("", "pfmail")
+	if err != nil {
+		t.Fatalf("Creating temp dir failed: %s", err.Error())
+	}
+
+	dir := filepath.Join(root, "templates", "mail")
+	os.MkdirAll(dir, 0700)
+
+	files, _ := filepath.Glob("../share/templates/mail/*.tmpl")
+	for _, fn := range files {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("Reading %s failed: %s", fn, err.Error())
+		}
+
+		ioutil.WriteFile(filepath.Join(dir, filepath.Base(fn)), b, 0600)
+	}
+
+	Config.File_roots = []string{root}
+
+	err = Template_Load()
+	if err != nil {
+		t.Fatalf("Loading templates failed: %s", err.Error())
+	}
+
+	return
+}
+
+func TestMail_Template(t *testing.T) {
+	root := mail_test_templates(t)
+	defer os.RemoveAll(root)
+
+	md := PfMailData{
+		Sys:      &PfSys{Name: "Test", PublicURL: "https://test.example.net"},
+		UserName: "user",
+		FullName: "Jack & Jill",
+		Email:    "user@example.net",
+		Data:     map[string]string{"URL": "https://test.example.net/confirm/?a=1&b=2", "VerifyCode": "1234"},
+		tfunc: func(id string, args ...interface{}) string {
+			if id == "Dear" {
+				return "Beste"
+			}
+			return id
+		},
+	}
+
+	text, html, err := mail_render("verify_email", md)
+	if err != nil {
+		t.Fatalf("Rendering failed: %s", err.Error())
+	}
+
+	if !strings.HasPrefix(text, "Beste Jack & Jill,\r\n") {
+		t.Errorf("Text not translated or escaped: %q", text)
+	}
+
+	if !strings.Contains(text, "https://test.example.net/confirm/?a=1&b=2\r\n") {
+		t.Errorf("URL missing from text: %q", text)
+	}
+
+	if !strings.Contains(text, "Test -- https://test.example.net\r\n") {
+		t.Errorf("Footer missing from text: %q", text)
+	}
+
+	if !strings.Contains(html, "Beste Jack &amp; Jill,") {
+		t.Errorf("HTML not translated or escaped: %q", html)
+	}
+
+	/* Password changed mails have no HTML version */
+	text, html, err = mail_render("password_changed", md)
+	if err != nil {
+		t.Fatalf("Rendering failed: %s", err.Error())
+	}
+
+	if text == "" || html != "" {
+		t.Errorf("Unexpected rendering %q %q", text, html)
+	}
+
+	_, _, err = mail_render("nonexistent", md)
+	if err == nil {
+		t.Errorf("Unknown template rendered")
+	}
+}
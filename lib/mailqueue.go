@@ -0,0 +1,398 @@
+package pitchfork
+
+/*
+ * Outbound mail queue
+ *
+ * Note: the queue runner uses non-audit versions of DB queries,
+ * only the sysadmin commands are audited.
+ *
+ * Messages are stored in SQL and handed to the MTA by a
+ * background runner, retrying with an exponential backoff.
+ * Messages that keep failing, or that are permanently
+ * rejected, are kept as 'dead' for inspection.
+ *
+ * Messages are claimed before sending, thus multiple nodes
+ * can share the queue.
+ */
+
+import (
+	"errors"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Give up after this many attempts */
+const MAILQUEUE_MAXATTEMPTS = 15
+
+/* First retry after a minute, doubling up to this delay */
+const MAILQUEUE_MAXDELAY = 8 * time.Hour
+
+/* Messages handled per run */
+const MAILQUEUE_BATCH = 100
+
+type PfMailQueueEntry struct {
+	Id          int
+	Entered     time.Time
+	Src         string
+	Dst         string
+	State       string
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+var mailq_exit chan bool
+var mailq_done chan bool
+var mailq_poke chan bool
+var mailq_running bool
+
+/* Queue a message, the runner is woken up to send it */
+func Mail_Queue(src string, dst []string, msg []byte) (err error) {
+	if len(dst) == 0 {
+		err = errors.New("No recipients")
+		return
+	}
+
+	q := "INSERT INTO mailqueue " +
+		"(src, dst, msg) " +
+		"VALUES($1, $2, $3)"
+	err = DB.ExecNA(1, q, src, strings.Join(dst, " "), msg)
+	if err != nil {
+		return
+	}
+
+	mailq_wakeup()
+	return
+}
+
+func mailq_wakeup() {
+	select {
+	case mailq_poke <- true:
+	default:
+		/* Not running or already busy */
+	}
+}
+
+/* Delay before the next attempt */
+func mailq_backoff(attempts int) (delay time.Duration) {
+	delay = time.Minute
+
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= MAILQUEUE_MAXDELAY {
+			return MAILQUEUE_MAXDELAY
+		}
+	}
+
+	return
+}
+
+/* 5xx replies will not get better by retrying */
+func mailq_permanent(err error) bool {
+	terr, ok := err.(*textproto.Error)
+	return ok && terr.Code >= 500
+}
+
+func mailq_send(id int) {
+	var src, dst string
+	var msg []byte
+	var attempts int
+
+	/* Claim it, so that other nodes skip it while we are sending */
+	q := "UPDATE mailqueue " +
+		"SET attempts = attempts + 1, " +
+		"last_attempt = NOW()::TIMESTAMP, " +
+		"next_attempt = NOW()::TIMESTAMP + INTERVAL '15 minutes' " +
+		"WHERE id = $1 " +
+		"AND state = 'queued' " +
+		"AND next_attempt <= NOW()::TIMESTAMP " +
+		"RETURNING src, dst, msg, attempts"
+	err := DB.QueryRowNA(q, id).Scan(&src, &dst, &msg, &attempts)
+	if err == ErrNoRows {
+		/* Sent or claimed in the mean time */
+		return
+	} else if err != nil {
+		Errf("Mail queue: claiming %d failed: %s", id, err.Error())
+		return
+	}
+
+	err = mail_smtp(src, strings.Fields(dst), msg)
+	if err == nil {
+		q = "DELETE FROM mailqueue WHERE id = $1"
+		err = DB.ExecNA(1, q, id)
+		if err != nil {
+			Errf("Mail queue: removing sent %d failed: %s", id, err.Error())
+		}
+		return
+	}
+
+	if mailq_permanent(err) || attempts >= MAILQUEUE_MAXATTEMPTS {
+		Errf("Mail queue: giving up on %d to %s after %d attempts: %s", id, dst, attempts, err.Error())
+
+		q = "UPDATE mailqueue " +
+			"SET state = 'dead', " +
+			"last_error = $2 " +
+			"WHERE id = $1"
+		err = DB.ExecNA(1, q, id, err.Error())
+	} else {
+		delay := mailq_backoff(attempts)
+
+		Logf("Mail queue: sending %d to %s failed, retrying in %s: %s", id, dst, delay.String(), err.Error())
+
+		q = "UPDATE mailqueue " +
+			"SET next_attempt = NOW()::TIMESTAMP + $2::INTEGER * INTERVAL '1 second', " +
+			"last_error = $3 " +
+			"WHERE id = $1"
+		err = DB.ExecNA(1, q, id, int(delay.Seconds()), err.Error())
+	}
+
+	if err != nil {
+		Errf("Mail queue: updating %d failed: %s", id, err.Error())
+	}
+}
+
+/* Send everything that is due */
+func mailq_run() {
+	var ids []int
+
+	q := "SELECT id " +
+		"FROM mailqueue " +
+		"WHERE state = 'queued' " +
+		"AND next_attempt <= NOW()::TIMESTAMP " +
+		"ORDER BY next_attempt " +
+		"LIMIT " + strconv.Itoa(MAILQUEUE_BATCH)
+	rows, err := DB.Query(q)
+	if err != nil {
+		Errf("Mail queue: %s", err.Error())
+		return
+	}
+
+	for rows.Next() {
+		var id int
+
+		err = rows.Scan(&id)
+		if err != nil {
+			break
+		}
+
+		ids = append(ids, id)
+	}
+
+	rows.Close()
+
+	for _, id := range ids {
+		mailq_send(id)
+	}
+
+	/* More waiting? Then go again */
+	if len(ids) == MAILQUEUE_BATCH {
+		mailq_wakeup()
+	}
+}
+
+func mailq_rtn(interval time.Duration) {
+	mailq_running = true
+
+	/* Timer for retries */
+	tmr := time.NewTimer(interval)
+
+	/* Send what was left from a previous run */
+	mailq_run()
+
+	for mailq_running {
+		select {
+		case _, ok := <-mailq_exit:
+			if !ok {
+				mailq_running = false
+				break
+			}
+			break
+
+		case <-mailq_poke:
+			mailq_run()
+			break
+
+		case <-tmr.C:
+			mailq_run()
+
+			/* Restart timer */
+			tmr = time.NewTimer(interval)
+			break
+		}
+	}
+
+	mailq_done <- true
+}
+
+func MailQ_start(interval time.Duration) {
+	mailq_exit = make(chan bool)
+	mailq_done = make(chan bool)
+	mailq_poke = make(chan bool, 1)
+
+	go mailq_rtn(interval)
+}
+
+func MailQ_stop() {
+	if !mailq_running {
+		return
+	}
+
+	/* Close the channel */
+	close(mailq_exit)
+
+	/* Wait for it to finish */
+	<-mailq_done
+}
+
+func MailQ_List() (entries []PfMailQueueEntry, err error) {
+	q := "SELECT id, entered, src, dst, state, attempts, next_attempt, last_error " +
+		"FROM mailqueue " +
+		"ORDER BY id"
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var e PfMailQueueEntry
+
+		err = rows.Scan(&e.Id, &e.Entered, &e.Src, &e.Dst, &e.State, &e.Attempts, &e.NextAttempt, &e.LastError)
+		if err != nil {
+			return
+		}
+
+		entries = append(entries, e)
+	}
+
+	return
+}
+
+func mailqueue_list(ctx PfCtx, args []string) (err error) {
+	entries, err := MailQ_List()
+	if err != nil {
+		return
+	}
+
+	if len(entries) == 0 {
+		ctx.OutLn("The mail queue is empty")
+		return
+	}
+
+	ctx.Outf("%6s %16s %6s %8s %16s %s\n", "ID", "Entered", "State", "Attempts", "Next Attempt", "Recipients")
+
+	for _, e := range entries {
+		next := Fmt_Time(e.NextAttempt)
+		if e.State == "dead" {
+			next = "-"
+		}
+
+		ctx.Outf("%6d %16s %6s %8d %16s %s\n", e.Id, Fmt_Time(e.Entered), e.State, e.Attempts, next, e.Dst)
+
+		if e.LastError != "" {
+			ctx.Outf("%6s %s\n", "", e.LastError)
+		}
+	}
+
+	return
+}
+
+/* Requeue a (dead) message for immediate delivery */
+func mailqueue_retry(ctx PfCtx, args []string) (err error) {
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		err = errors.New("Invalid queue id")
+		return
+	}
+
+	q := "UPDATE mailqueue " +
+		"SET state = 'queued', " +
+		"attempts = 0, " +
+		"next_attempt = NOW()::TIMESTAMP " +
+		"WHERE id = $1"
+	err = DB.Exec(ctx,
+		"Requeued mail $1",
+		1, q,
+		id)
+	if err == ErrNoRows {
+		err = errors.New("No such message in the queue")
+		return
+	} else if err != nil {
+		return
+	}
+
+	mailq_wakeup()
+
+	ctx.OutLn("Message %d requeued", id)
+	return
+}
+
+/* Attempt delivery of all queued messages now */
+func mailqueue_flush(ctx PfCtx, args []string) (err error) {
+	q := "UPDATE mailqueue " +
+		"SET next_attempt = NOW()::TIMESTAMP " +
+		"WHERE state = 'queued'"
+	err = DB.Exec(ctx,
+		"Flushed mail queue",
+		-1, q)
+	if err != nil {
+		return
+	}
+
+	mailq_wakeup()
+
+	ctx.OutLn("Mail queue flushed")
+	return
+}
+
+/* Remove a message, or all dead ones */
+func mailqueue_remove(ctx PfCtx, args []string) (err error) {
+	if args[0] == "dead" {
+		q := "DELETE FROM mailqueue " +
+			"WHERE state = 'dead'"
+		err = DB.Exec(ctx,
+			"Removed dead mail from queue",
+			-1, q)
+		if err == nil {
+			ctx.OutLn("Dead messages removed")
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		err = errors.New("Invalid queue id")
+		return
+	}
+
+	q := "DELETE FROM mailqueue " +
+		"WHERE id = $1"
+	err = DB.Exec(ctx,
+		"Removed mail $1 from queue",
+		1, q,
+		id)
+	if err == ErrNoRows {
+		err = errors.New("No such message in the queue")
+		return
+	} else if err != nil {
+		return
+	}
+
+	ctx.OutLn("Message %d removed", id)
+	return
+}
+
+func mailqueue_menu(ctx PfCtx, args []string) (err error) {
+	menu := NewPfMenu([]PfMEntry{
+		{"list", mailqueue_list, 0, 0, nil, PERM_SYS_ADMIN, "List the messages in the mail queue"},
+		{"retry", mailqueue_retry, 1, 1, []string{"id#int"}, PERM_SYS_ADMIN, "Requeue a (dead) message for delivery"},
+		{"flush", mailqueue_flush, 0, 0, nil, PERM_SYS_ADMIN, "Attempt delivery of all queued messages now"},
+		{"remove", mailqueue_remove, 1, 1, []string{"id"}, PERM_SYS_ADMIN, "Remove a message, or 'dead' for all dead messages"},
+	})
+
+	err = ctx.Menu(args, menu)
+	return
+}
@@ -0,0 +1,46 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run MailQ -v
+ */
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestMailQ_Backoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{10, 8 * time.Hour},
+		{MAILQUEUE_MAXATTEMPTS, MAILQUEUE_MAXDELAY},
+	}
+
+	for _, tst := range tests {
+		d := mailq_backoff(tst.attempts)
+		if d != tst.delay {
+			t.Errorf("Attempt %d: expected %s got %s", tst.attempts, tst.delay, d)
+		}
+	}
+}
+
+func TestMailQ_Permanent(t *testing.T) {
+	if !mailq_permanent(&textproto.Error{Code: 550, Msg: "No such user"}) {
+		t.Errorf("550 should be permanent")
+	}
+
+	if mailq_permanent(&textproto.Error{Code: 451, Msg: "Try again"}) {
+		t.Errorf("451 should not be permanent")
+	}
+
+	if mailq_permanent(errors.New("connection refused")) {
+		t.Errorf("Connection errors should not be permanent")
+	}
+}
@@ -189,6 +189,21 @@ func (ctx *PfCtxS) Menu(args []string, menu PfMenu) (err error) {
 			return
 		}
 
+		/* OAuth2 tokens are limited to their scope */
+		if ctx.scoped {
+			group := ""
+			if ctx.HasSelectedGroup() {
+				group = ctx.SelectedGroup().GetGroupName()
+			}
+
+			if !Scope_Allows(ctx.scope, ctx.loc, group) {
+				err = errors.New("Command '" + ctx.loc + "' is not allowed by the token scope")
+				ctx.Log("User " + ctx.TheUser().GetUserName() + " tried access to command '" + ctx.loc + "': " + err.Error())
+				ctx.SetStatus(StatusForbidden)
+				return
+			}
+		}
+
 		/* Walk Only & command & return the menu? */
 		if m.Args != nil && ctx.menu_walkonly {
 			ctx.menu_menu = &m
@@ -207,6 +222,12 @@ func (ctx *PfCtxS) Menu(args []string, menu PfMenu) (err error) {
 			}
 		}
 
+		/* Dual control: a second SysAdmin has to approve it (approval.go) */
+		if approval_needed(ctx.loc) && ctx.approved != ctx.loc {
+			err = approval_request(ctx, ctx.loc, m.Args, nargs)
+			return
+		}
+
 		/* Execute the menu */
 		err = m.Fun(ctx, nargs)
 		return
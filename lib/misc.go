@@ -206,6 +206,14 @@ func NormalizeBoolean(val string) string {
 	return YesNo(IsTrue(val))
 }
 
+/* Case, dashes and spaces do not matter when entering a code */
+func NormalizeCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	return code
+}
+
 /* Parse the string (obeying quoting) */
 func SplitArgs(str string) (args []string) {
 	r := regexp.MustCompile("'.+'|\".+\"|\\S+")
@@ -137,3 +137,22 @@ func TestMisc_URL_Append(t *testing.T) {
 		test_url_append(t, tst.url1, tst.url2, tst.expected)
 	}
 }
+
+func TestMisc_NormalizeCode(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected string
+	}{
+		{"BCDF-GHJK", "BCDFGHJK"},
+		{"bcdf-ghjk", "BCDFGHJK"},
+		{" BCDF GHJK ", "BCDFGHJK"},
+		{"abcde fghij", "ABCDEFGHIJ"},
+	}
+
+	for _, tst := range tests {
+		n := NormalizeCode(tst.code)
+		if n != tst.expected {
+			t.Errorf("Normalizing %q gave %q, expected %q", tst.code, n, tst.expected)
+		}
+	}
+}
@@ -233,7 +233,7 @@ func (ml *PfML) List(ctx PfCtx, grp PfGroup) (mls []PfML, err error) {
 			return
 		}
 
-		ml.Address = ml.GroupName + "-" + ml.ListName + "@" + System_Get().EmailDomain
+		ml.Address = ml.ListAddress()
 
 		mls = append(mls, ml)
 	}
@@ -283,7 +283,7 @@ func (ml *PfML) ListWithUser(ctx PfCtx, grp PfGroup, user PfUser) (mls []PfML, e
 			return
 		}
 
-		ml.Address = ml.GroupName + "-" + ml.ListName + "@" + System_Get().EmailDomain
+		ml.Address = ml.ListAddress()
 
 		mls = append(mls, ml)
 	}
@@ -0,0 +1,182 @@
+package pitchfork
+
+/*
+ * PGP handling of Mailing List traffic
+ *
+ * Posts are encrypted to the list key, either PGP/MIME (RFC3156)
+ * or inline. The list decrypts them with its secret key and
+ * encrypts a PGP/MIME copy to the key of every subscriber.
+ * Subscribers without a usable key are notified instead.
+ */
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+
+	pfpgp "trident.li/pitchfork/lib/pgp"
+)
+
+func ml_is_encrypted(hdr []string, body []byte) bool {
+	mt, _, err := mime.ParseMediaType(ml_hdr_get(hdr, "Content-Type"))
+	if err == nil && mt == "multipart/encrypted" {
+		return true
+	}
+
+	return bytes.Contains(body, []byte("-----BEGIN PGP MESSAGE-----"))
+}
+
+/* Replace the encrypted body of a message with the decrypted one */
+func (ml *PfML) decrypt(msg *ml_msg) (err error) {
+	var plain []byte
+
+	if ml.Seckey == "" {
+		err = errors.New("List has no PGP key")
+		return
+	}
+
+	outer, _ := ml_hdr_split(msg.hdr)
+	outer = append(outer, "MIME-Version: 1.0")
+
+	mt, params, _ := mime.ParseMediaType(ml_hdr_get(msg.hdr, "Content-Type"))
+	if mt != "multipart/encrypted" {
+		/* Inline PGP, the result is plain text */
+		plain, err = pfpgp.Decrypt(ml.Seckey, msg.body)
+		if err != nil {
+			return
+		}
+
+		msg.hdr = append(outer,
+			"Content-Type: text/plain; charset=utf-8",
+			"Content-Transfer-Encoding: 8bit")
+		msg.body = bytes.Replace(plain, []byte("\r\n"), []byte("\n"), -1)
+		msg.crypted = true
+		return
+	}
+
+	/* PGP/MIME, the second part carries the encrypted MIME entity */
+	var armored []byte
+
+	mr := multipart.NewReader(bytes.NewReader(msg.body), params["boundary"])
+	for {
+		var p *multipart.Part
+
+		p, err = mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+
+		pt, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if pt == "application/octet-stream" {
+			armored, err = ioutil.ReadAll(p)
+			if err != nil {
+				return
+			}
+			break
+		}
+	}
+
+	if armored == nil {
+		err = errors.New("No encrypted part found")
+		return
+	}
+
+	plain, err = pfpgp.Decrypt(ml.Seckey, armored)
+	if err != nil {
+		return
+	}
+
+	ehdr, ebody := ml_splitmsg(plain)
+	_, inner := ml_hdr_split(ehdr)
+
+	msg.hdr = append(outer, inner...)
+	msg.body = ebody
+	msg.crypted = true
+	return
+}
+
+/* Encrypt the body of a message into a PGP/MIME message */
+func ml_encrypt(hdr []string, body []byte, keyring string, email string) (out []byte, err error) {
+	if keyring == "" {
+		err = errors.New("No PGP key has been configured")
+		return
+	}
+
+	outer, inner := ml_hdr_split(hdr)
+	if len(inner) == 0 {
+		inner = []string{"Content-Type: text/plain"}
+	}
+
+	/* The encrypted entity uses canonical line endings */
+	entity := bytes.Replace(ml_joinmsg(inner, body), []byte("\n"), []byte(CRLF), -1)
+
+	armored, err := pfpgp.Encrypt(keyring, email, entity)
+	if err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", "application/pgp-encrypted")
+	h.Set("Content-Description", "PGP/MIME version identification")
+
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return
+	}
+	pw.Write([]byte("Version: 1\n"))
+
+	h = textproto.MIMEHeader{}
+	h.Set("Content-Type", "application/octet-stream; name=\"encrypted.asc\"")
+	h.Set("Content-Description", "OpenPGP encrypted message")
+	h.Set("Content-Disposition", "inline; filename=\"encrypted.asc\"")
+
+	pw, err = mw.CreatePart(h)
+	if err != nil {
+		return
+	}
+	pw.Write(armored)
+
+	err = mw.Close()
+	if err != nil {
+		return
+	}
+
+	outer = append(outer,
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=\""+mw.Boundary()+"\"")
+
+	out = ml_joinmsg(outer, buf.Bytes())
+	return
+}
+
+/* Tell a subscriber that a message could not be encrypted for them */
+func (ml *PfML) nokey(r PfMLRecipient, reason error) {
+	sys := System_Get()
+	subject := "Undeliverable message for " + ml.ListAddress()
+
+	body := "Dear " + r.FullName + "," + CRLF +
+		CRLF +
+		"A message sent to the encrypted mailinglist:" + CRLF +
+		"  " + ml.ListAddress() + CRLF +
+		"could not be delivered to you as there is no usable PGP key for" + CRLF +
+		"your address " + r.Email + ":" + CRLF +
+		"  " + reason.Error() + CRLF +
+		CRLF +
+		"Please add a valid PGP key for this address at:" + CRLF +
+		"  " + sys.PublicURL + "/user/" + r.UserName + "/email/" + CRLF +
+		"to receive future messages of this list." + CRLF
+
+	err := mailA(nil, "", "", []string{r.FullName}, []string{r.Email}, true, subject, body, true, "", true)
+	if err != nil {
+		Errf("ML %s: notifying %s about missing key failed: %s", ml.ListAddress(), r.Email, err.Error())
+	}
+}
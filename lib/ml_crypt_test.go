@@ -0,0 +1,185 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run ML_Crypt -v
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pfpgp "trident.li/pitchfork/lib/pgp"
+)
+
+/* Returns the armored part of a PGP/MIME message */
+func ml_test_armored(t *testing.T, data []byte) []byte {
+	hdr, body := ml_splitmsg(data)
+
+	mt, params, err := mime.ParseMediaType(ml_hdr_get(hdr, "Content-Type"))
+	if err != nil || mt != "multipart/encrypted" {
+		t.Fatalf("Not PGP/MIME: %v", hdr)
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("No encrypted part: %v", err)
+		}
+
+		if strings.HasPrefix(p.Header.Get("Content-Type"), "application/octet-stream") {
+			armored, _ := ioutil.ReadAll(p)
+			return armored
+		}
+	}
+}
+
+func TestML_Crypt(t *testing.T) {
+	ml_sec, ml_pub, err := pfpgp.CreateKey("grp-list@example.net", "grp list", "Test list")
+	if err != nil {
+		t.Fatalf("Creating list key failed: %s", err.Error())
+	}
+
+	u_sec, u_pub, err := pfpgp.CreateKey("user@example.org", "User", "")
+	if err != nil {
+		t.Fatalf("Creating user key failed: %s", err.Error())
+	}
+
+	ml := &PfML{ListName: "list", GroupName: "grp", Always_crypt: true, Seckey: ml_sec}
+
+	/* A PGP/MIME post to the list */
+	hdr := []string{"From: user@example.org", "Subject: secret", "Content-Type: text/plain; charset=utf-8"}
+	post, err := ml_encrypt(hdr, []byte("The secret\n"), ml_pub, "grp-list@example.net")
+	if err != nil {
+		t.Fatalf("Encrypting post failed: %s", err.Error())
+	}
+
+	phdr, pbody := ml_splitmsg(post)
+	if !ml_is_encrypted(phdr, pbody) {
+		t.Fatalf("Post not detected as encrypted")
+	}
+
+	msg := &ml_msg{phdr, pbody, false}
+	err = ml.decrypt(msg)
+	if err != nil {
+		t.Fatalf("Decrypting post failed: %s", err.Error())
+	}
+
+	if !msg.crypted || string(msg.body) != "The secret\n" {
+		t.Errorf("Unexpected decrypted body %q", msg.body)
+	}
+
+	if ml_hdr_get(msg.hdr, "Subject") != "secret" || ml_hdr_get(msg.hdr, "Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("Unexpected decrypted headers %v", msg.hdr)
+	}
+
+	/* Re-encrypt to the subscriber */
+	out, err := ml_encrypt(msg.hdr, msg.body, u_pub, "user@example.org")
+	if err != nil {
+		t.Fatalf("Re-encrypting failed: %s", err.Error())
+	}
+
+	plain, err := pfpgp.Decrypt(u_sec, ml_test_armored(t, out))
+	if err != nil {
+		t.Fatalf("Subscriber can not decrypt: %s", err.Error())
+	}
+
+	if !strings.Contains(string(plain), "\r\n\r\nThe secret\r\n") {
+		t.Errorf("Unexpected entity %q", plain)
+	}
+
+	/* Not decryptable by the list key */
+	_, err = pfpgp.Decrypt(ml_sec, ml_test_armored(t, out))
+	if err == nil {
+		t.Errorf("Copy for subscriber also readable with list key")
+	}
+
+	/* No key, no delivery */
+	_, err = ml_encrypt(msg.hdr, msg.body, "", "other@example.org")
+	if err == nil {
+		t.Errorf("Encrypting without a key succeeded")
+	}
+
+	_, err = ml_encrypt(msg.hdr, msg.body, u_pub, "other@example.org")
+	if err == nil {
+		t.Errorf("Encrypting with a key for another address succeeded")
+	}
+}
+
+func TestML_Crypt_Inline(t *testing.T) {
+	ml_sec, ml_pub, err := pfpgp.CreateKey("grp-list@example.net", "grp list", "Test list")
+	if err != nil {
+		t.Fatalf("Creating list key failed: %s", err.Error())
+	}
+
+	armored, err := pfpgp.Encrypt(ml_pub, "grp-list@example.net", []byte("Inline secret\n"))
+	if err != nil {
+		t.Fatalf("Encrypting failed: %s", err.Error())
+	}
+
+	hdr := []string{"From: user@example.org", "Content-Type: text/plain"}
+	body := append([]byte("Some text before\n"), armored...)
+
+	if !ml_is_encrypted(hdr, body) {
+		t.Fatalf("Inline PGP not detected")
+	}
+
+	if ml_is_encrypted(hdr, []byte("Just text\n")) {
+		t.Errorf("Plain text detected as encrypted")
+	}
+
+	ml := &PfML{ListName: "list", GroupName: "grp", Seckey: ml_sec}
+	msg := &ml_msg{hdr, body, false}
+
+	err = ml.decrypt(msg)
+	if err != nil {
+		t.Fatalf("Decrypting failed: %s", err.Error())
+	}
+
+	if string(msg.body) != "Inline secret\n" {
+		t.Errorf("Unexpected body %q", msg.body)
+	}
+}
+
+func TestML_Crypt_SignedOnly(t *testing.T) {
+	ml_sec, _, err := pfpgp.CreateKey("grp-list@example.net", "grp list", "Test list")
+	if err != nil {
+		t.Fatalf("Creating list key failed: %s", err.Error())
+	}
+
+	u_sec, _, err := pfpgp.CreateKey("user@example.org", "User", "")
+	if err != nil {
+		t.Fatalf("Creating user key failed: %s", err.Error())
+	}
+
+	ents, err := openpgp.ReadArmoredKeyRing(strings.NewReader(u_sec))
+	if err != nil {
+		t.Fatalf("Reading user key failed: %s", err.Error())
+	}
+
+	/* Signed, but not encrypted, in a PGP MESSAGE armor */
+	buf := new(bytes.Buffer)
+	aw, _ := armor.Encode(buf, "PGP MESSAGE", nil)
+	w, err := openpgp.Sign(aw, ents[0], &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		t.Fatalf("Signing failed: %s", err.Error())
+	}
+	w.Write([]byte("Not a secret\n"))
+	w.Close()
+	aw.Close()
+
+	ml := &PfML{ListName: "list", GroupName: "grp", Always_crypt: true, Seckey: ml_sec}
+	msg := &ml_msg{[]string{"From: user@example.org", "Content-Type: text/plain"}, buf.Bytes(), false}
+
+	err = ml.decrypt(msg)
+	if err == nil || msg.crypted {
+		t.Errorf("Signed-only message accepted as decrypted: %q", msg.body)
+	}
+}
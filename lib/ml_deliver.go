@@ -0,0 +1,544 @@
+package pitchfork
+
+/*
+ * Redistribution of inbound Mailing List messages
+ *
+ * Lists are addressed as either:
+ *   <list>@<group>.<EmailDomain>
+ *   <group>-<list>@<EmailDomain>
+ *
+ * Messages are kept mostly as received: list headers are
+ * added and the system signature is appended, after which
+ * a copy is queued for every subscriber that is allowed
+ * to receive mail.
+ *
+ * Distributed messages are remembered per list by Message-ID,
+ * thus a retry by the sender, eg when another list in the same
+ * transaction failed, does not reach the subscribers twice.
+ */
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+/* Distributed messages are remembered this long, senders retry for days */
+const ML_DISTRIBUTED_WINDOW = "7 days"
+
+type PfMLRecipient struct {
+	UserName string
+	FullName string
+	Email    string
+	Keyring  string
+}
+
+/* A message accepted for distribution */
+type ml_msg struct {
+	hdr     []string
+	body    []byte
+	crypted bool /* Decrypted, thus to be encrypted per recipient */
+}
+
+/* The address that subscribers post to */
+func (ml *PfML) ListAddress() string {
+	return ml.GroupName + "-" + ml.ListName + "@" + System_Get().EmailDomain
+}
+
+/* The RFC2919 List-Id of the list */
+func (ml *PfML) ListId() string {
+	return ml.ListName + "." + ml.GroupName + "." + System_Get().EmailDomain
+}
+
+/* Find the Mailing List that an address belongs to */
+func ML_FromAddress(addr string) (ml *PfML, err error) {
+	addr = strings.ToLower(strings.Trim(strings.TrimSpace(addr), "<>"))
+	domain := strings.ToLower(System_Get().EmailDomain)
+
+	at := strings.LastIndex(addr, "@")
+	if at < 1 {
+		err = errors.New("Invalid address")
+		return
+	}
+
+	lhs := addr[:at]
+	rhs := addr[at+1:]
+
+	ml = NewPfML()
+
+	/* <list>@<group>.<EmailDomain> */
+	if strings.HasSuffix(rhs, "."+domain) {
+		err = ml.fetch(strings.TrimSuffix(rhs, "."+domain), lhs)
+		if err == nil {
+			return
+		}
+	}
+
+	/* <group>-<list>@<EmailDomain>, both names can contain a dash */
+	if rhs == domain {
+		for i := 1; i < len(lhs)-1; i++ {
+			if lhs[i] != '-' {
+				continue
+			}
+
+			err = ml.fetch(lhs[:i], lhs[i+1:])
+			if err == nil {
+				return
+			}
+		}
+	}
+
+	ml = nil
+	err = errors.New("No such Mailing List")
+	return
+}
+
+/* Returns the username of the group member owning the email address */
+func (ml *PfML) SenderMember(email string) (username string, err error) {
+	q := "SELECT me.member " +
+		"FROM member_email me " +
+		"INNER JOIN member_trustgroup mt ON (mt.member = me.member) " +
+		"INNER JOIN member_state ms ON (ms.ident = mt.state) " +
+		"WHERE LOWER(me.email) = LOWER($1) " +
+		"AND mt.trustgroup = $2 " +
+		"AND ms.can_send " +
+		"AND NOT ms.blocked"
+
+	err = DB.QueryRow(q, email, ml.GroupName).Scan(&username)
+	return
+}
+
+/* Subscribers that should receive a copy of list traffic, skipping bouncing addresses */
+func (ml *PfML) Recipients() (rcpts []PfMLRecipient, err error) {
+	q := "SELECT m.ident, m.descr, mt.email, COALESCE(me.keyring, '') " +
+		"FROM member_mailinglist mlm " +
+		"INNER JOIN member_trustgroup mt ON (mt.member = mlm.member AND mt.trustgroup = mlm.trustgroup) " +
+		"INNER JOIN member_state ms ON (ms.ident = mt.state) " +
+		"LEFT OUTER JOIN member_email me ON (me.member = mt.member AND me.email = mt.email) " +
+		"INNER JOIN member m ON (m.ident = mlm.member) " +
+		"WHERE mlm.trustgroup = $1 " +
+		"AND mlm.lhs = $2 " +
+		"AND ms.can_recv " +
+		"AND NOT ms.blocked " +
+		"AND NOT COALESCE(me.ml_disabled, FALSE) " +
+		"ORDER BY m.ident"
+
+	rows, err := DB.Query(q, ml.GroupName, ml.ListName)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var r PfMLRecipient
+
+		err = rows.Scan(&r.UserName, &r.FullName, &r.Email, &r.Keyring)
+		if err != nil {
+			return
+		}
+
+		rcpts = append(rcpts, r)
+	}
+
+	return
+}
+
+/*
+ * Split a message in its header fields and body
+ *
+ * Header fields are kept raw (including folding) so
+ * that they can be passed on unmodified.
+ */
+func ml_splitmsg(data []byte) (hdr []string, body []byte) {
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+
+	end := bytes.Index(data, []byte("\n\n"))
+	if end == -1 {
+		end = len(data)
+		body = []byte{}
+	} else {
+		body = data[end+2:]
+	}
+
+	for _, l := range strings.Split(string(data[:end]), "\n") {
+		if len(l) > 0 && (l[0] == ' ' || l[0] == '\t') && len(hdr) > 0 {
+			hdr[len(hdr)-1] += "\n" + l
+			continue
+		}
+
+		if l == "" {
+			continue
+		}
+
+		hdr = append(hdr, l)
+	}
+
+	return
+}
+
+func ml_joinmsg(hdr []string, body []byte) []byte {
+	return append([]byte(strings.Join(hdr, "\n")+"\n\n"), body...)
+}
+
+func ml_hdr_name(field string) string {
+	c := strings.Index(field, ":")
+	if c == -1 {
+		return ""
+	}
+
+	return strings.ToLower(strings.TrimSpace(field[:c]))
+}
+
+/* Unfolded value of the first field with the given name */
+func ml_hdr_get(hdr []string, name string) string {
+	name = strings.ToLower(name)
+
+	for _, f := range hdr {
+		if ml_hdr_name(f) == name {
+			val := f[strings.Index(f, ":")+1:]
+			val = strings.Replace(val, "\n", "", -1)
+			return strings.TrimSpace(val)
+		}
+	}
+
+	return ""
+}
+
+/* Separate the Content-* fields, describing the body, from the rest */
+func ml_hdr_split(hdr []string) (outer []string, inner []string) {
+	for _, f := range hdr {
+		name := ml_hdr_name(f)
+
+		if strings.HasPrefix(name, "content-") {
+			inner = append(inner, f)
+		} else if name != "mime-version" {
+			outer = append(outer, f)
+		}
+	}
+
+	return
+}
+
+func ml_mimeheader(fields []string) (h textproto.MIMEHeader) {
+	h = textproto.MIMEHeader{}
+
+	for _, f := range fields {
+		name := ml_hdr_name(f)
+		h.Add(f[:strings.Index(f, ":")], ml_hdr_get([]string{f}, name))
+	}
+
+	return
+}
+
+func ml_hdr_del(hdr []string, name string) (out []string) {
+	name = strings.ToLower(name)
+
+	for _, f := range hdr {
+		if ml_hdr_name(f) != name {
+			out = append(out, f)
+		}
+	}
+
+	return
+}
+
+/* Base64 with the line length limit of RFC2045 */
+func ml_base64(data []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(data)
+	out := ""
+
+	for len(enc) > 76 {
+		out += enc[:76] + "\n"
+		enc = enc[76:]
+	}
+
+	return []byte(out + enc + "\n")
+}
+
+/*
+ * Append the signature to a message
+ *
+ * Plain text bodies get it appended in their own transfer encoding,
+ * anything else is wrapped in a multipart/mixed with the signature
+ * as a separate text part, thus leaving signed content intact.
+ */
+func ml_add_sig(hdr []string, body []byte, sig string) ([]string, []byte, error) {
+	if sig == "" {
+		return hdr, body, nil
+	}
+
+	sig = strings.Replace(sig, "\r\n", "\n", -1)
+	sig = "-- \n" + strings.TrimRight(sig, "\n") + "\n"
+
+	mediatype := "text/plain"
+	ct := ml_hdr_get(hdr, "Content-Type")
+	if ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err == nil {
+			mediatype = mt
+		}
+	}
+
+	if mediatype == "text/plain" {
+		if len(body) > 0 && body[len(body)-1] != '\n' {
+			body = append(body, '\n')
+		}
+
+		switch strings.ToLower(ml_hdr_get(hdr, "Content-Transfer-Encoding")) {
+		case "base64":
+			dec, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+			if err != nil {
+				return hdr, body, errors.New("Invalid base64 body: " + err.Error())
+			}
+
+			if len(dec) > 0 && dec[len(dec)-1] != '\n' {
+				dec = append(dec, '\n')
+			}
+
+			body = ml_base64(append(dec, []byte(sig)...))
+
+		case "quoted-printable":
+			var qp bytes.Buffer
+			w := quotedprintable.NewWriter(&qp)
+			w.Write([]byte(sig))
+			w.Close()
+
+			body = append(body, bytes.Replace(qp.Bytes(), []byte("\r\n"), []byte("\n"), -1)...)
+
+		default:
+			body = append(body, []byte(sig)...)
+		}
+
+		return hdr, body, nil
+	}
+
+	/* Move the Content-* fields to the wrapped part */
+	var buf bytes.Buffer
+
+	outer, inner := ml_hdr_split(hdr)
+
+	mw := multipart.NewWriter(&buf)
+
+	pw, err := mw.CreatePart(ml_mimeheader(inner))
+	if err != nil {
+		return hdr, body, err
+	}
+	pw.Write(body)
+
+	sh := textproto.MIMEHeader{}
+	sh.Set("Content-Type", "text/plain; charset=utf-8")
+	sh.Set("Content-Disposition", "inline")
+
+	pw, err = mw.CreatePart(sh)
+	if err != nil {
+		return hdr, body, err
+	}
+	pw.Write([]byte(sig))
+
+	err = mw.Close()
+	if err != nil {
+		return hdr, body, err
+	}
+
+	outer = append(outer,
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=\""+mw.Boundary()+"\"")
+
+	return outer, buf.Bytes(), nil
+}
+
+/*
+ * Check that a message may be posted to the list
+ *
+ * Encrypted messages are decrypted with the list key.
+ * Errors returned are permanent: the message is rejected.
+ */
+func (ml *PfML) Accept(data []byte) (msg *ml_msg, err error) {
+	hdr, body := ml_splitmsg(data)
+
+	/* Our own traffic coming back? */
+	for _, f := range hdr {
+		if ml_hdr_name(f) == "x-loop" &&
+			strings.EqualFold(ml_hdr_get([]string{f}, "x-loop"), ml.ListAddress()) {
+			err = errors.New("Mail loop detected")
+			return
+		}
+	}
+
+	if ml.Members_only {
+		var from *mail.Address
+
+		from, err = mail.ParseAddress(ml_hdr_get(hdr, "From"))
+		if err != nil {
+			err = errors.New("Invalid From address")
+			return
+		}
+
+		_, err = ml.SenderMember(from.Address)
+		if err == ErrNoRows {
+			err = errors.New("Only members of " + ml.GroupName + " can post to " + ml.ListAddress())
+			return
+		} else if err != nil {
+			return
+		}
+	}
+
+	m := &ml_msg{hdr, body, false}
+
+	if ml_is_encrypted(hdr, body) {
+		err = ml.decrypt(m)
+		if err != nil {
+			err = errors.New("Could not decrypt message, encrypt it to the key of " + ml.ListAddress() + ": " + err.Error())
+			return
+		}
+	} else if ml.Always_crypt {
+		err = errors.New(ml.ListAddress() + " only accepts PGP encrypted messages")
+		return
+	}
+
+	msg = m
+	return
+}
+
+/* The key of a message for deduplication, the Message-ID or a hash of it */
+func ml_msg_key(msg *ml_msg) string {
+	id := ml_hdr_get(msg.hdr, "Message-ID")
+	if id != "" {
+		return id
+	}
+
+	sum := sha256.Sum256(ml_joinmsg(msg.hdr, msg.body))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+/* Record a message as distributed, dup when it already was */
+func (ml *PfML) distributed_claim(key string) (dup bool, err error) {
+	q := "DELETE FROM ml_distributed " +
+		"WHERE entered < NOW() - INTERVAL '" + ML_DISTRIBUTED_WINDOW + "'"
+	err = DB.ExecNA(-1, q)
+	if err != nil {
+		return
+	}
+
+	/* The primary key makes this the check, also for concurrent deliveries */
+	q = "INSERT INTO ml_distributed (trustgroup, lhs, msgid) " +
+		"VALUES($1, $2, $3)"
+	err = DB.ExecNA(1, q, ml.GroupName, ml.ListName, key)
+	if err != nil && DB_IsPQErrorConstraint(err) {
+		dup = true
+		err = nil
+	}
+
+	return
+}
+
+/* Forget a message that could not be distributed, thus a retry is not a dup */
+func (ml *PfML) distributed_release(key string) {
+	q := "DELETE FROM ml_distributed " +
+		"WHERE trustgroup = $1 " +
+		"AND lhs = $2 " +
+		"AND msgid = $3"
+	DB.ExecNA(-1, q, ml.GroupName, ml.ListName, key)
+}
+
+/*
+ * Distribute a message to all the subscribers
+ *
+ * An error is only returned when nothing could be queued,
+ * in which case the message can be retried without
+ * subscribers receiving it twice. A message that was
+ * distributed before is accepted but not queued again.
+ */
+func (ml *PfML) Distribute(msg *ml_msg) (err error) {
+	sys := System_Get()
+
+	key := ml_msg_key(msg)
+
+	dup, err := ml.distributed_claim(key)
+	if err != nil {
+		return
+	}
+
+	if dup {
+		Logf("ML %s: message %s was already distributed, skipping", ml.ListAddress(), key)
+		return
+	}
+
+	/* Nothing queued, thus forget it */
+	defer func() {
+		if err != nil {
+			ml.distributed_release(key)
+		}
+	}()
+
+	hdr := msg.hdr
+	body := msg.body
+
+	/* Replace any list headers of a previous hop with ours */
+	for _, name := range []string{"Return-Path", "Delivered-To", "X-Original-To",
+		"List-Id", "List-Post", "Precedence"} {
+		hdr = ml_hdr_del(hdr, name)
+	}
+
+	hdr, body, err = ml_add_sig(hdr, body, sys.EmailSig)
+	if err != nil {
+		return
+	}
+
+	descr := strings.Replace(ml.Descr, "\"", "", -1)
+
+	hdr = append(hdr,
+		"List-Id: \""+descr+"\" <"+ml.ListId()+">",
+		"List-Post: <mailto:"+ml.ListAddress()+">",
+		"Precedence: list",
+		"X-Loop: "+ml.ListAddress())
+
+	rcpts, err := ml.Recipients()
+	if err != nil {
+		return
+	}
+
+	sent := 0
+	failed := 0
+	nokey := 0
+
+	for _, r := range rcpts {
+		var out []byte
+
+		if msg.crypted {
+			out, err = ml_encrypt(hdr, body, r.Keyring, r.Email)
+			if err != nil {
+				ml.nokey(r, err)
+				nokey++
+				continue
+			}
+		} else {
+			out = ml_joinmsg(hdr, body)
+		}
+
+		err = Mail_Queue(Mail_VERP(r.Email), []string{r.Email}, out)
+		if err != nil {
+			Errf("ML %s: queueing for %s (%s) failed: %s", ml.ListAddress(), r.UserName, r.Email, err.Error())
+			failed++
+			continue
+		}
+
+		sent++
+	}
+
+	if sent > 0 || failed == 0 {
+		err = nil
+	}
+
+	Logf("ML %s: queued for %d of %d subscribers (%d without key)", ml.ListAddress(), sent, len(rcpts), nokey)
+	return
+}
@@ -0,0 +1,287 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run ML_ -v
+ */
+
+import (
+	"bufio"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestML_AddSig_Plain(t *testing.T) {
+	hdr, body := ml_splitmsg([]byte("From: a@example.net\r\nSubject: test\r\n\r\nHello\r\n"))
+
+	hdr, out, err := ml_add_sig(hdr, body, "The Sig")
+	if err != nil {
+		t.Fatalf("Adding signature failed: %s", err.Error())
+	}
+
+	if string(out) != "Hello\n-- \nThe Sig\n" {
+		t.Errorf("Unexpected body %q", out)
+	}
+
+	if ml_hdr_get(hdr, "subject") != "test" {
+		t.Errorf("Headers changed: %v", hdr)
+	}
+}
+
+func TestML_AddSig_Base64(t *testing.T) {
+	msg := "Content-Type: text/plain; charset=utf-8\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"SGVsbG8=\n"
+
+	hdr, body := ml_splitmsg([]byte(msg))
+
+	_, out, err := ml_add_sig(hdr, body, "Sig")
+	if err != nil {
+		t.Fatalf("Adding signature failed: %s", err.Error())
+	}
+
+	/* "Hello\n-- \nSig\n" */
+	if strings.TrimSpace(string(out)) != "SGVsbG8KLS0gClNpZwo=" {
+		t.Errorf("Unexpected body %q", out)
+	}
+}
+
+func TestML_AddSig_Multipart(t *testing.T) {
+	msg := "From: a@example.net\n" +
+		"MIME-Version: 1.0\n" +
+		"Content-Type: multipart/signed; boundary=\"b1\";\n" +
+		" protocol=\"application/pgp-signature\"\n" +
+		"\n" +
+		"--b1\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"Signed text\n" +
+		"--b1\n" +
+		"Content-Type: application/pgp-signature\n" +
+		"\n" +
+		"SIG\n" +
+		"--b1--\n"
+
+	hdr, body := ml_splitmsg([]byte(msg))
+
+	hdr, out, err := ml_add_sig(hdr, body, "Sig")
+	if err != nil {
+		t.Fatalf("Adding signature failed: %s", err.Error())
+	}
+
+	mt, params, err := mime.ParseMediaType(ml_hdr_get(hdr, "Content-Type"))
+	if err != nil || mt != "multipart/mixed" {
+		t.Fatalf("Not wrapped: %v", hdr)
+	}
+
+	mr := multipart.NewReader(strings.NewReader(string(out)), params["boundary"])
+
+	p, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("First part: %s", err.Error())
+	}
+
+	if !strings.HasPrefix(p.Header.Get("Content-Type"), "multipart/signed") {
+		t.Errorf("Signed part lost its type: %v", p.Header)
+	}
+
+	inner, _ := ioutil.ReadAll(p)
+	if !strings.Contains(string(inner), "Signed text\n--b1\n") {
+		t.Errorf("Signed part modified: %q", inner)
+	}
+
+	p, err = mr.NextPart()
+	if err != nil {
+		t.Fatalf("Second part: %s", err.Error())
+	}
+
+	sig, _ := ioutil.ReadAll(p)
+	if string(sig) != "-- \nSig\n" {
+		t.Errorf("Unexpected signature part %q", sig)
+	}
+}
+
+/* A local SMTP stand-in that records the single transaction it receives */
+func ml_test_smtp(t *testing.T, l net.Listener, got chan []string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 stand-in ESMTP")
+
+	var rec []string
+
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			break
+		}
+
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			tc.PrintfLine("250 stand-in")
+
+		case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+			rec = append(rec, line)
+			tc.PrintfLine("250 Ok")
+
+		case cmd == "DATA":
+			tc.PrintfLine("354 Go ahead")
+			data, _ := ioutil.ReadAll(tc.DotReader())
+			rec = append(rec, string(data))
+			tc.PrintfLine("250 Queued")
+
+		case cmd == "QUIT":
+			tc.PrintfLine("221 Bye")
+			got <- rec
+			return
+
+		default:
+			tc.PrintfLine("502 Unknown")
+		}
+	}
+
+	got <- rec
+}
+
+func TestML_SMTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err.Error())
+	}
+	defer l.Close()
+
+	got := make(chan []string, 1)
+	go ml_test_smtp(t, l, got)
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	Config.SMTP_host = host
+	Config.SMTP_port = port
+	Config.SMTP_SSL = "ignore"
+	Config.Nodename = "test.example.net"
+
+	msg := "Subject: test\n\n.leading dot\nbody\n"
+
+	err = mail_smtp("bounce@example.net", []string{"user@example.org"}, []byte(msg))
+	if err != nil {
+		t.Fatalf("Sending failed: %s", err.Error())
+	}
+
+	rec := <-got
+	if len(rec) != 3 {
+		t.Fatalf("Expected MAIL, RCPT and DATA, got %q", rec)
+	}
+
+	if rec[0] != "MAIL FROM:<bounce@example.net>" {
+		t.Errorf("Unexpected envelope sender %q", rec[0])
+	}
+
+	if rec[1] != "RCPT TO:<user@example.org>" {
+		t.Errorf("Unexpected envelope recipient %q", rec[1])
+	}
+
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(rec[2])))
+	h, err := r.ReadMIMEHeader()
+	if err != nil || h.Get("Subject") != "test" {
+		t.Errorf("Message mangled: %q", rec[2])
+	}
+
+	if !strings.Contains(rec[2], "\n.leading dot\n") {
+		t.Errorf("Dot stuffing not undone: %q", rec[2])
+	}
+}
+
+func TestML_Addr(t *testing.T) {
+	addr, params, ok := mlsrv_addr("FROM:<user@example.net> SIZE=100", "FROM:")
+	if !ok || addr != "user@example.net" || params != "SIZE=100" {
+		t.Errorf("Parsing failed: %q %q %v", addr, params, ok)
+	}
+
+	addr, _, ok = mlsrv_addr("from: <>", "FROM:")
+	if !ok || addr != "" {
+		t.Errorf("Null sender not parsed: %q %v", addr, ok)
+	}
+
+	_, _, ok = mlsrv_addr("TO:user@example.net", "TO:")
+	if ok {
+		t.Errorf("Address without <> accepted")
+	}
+}
+
+/* Send a command and check the reply code */
+func ml_test_cmd(t *testing.T, tc *textproto.Conn, cmd string, code int) {
+	if cmd != "" {
+		tc.PrintfLine("%s", cmd)
+	}
+
+	_, msg, err := tc.ReadResponse(code)
+	if err != nil {
+		t.Fatalf("%q: expected %d, got %q %v", cmd, code, msg, err)
+	}
+}
+
+func TestML_MsgKey(t *testing.T) {
+	hdr, body := ml_splitmsg([]byte("From: a@example.net\r\nMessage-ID: <1@example.net>\r\n\r\nHello\r\n"))
+
+	if k := ml_msg_key(&ml_msg{hdr, body, false}); k != "<1@example.net>" {
+		t.Errorf("Unexpected key %q", k)
+	}
+
+	/* Without Message-ID the same message gives the same key */
+	hdr, body = ml_splitmsg([]byte("From: a@example.net\r\n\r\nHello\r\n"))
+	k1 := ml_msg_key(&ml_msg{hdr, body, false})
+	k2 := ml_msg_key(&ml_msg{hdr, body, false})
+
+	hdr, body = ml_splitmsg([]byte("From: a@example.net\r\n\r\nBye\r\n"))
+	k3 := ml_msg_key(&ml_msg{hdr, body, false})
+
+	if !strings.HasPrefix(k1, "sha256:") || k1 != k2 || k1 == k3 {
+		t.Errorf("Unexpected keys %q %q %q", k1, k2, k3)
+	}
+}
+
+func TestML_Server_TooBig(t *testing.T) {
+	system_cached.Name = "test"
+	system_cached.EmailDomain = "example.net"
+	defer func() {
+		system_cached = PfSys{}
+	}()
+
+	maxsize := Config.ML_maxsize
+	Config.ML_maxsize = 100
+	defer func() {
+		Config.ML_maxsize = maxsize
+	}()
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+
+	go mlsrv_session(srv, false)
+
+	tc := textproto.NewConn(cli)
+
+	ml_test_cmd(t, tc, "", 220)
+	ml_test_cmd(t, tc, "HELO client.example.org", 250)
+	ml_test_cmd(t, tc, "MAIL FROM:<user@example.org>", 250)
+	ml_test_cmd(t, tc, "RCPT TO:<"+MAIL_BOUNCE_LHS+"@example.net>", 250)
+	ml_test_cmd(t, tc, "DATA", 354)
+
+	w := tc.DotWriter()
+	w.Write([]byte("Subject: big\n\n" + strings.Repeat("0123456789\n", 100)))
+	w.Close()
+
+	ml_test_cmd(t, tc, "", 552)
+
+	/* The session is still usable */
+	ml_test_cmd(t, tc, "NOOP", 250)
+	ml_test_cmd(t, tc, "QUIT", 221)
+}
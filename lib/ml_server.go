@@ -0,0 +1,370 @@
+package pitchfork
+
+/*
+ * Mailing List server
+ *
+ * A minimal SMTP (RFC5321) or LMTP (RFC2033) receiver that the
+ * local MTA hands list traffic and bounces to; see ml_deliver.go
+ * and mail_bounce.go for what happens with the messages.
+ *
+ * There is no STARTTLS or AUTH support, thus only configure
+ * ml_listen on a loopback address.
+ */
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Limit the number of lists a single message can be addressed to */
+const MLSRV_MAXRCPTS = 100
+
+/* Idle time after which a client is disconnected */
+const MLSRV_TIMEOUT = 5 * time.Minute
+
+var mlsrv_listener net.Listener
+var mlsrv_exit chan bool
+var mlsrv_done chan bool
+var mlsrv_running bool
+
+/* Either a list or a bounce address */
+type mlsrv_rcpt struct {
+	ml     *PfML
+	bounce bool
+	verp   string
+}
+
+type mlsrv_sess struct {
+	conn    net.Conn
+	tc      *textproto.Conn
+	lmtp    bool
+	helo    string
+	gotmail bool
+	from    string
+	rcpts   []mlsrv_rcpt
+}
+
+func (s *mlsrv_sess) reply(code int, msg string) {
+	s.tc.PrintfLine("%d %s", code, msg)
+}
+
+func (s *mlsrv_sess) reset() {
+	s.gotmail = false
+	s.from = ""
+	s.rcpts = nil
+}
+
+/* Extract the address out of "FROM:<addr> PARAMS" */
+func mlsrv_addr(arg string, prefix string) (addr string, params string, ok bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", "", false
+	}
+
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", "", false
+	}
+
+	e := strings.Index(arg, ">")
+	if e == -1 {
+		return "", "", false
+	}
+
+	return arg[1:e], strings.TrimSpace(arg[e+1:]), true
+}
+
+func (s *mlsrv_sess) cmd_helo(verb string, arg string) {
+	if s.lmtp && verb != "LHLO" {
+		s.reply(500, "5.5.1 Use LHLO")
+		return
+	}
+
+	if !s.lmtp && verb == "LHLO" {
+		s.reply(500, "5.5.1 Use HELO or EHLO")
+		return
+	}
+
+	if arg == "" {
+		s.reply(501, "5.5.4 Missing hostname")
+		return
+	}
+
+	s.helo = arg
+	s.reset()
+
+	if verb == "HELO" {
+		s.reply(250, Config.Nodename)
+		return
+	}
+
+	s.tc.PrintfLine("250-%s", Config.Nodename)
+	s.tc.PrintfLine("250-8BITMIME")
+	s.tc.PrintfLine("250-ENHANCEDSTATUSCODES")
+	s.tc.PrintfLine("250 SIZE %d", Config.ML_maxsize)
+}
+
+func (s *mlsrv_sess) cmd_mail(arg string) {
+	if s.helo == "" {
+		s.reply(503, "5.5.1 Say hello first")
+		return
+	}
+
+	if s.gotmail {
+		s.reply(503, "5.5.1 Sender already given")
+		return
+	}
+
+	addr, params, ok := mlsrv_addr(arg, "FROM:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+
+	for _, p := range strings.Fields(params) {
+		if strings.HasPrefix(strings.ToUpper(p), "SIZE=") {
+			size, _ := strconv.Atoi(p[5:])
+			if size > Config.ML_maxsize {
+				s.reply(552, "5.3.4 Message too big")
+				return
+			}
+		}
+	}
+
+	s.gotmail = true
+	s.from = addr
+	s.reply(250, "2.1.0 Ok")
+}
+
+func (s *mlsrv_sess) cmd_rcpt(arg string) {
+	if !s.gotmail {
+		s.reply(503, "5.5.1 Need MAIL first")
+		return
+	}
+
+	addr, _, ok := mlsrv_addr(arg, "TO:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+
+	if len(s.rcpts) >= MLSRV_MAXRCPTS {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+
+	verp, isbounce := Mail_UnVERP(addr)
+	if isbounce {
+		s.rcpts = append(s.rcpts, mlsrv_rcpt{nil, true, verp})
+		s.reply(250, "2.1.5 Ok")
+		return
+	}
+
+	ml, err := ML_FromAddress(addr)
+	if err != nil {
+		s.reply(550, "5.1.1 No such list <"+addr+">")
+		return
+	}
+
+	/* Bounces are not accepted for lists */
+	if s.from == "" {
+		s.reply(550, "5.7.1 Null sender not accepted for lists")
+		return
+	}
+
+	s.rcpts = append(s.rcpts, mlsrv_rcpt{ml, false, ""})
+	s.reply(250, "2.1.5 Ok")
+}
+
+/* Returns the reply for a single recipient */
+func (s *mlsrv_sess) deliver(rcpt mlsrv_rcpt, data []byte) (code int, msg string) {
+	if rcpt.bounce {
+		err := Mail_Bounce(rcpt.verp, data)
+		if err != nil {
+			Errf("Bounce processing failed: %s", err.Error())
+			return 451, "4.3.0 Temporary failure, try again later"
+		}
+
+		return 250, "2.0.0 Ok"
+	}
+
+	ml := rcpt.ml
+
+	m, err := ml.Accept(data)
+	if err != nil {
+		Logf("ML %s: rejected message from %s: %s", ml.ListAddress(), s.from, err.Error())
+		return 550, "5.7.1 " + err.Error()
+	}
+
+	err = ml.Distribute(m)
+	if err != nil {
+		Errf("ML %s: distribution failed: %s", ml.ListAddress(), err.Error())
+		return 451, "4.3.0 Temporary failure, try again later"
+	}
+
+	return 250, "2.0.0 Ok"
+}
+
+func (s *mlsrv_sess) cmd_data() {
+	if len(s.rcpts) == 0 {
+		s.reply(503, "5.5.1 Need RCPT first")
+		return
+	}
+
+	s.reply(354, "End data with <CR><LF>.<CR><LF>")
+
+	/* Read one byte more than allowed to detect oversized messages */
+	dr := s.tc.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(dr, int64(Config.ML_maxsize)+1))
+	if err != nil {
+		s.reply(451, "4.3.0 Reading message failed")
+		s.reset()
+		return
+	}
+
+	if len(data) > Config.ML_maxsize {
+		/* Swallow the rest of the message, up to the final dot */
+		io.Copy(ioutil.Discard, dr)
+		s.reply(552, "5.3.4 Message too big")
+		s.reset()
+		return
+	}
+
+	if s.lmtp {
+		/* LMTP: a reply per recipient */
+		for _, rcpt := range s.rcpts {
+			s.reply(s.deliver(rcpt, data))
+		}
+	} else {
+		/* SMTP: the first failure, if any, is the reply */
+		code, msg := 250, "2.0.0 Ok"
+
+		for _, rcpt := range s.rcpts {
+			c, m := s.deliver(rcpt, data)
+			if c != 250 && code == 250 {
+				code, msg = c, m
+			}
+		}
+
+		s.reply(code, msg)
+	}
+
+	s.reset()
+}
+
+func mlsrv_session(conn net.Conn, lmtp bool) {
+	s := &mlsrv_sess{conn: conn, tc: textproto.NewConn(conn), lmtp: lmtp}
+	defer s.tc.Close()
+
+	proto := "ESMTP"
+	if lmtp {
+		proto = "LMTP"
+	}
+
+	s.reply(220, Config.Nodename+" "+AppName+" "+proto+" ready")
+
+	for {
+		conn.SetDeadline(time.Now().Add(MLSRV_TIMEOUT))
+
+		line, err := s.tc.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb := strings.ToUpper(line)
+		arg := ""
+
+		sp := strings.Index(line, " ")
+		if sp != -1 {
+			verb = strings.ToUpper(line[:sp])
+			arg = strings.TrimSpace(line[sp+1:])
+		}
+
+		switch verb {
+		case "HELO", "EHLO", "LHLO":
+			s.cmd_helo(verb, arg)
+
+		case "MAIL":
+			s.cmd_mail(arg)
+
+		case "RCPT":
+			s.cmd_rcpt(arg)
+
+		case "DATA":
+			s.cmd_data()
+
+		case "RSET":
+			s.reset()
+			s.reply(250, "2.0.0 Ok")
+
+		case "NOOP":
+			s.reply(250, "2.0.0 Ok")
+
+		case "VRFY":
+			s.reply(252, "2.5.0 Cannot VRFY")
+
+		case "QUIT":
+			s.reply(221, "2.0.0 Bye")
+			return
+
+		default:
+			s.reply(502, "5.5.2 Command not implemented")
+		}
+	}
+}
+
+func mlsrv_rtn(lmtp bool) {
+	for {
+		conn, err := mlsrv_listener.Accept()
+		if err != nil {
+			select {
+			case <-mlsrv_exit:
+				/* Listener closed by MLServer_stop() */
+				mlsrv_done <- true
+				return
+
+			default:
+				Errf("ML server: accept failed: %s", err.Error())
+				time.Sleep(time.Second)
+				continue
+			}
+		}
+
+		go mlsrv_session(conn, lmtp)
+	}
+}
+
+func MLServer_start(addr string, lmtp bool) (err error) {
+	mlsrv_listener, err = net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	mlsrv_exit = make(chan bool)
+	mlsrv_done = make(chan bool)
+	mlsrv_running = true
+
+	Logf("ML server listening on %s", addr)
+
+	go mlsrv_rtn(lmtp)
+	return
+}
+
+func MLServer_stop() {
+	if !mlsrv_running {
+		return
+	}
+
+	mlsrv_running = false
+
+	/* Signal the exit, then unblock Accept() */
+	close(mlsrv_exit)
+	mlsrv_listener.Close()
+
+	/* Wait for it to finish */
+	<-mlsrv_done
+}
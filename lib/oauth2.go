@@ -7,20 +7,28 @@ import (
 )
 
 type OAuth_Auth struct {
-	ClientID string `label:"Client ID" pfset:"nobody" pfget:"none"`
-	Scope    string `label:"Scope" pfset:"nobody" pfget:"none"`
-	RType    string `label:"Request Type" pfset:"nobody" pfget:"none"`
-	Redirect string `label:"Redirect URL" pfset:"nobody" pfget:"none"`
-	Auth     string `label:"Authorize" pftype:"submit"`
-	Deny     string `label:"Deny" pftype:"submit" htmlclass:"deny"`
+	Client        string `label:"Application" pfset:"nobody" pfget:"none"`
+	ClientID      string `label:"Client ID" pfset:"nobody" pfget:"none"`
+	Scope         string `label:"Scope" pfset:"nobody" pfget:"none"`
+	RType         string `label:"Request Type" pfset:"nobody" pfget:"none"`
+	Redirect      string `label:"Redirect URL" pfset:"nobody" pfget:"none"`
+	Nonce         string `label:"Nonce" pfset:"nobody" pfget:"none"`
+	CodeChallenge string /* PKCE, not shown */
+	CodeMethod    string
+	Auth          string `label:"Authorize" pftype:"submit"`
+	Deny          string `label:"Deny" pftype:"submit" htmlclass:"deny"`
 }
 
 type OAuth2Claims struct {
 	JWTClaims
-	ClientID string `json:"oa_client_id"`
-	Scope    string `json:"oa_scope"`
-	RType    string `json:"oa_rtype,omitempty"`
-	Redirect string `json:"oa_redirect,omitempty"`
+	ClientID      string `json:"oa_client_id"`
+	Scope         string `json:"oa_scope"`
+	RType         string `json:"oa_rtype,omitempty"`
+	Redirect      string `json:"oa_redirect,omitempty"`
+	Nonce         string `json:"oa_nonce,omitempty"`
+	CodeChallenge string `json:"oa_cc,omitempty"`
+	CodeMethod    string `json:"oa_ccm,omitempty"`
+	Family        string `json:"oa_family,omitempty"`
 }
 
 func OAuth2_AuthToken_New(ctx PfCtx, o OAuth_Auth) (tok string, err error) {
@@ -36,6 +44,9 @@ func OAuth2_AuthToken_New(ctx PfCtx, o OAuth_Auth) (tok string, err error) {
 	claims.Scope = o.Scope
 	claims.RType = o.RType
 	claims.Redirect = o.Redirect
+	claims.Nonce = o.Nonce
+	claims.CodeChallenge = o.CodeChallenge
+	claims.CodeMethod = o.CodeMethod
 
 	username := ctx.TheUser().GetUserName()
 
@@ -45,6 +56,7 @@ func OAuth2_AuthToken_New(ctx PfCtx, o OAuth_Auth) (tok string, err error) {
 }
 
 func OAuth2_AuthToken_Check(tok string) (claims *OAuth2Claims, err error) {
+	claims = &OAuth2Claims{}
 	_, err = Token_Parse(tok, "oauth_auth", claims)
 	return
 }
@@ -56,15 +68,44 @@ func OAuth2_AccessToken_New(ctx PfCtx, client_id string, scope string) (tok stri
 		return
 	}
 
+	username := ctx.TheUser().GetUserName()
+
+	tok, err = OAuth2_AccessToken_NewUser(username, client_id, scope, "")
+	return
+}
+
+/*
+ * Access Token for a user that authorized the client earlier
+ *
+ * Used by the token endpoint, where the client, not the user, is talking to us.
+ * family is the refresh token family, revoking it revokes this token too.
+ */
+func OAuth2_AccessToken_NewUser(username string, client_id string, scope string, family string) (tok string, err error) {
 	claims := &OAuth2Claims{}
 	claims.ClientID = client_id
 	claims.Scope = scope
+	claims.Family = family
 
-	username := ctx.TheUser().GetUserName()
-
-	/* Access Tokens - 24 hour validity */
 	token := Token_New("oauth_access", username, TOKEN_EXPIRATIONMINUTES, claims)
 
 	tok, err = token.Sign()
 	return
 }
+
+func OAuth2_AccessToken_Check(tok string) (claims *OAuth2Claims, err error) {
+	claims = &OAuth2Claims{}
+	_, err = Token_Parse(tok, "oauth_access", claims)
+	if err != nil {
+		return
+	}
+
+	/* The refresh token family it was issued from might be revoked */
+	if claims.Family != "" && Jwt_isinvalidated(oauth2_family_key(claims.Family), claims) {
+		err = errors.New("Token has been revoked")
+		return
+	}
+
+	/* The user might have revoked the client */
+	err = OAuth2_ConsentUse(claims.Subject, claims.ClientID)
+	return
+}
@@ -0,0 +1,572 @@
+package pitchfork
+
+/*
+ * OAuth2 Client Registry and Consent
+ *
+ * Only clients registered by a sysadmin can request authorization.
+ * Redirect URIs must match one of the registered ones exactly,
+ * requested scopes must be a subset of the allowed scopes.
+ *
+ * Confidential clients authenticate to the token endpoint with
+ * their secret, public clients (native apps, single page apps)
+ * cannot keep a secret and thus do not have one.
+ *
+ * The consent of a user is recorded per client, revoking it
+ * invalidates the access tokens the client holds.
+ */
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type PfOAuth2Client struct {
+	ClientID     string
+	Descr        string
+	Secret       string /* Hashed */
+	Confidential bool
+	RedirectURIs []string
+	Scopes       string
+	Entered      time.Time
+}
+
+type PfOAuth2Consent struct {
+	ClientID string
+	Descr    string
+	Scope    string
+	Entered  time.Time
+	LastUsed time.Time
+}
+
+func (c *PfOAuth2Client) ToString() (out string) {
+	t := "public"
+	if c.Confidential {
+		t = "confidential"
+	}
+
+	out = c.ClientID + " (" + t + ") " + c.Descr + "\n"
+	out += "\tScopes: " + c.Scopes + "\n"
+	out += "\tRedirect URIs: " + strings.Join(c.RedirectURIs, " ")
+	return
+}
+
+func oauth2_client_scan(scan func(dest ...interface{}) error) (c PfOAuth2Client, err error) {
+	var uris string
+
+	err = scan(&c.ClientID, &c.Descr, &c.Secret, &c.Confidential, &uris, &c.Scopes, &c.Entered)
+	c.RedirectURIs = strings.Fields(uris)
+	return
+}
+
+const oauth2_client_cols = "client_id, descr, secret, confidential, redirect_uris, scopes, entered "
+
+func OAuth2_ClientGet(client_id string) (c PfOAuth2Client, err error) {
+	q := "SELECT " + oauth2_client_cols +
+		"FROM oauth2_client " +
+		"WHERE client_id = $1"
+	c, err = oauth2_client_scan(DB.QueryRow(q, client_id).Scan)
+	if err == ErrNoRows {
+		err = errors.New("Unknown client_id")
+	}
+
+	return
+}
+
+func OAuth2_ClientList() (clients []PfOAuth2Client, err error) {
+	q := "SELECT " + oauth2_client_cols +
+		"FROM oauth2_client " +
+		"ORDER BY client_id"
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var c PfOAuth2Client
+
+		c, err = oauth2_client_scan(rows.Scan)
+		if err != nil {
+			return
+		}
+
+		clients = append(clients, c)
+	}
+
+	return
+}
+
+/* Exact match, no prefixes or wildcards, RFC6819 5.2.3.5 */
+func (c *PfOAuth2Client) CheckRedirect(redirect string) (err error) {
+	for _, u := range c.RedirectURIs {
+		if u == redirect {
+			return nil
+		}
+	}
+
+	err = errors.New("redirect_uri is not registered for this client")
+	return
+}
+
+func (c *PfOAuth2Client) CheckScope(scope string) (err error) {
+	for _, s := range strings.Fields(scope) {
+		var sc PfScope
+
+		sc, _, err = Scope_Find(s)
+		if err != nil {
+			return
+		}
+
+		/* Allowing a scope allows it for any single group */
+		if !OAuth2_HasScope(c.Scopes, s) && !OAuth2_HasScope(c.Scopes, sc.Scope) {
+			err = errors.New("Scope " + s + " is not allowed for this client")
+			return
+		}
+	}
+
+	return
+}
+
+/* Public clients do not have a secret, they should not pretend to */
+func (c *PfOAuth2Client) CheckSecret(secret string) (err error) {
+	if !c.Confidential {
+		if secret != "" {
+			err = errors.New("Public clients do not have a secret")
+		}
+		return
+	}
+
+	if secret == "" || c.Secret == "" {
+		err = errors.New("Client authentication required")
+		return
+	}
+
+	var pw PfPass
+	err = pw.Verify(secret, c.Secret)
+	if err != nil {
+		err = errors.New("Client authentication failed")
+	}
+
+	return
+}
+
+/* Does the user already allow the client the requested scopes? */
+func OAuth2_HasConsent(username string, client_id string, scope string) bool {
+	var granted string
+
+	q := "SELECT scope " +
+		"FROM oauth2_consent " +
+		"WHERE member = $1 " +
+		"AND client_id = $2"
+	err := DB.QueryRow(q, username, client_id).Scan(&granted)
+	if err != nil {
+		return false
+	}
+
+	for _, s := range strings.Fields(scope) {
+		if !OAuth2_HasScope(granted, s) {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Record the consent, extending the scopes granted earlier */
+func OAuth2_ConsentAdd(ctx PfCtx, username string, client_id string, scope string) (err error) {
+	var granted string
+
+	q := "SELECT scope " +
+		"FROM oauth2_consent " +
+		"WHERE member = $1 " +
+		"AND client_id = $2"
+	err = DB.QueryRow(q, username, client_id).Scan(&granted)
+	if err == ErrNoRows {
+		q = "INSERT INTO oauth2_consent " +
+			"(member, client_id, scope) " +
+			"VALUES($1, $2, $3)"
+		err = DB.Exec(ctx,
+			"Authorized OAuth2 client $2 for $3",
+			1, q, username, client_id, scope)
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	for _, s := range strings.Fields(scope) {
+		if !OAuth2_HasScope(granted, s) {
+			granted += " " + s
+		}
+	}
+
+	q = "UPDATE oauth2_consent " +
+		"SET scope = $3 " +
+		"WHERE member = $1 " +
+		"AND client_id = $2"
+	err = DB.Exec(ctx,
+		"Authorized OAuth2 client $2 for $3",
+		1, q, username, client_id, strings.TrimSpace(granted))
+	return
+}
+
+/* Tokens are only accepted while the consent stands */
+func OAuth2_ConsentUse(username string, client_id string) (err error) {
+	q := "UPDATE oauth2_consent " +
+		"SET last_used = NOW() " +
+		"WHERE member = $1 " +
+		"AND client_id = $2"
+	err = DB.ExecNA(1, q, username, client_id)
+	if err != nil {
+		err = errors.New("Authorization for client " + client_id + " has been revoked")
+	}
+
+	return
+}
+
+func OAuth2_ConsentList(username string) (consents []PfOAuth2Consent, err error) {
+	q := "SELECT co.client_id, cl.descr, co.scope, co.entered, " +
+		"COALESCE(co.last_used, co.entered) " +
+		"FROM oauth2_consent co " +
+		"INNER JOIN oauth2_client cl ON co.client_id = cl.client_id " +
+		"WHERE co.member = $1 " +
+		"ORDER BY co.client_id"
+	rows, err := DB.Query(q, username)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var co PfOAuth2Consent
+
+		err = rows.Scan(&co.ClientID, &co.Descr, &co.Scope, &co.Entered, &co.LastUsed)
+		if err != nil {
+			return
+		}
+
+		consents = append(consents, co)
+	}
+
+	return
+}
+
+func OAuth2_ConsentRevoke(ctx PfCtx, username string, client_id string) (err error) {
+	q := "DELETE FROM oauth2_consent " +
+		"WHERE member = $1 " +
+		"AND client_id = $2"
+	err = DB.Exec(ctx,
+		"Revoked OAuth2 client $2",
+		1, q, username, client_id)
+	if err == ErrNoRows {
+		err = errors.New("Client " + client_id + " was not authorized")
+	}
+
+	return
+}
+
+/* Revoke all OAuth2 clients of the user, with their refresh tokens */
+func OAuth2_ConsentRevokeAll(ctx PfCtx, username string) (err error) {
+	/* Also removed by the cascade, but explicitly, as these grant access */
+	q := "DELETE FROM oauth2_refresh " +
+		"WHERE member = $1"
+	err = DB.Exec(ctx,
+		"Revoked all OAuth2 refresh tokens of $1",
+		-1, q, username)
+	if err != nil {
+		return
+	}
+
+	q = "DELETE FROM oauth2_consent " +
+		"WHERE member = $1"
+	err = DB.Exec(ctx,
+		"Revoked all OAuth2 clients of $1",
+		-1, q, username)
+	return
+}
+
+/* A new secret, only shown once */
+func oauth2_client_secret(ctx PfCtx, client_id string) (secret string, err error) {
+	var pw PfPass
+
+	secret, err = pw.GenRandHex(32)
+	if err != nil {
+		return
+	}
+
+	hash, err := pw.Make(secret)
+	if err != nil {
+		return
+	}
+
+	q := "UPDATE oauth2_client " +
+		"SET secret = $2 " +
+		"WHERE client_id = $1 " +
+		"AND confidential"
+	err = DB.Exec(ctx,
+		"Changed secret of OAuth2 client $1",
+		1, q, client_id, hash)
+	if err == ErrNoRows {
+		err = errors.New("Unknown or public client " + client_id)
+	}
+
+	return
+}
+
+func system_oauth2_list(ctx PfCtx, args []string) (err error) {
+	clients, err := OAuth2_ClientList()
+	if err != nil {
+		return
+	}
+
+	if len(clients) == 0 {
+		ctx.OutLn("No OAuth2 clients registered")
+		return
+	}
+
+	for _, c := range clients {
+		ctx.OutLn("%s", c.ToString())
+	}
+
+	return
+}
+
+func system_oauth2_add(ctx PfCtx, args []string) (err error) {
+	client_id := args[0]
+	descr := args[1]
+	confidential := IsTrue(args[2])
+
+	client_id, err = Chk_ident("Client ID", client_id)
+	if err != nil {
+		return
+	}
+
+	q := "INSERT INTO oauth2_client " +
+		"(client_id, descr, confidential) " +
+		"VALUES($1, $2, $3)"
+	err = DB.Exec(ctx,
+		"Added OAuth2 client $1",
+		1, q, client_id, descr, confidential)
+	if err != nil {
+		if DB_IsPQErrorConstraint(err) {
+			err = errors.New("Client " + client_id + " already exists")
+		}
+		return
+	}
+
+	ctx.OutLn("Client %s added", client_id)
+
+	if confidential {
+		var secret string
+
+		secret, err = oauth2_client_secret(ctx, client_id)
+		if err != nil {
+			return
+		}
+
+		ctx.OutLn("Secret: %s", secret)
+	}
+
+	return
+}
+
+func system_oauth2_secret(ctx PfCtx, args []string) (err error) {
+	secret, err := oauth2_client_secret(ctx, args[0])
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Secret: %s", secret)
+	return
+}
+
+func system_oauth2_remove(ctx PfCtx, args []string) (err error) {
+	client_id := args[0]
+
+	q := "DELETE FROM oauth2_client " +
+		"WHERE client_id = $1"
+	err = DB.Exec(ctx,
+		"Removed OAuth2 client $1",
+		1, q, client_id)
+	if err == ErrNoRows {
+		err = errors.New("Unknown client " + client_id)
+	}
+
+	return
+}
+
+func system_oauth2_redirect_set(ctx PfCtx, c PfOAuth2Client) (err error) {
+	q := "UPDATE oauth2_client " +
+		"SET redirect_uris = $2 " +
+		"WHERE client_id = $1"
+	err = DB.Exec(ctx,
+		"Set redirect URIs of OAuth2 client $1 to $2",
+		1, q, c.ClientID, strings.Join(c.RedirectURIs, " "))
+	return
+}
+
+/* No fragments (RFC6749 3.1.2), and over HTTPS unless it is local (RFC8252 7.3) */
+func oauth2_redirect_check(redir string) (err error) {
+	if redir == "" || strings.ContainsAny(redir, " #") {
+		err = errors.New("Invalid redirect URI")
+		return
+	}
+
+	u, err := url.Parse(redir)
+	if err != nil || u.Host == "" {
+		err = errors.New("Invalid redirect URI")
+		return
+	}
+
+	if u.Scheme == "https" {
+		return
+	}
+
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	if u.Scheme == "http" && (host == "localhost" || (ip != nil && ip.IsLoopback())) {
+		return
+	}
+
+	err = errors.New("Redirect URI must use https, or http on a loopback address")
+	return
+}
+
+func system_oauth2_redirect_add(ctx PfCtx, args []string) (err error) {
+	c, err := OAuth2_ClientGet(args[0])
+	if err != nil {
+		return
+	}
+
+	redir := strings.TrimSpace(args[1])
+
+	err = oauth2_redirect_check(redir)
+	if err != nil {
+		return
+	}
+
+	if c.CheckRedirect(redir) == nil {
+		err = errors.New("Redirect URI already registered")
+		return
+	}
+
+	c.RedirectURIs = append(c.RedirectURIs, redir)
+	err = system_oauth2_redirect_set(ctx, c)
+	return
+}
+
+func system_oauth2_redirect_remove(ctx PfCtx, args []string) (err error) {
+	c, err := OAuth2_ClientGet(args[0])
+	if err != nil {
+		return
+	}
+
+	err = c.CheckRedirect(args[1])
+	if err != nil {
+		return
+	}
+
+	var uris []string
+	for _, u := range c.RedirectURIs {
+		if u != args[1] {
+			uris = append(uris, u)
+		}
+	}
+
+	c.RedirectURIs = uris
+	err = system_oauth2_redirect_set(ctx, c)
+	return
+}
+
+func system_oauth2_scopes(ctx PfCtx, args []string) (err error) {
+	scopes := strings.Join(strings.Fields(args[1]), " ")
+
+	err = Scope_Valid(scopes)
+	if err != nil {
+		return
+	}
+
+	q := "UPDATE oauth2_client " +
+		"SET scopes = $2 " +
+		"WHERE client_id = $1"
+	err = DB.Exec(ctx,
+		"Set scopes of OAuth2 client $1 to $2",
+		1, q, args[0], scopes)
+	if err == ErrNoRows {
+		err = errors.New("Unknown client " + args[0])
+	}
+
+	return
+}
+
+func system_oauth2_menu(ctx PfCtx, args []string) (err error) {
+	menu := NewPfMenu([]PfMEntry{
+		{"list", system_oauth2_list, 0, 0, nil, PERM_SYS_ADMIN, "List the registered OAuth2 clients"},
+		{"add", system_oauth2_add, 3, 3, []string{"client_id", "descr", "confidential#bool"}, PERM_SYS_ADMIN, "Register an OAuth2 client"},
+		{"remove", system_oauth2_remove, 1, 1, []string{"client_id"}, PERM_SYS_ADMIN, "Remove an OAuth2 client, revoking all its authorizations"},
+		{"secret", system_oauth2_secret, 1, 1, []string{"client_id"}, PERM_SYS_ADMIN, "Generate a new secret for a confidential client"},
+		{"redirect_add", system_oauth2_redirect_add, 2, 2, []string{"client_id", "redirect_uri"}, PERM_SYS_ADMIN, "Allow a redirect URI"},
+		{"redirect_remove", system_oauth2_redirect_remove, 2, 2, []string{"client_id", "redirect_uri"}, PERM_SYS_ADMIN, "Remove an allowed redirect URI"},
+		{"scopes", system_oauth2_scopes, 2, 2, []string{"client_id", "scopes"}, PERM_SYS_ADMIN, "Set the scopes a client may request (space separated)"},
+	})
+
+	err = ctx.Menu(args, menu)
+	return
+}
+
+func user_oauth2_list(ctx PfCtx, args []string) (err error) {
+	consents, err := OAuth2_ConsentList(ctx.SelectedUser().GetUserName())
+	if err != nil {
+		return
+	}
+
+	if len(consents) == 0 {
+		ctx.OutLn("No OAuth2 clients authorized")
+		return
+	}
+
+	for _, co := range consents {
+		ctx.OutLn("%s %s (%s) authorized %s, last used %s", co.ClientID, co.Descr, co.Scope, Fmt_Time(co.Entered), Fmt_Time(co.LastUsed))
+	}
+
+	return
+}
+
+func user_oauth2_revoke(ctx PfCtx, args []string) (err error) {
+	err = OAuth2_ConsentRevoke(ctx, ctx.SelectedUser().GetUserName(), args[1])
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Client %s revoked", args[1])
+	return
+}
+
+func user_oauth2_menu(ctx PfCtx, args []string) (err error) {
+	perms := PERM_USER_SELF
+
+	menu := NewPfMenu([]PfMEntry{
+		{"list", user_oauth2_list, 1, 1, []string{"username"}, perms, "List the OAuth2 clients authorized by the user"},
+		{"revoke", user_oauth2_revoke, 2, 2, []string{"username", "client_id"}, perms, "Revoke the authorization of an OAuth2 client"},
+	})
+
+	if len(args) >= 2 {
+		/* Check if we have perms for this user */
+		err = ctx.SelectUser(args[1], perms)
+		if err != nil {
+			return
+		}
+	} else {
+		/* Nothing selected */
+		ctx.SelectUser("", PERM_NONE)
+	}
+
+	err = ctx.Menu(args, menu)
+	return
+}
@@ -0,0 +1,97 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run OAuth2_Client -v
+ */
+
+import (
+	"testing"
+)
+
+func TestOAuth2_ClientChecks(t *testing.T) {
+	var pw PfPass
+
+	hash, err := pw.Make("s3cret")
+	if err != nil {
+		t.Fatalf("Hashing failed: %s", err.Error())
+	}
+
+	c := PfOAuth2Client{
+		ClientID:     "wiki",
+		Secret:       hash,
+		Confidential: true,
+		RedirectURIs: []string{"https://wiki.example.net/oidc/callback"},
+		Scopes:       "openid profile",
+	}
+
+	if c.CheckRedirect("https://wiki.example.net/oidc/callback") != nil {
+		t.Errorf("Registered redirect rejected")
+	}
+
+	/* No prefix or lookalike matches */
+	for _, r := range []string{
+		"https://wiki.example.net/oidc/callback/../../evil",
+		"https://wiki.example.net/oidc/callback?x=1",
+		"https://wiki.example.net.evil.example/oidc/callback",
+	} {
+		if c.CheckRedirect(r) == nil {
+			t.Errorf("Unregistered redirect %q accepted", r)
+		}
+	}
+
+	if c.CheckScope("profile openid") != nil {
+		t.Errorf("Allowed scopes rejected")
+	}
+
+	if c.CheckScope("openid email") == nil {
+		t.Errorf("Disallowed scope accepted")
+	}
+
+	if c.CheckSecret("s3cret") != nil {
+		t.Errorf("Correct secret rejected")
+	}
+
+	if c.CheckSecret("") == nil || c.CheckSecret("wrong") == nil {
+		t.Errorf("Missing or wrong secret accepted")
+	}
+
+	/* Public clients have no secret */
+	c.Confidential = false
+	c.Secret = ""
+
+	if c.CheckSecret("") != nil {
+		t.Errorf("Public client rejected")
+	}
+
+	if c.CheckSecret("s3cret") == nil {
+		t.Errorf("Public client with secret accepted")
+	}
+}
+
+func TestOAuth2_ClientRedirectCheck(t *testing.T) {
+	for _, r := range []string{
+		"https://wiki.example.net/oidc/callback",
+		"http://localhost:8080/callback",
+		"http://127.0.0.1/callback",
+		"http://[::1]:9000/callback",
+	} {
+		if oauth2_redirect_check(r) != nil {
+			t.Errorf("Valid redirect %q rejected", r)
+		}
+	}
+
+	for _, r := range []string{
+		"",
+		"https://wiki.example.net/oidc/callback#frag",
+		"http://wiki.example.net/oidc/callback",
+		"http://localhost.example.net/callback",
+		"http://10.0.0.1/callback",
+		"ftp://localhost/callback",
+		"javascript:alert(1)",
+		"/relative/callback",
+	} {
+		if oauth2_redirect_check(r) == nil {
+			t.Errorf("Invalid redirect %q accepted", r)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package pitchfork
+
+/*
+ * OAuth2 Device Authorization Grant (RFC8628)
+ *
+ * For devices that can't show a login page, eg tcli on a headless server:
+ * - the device requests a device_code and a short user_code
+ * - the user enters the user_code at /oauth2/device in their browser
+ *   where they are logged in (with any 2FA, including WebAuthn)
+ * - meanwhile the device polls the token endpoint till approved
+ *
+ * The session scope results in a normal session token,
+ * which is how 'tcli login --device' logs in.
+ */
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const OAUTH2_GRANT_DEVICE = "urn:ietf:params:oauth:grant-type:device_code"
+
+/* How long the user has to enter the code */
+const OAUTH2_DEVICE_MINUTES = 10
+
+/* Minimum seconds between polls */
+const OAUTH2_DEVICE_INTERVAL = 5
+
+/* RFC8628 6.1: no vowels, thus no words, and no ambiguous characters */
+const oauth2_device_chars = "BCDFGHJKLMNPQRSTVWXZ"
+
+/* RFC8628 3.5 Error codes returned while polling */
+var (
+	ErrOAuth2DevicePending  = errors.New("authorization_pending")
+	ErrOAuth2DeviceSlowDown = errors.New("slow_down")
+	ErrOAuth2DeviceDenied   = errors.New("access_denied")
+	ErrOAuth2DeviceExpired  = errors.New("expired_token")
+)
+
+type PfOAuth2Device struct {
+	UserCode string
+	ClientID string
+	Descr    string
+	Scope    string
+	Expires  time.Time
+}
+
+/* A user code formatted as XXXX-XXXX */
+func oauth2_device_usercode() (code string, err error) {
+	var pw PfPass
+
+	rnd, err := pw.GenRandChars(8, oauth2_device_chars)
+	if err != nil {
+		return
+	}
+
+	code = rnd[:4] + "-" + rnd[4:]
+	return
+}
+
+/* Start a device authorization */
+func OAuth2_DeviceNew(client_id string, scope string) (device_code string, user_code string, err error) {
+	var pw PfPass
+
+	/* Cleanup, expired requests are useless */
+	q := "DELETE FROM oauth2_device " +
+		"WHERE expires < NOW()"
+	err = DB.ExecNA(-1, q)
+	if err != nil {
+		return
+	}
+
+	device_code, err = pw.GenRandHex(32)
+	if err != nil {
+		return
+	}
+
+	user_code, err = oauth2_device_usercode()
+	if err != nil {
+		return
+	}
+
+	exp := time.Now().Add(time.Minute * OAUTH2_DEVICE_MINUTES).Unix()
+
+	q = "INSERT INTO oauth2_device " +
+		"(device_code, user_code, client_id, scope, expires) " +
+		"VALUES($1, $2, $3, $4, TO_TIMESTAMP($5))"
+	err = DB.ExecNA(1, q, pw.SOTPHash(device_code), NormalizeCode(user_code), client_id, scope, exp)
+	if err != nil {
+		/* A user code collision, the device can just ask again */
+		device_code = ""
+		user_code = ""
+	}
+
+	return
+}
+
+/* A pending request, for showing to the user */
+func OAuth2_DeviceGet(user_code string) (d PfOAuth2Device, err error) {
+	q := "SELECT dev.user_code, dev.client_id, cl.descr, dev.scope, dev.expires " +
+		"FROM oauth2_device dev " +
+		"INNER JOIN oauth2_client cl ON dev.client_id = cl.client_id " +
+		"WHERE dev.user_code = $1 " +
+		"AND dev.state = 'pending' " +
+		"AND dev.expires > NOW()"
+	err = DB.QueryRow(q, NormalizeCode(user_code)).Scan(&d.UserCode, &d.ClientID, &d.Descr, &d.Scope, &d.Expires)
+	if err == ErrNoRows {
+		err = errors.New("Unknown or expired code")
+	}
+
+	return
+}
+
+/* The user approves or denies the request */
+func OAuth2_DeviceDecide(ctx PfCtx, user_code string, approve bool) (err error) {
+	d, err := OAuth2_DeviceGet(user_code)
+	if err != nil {
+		return
+	}
+
+	username := ctx.TheUser().GetUserName()
+
+	state := "denied"
+	if approve {
+		state = "approved"
+
+		/* A session is not an authorization of the client */
+		if d.Scope != SCOPE_SESSION {
+			err = OAuth2_ConsentAdd(ctx, username, d.ClientID, d.Scope)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	q := "UPDATE oauth2_device " +
+		"SET member = $2, state = $3 " +
+		"WHERE user_code = $1 " +
+		"AND state = 'pending'"
+	err = DB.Exec(ctx,
+		"Device authorization of OAuth2 client $4: $3",
+		1, q, d.UserCode, username, state, d.ClientID)
+	return
+}
+
+/*
+ * The device polls for the result
+ *
+ * The result can only be collected once.
+ */
+func OAuth2_DevicePoll(client_id string, device_code string) (username string, scope string, err error) {
+	var pw PfPass
+	var id int
+	var state string
+	var member sql.NullString
+	var expired, tooquick bool
+
+	hash := pw.SOTPHash(device_code)
+
+	q := "SELECT id, member, scope, state, " +
+		"expires < NOW(), " +
+		"COALESCE(last_poll > NOW() - INTERVAL '" + strconv.Itoa(OAUTH2_DEVICE_INTERVAL) + " seconds', FALSE) " +
+		"FROM oauth2_device " +
+		"WHERE device_code = $1 " +
+		"AND client_id = $2"
+	err = DB.QueryRow(q, hash, client_id).Scan(&id, &member, &scope, &state, &expired, &tooquick)
+	if err == ErrNoRows {
+		err = errors.New("Invalid device_code")
+		return
+	} else if err != nil {
+		return
+	}
+
+	if expired {
+		err = ErrOAuth2DeviceExpired
+		return
+	}
+
+	q = "UPDATE oauth2_device " +
+		"SET last_poll = NOW() " +
+		"WHERE id = $1"
+	err = DB.ExecNA(1, q, id)
+	if err != nil {
+		return
+	}
+
+	if tooquick {
+		err = ErrOAuth2DeviceSlowDown
+		return
+	}
+
+	switch state {
+	case "pending":
+		err = ErrOAuth2DevicePending
+		return
+
+	case "denied":
+		err = ErrOAuth2DeviceDenied
+		break
+	}
+
+	q = "DELETE FROM oauth2_device " +
+		"WHERE id = $1"
+	e := DB.ExecNA(1, q, id)
+	if err != nil {
+		return
+	}
+
+	/* Somebody else collected it */
+	if e != nil {
+		err = errors.New("Invalid device_code")
+		return
+	}
+
+	username = member.String
+	return
+}
+
+/* A session token for the user, as if they logged in */
+func OAuth2_DeviceSession(ctx PfCtx, username string) (tok string, err error) {
+	user := ctx.NewUser()
+	user.SetUserName(username)
+
+	err = user.Refresh(ctx)
+	if err != nil {
+		return
+	}
+
+	/* Not a SysAdmin, they can swap when they are allowed to */
+	claims := &SessionClaims{}
+	claims.UserDesc = user.GetFullName()
+
+	claims.Id, err = session_new(ctx, username)
+	if err != nil {
+		return
+	}
+
+	token := Token_New("websession", username, TOKEN_EXPIRATIONMINUTES, claims)
+
+	tok, err = token.Sign()
+	if err != nil {
+		return
+	}
+
+	login_alert_check(ctx, username)
+	userevent_user(ctx, username, "login_device")
+	return
+}
@@ -0,0 +1,29 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run OAuth2_Device -v
+ */
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOAuth2_DeviceUserCode(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code, err := oauth2_device_usercode()
+		if err != nil {
+			t.Fatalf("Generating user code failed: %s", err.Error())
+		}
+
+		if len(code) != 9 || code[4] != '-' {
+			t.Fatalf("User code %q is not formatted as XXXX-XXXX", code)
+		}
+
+		for _, c := range NormalizeCode(code) {
+			if !strings.ContainsRune(oauth2_device_chars, c) {
+				t.Fatalf("User code %q contains %q", code, c)
+			}
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package pitchfork
+
+/*
+ * OAuth2 token lifecycle
+ *
+ * - PKCE (RFC7636), required for public clients
+ * - Refresh tokens, opaque and stored hashed, rotated on every use;
+ *   presenting a used refresh token revokes the whole family,
+ *   including the access tokens issued from it
+ * - Revocation (RFC7009) and Introspection (RFC7662)
+ *
+ * Access tokens are JWTs, revoking them uses the JWT invalidation
+ * list, which is shared in SQL between all nodes.
+ *
+ * Note: these use non-audit versions of DB queries, the client,
+ * not a user, is talking to us and tokens are refreshed often.
+ */
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+/* Refresh tokens are valid this long without being used */
+const OAUTH2_REFRESH_DAYS = 30
+
+/* RFC7636 4.1, 43-128 characters from the unreserved set */
+func oauth2_pkce_valid(s string) bool {
+	if len(s) < 43 || len(s) > 128 {
+		return false
+	}
+
+	for _, c := range s {
+		switch {
+		case c >= 'A' && c <= 'Z':
+		case c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9':
+		case c == '-' || c == '.' || c == '_' || c == '~':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Check the challenge in an authorization request, returns the method */
+func OAuth2_PKCECheck(challenge string, method string) (m string, err error) {
+	/* RFC7636 4.3: defaults to plain */
+	if method == "" {
+		method = "plain"
+	}
+
+	if method != "S256" && method != "plain" {
+		err = errors.New("Unsupported code_challenge_method " + method)
+		return
+	}
+
+	if !oauth2_pkce_valid(challenge) {
+		err = errors.New("Invalid code_challenge")
+		return
+	}
+
+	m = method
+	return
+}
+
+/* Verify the code_verifier against the challenge in the code */
+func OAuth2_PKCEVerify(claims *OAuth2Claims, verifier string) (err error) {
+	/* No PKCE used when authorizing */
+	if claims.CodeChallenge == "" {
+		return
+	}
+
+	if !oauth2_pkce_valid(verifier) {
+		err = errors.New("Invalid or missing code_verifier")
+		return
+	}
+
+	chal := verifier
+	if claims.CodeMethod == "S256" {
+		h := sha256.Sum256([]byte(verifier))
+		chal = base64.RawURLEncoding.EncodeToString(h[:])
+	}
+
+	if subtle.ConstantTimeCompare([]byte(chal), []byte(claims.CodeChallenge)) != 1 {
+		err = errors.New("code_verifier does not match")
+		return
+	}
+
+	return
+}
+
+func oauth2_refresh_hash(tok string) string {
+	var pw PfPass
+	return pw.SOTPHash(tok)
+}
+
+/* A new refresh token family, for a new grant */
+func OAuth2_RefreshFamily() (family string, err error) {
+	var pw PfPass
+	family, err = pw.GenRandHex(16)
+	return
+}
+
+/* Access tokens carry their family, this key invalidates them all */
+func oauth2_family_key(family string) string {
+	return "oauth2_family:" + family
+}
+
+/* Revoke a family, its refresh tokens and the access tokens issued from it */
+func oauth2_family_revoke(family string) {
+	/* Access tokens issued from it expire at the latest by then */
+	claims := &JWTClaims{}
+	claims.ExpiresAt = time.Now().Add(time.Minute * TOKEN_EXPIRATIONMINUTES).Unix()
+
+	Jwt_invalidate(oauth2_family_key(family), claims)
+
+	q := "DELETE FROM oauth2_refresh " +
+		"WHERE family = $1"
+	DB.ExecNA(-1, q, family)
+}
+
+/*
+ * Issue a refresh token
+ *
+ * family is from OAuth2_RefreshFamily() for a new grant, or the
+ * family of the refresh token that is being rotated.
+ */
+func OAuth2_RefreshNew(username string, client_id string, scope string, family string) (tok string, err error) {
+	var pw PfPass
+
+	/* Cleanup, used tokens are only needed till they expire */
+	q := "DELETE FROM oauth2_refresh " +
+		"WHERE expires < NOW()"
+	err = DB.ExecNA(-1, q)
+	if err != nil {
+		return
+	}
+
+	tok, err = pw.GenRandHex(32)
+	if err != nil {
+		return
+	}
+
+	exp := time.Now().Add(time.Hour * 24 * OAUTH2_REFRESH_DAYS).Unix()
+
+	q = "INSERT INTO oauth2_refresh " +
+		"(token, family, member, client_id, scope, expires) " +
+		"VALUES($1, $2, $3, $4, $5, TO_TIMESTAMP($6))"
+	err = DB.ExecNA(1, q, oauth2_refresh_hash(tok), family, username, client_id, scope, exp)
+	if err != nil {
+		if DB_IsPQErrorConstraint(err) {
+			err = errors.New("Authorization for client " + client_id + " has been revoked")
+		}
+		tok = ""
+	}
+
+	return
+}
+
+/*
+ * Use a refresh token, it can only be used once
+ *
+ * A replay means that either the client or an attacker holds
+ * a stolen token, as we can't know which, all tokens derived
+ * from the same grant are revoked.
+ */
+func OAuth2_RefreshUse(client_id string, tok string) (username string, scope string, family string, err error) {
+	hash := oauth2_refresh_hash(tok)
+
+	q := "UPDATE oauth2_refresh " +
+		"SET used = TRUE " +
+		"WHERE token = $1 " +
+		"AND client_id = $2 " +
+		"AND NOT used " +
+		"AND expires > NOW() " +
+		"RETURNING member, scope, family"
+	err = DB.QueryRowNA(q, hash, client_id).Scan(&username, &scope, &family)
+	if err == nil {
+		return
+	}
+
+	if err != ErrNoRows {
+		return
+	}
+
+	err = errors.New("Invalid refresh token")
+
+	var used bool
+	q = "SELECT family, used " +
+		"FROM oauth2_refresh " +
+		"WHERE token = $1 " +
+		"AND client_id = $2"
+	e := DB.QueryRow(q, hash, client_id).Scan(&family, &used)
+	if e != nil || !used {
+		return
+	}
+
+	Errf("OAuth2: reuse of refresh token of client %s, revoking family %s", client_id, family)
+
+	oauth2_family_revoke(family)
+
+	err = errors.New("Refresh token reused, authorization revoked")
+	return
+}
+
+/* Revoke a refresh token, and thus all its rotations */
+func OAuth2_RefreshRevoke(client_id string, tok string) (err error) {
+	var family string
+
+	q := "SELECT family " +
+		"FROM oauth2_refresh " +
+		"WHERE token = $1 " +
+		"AND client_id = $2"
+	err = DB.QueryRow(q, oauth2_refresh_hash(tok), client_id).Scan(&family)
+	if err == ErrNoRows {
+		/* RFC7009 2.2: invalid tokens do not cause an error */
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	oauth2_family_revoke(family)
+	return
+}
+
+/* Revoke an access token, only the client it was issued to can do so */
+func OAuth2_AccessToken_Revoke(client_id string, tok string) (err error) {
+	claims := &OAuth2Claims{}
+
+	_, err = Token_Parse(tok, "oauth_access", claims)
+	if err != nil {
+		return
+	}
+
+	if claims.ClientID != client_id {
+		err = errors.New("Token was issued to another client")
+		return
+	}
+
+	Jwt_invalidate(tok, claims)
+	return
+}
+
+/* RFC7662 2.2 Introspection Response */
+type OAuth2Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+	Iss       string `json:"iss,omitempty"`
+}
+
+/*
+ * Describe a token, inactive when it is invalid, expired or revoked
+ *
+ * The hint only determines what is tried first.
+ */
+func OAuth2_Introspect(tok string, hint string) (in OAuth2Introspection) {
+	if hint != "refresh_token" {
+		claims, err := OAuth2_AccessToken_Check(tok)
+		if err == nil {
+			in.Active = true
+			in.Scope = claims.Scope
+			in.ClientID = claims.ClientID
+			in.Username = claims.Subject
+			in.Sub = claims.Subject
+			in.TokenType = "Bearer"
+			in.Exp = claims.ExpiresAt
+			in.Iat = claims.IssuedAt
+			in.Iss = OIDC_Issuer()
+			return
+		}
+	}
+
+	var exp, iat time.Time
+
+	q := "SELECT member, client_id, scope, expires, entered " +
+		"FROM oauth2_refresh " +
+		"WHERE token = $1 " +
+		"AND NOT used " +
+		"AND expires > NOW()"
+	err := DB.QueryRow(q, oauth2_refresh_hash(tok)).Scan(&in.Username, &in.ClientID, &in.Scope, &exp, &iat)
+	if err != nil {
+		return OAuth2Introspection{}
+	}
+
+	in.Active = true
+	in.Sub = in.Username
+	in.TokenType = "refresh_token"
+	in.Exp = exp.Unix()
+	in.Iat = iat.Unix()
+	in.Iss = OIDC_Issuer()
+	return
+}
@@ -0,0 +1,107 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run OAuth2_PKCE -v
+ * $ go test trident.li/pitchfork/lib -run OAuth2_FamilyRevoke -v
+ *
+ * The FamilyRevoke test requires the database (JWT invalidation list).
+ */
+
+import (
+	"testing"
+)
+
+/* RFC7636 Appendix B */
+const pkce_test_verifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+const pkce_test_challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+func TestOAuth2_PKCECheck(t *testing.T) {
+	m, err := OAuth2_PKCECheck(pkce_test_challenge, "S256")
+	if err != nil || m != "S256" {
+		t.Errorf("S256 challenge rejected: %v", err)
+	}
+
+	m, err = OAuth2_PKCECheck(pkce_test_challenge, "")
+	if err != nil || m != "plain" {
+		t.Errorf("Default method is not plain: %q %v", m, err)
+	}
+
+	_, err = OAuth2_PKCECheck(pkce_test_challenge, "S512")
+	if err == nil {
+		t.Errorf("Unknown method accepted")
+	}
+
+	_, err = OAuth2_PKCECheck("short", "S256")
+	if err == nil {
+		t.Errorf("Short challenge accepted")
+	}
+
+	_, err = OAuth2_PKCECheck(pkce_test_challenge[:42]+"/", "S256")
+	if err == nil {
+		t.Errorf("Challenge with invalid character accepted")
+	}
+}
+
+func TestOAuth2_PKCEVerify(t *testing.T) {
+	claims := &OAuth2Claims{CodeChallenge: pkce_test_challenge, CodeMethod: "S256"}
+
+	if OAuth2_PKCEVerify(claims, pkce_test_verifier) != nil {
+		t.Errorf("Correct verifier rejected")
+	}
+
+	if OAuth2_PKCEVerify(claims, "") == nil {
+		t.Errorf("Missing verifier accepted")
+	}
+
+	if OAuth2_PKCEVerify(claims, pkce_test_challenge) == nil {
+		t.Errorf("Challenge accepted as verifier")
+	}
+
+	claims.CodeMethod = "plain"
+	claims.CodeChallenge = pkce_test_verifier
+	if OAuth2_PKCEVerify(claims, pkce_test_verifier) != nil {
+		t.Errorf("Plain verifier rejected")
+	}
+
+	/* Codes issued without PKCE */
+	if OAuth2_PKCEVerify(&OAuth2Claims{}, "") != nil {
+		t.Errorf("Code without challenge rejected")
+	}
+}
+
+func TestOAuth2_FamilyRevoke(t *testing.T) {
+	family, err := OAuth2_RefreshFamily()
+	if err != nil {
+		t.Fatalf("Could not create family: %s", err.Error())
+	}
+
+	tok, err := OAuth2_AccessToken_NewUser("oauth2test", "oauth2client", "openid", family)
+	if err != nil {
+		t.Fatalf("Could not sign token: %s", err.Error())
+	}
+
+	claims := &OAuth2Claims{}
+	_, err = Token_Parse(tok, "oauth_access", claims)
+	if err != nil {
+		t.Fatalf("Could not parse token: %s", err.Error())
+	}
+
+	if claims.Family != family {
+		t.Errorf("Token family is %q, expected %q", claims.Family, family)
+	}
+
+	if Jwt_isinvalidated(oauth2_family_key(family), claims) {
+		t.Errorf("Family should not be revoked yet")
+	}
+
+	oauth2_family_revoke(family)
+
+	if !Jwt_isinvalidated(oauth2_family_key(family), claims) {
+		t.Errorf("Family should be revoked")
+	}
+
+	_, err = OAuth2_AccessToken_Check(tok)
+	if err == nil {
+		t.Errorf("Access token of a revoked family was accepted")
+	}
+}
@@ -0,0 +1,230 @@
+package pitchfork
+
+/*
+ * OpenID Connect Provider
+ *
+ * Builds on the OAuth2 endpoints (ui/oauth2.go) to provide
+ * OpenID Connect Core and Discovery:
+ *  - /.well-known/openid-configuration
+ *  - /oauth2/jwks      (the public keys of the JWT keyring)
+ *  - /oauth2/userinfo  (claims for an access token)
+ *  - id_token in the token and implicit responses
+ *
+ * id_tokens are signed with the same key as all other tokens,
+ * the issuer is the PublicURL of the system.
+ */
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+)
+
+/* The OpenID scope that turns an OAuth2 request into an OIDC one */
+const OIDC_SCOPE = "openid"
+
+/* RFC7517 JSON Web Key, only EC keys are used */
+type OIDC_JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+}
+
+/* OpenID Connect Discovery 1.0 provider metadata */
+type OIDC_Discovery struct {
+	Issuer                 string   `json:"issuer"`
+	AuthorizationEndpoint  string   `json:"authorization_endpoint"`
+	TokenEndpoint          string   `json:"token_endpoint"`
+	UserInfoEndpoint       string   `json:"userinfo_endpoint"`
+	RevocationEndpoint     string   `json:"revocation_endpoint"`
+	IntrospectionEndpoint  string   `json:"introspection_endpoint"`
+	DeviceEndpoint         string   `json:"device_authorization_endpoint"`
+	JWKSURI                string   `json:"jwks_uri"`
+	ScopesSupported        []string `json:"scopes_supported"`
+	ResponseTypesSupported []string `json:"response_types_supported"`
+	ResponseModesSupported []string `json:"response_modes_supported"`
+	GrantTypesSupported    []string `json:"grant_types_supported"`
+	SubjectTypesSupported  []string `json:"subject_types_supported"`
+	IDTokenAlgsSupported   []string `json:"id_token_signing_alg_values_supported"`
+	TokenAuthMethods       []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethods   []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported        []string `json:"claims_supported"`
+}
+
+/* Does the space separated scope list contain the given scope? */
+func OAuth2_HasScope(scope string, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+
+	return false
+}
+
+func OIDC_Issuer() string {
+	return System_Get().PublicURL
+}
+
+func OIDC_GetDiscovery() (disc OIDC_Discovery) {
+	iss := OIDC_Issuer()
+
+	disc.Issuer = iss
+	disc.AuthorizationEndpoint = iss + "/oauth2/authorize"
+	disc.TokenEndpoint = iss + "/oauth2/token"
+	disc.UserInfoEndpoint = iss + "/oauth2/userinfo"
+	disc.RevocationEndpoint = iss + "/oauth2/revoke"
+	disc.IntrospectionEndpoint = iss + "/oauth2/introspect"
+	disc.DeviceEndpoint = iss + "/oauth2/device_authorization"
+	disc.JWKSURI = iss + "/oauth2/jwks"
+	disc.ScopesSupported = Scope_Names()
+	disc.ResponseTypesSupported = []string{"code", "token", "id_token", "id_token token"}
+	disc.ResponseModesSupported = []string{"query", "fragment"}
+	disc.GrantTypesSupported = []string{"authorization_code", "implicit", "refresh_token", OAUTH2_GRANT_DEVICE}
+	disc.SubjectTypesSupported = []string{"public"}
+	disc.IDTokenAlgsSupported = []string{jwt.SigningMethodES512.Alg()}
+	disc.TokenAuthMethods = []string{"client_secret_post", "client_secret_basic", "none"}
+	disc.CodeChallengeMethods = []string{"S256", "plain"}
+	disc.ClaimsSupported = []string{
+		"iss", "sub", "aud", "exp", "iat", "nonce", "at_hash",
+		"name", "given_name", "family_name", "preferred_username", "profile",
+		"email", "email_verified",
+	}
+
+	return
+}
+
+/* A public JWT key as a JWK, the key ID is the RFC7638 thumbprint */
+func oidc_jwk(pub *ecdsa.PublicKey) (jwk OIDC_JWK) {
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	x := make([]byte, size)
+	y := make([]byte, size)
+	pub.X.FillBytes(x)
+	pub.Y.FillBytes(y)
+
+	jwk.Kty = "EC"
+	jwk.Crv = pub.Curve.Params().Name
+	jwk.X = base64.RawURLEncoding.EncodeToString(x)
+	jwk.Y = base64.RawURLEncoding.EncodeToString(y)
+	jwk.Alg = jwt.SigningMethodES512.Alg()
+	jwk.Use = "sig"
+
+	/* Required members in lexicographic order, without whitespace */
+	tp := `{"crv":"` + jwk.Crv + `","kty":"` + jwk.Kty + `","x":"` + jwk.X + `","y":"` + jwk.Y + `"}`
+	h := sha256.Sum256([]byte(tp))
+	jwk.Kid = base64.RawURLEncoding.EncodeToString(h[:])
+	return
+}
+
+/* The active JWT key as a JWK */
+func OIDC_GetJWK() (jwk OIDC_JWK, err error) {
+	key, err := jwtkey_active()
+	if err != nil {
+		return
+	}
+
+	jwk = oidc_jwk(key.pub)
+	return
+}
+
+/* All keys that tokens can be signed with, thus also the previous ones */
+func OIDC_GetJWKS() (jwks []OIDC_JWK) {
+	for _, pub := range jwtkey_pubs() {
+		jwks = append(jwks, oidc_jwk(pub))
+	}
+
+	return
+}
+
+/* Standard claims for the user, limited to what the scope allows */
+func OIDC_UserInfo(ctx PfCtx, user PfUser, scope string) (info map[string]interface{}) {
+	info = make(map[string]interface{})
+
+	info["sub"] = user.GetUserName()
+
+	if OAuth2_HasScope(scope, "profile") {
+		info["preferred_username"] = user.GetUserName()
+		info["profile"] = System_Get().PublicURL + "/user/" + user.GetUserName() + "/"
+
+		if user.GetFullName() != "" {
+			info["name"] = user.GetFullName()
+		}
+
+		if user.GetFirstName() != "" {
+			info["given_name"] = user.GetFirstName()
+		}
+
+		if user.GetLastName() != "" {
+			info["family_name"] = user.GetLastName()
+		}
+	}
+
+	if OAuth2_HasScope(scope, "email") {
+		email, err := user.GetPriEmail(ctx, false)
+		if err == nil && email.Email != "" {
+			info["email"] = email.Email
+			info["email_verified"] = email.Verified
+		}
+	}
+
+	return
+}
+
+/* Left half of the hash of the access token (OIDC Core 3.1.3.6) */
+func oidc_at_hash(access_token string) string {
+	/* ES512 thus SHA-512 */
+	h := sha512.Sum512([]byte(access_token))
+	return base64.RawURLEncoding.EncodeToString(h[:len(h)/2])
+}
+
+/* Sign an id_token with the given (user) claims */
+func oidc_idtoken(claims map[string]interface{}, client_id string, nonce string, access_token string) (tok string, err error) {
+	key, err := jwtkey_active()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+
+	mc := jwt.MapClaims{}
+	for k, v := range claims {
+		mc[k] = v
+	}
+
+	mc["iss"] = OIDC_Issuer()
+	mc["aud"] = client_id
+	mc["iat"] = now.Unix()
+	mc["exp"] = now.Add(time.Minute * TOKEN_EXPIRATIONMINUTES).Unix()
+
+	if nonce != "" {
+		mc["nonce"] = nonce
+	}
+
+	if access_token != "" {
+		mc["at_hash"] = oidc_at_hash(access_token)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES512, mc)
+	token.Header["kid"] = key.kid
+
+	tok, err = token.SignedString(key.prv)
+	return
+}
+
+/*
+ * An id_token for the user
+ *
+ * access_token is optional, when provided the at_hash is included.
+ */
+func OIDC_IDToken(ctx PfCtx, user PfUser, client_id string, scope string, nonce string, access_token string) (tok string, err error) {
+	return oidc_idtoken(OIDC_UserInfo(ctx, user, scope), client_id, nonce, access_token)
+}
@@ -0,0 +1,111 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run OIDC -v
+ */
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"math/big"
+	"testing"
+
+	jwt "github.com/golang-jwt/jwt"
+)
+
+func oidc_test_setup(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Key generation failed: %s", err.Error())
+	}
+
+	Config.Token_prv = k
+	Config.Token_pub = &k.PublicKey
+
+	system_cached.Name = "Test"
+	system_cached.PublicURL = "https://sso.example.net"
+}
+
+func TestOIDC_JWK(t *testing.T) {
+	oidc_test_setup(t)
+
+	jwk, err := OIDC_GetJWK()
+	if err != nil {
+		t.Fatalf("JWK failed: %s", err.Error())
+	}
+
+	if jwk.Kty != "EC" || jwk.Crv != "P-521" || jwk.Alg != "ES512" {
+		t.Errorf("Unexpected JWK %+v", jwk)
+	}
+
+	/* The thumbprint is stable */
+	jwk2, _ := OIDC_GetJWK()
+	if jwk.Kid == "" || jwk.Kid != jwk2.Kid {
+		t.Errorf("Unstable key ID %q %q", jwk.Kid, jwk2.Kid)
+	}
+
+	/* The key can be reconstructed from the JWK */
+	x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+	y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+	pub := Config.Token_pub.(*ecdsa.PublicKey)
+	if len(x) != 66 || new(big.Int).SetBytes(x).Cmp(pub.X) != 0 || new(big.Int).SetBytes(y).Cmp(pub.Y) != 0 {
+		t.Errorf("JWK does not match the public key")
+	}
+}
+
+func TestOIDC_IDToken(t *testing.T) {
+	oidc_test_setup(t)
+
+	info := map[string]interface{}{"sub": "jdoe", "email": "jdoe@example.net"}
+
+	tok, err := oidc_idtoken(info, "wiki", "n-0S6_WzA2Mj", "access")
+	if err != nil {
+		t.Fatalf("id_token failed: %s", err.Error())
+	}
+
+	jwk, _ := OIDC_GetJWK()
+
+	claims := jwt.MapClaims{}
+	parsed, err := jwt.ParseWithClaims(tok, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["kid"] != jwk.Kid {
+			t.Errorf("Unexpected kid %v", token.Header["kid"])
+		}
+		return Config.Token_pub, nil
+	})
+	if err != nil || !parsed.Valid {
+		t.Fatalf("id_token does not verify: %v", err)
+	}
+
+	if claims["iss"] != "https://sso.example.net" || claims["aud"] != "wiki" || claims["sub"] != "jdoe" {
+		t.Errorf("Unexpected claims %v", claims)
+	}
+
+	if claims["nonce"] != "n-0S6_WzA2Mj" || claims["email"] != "jdoe@example.net" {
+		t.Errorf("Missing claims %v", claims)
+	}
+
+	h := sha512.Sum512([]byte("access"))
+	if claims["at_hash"] != base64.RawURLEncoding.EncodeToString(h[:32]) {
+		t.Errorf("Unexpected at_hash %v", claims["at_hash"])
+	}
+}
+
+func TestOIDC_Scope(t *testing.T) {
+	if !OAuth2_HasScope("openid  profile", "profile") {
+		t.Errorf("profile scope not found")
+	}
+
+	if OAuth2_HasScope("openid profile", "email") || OAuth2_HasScope("openidemail", "openid") {
+		t.Errorf("Unexpected scope match")
+	}
+
+	oidc_test_setup(t)
+
+	disc := OIDC_GetDiscovery()
+	if disc.Issuer != "https://sso.example.net" || disc.JWKSURI != "https://sso.example.net/oauth2/jwks" {
+		t.Errorf("Unexpected discovery %+v", disc)
+	}
+}
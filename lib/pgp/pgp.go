@@ -8,6 +8,7 @@ import (
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
 	"golang.org/x/crypto/openpgp/s2k"
+	"io/ioutil"
 	"strconv"
 	"strings"
 	"time"
@@ -142,3 +143,117 @@ func GetKeyInfo(keyring string, email string) (key_id string, key_exp time.Time,
 
 	return
 }
+
+/* Find the entity in a keyring that has an identity for email */
+func FindKey(keyring string, email string) (ent *openpgp.Entity, err error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewBufferString(keyring))
+	if err != nil {
+		return
+	}
+
+	for _, e := range entities {
+		for _, i := range e.Identities {
+			if strings.EqualFold(i.UserId.Email, email) {
+				ent = e
+				return
+			}
+		}
+	}
+
+	err = errors.New("Key for " + email + " not found")
+	return
+}
+
+/* Decrypt an armored message with an armored secret key */
+func Decrypt(seckey string, armored []byte) (plain []byte, err error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewBufferString(seckey))
+	if err != nil {
+		return
+	}
+
+	block, err := armor.Decode(bytes.NewReader(armored))
+	if err != nil {
+		return
+	}
+
+	if block.Type != "PGP MESSAGE" {
+		err = errors.New("Not a PGP message but " + block.Type)
+		return
+	}
+
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return
+	}
+
+	/* A signed-only message is readable, but was not encrypted */
+	if !md.IsEncrypted {
+		err = errors.New("PGP message is not encrypted")
+		return
+	}
+
+	plain, err = ioutil.ReadAll(md.UnverifiedBody)
+	return
+}
+
+/* Encrypt to the key for email in keyring, returns an armored message */
+func Encrypt(keyring string, email string, plain []byte) (armored []byte, err error) {
+	ent, err := FindKey(keyring, email)
+	if err != nil {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	aw, err := armor.Encode(buf, "PGP MESSAGE", nil)
+	if err != nil {
+		return
+	}
+
+	/* Fails when the key is expired or revoked */
+	w, err := openpgp.Encrypt(aw, []*openpgp.Entity{ent}, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return
+	}
+
+	_, err = w.Write(plain)
+	if err != nil {
+		return
+	}
+
+	err = w.Close()
+	if err != nil {
+		return
+	}
+
+	err = aw.Close()
+	if err != nil {
+		return
+	}
+
+	armored = buf.Bytes()
+	return
+}
+
+/* Create an armored detached signature with an armored secret key, hashed with SHA256 */
+func Sign(seckey string, data []byte) (armored []byte, err error) {
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewBufferString(seckey))
+	if err != nil {
+		return
+	}
+
+	if len(keyring) == 0 || keyring[0].PrivateKey == nil {
+		err = errors.New("No secret key found")
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	cfg := &packet.Config{DefaultHash: crypto.SHA256}
+
+	err = openpgp.ArmoredDetachSign(buf, keyring[0], bytes.NewReader(data), cfg)
+	if err != nil {
+		return
+	}
+
+	armored = buf.Bytes()
+	return
+}
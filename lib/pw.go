@@ -5,18 +5,43 @@ import (
 	"crypto/rand"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 	"strconv"
+	"strings"
 	"time"
 	"unicode"
 
 	// Externals
+	"golang.org/x/crypto/argon2"
 	"trident.li/go/osutil-crypt"
 	cc "trident.li/go/osutil-crypt/common"
 )
 
+/* PHC string format prefix of Argon2id hashes */
+const PW_ARGON2ID = "$argon2id$"
+
+/* Argon2id defaults, see pw_argon2_* in the configuration */
+const (
+	PW_ARGON2_MEMORY  = 64 * 1024 /* KiB */
+	PW_ARGON2_TIME    = 3
+	PW_ARGON2_THREADS = 2
+	PW_ARGON2_SALTLEN = 16
+	PW_ARGON2_KEYLEN  = 32
+)
+
+type pw_argon2 struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
 type PfPass struct {
 }
 
@@ -57,6 +82,35 @@ func (pw *PfPass) GenRandHex(length int) (hex string, err error) {
 	return
 }
 
+/*
+ * Random string of length characters from chars
+ *
+ * Bytes at or above the largest multiple of len(chars) are
+ * discarded, a plain modulo would favour the first characters.
+ */
+func (pw *PfPass) GenRandChars(length int, chars string) (str string, err error) {
+	max := 256 - (256 % len(chars))
+
+	out := make([]byte, 0, length)
+	for len(out) < length {
+		var bytes []byte
+
+		bytes, err = pw.GenRand(length - len(out))
+		if err != nil {
+			return
+		}
+
+		for _, b := range bytes {
+			if int(b) < max {
+				out = append(out, chars[int(b)%len(chars)])
+			}
+		}
+	}
+
+	str = string(out)
+	return
+}
+
 func (pw *PfPass) GenPass(length int) (pass string, err error) {
 	bytes, err := pw.GenRand(length)
 	if err != nil {
@@ -69,7 +123,8 @@ func (pw *PfPass) GenPass(length int) (pass string, err error) {
 }
 
 /*
- * For the time being, all passwords are SHA512 hashed
+ * SHA512-crypt, for passwords that are checked by other daemons
+ * (chat, jabber), which only understand the crypt(3) schemes
  */
 func (pw *PfPass) Make(password string) (hash string, err error) {
 	c, err := crypt.NewFromHash("$6$")
@@ -79,13 +134,168 @@ func (pw *PfPass) Make(password string) (hash string, err error) {
 	return c.Generate([]byte(password), nil)
 }
 
+/* Parameters argon2.IDKey accepts, it panics on others */
+func pw_argon2_check(memory uint64, iter uint64, threads uint64) (err error) {
+	switch {
+	case threads < 1 || threads > 255:
+		err = errors.New("Argon2id threads must be 1-255")
+
+	case iter < 1 || iter > math.MaxUint32:
+		err = errors.New("Argon2id time must be at least 1")
+
+	case memory < 8*threads || memory > math.MaxUint32:
+		err = errors.New("Argon2id memory must be at least 8 KiB per thread")
+	}
+
+	return
+}
+
+/* Check the configured Argon2id cost parameters, 0 is the default */
+func pw_argon2_cfgcheck() (err error) {
+	memory := int64(PW_ARGON2_MEMORY)
+	iter := int64(PW_ARGON2_TIME)
+	threads := int64(PW_ARGON2_THREADS)
+
+	if Config.PW_Argon2_Mem < 0 || Config.PW_Argon2_Time < 0 || Config.PW_Argon2_Par < 0 {
+		err = errors.New("Argon2id parameters can not be negative")
+		return
+	}
+
+	if Config.PW_Argon2_Mem > 0 {
+		memory = int64(Config.PW_Argon2_Mem)
+	}
+
+	if Config.PW_Argon2_Time > 0 {
+		iter = int64(Config.PW_Argon2_Time)
+	}
+
+	if Config.PW_Argon2_Par > 0 {
+		threads = int64(Config.PW_Argon2_Par)
+	}
+
+	err = pw_argon2_check(uint64(memory), uint64(iter), uint64(threads))
+	return
+}
+
+/* The configured Argon2id cost parameters, checked when loading the configuration */
+func pw_argon2_params() (a pw_argon2) {
+	a.memory = PW_ARGON2_MEMORY
+	a.time = PW_ARGON2_TIME
+	a.threads = PW_ARGON2_THREADS
+
+	if Config.PW_Argon2_Mem > 0 {
+		a.memory = uint32(Config.PW_Argon2_Mem)
+	}
+
+	if Config.PW_Argon2_Time > 0 {
+		a.time = uint32(Config.PW_Argon2_Time)
+	}
+
+	if Config.PW_Argon2_Par > 0 {
+		a.threads = uint8(Config.PW_Argon2_Par)
+	}
+
+	return
+}
+
+/* $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key> */
+func pw_argon2_parse(hash string) (a pw_argon2, err error) {
+	var version int
+
+	p := strings.Split(hash, "$")
+	if len(p) != 6 || p[1] != "argon2id" {
+		err = errors.New("Not an Argon2id hash")
+		return
+	}
+
+	_, err = fmt.Sscanf(p[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		err = errors.New("Unsupported Argon2 version")
+		return
+	}
+
+	var memory, iter, threads uint64
+
+	_, err = fmt.Sscanf(p[3], "m=%d,t=%d,p=%d", &memory, &iter, &threads)
+	if err != nil {
+		err = errors.New("Invalid Argon2id parameters")
+		return
+	}
+
+	err = pw_argon2_check(memory, iter, threads)
+	if err != nil {
+		return
+	}
+
+	a.memory = uint32(memory)
+	a.time = uint32(iter)
+	a.threads = uint8(threads)
+
+	a.salt, err = base64.RawStdEncoding.DecodeString(p[4])
+	if err != nil {
+		err = errors.New("Invalid Argon2id salt")
+		return
+	}
+
+	a.key, err = base64.RawStdEncoding.DecodeString(p[5])
+	if err != nil || len(a.key) == 0 {
+		err = errors.New("Invalid Argon2id key")
+		return
+	}
+
+	return
+}
+
+/* Portal passwords are Argon2id hashed */
+func (pw *PfPass) MakePortal(password string) (hash string, err error) {
+	a := pw_argon2_params()
+
+	a.salt, err = pw.GenRand(PW_ARGON2_SALTLEN)
+	if err != nil {
+		return
+	}
+
+	a.key = argon2.IDKey([]byte(password), a.salt, a.time, a.memory, a.threads, PW_ARGON2_KEYLEN)
+
+	hash = fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		PW_ARGON2ID, argon2.Version, a.memory, a.time, a.threads,
+		base64.RawStdEncoding.EncodeToString(a.salt),
+		base64.RawStdEncoding.EncodeToString(a.key))
+	return
+}
+
+/*
+ * Does the hash use an older scheme or weaker parameters
+ * than currently configured? Then it should be replaced.
+ */
+func (pw *PfPass) NeedsRehash(hash string) bool {
+	if !strings.HasPrefix(hash, PW_ARGON2ID) {
+		return true
+	}
+
+	a, err := pw_argon2_parse(hash)
+	if err != nil {
+		return true
+	}
+
+	c := pw_argon2_params()
+
+	return a.memory < c.memory || a.time < c.time || a.threads < c.threads
+}
+
 /*
  * hashedPassword is in the semi-standardized /etc/shadow passwd format
  * the format can be:
  * 	$<hashtype>$<salt>$<hash>
  * 	$<hashtype>$rounds=<iter>$<salt>$<hash>
+ *
+ * or the PHC string format for Argon2id
  */
 func (pw *PfPass) Verify(password string, hashedPassword string) (err error) {
+	if strings.HasPrefix(hashedPassword, PW_ARGON2ID) {
+		return pw.verify_argon2(password, hashedPassword)
+	}
+
 	c, err := crypt.NewFromHash(hashedPassword)
 	if err != nil {
 		return
@@ -98,6 +308,21 @@ func (pw *PfPass) Verify(password string, hashedPassword string) (err error) {
 	return
 }
 
+/* Uses the parameters stored in the hash, not the configured ones */
+func (pw *PfPass) verify_argon2(password string, hashedPassword string) (err error) {
+	a, err := pw_argon2_parse(hashedPassword)
+	if err != nil {
+		return
+	}
+
+	key := argon2.IDKey([]byte(password), a.salt, a.time, a.memory, a.threads, uint32(len(a.key)))
+	if subtle.ConstantTimeCompare(key, a.key) != 1 {
+		err = errors.New("Provided password does not match stored password")
+	}
+
+	return
+}
+
 func calc_otp(key string, value int64) int {
 	hash := hmac.New(sha1.New, []byte(key))
 	err := binary.Write(hash, binary.BigEndian, value)
@@ -0,0 +1,155 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run PW_ -v
+ */
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPW_Argon2id(t *testing.T) {
+	var pw PfPass
+
+	/* Keep the test quick */
+	Config.PW_Argon2_Mem = 1024
+	Config.PW_Argon2_Time = 1
+	Config.PW_Argon2_Par = 1
+	defer func() {
+		Config.PW_Argon2_Mem = 0
+		Config.PW_Argon2_Time = 0
+		Config.PW_Argon2_Par = 0
+	}()
+
+	hash, err := pw.MakePortal("correct horse")
+	if err != nil {
+		t.Fatalf("Hashing failed: %s", err.Error())
+	}
+
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Unexpected hash %q", hash)
+	}
+
+	if pw.Verify("correct horse", hash) != nil {
+		t.Errorf("Correct password does not verify")
+	}
+
+	if pw.Verify("wrong horse", hash) == nil {
+		t.Errorf("Wrong password verifies")
+	}
+
+	if pw.NeedsRehash(hash) {
+		t.Errorf("Current hash needs a rehash")
+	}
+
+	/* Stronger parameters configured */
+	Config.PW_Argon2_Time = 2
+	if !pw.NeedsRehash(hash) {
+		t.Errorf("Weaker hash does not need a rehash")
+	}
+
+	/* Still verifies with the parameters from the hash */
+	if pw.Verify("correct horse", hash) != nil {
+		t.Errorf("Correct password does not verify after changing parameters")
+	}
+
+	if pw.Verify("correct horse", "$argon2id$v=19$m=1024$bad") == nil {
+		t.Errorf("Malformed hash verifies")
+	}
+}
+
+func TestPW_Argon2Params(t *testing.T) {
+	var pw PfPass
+
+	defer func() {
+		Config.PW_Argon2_Mem = 0
+		Config.PW_Argon2_Time = 0
+		Config.PW_Argon2_Par = 0
+	}()
+
+	if pw_argon2_cfgcheck() != nil {
+		t.Errorf("Defaults rejected")
+	}
+
+	tsts := []struct {
+		mem, time, par int
+		ok             bool
+	}{
+		{1024, 1, 1, true},
+		{2040, 1, 255, true},
+		{4096, 1, 256, false},
+		{1024, -1, 1, false},
+		{8, 1, 2, false},
+	}
+
+	for _, tst := range tsts {
+		Config.PW_Argon2_Mem = tst.mem
+		Config.PW_Argon2_Time = tst.time
+		Config.PW_Argon2_Par = tst.par
+
+		err := pw_argon2_cfgcheck()
+		if (err == nil) != tst.ok {
+			t.Errorf("m=%d t=%d p=%d: unexpected result %v", tst.mem, tst.time, tst.par, err)
+		}
+	}
+
+	/* Stored hashes with parameters that argon2 panics on */
+	for _, h := range []string{
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=256$c2FsdHNhbHQ$a2V5",
+		"$argon2id$v=19$m=4,t=1,p=1$c2FsdHNhbHQ$a2V5",
+	} {
+		_, err := pw_argon2_parse(h)
+		if err == nil {
+			t.Errorf("Hash %q accepted", h)
+		}
+
+		if pw.Verify("password", h) == nil {
+			t.Errorf("Hash %q verifies", h)
+		}
+	}
+}
+
+func TestPW_Legacy(t *testing.T) {
+	var pw PfPass
+
+	hash, err := pw.Make("correct horse")
+	if err != nil {
+		t.Fatalf("Hashing failed: %s", err.Error())
+	}
+
+	if !strings.HasPrefix(hash, "$6$") {
+		t.Errorf("Unexpected hash %q", hash)
+	}
+
+	if pw.Verify("correct horse", hash) != nil {
+		t.Errorf("Correct password does not verify")
+	}
+
+	if !pw.NeedsRehash(hash) {
+		t.Errorf("SHA512-crypt hash does not need a rehash")
+	}
+}
+
+func TestPW_GenRandChars(t *testing.T) {
+	var pw PfPass
+
+	const chars = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+	str, err := pw.GenRandChars(1000, chars)
+	if err != nil {
+		t.Fatalf("Generating failed: %s", err.Error())
+	}
+
+	if len(str) != 1000 {
+		t.Errorf("Length is %d, expected 1000", len(str))
+	}
+
+	for _, c := range str {
+		if !strings.ContainsRune(chars, c) {
+			t.Fatalf("Unexpected character %q", c)
+		}
+	}
+}
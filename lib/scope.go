@@ -0,0 +1,225 @@
+package pitchfork
+
+/*
+ * OAuth2 Scopes
+ *
+ * A catalogue of scopes, each mapping onto the locations in the
+ * menu tree (see menu.go) that a token with that scope may reach.
+ *
+ * Scopes only ever restrict: the normal Perm checks still apply,
+ * a token can never do more than its user can.
+ *
+ * A ':write' scope implies the ':read' scope of the same name.
+ *
+ * Group scopes can be limited to a single group by prefixing
+ * them with 'group:<name>:', eg 'group:ops:wiki:write'.
+ *
+ * The OpenID scopes (openid, profile, email) only determine
+ * the claims in the id_token and userinfo, they do not give
+ * access to any commands.
+ *
+ * The session scope is only for the device grant, it results in
+ * a normal session as when logging in with a password (tcli login).
+ */
+
+import (
+	"errors"
+	"strings"
+)
+
+type PfScope struct {
+	Scope string   /* eg 'wiki:read' */
+	Desc  string   /* Shown to the user when asked for consent */
+	Group bool     /* Can be limited to a group */
+	Cmds  []string /* Menu locations, eg 'group wiki get' */
+}
+
+var scopes = []PfScope{
+	{"profile:read", "View your profile", false, []string{
+		"system whoami",
+		"user view",
+		"user get",
+		"user detail list",
+		"user language list",
+		"user email list",
+	}},
+	{"profile:write", "Change your profile", false, []string{
+		"user set",
+		"user detail set",
+		"user detail delete",
+		"user language set",
+		"user language delete",
+	}},
+	{"group:read", "View your groups and their members", false, []string{
+		"group list",
+		"group get",
+		"group member list",
+		"group vcards",
+	}},
+	{"wiki:read", "Read wiki pages", true, []string{
+		"group wiki get",
+		"group wiki list",
+		"group wiki diff",
+	}},
+	{"wiki:write", "Edit wiki pages", true, []string{
+		"group wiki update",
+		"group wiki move",
+		"group wiki delete",
+		"group wiki copy",
+	}},
+	{"file:read", "List files", true, []string{
+		"group file list",
+	}},
+	{"file:write", "Add and change files", true, []string{
+		"group file add_dir",
+		"group file add_url",
+		"group file move",
+		"group file delete",
+		"group file copy",
+	}},
+	{"calendar:read", "View calendar events", true, []string{
+		"group calendar list",
+		"group calendar get",
+		"group calendar history",
+	}},
+	{"calendar:write", "Add and change calendar events", true, []string{
+		"group calendar add",
+		"group calendar update",
+		"group calendar delete",
+	}},
+}
+
+/* A full session, not limited to a scope */
+const SCOPE_SESSION = "session"
+
+/* Scopes that are not in the catalogue, but are still valid */
+var scopes_oidc = []string{OIDC_SCOPE, "profile", "email", SCOPE_SESSION}
+
+/* Applications can add their own scopes */
+func Scope_Register(s PfScope) {
+	for i := range scopes {
+		if scopes[i].Scope == s.Scope {
+			scopes[i] = s
+			return
+		}
+	}
+
+	scopes = append(scopes, s)
+}
+
+func Scope_List() []PfScope {
+	return scopes
+}
+
+/* Scope names, for the discovery document */
+func Scope_Names() (names []string) {
+	names = append(names, scopes_oidc...)
+
+	for _, s := range scopes {
+		names = append(names, s.Scope)
+	}
+
+	return
+}
+
+/*
+ * Look up a single scope, splitting off the group if present
+ *
+ * Scopes outside the catalogue (OpenID, session) return an empty PfScope.
+ */
+func Scope_Find(name string) (s PfScope, group string, err error) {
+	for _, o := range scopes_oidc {
+		if name == o {
+			s.Scope = name
+			return
+		}
+	}
+
+	base := name
+
+	if strings.HasPrefix(name, "group:") {
+		p := strings.SplitN(name, ":", 3)
+		if len(p) == 3 && p[1] != "" {
+			group = p[1]
+			base = p[2]
+		}
+	}
+
+	for _, c := range scopes {
+		if c.Scope != base {
+			continue
+		}
+
+		if group != "" && !c.Group {
+			err = errors.New("Scope " + base + " can not be limited to a group")
+			return
+		}
+
+		s = c
+		return
+	}
+
+	err = errors.New("Unknown scope " + name)
+	return
+}
+
+/* Check that all the space separated scopes are known */
+func Scope_Valid(scope string) (err error) {
+	for _, name := range strings.Fields(scope) {
+		_, _, err = Scope_Find(name)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+/* A write scope includes the read scope */
+func scope_cmds(s PfScope) (cmds []string) {
+	cmds = s.Cmds
+
+	if strings.HasSuffix(s.Scope, ":write") {
+		r, _, err := Scope_Find(strings.TrimSuffix(s.Scope, ":write") + ":read")
+		if err == nil {
+			cmds = append(append([]string{}, cmds...), r.Cmds...)
+		}
+	}
+
+	return
+}
+
+/*
+ * Does the scope allow the menu location?
+ *
+ * Submenus on the way to an allowed command are allowed,
+ * as are the items below an allowed command (eg 'user get <field>').
+ *
+ * group is the currently selected group, a group limited scope
+ * only allows its commands for that group.
+ */
+func Scope_Allows(scope string, loc string, group string) bool {
+	for _, name := range strings.Fields(scope) {
+		s, grp, err := Scope_Find(name)
+		if err != nil {
+			continue
+		}
+
+		for _, c := range scope_cmds(s) {
+			/* On the way there */
+			if strings.HasPrefix(c, loc+" ") {
+				return true
+			}
+
+			if c != loc && !strings.HasPrefix(loc, c+" ") {
+				continue
+			}
+
+			if grp == "" || grp == group {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,73 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run Scope -v
+ */
+
+import (
+	"testing"
+)
+
+func TestScope_Valid(t *testing.T) {
+	tsts := []struct {
+		scope string
+		ok    bool
+	}{
+		{"", true},
+		{"openid profile email", true},
+		{"profile:read wiki:write", true},
+		{"group:ops:wiki:write", true},
+		{"wiki:admin", false},
+		{"group:ops:profile:read", false},
+		{"group::wiki:read", false},
+	}
+
+	for _, tst := range tsts {
+		err := Scope_Valid(tst.scope)
+		if (err == nil) != tst.ok {
+			t.Errorf("Scope_Valid(%q) = %v, expected ok=%v", tst.scope, err, tst.ok)
+		}
+	}
+}
+
+func TestScope_Allows(t *testing.T) {
+	tsts := []struct {
+		scope string
+		loc   string
+		group string
+		ok    bool
+	}{
+		/* Submenus on the way */
+		{"wiki:read", "group", "", true},
+		{"wiki:read", "group wiki", "ops", true},
+		{"wiki:read", "group wiki get", "ops", true},
+		{"wiki:read", "group wiki update", "ops", false},
+		{"wiki:read", "user", "", false},
+		{"wiki:read", "user password set", "", false},
+
+		/* Write implies read */
+		{"wiki:write", "group wiki get", "ops", true},
+		{"wiki:write", "group wiki update", "ops", true},
+
+		/* Below an allowed command */
+		{"profile:read", "user get firstname", "", true},
+		{"profile:read", "user set firstname", "", false},
+
+		/* Limited to a group */
+		{"group:ops:wiki:write", "group wiki", "", true},
+		{"group:ops:wiki:write", "group wiki update", "ops", true},
+		{"group:ops:wiki:write", "group wiki update", "dev", false},
+		{"group:ops:wiki:write", "group file list", "ops", false},
+
+		/* OpenID scopes give no access */
+		{"openid profile email", "system whoami", "", false},
+		{"", "system whoami", "", false},
+	}
+
+	for _, tst := range tsts {
+		ok := Scope_Allows(tst.scope, tst.loc, tst.group)
+		if ok != tst.ok {
+			t.Errorf("Scope_Allows(%q, %q, %q) = %v, expected %v", tst.scope, tst.loc, tst.group, ok, tst.ok)
+		}
+	}
+}
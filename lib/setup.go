@@ -1,6 +1,7 @@
 package pitchfork
 
 import (
+	"strconv"
 	"time"
 )
 
@@ -51,14 +52,34 @@ func Setup(toolname string, confroot string, verbosedb bool, app_schema_version
 /* Start background services */
 func Starts() {
 	/* Start IP Tracker -- against brute force login attempts */
-	Iptrk_start(5, 10*time.Hour, "1 hour")
+	Iptrk_start(iptrk_max_default[IPTRK_LOGIN], 5*time.Minute, strconv.Itoa(Config.IPtrk_minutes)+" minutes")
 
 	/* Start JWT Invalidation caching/clearing */
 	JwtInv_start(30 * time.Minute)
+
+	/* Load the JWT signing keyring */
+	JWTKey_start()
+
+	/* End expired impersonations, notifying the users */
+	Impersonate_start(5 * time.Minute)
+
+	/* Start the outbound mail queue runner */
+	MailQ_start(1 * time.Minute)
+
+	/* Start the Mailing List server, when configured */
+	if Config.ML_listen != "" {
+		err := MLServer_start(Config.ML_listen, Config.ML_lmtp)
+		if err != nil {
+			Errf("Mailing List server failed to start: %s", err.Error())
+		}
+	}
 }
 
 /* Should be deferred  Starts() call */
 func Stops() {
 	Iptrk_stop()
 	JwtInv_stop()
+	MLServer_stop()
+	MailQ_stop()
+	Impersonate_stop()
 }
@@ -1,6 +1,8 @@
 package pitchfork
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"errors"
 	"github.com/pborman/uuid"
 	"net"
@@ -27,6 +29,10 @@ type PfSys struct {
 	OAuthEnabled     bool        `label:"OAuth/OpenID Enabled" pfset:"sysadmin" pfcol:"oauth_enabled" hint:"Enable OAuth 2.0 and OpenID Connect support (/oauth2/ + /.wellknown/webfinger). Default: On"`
 	NoIndex          bool        `label:"No Web Indexing" pfset:"sysadmin" pfcol:"no_index" hint:"Disallow Web crawlers/robots from indexing and following links. Default: On"`
 	EmailSig         string      `label:"Email Signature" pftype:"text" pfset:"sysadmin" pfcol:"email_sig" hint:"Signature appended to mailinglist messages"`
+	MailEncrypt      bool        `label:"Encrypt Email" pfset:"sysadmin" pfcol:"mail_encrypt" hint:"Encrypt system email to the PGP key of the recipient when one is configured for the address. System email is always signed with the System PGP Key."`
+	PGPPubkey        string      `label:"System PGP Key" pftype:"text" pfset:"nobody" pfget:"user" pfcol:"pgp_pubkey" pfskipfailperm:"yes" hint:"Public PGP key that signs system email, generated by setup"`
+	PGPSeckey        string      `label:"System PGP Secret Key" pfset:"nobody" pfget:"nobody" pfcol:"pgp_seckey" pfskipfailperm:"yes"`
+	Secret           string      `label:"System Secret" pfset:"nobody" pfget:"nobody" pfcol:"secret" pfskipfailperm:"yes"`
 	Require2FA       bool        `label:"Require 2FA" pfset:"sysadmin" hint:"Require Two Factor Authentication (2FA) for every Login, If disabled users may still configure 2FA for their account."`
 	PW_comment       string      `pfsection:"Password Rules" label:"Setting password rules is not recommended. Please use XKCD style passwords instead." pftype:"note"`
 	PW_Enforce       bool        `pfsection:"Password Rules" label:"Enforce Rules" hint:"When enabled the rules below are enforced on new passwords"`
@@ -72,6 +78,51 @@ func System_Get() (system *PfSys) {
 	return &system_cached
 }
 
+/*
+ * HMAC of data with the system secret
+ *
+ * For values we hand out and need to recognize later, eg VERP
+ * addresses. purpose separates the uses of the secret.
+ *
+ * The secret is random, generated on first use and shared
+ * by all nodes through the config table.
+ */
+func System_HMAC(purpose string, data string) (mac []byte, err error) {
+	sys := System_Get()
+
+	if sys.Secret == "" {
+		var pw PfPass
+		var secret string
+
+		secret, err = pw.GenRandHex(32)
+		if err != nil {
+			return
+		}
+
+		/* Another node might be first, then its secret is used */
+		q := "UPDATE config " +
+			"SET value = $1 " +
+			"WHERE key = 'secret' " +
+			"AND value = ''"
+		err = DB.ExecNA(-1, q, secret)
+		if err != nil {
+			return
+		}
+
+		system_cached.Refresh()
+
+		if sys.Secret == "" {
+			err = errors.New("No system secret available")
+			return
+		}
+	}
+
+	h := hmac.New(sha256.New, []byte(sys.Secret))
+	h.Write([]byte(purpose + ":" + data))
+	mac = h.Sum(nil)
+	return
+}
+
 func System_AuditMax(search string, user_name string, gr_name string) (total int, err error) {
 	var args []interface{}
 
@@ -318,6 +369,41 @@ func system_report(ctx PfCtx, args []string) (err error) {
 
 	ctx.OutLn("")
 
+	var schemes map[string]int
+	var legacy int
+	schemes, legacy, err = User_PasswordSchemes()
+	if err != nil {
+		return
+	}
+
+	var locked []PfLockedUser
+	locked, err = User_LockedList()
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Accounts with failed logins:")
+	if len(locked) == 0 {
+		ctx.OutLn("  None")
+	}
+
+	for _, u := range locked {
+		state := ""
+		if !u.LockedUntil.IsZero() {
+			state = ", locked until " + Fmt_Time(u.LockedUntil)
+		}
+
+		ctx.OutLn("  %-20s %3d failed%s", u.UserName, u.Attempts, state)
+	}
+	ctx.OutLn("")
+
+	ctx.OutLn("Password hashes:")
+	for scheme, cnt := range schemes {
+		ctx.OutLn("  %s: %d", scheme, cnt)
+	}
+	ctx.OutLn("  Legacy, upgraded on next login: %d", legacy)
+	ctx.OutLn("")
+
 	var sizes [][]string
 	sizes, err = DB.SizeReport(maxdb)
 	if err != nil {
@@ -329,6 +415,28 @@ func system_report(ctx PfCtx, args []string) (err error) {
 		ctx.OutLn("  %-30s %10s", sizes[s][0], sizes[s][1])
 	}
 	ctx.OutLn("")
+
+	var bounces []PfUserEmail
+	bounces, err = Mail_BounceList()
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Bouncing Email Addresses:")
+	if len(bounces) == 0 {
+		ctx.OutLn("  None")
+	}
+
+	for _, b := range bounces {
+		state := ""
+		if b.MLDisabled {
+			state = " (list delivery disabled)"
+		}
+
+		ctx.OutLn("  %-20s %-40s %3d bounces, last %s%s", b.Member, b.Email, b.BounceCount, Fmt_Time(b.BounceLast), state)
+		ctx.OutLn("    %s", b.BounceStatus)
+	}
+	ctx.OutLn("")
 	return
 }
 
@@ -424,7 +532,7 @@ func System_db_cleanup() (err error) {
 func System_adduser(username string, password string) (err error) {
 	/* Hash the password */
 	var pw PfPass
-	pass, err := pw.Make(password)
+	pass, err := pw.MakePortal(password)
 	if err != nil {
 		return
 	}
@@ -462,7 +570,7 @@ func System_adduser(username string, password string) (err error) {
 func System_setpassword(username string, password string) (err error) {
 	/* Hash the password */
 	var pw PfPass
-	pass, err := pw.Make(password)
+	pass, err := pw.MakePortal(password)
 	if err != nil {
 		return
 	}
@@ -513,6 +621,10 @@ func system_whoami(ctx PfCtx, args []string) (err error) {
 		theuser := ctx.TheUser()
 		ctx.OutLn("Username: %s", theuser.GetUserName())
 		ctx.OutLn("Fullname: %s", theuser.GetFullName())
+
+		if ctx.IsSysAdmin() {
+			ctx.OutLn("SysAdmin: until %s", ctx.SysAdminUntil().UTC().Format(Config.TimeFormat))
+		}
 	} else {
 		ctx.OutLn("Not authenticated")
 	}
@@ -521,16 +633,26 @@ func system_whoami(ctx PfCtx, args []string) (err error) {
 
 func system_swapadmin(ctx PfCtx, args []string) (err error) {
 	if !ctx.SwapSysAdmin() {
-		err = errors.New("Swapping failed")
+		err = errors.New("Swapping failed, use 'system elevate' to become a SysAdmin")
 		return
 	}
 
-	mod := "Regular"
-	if ctx.IsSysAdmin() {
-		mod = "SysAdmin"
+	ctx.OutLn("Now a Regular user")
+	return nil
+}
+
+func system_elevate(ctx PfCtx, args []string) (err error) {
+	twofactor := ""
+	if len(args) == 2 {
+		twofactor = args[1]
+	}
+
+	err = ctx.ElevateSysAdmin(args[0], twofactor)
+	if err != nil {
+		return
 	}
 
-	ctx.OutLn("Now a %s user", mod)
+	ctx.OutLn("Now a SysAdmin user until %s", ctx.SysAdminUntil().UTC().Format(Config.TimeFormat))
 	return nil
 }
 
@@ -705,11 +827,20 @@ func system_menu(ctx PfCtx, args []string) (err error) {
 		{"login", system_login, 2, 3, []string{"username", "password", "twofactor"}, PERM_NONE, "Login"},
 		{"logout", system_logout, 0, 0, nil, PERM_NONE, "Logout"},
 		{"whoami", system_whoami, 0, 0, nil, PERM_NONE, "Who Am I?"},
-		{"swapadmin", system_swapadmin, 0, 0, nil, PERM_SYS_ADMIN_CAN, "Swap from regular to sysadmin user"},
+		{"webauthn_login", system_webauthn_login, 1, 1, []string{"username"}, PERM_NONE, "Get the WebAuthn options for logging in"},
+		{"swapadmin", system_swapadmin, 0, 0, nil, PERM_SYS_ADMIN_CAN, "Swap from sysadmin back to regular user"},
+		{"elevate", system_elevate, 1, 2, []string{"password#password", "twofactor"}, PERM_SYS_ADMIN_CAN, "Become a sysadmin user for a limited time, requires the password and twofactor code"},
 		{"set", system_set, 0, -1, nil, PERM_SYS_ADMIN, "Configure the system"},
 		{"get", system_get, 0, -1, nil, PERM_NONE, "Get values from the system"},
 		{"batch", system_batch, 1, 4, []string{"filename", "username", "password", "twofactor"}, PERM_NONE, "Run a batch script (sysadmin level username/password required for non-sysadmin logged in users)"},
 		{"iptrk", iptrk_menu, 0, -1, nil, PERM_SYS_ADMIN, "IPtrk control and information"},
+		{"oauth2", system_oauth2_menu, 0, -1, nil, PERM_SYS_ADMIN, "OAuth2 client registry"},
+		{"jwtkey", system_jwtkey_menu, 0, -1, nil, PERM_SYS_ADMIN, "JWT signing keys"},
+		{"approval", system_approval_menu, 0, -1, nil, PERM_SYS_ADMIN, "Two-person approval of sensitive commands"},
+		{"impersonate", system_impersonate_menu, 0, -1, nil, PERM_USER, "View the system as another user"},
+		{"mailqueue", mailqueue_menu, 0, -1, nil, PERM_SYS_ADMIN, "Outbound mail queue control and information"},
+		{"pgp_key", system_pgp_key, 0, 0, nil, PERM_USER, "Show the public PGP key that signs system email"},
+		{"pgp_create", system_pgp_create, 0, 0, nil, PERM_SYS_ADMIN, "Replace the system PGP key with a newly generated one"},
 		{"auditlog", system_auditlog, 1, 5, []string{"search", "username", "group", "offset#int", "max#int"}, PERM_SYS_ADMIN, "View the Audit Log"},
 	})
 
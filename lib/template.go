@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	texttemplate "text/template"
 	"time"
 )
 
@@ -17,6 +18,9 @@ const PAGER_PERPAGE = 10
 /* Templates */
 var g_tmp *template.Template
 
+/* Plain text templates (*.txt.tmpl), eg for mail, these are not HTML escaped */
+var g_txttmp *texttemplate.Template
+
 var template_funcs = template.FuncMap{
 	"pager_less_ok":     tmp_pager_less_ok,
 	"pager_less":        tmp_pager_less,
@@ -48,6 +52,10 @@ func Template_Get() *template.Template {
 	return g_tmp
 }
 
+func Template_GetText() *texttemplate.Template {
+	return g_txttmp
+}
+
 /* Template Functions - used from inside the templates */
 func tmp_pager_less_ok(cur int) bool {
 	return cur >= PAGER_PERPAGE
@@ -283,6 +291,11 @@ func template_loader(root string, path string) error {
 	/* We want just the name, not the whole path */
 	name := path[len(root)+1:]
 
+	/* Plain text templates go into their own set */
+	if strings.HasSuffix(path, ".txt.tmpl") {
+		return template_loader_text(name, path)
+	}
+
 	/* Do we already have a version of this template? */
 	if g_tmp.Lookup(name) != nil {
 		Dbgf("Skipping overruled template %s", name)
@@ -308,8 +321,29 @@ func template_loader(root string, path string) error {
 	return err
 }
 
+func template_loader_text(name string, path string) error {
+	if g_txttmp.Lookup(name) != nil {
+		Dbgf("Skipping overruled text template %s", name)
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	t := g_txttmp.New(name)
+	Dbgf("Loaded text template %s", name)
+
+	t.Funcs(texttemplate.FuncMap(template_funcs))
+
+	_, err = t.Parse(string(b))
+	return err
+}
+
 func Template_Load() (err error) {
 	g_tmp = template.New("Pitchfork Templates")
+	g_txttmp = texttemplate.New("Pitchfork Text Templates")
 
 	/* Pre-load the templates from multiple roots */
 	for _, root := range Config.File_roots {
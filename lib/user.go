@@ -509,8 +509,13 @@ func (user *PfUserS) SetPassword(ctx PfCtx, pwtype string, password string) (err
 		return
 	}
 
-	/* Hash the password */
-	val, err := pw.Make(password)
+	/* Hash the password, chat/jabber need a scheme their daemons understand */
+	var val string
+	if pwtype == "portal" {
+		val, err = pw.MakePortal(password)
+	} else {
+		val, err = pw.Make(password)
+	}
 	if err != nil {
 		return
 	}
@@ -527,8 +532,8 @@ func (user *PfUserS) SetPassword(ctx PfCtx, pwtype string, password string) (err
 		return
 	}
 
-	/* Reset login attempts */
-	_, err = DB.UpdateFieldNP(ctx, user, user.UserName, "member", "login_attempts", "0")
+	/* Reset login attempts and lockout */
+	err = user_lockout_clear(ctx, user.UserName)
 	if err != nil {
 		return
 	}
@@ -576,8 +581,9 @@ func (user *PfUserS) CheckAuth(ctx PfCtx, username string, password string, twof
 		return
 	}
 
-	if user.LoginAttempts > 5 {
-		err = errors.New("Too many login attempts for this account")
+	/* Locked, or too soon after the previous failure? */
+	err = user_lockout_check(user.UserName)
+	if err != nil {
 		return
 	}
 
@@ -587,31 +593,105 @@ func (user *PfUserS) CheckAuth(ctx PfCtx, username string, password string, twof
 		/* Check the TwoFactor code */
 		err = user.Verify_TwoFactor(ctx, twofactor, 0)
 		if err == nil {
-			/* All okay -> reset login_attempts + update activity field */
-			q := "UPDATE member SET login_attempts = 0, activity = NOW() WHERE ident = $1"
+			/* All okay -> reset login_attempts/lockout + update activity field */
+			q := "UPDATE member " +
+				"SET login_attempts = 0, login_failed = NULL, locked_until = NULL, unlock_token = NULL, activity = NOW() " +
+				"WHERE ident = $1"
 			e := DB.ExecNA(1, q, user.UserName)
 			if e != nil {
 				/* Log failed updates */
 				Errf("Updating user.login_attempts/activity failed: %s", e)
 			}
 
-			/* Reset attempts from this IP */
-			Iptrk_reset(ip)
+			/* Reset login attempts from this IP, not of its networks */
+			Iptrk_login_ok(ip)
+
+			/* Upgrade the hash while we know the password */
+			user.rehashPassword(ctx, password)
 
 			return
 		}
 	}
 
 	/* Failed login attempt (either password or twofactor code is wrong) */
-	e := DB.Increase(ctx,
-		"Login attempt failed for user $1",
-		"member",
-		user.UserName,
-		"login_attempts")
+	user.lockout_fail(ctx)
+
+	return
+}
+
+/*
+ * Replace a portal password hash of an older scheme
+ * or weaker parameters, see PfPass.NeedsRehash()
+ *
+ * Only called with a verified password, failure is just logged.
+ */
+func (user *PfUserS) rehashPassword(ctx PfCtx, password string) {
+	var pw PfPass
+
+	if !pw.NeedsRehash(user.Password) {
+		return
+	}
 
-	/* Log failed updates */
-	if e != nil {
-		Errf("Updating login_attempts failed: %s", e)
+	hash, err := pw.MakePortal(password)
+	if err != nil {
+		Errf("Rehashing password of %s failed: %s", user.UserName, err.Error())
+		return
+	}
+
+	/* Only when it was not changed in the meantime */
+	q := "UPDATE member " +
+		"SET password = $2 " +
+		"WHERE ident = $1 " +
+		"AND password = $3"
+	err = DB.Exec(ctx,
+		"Upgraded password hash of $1",
+		1, q, user.UserName, hash, user.Password)
+	if err != nil {
+		Errf("Rehashing password of %s failed: %s", user.UserName, err.Error())
+		return
+	}
+
+	user.Password = hash
+}
+
+/*
+ * Count the portal password hashes per scheme, legacy being
+ * those that get rehashed on the next login
+ */
+func User_PasswordSchemes() (schemes map[string]int, legacy int, err error) {
+	var pw PfPass
+
+	schemes = make(map[string]int)
+
+	q := "SELECT password " +
+		"FROM member " +
+		"WHERE COALESCE(password, '') <> ''"
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+
+		err = rows.Scan(&hash)
+		if err != nil {
+			return
+		}
+
+		scheme := "unknown"
+		p := strings.Split(hash, "$")
+		if len(p) > 2 {
+			scheme = p[1]
+		}
+
+		schemes[scheme]++
+
+		if pw.NeedsRehash(hash) {
+			legacy++
+		}
 	}
 
 	return
@@ -1115,11 +1195,15 @@ func user_pw_recover(ctx PfCtx, args []string) (err error) {
 	 * That does make determining what is wrong harder
 	 * for legit users, but any adversary does not learn
 	 * much either
-	 *
-	 * XXX: ratelimit this API call?
 	 */
 	failerr := errors.New("Invalid recovery details")
 
+	/* Count attempts */
+	ip := ctx.GetClientIP().String()
+	if Iptrk_hit(IPTRK_RECOVER, ip) {
+		return errors.New("Too many recovery attempts from IP: " + ip)
+	}
+
 	err = ctx.SelectUser(username, PERM_NONE)
 	if err != nil {
 		ctx.Errf("Can't select user %s for recovery", username)
@@ -1174,7 +1258,7 @@ func user_pw_recover(ctx PfCtx, args []string) (err error) {
 }
 
 func user_pw_resetcount(ctx PfCtx, args []string) (err error) {
-	username := args[1]
+	username := args[0]
 
 	err = ctx.SelectUser(username, PERM_USER_SELF)
 	if err != nil {
@@ -1182,7 +1266,7 @@ func user_pw_resetcount(ctx PfCtx, args []string) (err error) {
 	}
 
 	user := ctx.SelectedUser()
-	_, err = DB.UpdateFieldNP(ctx, user, user.GetUserName(), "member", "login_attempts", "0")
+	err = user_lockout_clear(ctx, user.GetUserName())
 	return
 }
 
@@ -1190,7 +1274,9 @@ func user_pw(ctx PfCtx, args []string) (err error) {
 	menu := NewPfMenu([]PfMEntry{
 		{"set", user_pw_set, 3, 4, []string{"pwtype", "username", "newpassword#password", "curpassword#password"}, PERM_USER_SELF, "Set password of type (portal|chat|jabber), requires providing current portal password"},
 		{"recover", user_pw_recover, 3, 3, []string{"username", "token#password", "password"}, PERM_NONE, "Set a password using the the recovery token"},
-		{"resetcount", user_pw_resetcount, 1, 1, []string{"username"}, PERM_SYS_ADMIN, "Reset authentication failure count"},
+		{"resetcount", user_pw_resetcount, 1, 1, []string{"username"}, PERM_SYS_ADMIN, "Reset authentication failure count and unlock the account"},
+		{"unlock", user_pw_unlock, 2, 2, []string{"username", "token#password"}, PERM_NONE, "Unlock a locked account using the token from the email"},
+		{"notme", user_pw_notme, 2, 2, []string{"username", "token#password"}, PERM_NONE, "Report a login as not yours using the token from the email, revokes all sessions and requires a new password"},
 	})
 
 	err = ctx.Menu(args, menu)
@@ -1212,6 +1298,9 @@ func user_menu(ctx PfCtx, args []string) (err error) {
 		{"events", user_events, 0, -1, nil, PERM_USER, "User Events"},
 		{"detail", user_detail, 0, -1, nil, PERM_USER, "Manage Contact Details"},
 		{"language", user_language, 0, -1, nil, PERM_USER, "Manage Language Skills"},
+		{"oauth2", user_oauth2_menu, 0, -1, nil, PERM_USER, "Authorized OAuth2 clients"},
+		{"token", user_token_menu, 0, -1, nil, PERM_USER, "Personal access tokens"},
+		{"session", user_session_menu, 0, -1, nil, PERM_USER, "Active sessions"},
 	})
 
 	return ctx.Menu(args, menu)
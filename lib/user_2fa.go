@@ -139,7 +139,7 @@ func (user *PfUserS) Verify_TwoFactor(ctx PfCtx, twofactor string, id int) (err
 		return nil
 	}
 
-	q := "SELECT id, type, counter, key " +
+	q := "SELECT id, type, counter, key, COALESCE(credential, '') " +
 		"FROM second_factors"
 
 	DB.Q_AddWhereAnd(&q, &args, "member", user.GetUserName())
@@ -173,8 +173,9 @@ func (user *PfUserS) Verify_TwoFactor(ctx PfCtx, twofactor string, id int) (err
 		var t_type string
 		var t_counter int64
 		var t_key string
+		var t_cred string
 
-		err = rows.Scan(&t_id, &t_type, &t_counter, &t_key)
+		err = rows.Scan(&t_id, &t_type, &t_counter, &t_key, &t_cred)
 		if err != nil {
 			return
 		}
@@ -201,6 +202,16 @@ func (user *PfUserS) Verify_TwoFactor(ctx PfCtx, twofactor string, id int) (err
 			}
 			break
 
+		case "RECOVERY":
+			if pw.VerifySOTP(t_key, NormalizeCode(twofactor)) {
+				err = user.tfa_recovery_use(ctx, t_id)
+				if err != nil {
+					return
+				}
+				return nil
+			}
+			break
+
 		case "SOTP":
 			if pw.VerifySOTP(t_key, twofactor) {
 				/* Correct, remove Single-use OTP code */
@@ -213,6 +224,23 @@ func (user *PfUserS) Verify_TwoFactor(ctx PfCtx, twofactor string, id int) (err
 			}
 			break
 
+		case "WEBAUTHN":
+			/* Assertions are JSON, other tokens can still match a code */
+			if !strings.HasPrefix(twofactor, "{") {
+				break
+			}
+
+			ok, e := user.webauthn_assert(ctx, t_id, t_cred, t_key, t_counter, twofactor)
+			if ok && e == nil {
+				return nil
+			}
+
+			if ok {
+				Errf("WebAuthn assertion for %s failed: %s", user.GetUserName(), e.Error())
+				return errors.New("Invalid 2FA")
+			}
+			break
+
 		default:
 			return errors.New("Unknown Hash Type")
 
@@ -402,6 +430,14 @@ func user_2fa_add(ctx PfCtx, args []string) (err error) {
 		}
 		break
 
+	case "RECOVERY":
+		err = errors.New("Recovery codes are generated with 'user 2fa recovery generate'")
+		break
+
+	case "WEBAUTHN":
+		err = errors.New("WebAuthn security keys are registered using the browser (webauthn_begin + webauthn_finish)")
+		break
+
 	default:
 		err = errors.New("Unknown 2FA Token Type: " + token_type)
 		break
@@ -553,10 +589,14 @@ func user_2fa_menu(ctx PfCtx, args []string) (err error) {
 		{"enable", user_2fa_enable, 4, 4, []string{"username", "id", "curpassword#password", "twofactorcode#int"}, perms, "Enable token"},
 		{"disable", user_2fa_disable, 3, 3, []string{"username", "id", "curpassword#password"}, perms, "Disable token"},
 		{"remove", user_2fa_remove, 3, 3, []string{"username", "id", "curpassword#password"}, perms, "Remove token"},
+		{"webauthn_begin", user_2fa_webauthn_begin, 2, 2, []string{"username", "curpassword#password"}, perms, "Start registration of a WebAuthn security key, returns the options for the browser"},
+		{"webauthn_finish", user_2fa_webauthn_finish, 3, 3, []string{"username", "descr", "response"}, perms, "Complete registration of a WebAuthn security key with the response of the browser"},
+		{"recovery", user_2fa_recovery_menu, 0, -1, nil, PERM_USER, "Recovery codes"},
 		{"types", user_2fa_types, 0, 0, nil, PERM_NONE, "List available 2FA Types"},
 	})
 
-	if len(args) >= 2 {
+	/* The recovery menu selects the user itself */
+	if len(args) >= 2 && args[0] != "recovery" {
 		/* Check if we have perms for this user */
 		err = ctx.SelectUser(args[1], perms)
 		if err != nil {
@@ -0,0 +1,207 @@
+package pitchfork
+
+/*
+ * 2FA Recovery Codes
+ *
+ * Single-use codes, stored hashed like SOTP codes, that can be
+ * used in place of a 2FA token when that token is lost.
+ * Generating a new batch replaces the remaining codes.
+ */
+
+import (
+	"errors"
+)
+
+/* Codes per batch */
+const TFA_RECOVERY_CODES = 10
+
+/* Unambiguous characters: no 0/O, 1/I/L */
+const tfa_recovery_chars = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+
+/* A code formatted as XXXXX-XXXXX */
+func tfa_recovery_code() (code string, err error) {
+	var pw PfPass
+
+	rnd, err := pw.GenRandChars(10, tfa_recovery_chars)
+	if err != nil {
+		return
+	}
+
+	code = rnd[:5] + "-" + rnd[5:]
+	return
+}
+
+/* Number of unused recovery codes of a user */
+func TwoFactorRecoveryCount(user PfUser) (count int, err error) {
+	q := "SELECT COUNT(*) " +
+		"FROM second_factors " +
+		"WHERE member = $1 " +
+		"AND type = 'RECOVERY'"
+	err = DB.QueryRow(q, user.GetUserName()).Scan(&count)
+	return
+}
+
+/*
+ * Consume a recovery code
+ *
+ * The removal is the check, thus a code can only be used once,
+ * even when used concurrently.
+ */
+func (user *PfUserS) tfa_recovery_use(ctx PfCtx, t_id int) (err error) {
+	q := "DELETE FROM second_factors " +
+		"WHERE id = $1 " +
+		"AND type = 'RECOVERY'"
+	err = DB.Exec(ctx,
+		"Used recovery code $1 (code removed)",
+		1, q, t_id)
+	if err != nil {
+		err = errors.New("Recovery code already used")
+		return
+	}
+
+	userevent_user(ctx, user.GetUserName(), "2fa_recovery_used")
+
+	left, _ := TwoFactorRecoveryCount(user)
+
+	/* Tell the user, in case it was not them */
+	email, e := user.GetPriEmail(ctx, false)
+	if e != nil {
+		Errf("No email to notify %s about recovery code use: %s", user.GetUserName(), e.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"IP":        ctx.GetClientIP().String(),
+		"Remaining": left,
+	}
+
+	/* Failure to mail does not prevent the login */
+	Mail_Template(ctx, email, "recovery_used", "Recovery code used", data)
+	return
+}
+
+func user_2fa_recovery_generate(ctx PfCtx, args []string) (err error) {
+	/* username := args[0] */
+	pw := args[1]
+
+	user := ctx.SelectedUser()
+
+	/* SysAdmins can bypass the password check */
+	if !ctx.TheUser().IsSysAdmin() {
+		err = user.Verify_Password(ctx, pw)
+		if err != nil {
+			return
+		}
+	}
+
+	/* Recovery codes are a fallback for a token, not a replacement */
+	tokens, err := user.Fetch2FA()
+	if err != nil {
+		return
+	}
+
+	hastoken := false
+	for _, t := range tokens {
+		if t.Active && t.Type != "RECOVERY" {
+			hastoken = true
+			break
+		}
+	}
+
+	if !hastoken {
+		err = errors.New("Configure and enable a 2FA token before generating recovery codes")
+		return
+	}
+
+	/* Replace the batch as a whole, or not at all */
+	err = DB.TxBegin(ctx)
+	if err != nil {
+		return
+	}
+
+	q := "DELETE FROM second_factors " +
+		"WHERE member = $1 " +
+		"AND type = 'RECOVERY'"
+	err = DB.Exec(ctx,
+		"Removed old recovery codes for $1",
+		-1, q, user.GetUserName())
+	if err != nil {
+		DB.TxRollback(ctx)
+		return
+	}
+
+	var hash PfPass
+	var codes []string
+
+	for i := 1; i <= TFA_RECOVERY_CODES; i++ {
+		var code string
+
+		code, err = tfa_recovery_code()
+		if err != nil {
+			DB.TxRollback(ctx)
+			return
+		}
+
+		q = "INSERT INTO second_factors " +
+			"(member, type, descr, entered, active, key) " +
+			"VALUES($1, 'RECOVERY', $2, NOW(), 't', $3)"
+		err = DB.Exec(ctx,
+			"Add 2FA Token RECOVERY: $2",
+			1, q,
+			user.GetUserName(), "Recovery code", hash.SOTPHash(NormalizeCode(code)))
+		if err != nil {
+			DB.TxRollback(ctx)
+			err = errors.New("Could not add recovery code")
+			return
+		}
+
+		codes = append(codes, code)
+	}
+
+	err = DB.TxCommit(ctx)
+	if err != nil {
+		return
+	}
+
+	for _, code := range codes {
+		ctx.OutLn("Code: %s", code)
+	}
+
+	userevent_user(ctx, user.GetUserName(), "2fa_recovery_generate")
+
+	ctx.OutLn("Store these codes safely, each can be used once instead of a 2FA token")
+	return
+}
+
+func user_2fa_recovery_count(ctx PfCtx, args []string) (err error) {
+	count, err := TwoFactorRecoveryCount(ctx.SelectedUser())
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Recovery codes remaining: %d", count)
+	return
+}
+
+func user_2fa_recovery_menu(ctx PfCtx, args []string) (err error) {
+	perms := PERM_USER_SELF
+
+	menu := NewPfMenu([]PfMEntry{
+		{"generate", user_2fa_recovery_generate, 2, 2, []string{"username", "curpassword#password"}, perms, "Generate a new batch of recovery codes, replacing the old ones"},
+		{"count", user_2fa_recovery_count, 1, 1, []string{"username"}, perms, "Number of unused recovery codes"},
+	})
+
+	if len(args) >= 2 {
+		/* Check if we have perms for this user */
+		err = ctx.SelectUser(args[1], perms)
+		if err != nil {
+			return
+		}
+	} else {
+		/* Nothing selected */
+		ctx.SelectUser("", PERM_NONE)
+	}
+
+	err = ctx.Menu(args, menu)
+	return
+}
@@ -0,0 +1,45 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run Recovery -v
+ */
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRecovery_Code(t *testing.T) {
+	var pw PfPass
+
+	seen := make(map[string]bool)
+
+	for i := 0; i < 50; i++ {
+		code, err := tfa_recovery_code()
+		if err != nil {
+			t.Fatalf("Generating code failed: %s", err.Error())
+		}
+
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("Unexpected format %q", code)
+		}
+
+		for _, c := range strings.Replace(code, "-", "", -1) {
+			if !strings.ContainsRune(tfa_recovery_chars, c) {
+				t.Errorf("Unexpected character %q in %q", c, code)
+			}
+		}
+
+		if seen[code] {
+			t.Errorf("Duplicate code %q", code)
+		}
+		seen[code] = true
+
+		/* What the user types need not match exactly */
+		hash := pw.SOTPHash(NormalizeCode(code))
+		typed := strings.ToLower(strings.Replace(code, "-", " ", 1))
+		if !pw.VerifySOTP(hash, NormalizeCode(typed)) {
+			t.Errorf("Code %q not accepted as %q", code, typed)
+		}
+	}
+}
@@ -19,6 +19,10 @@ type PfUserEmail struct {
 	KeyringUpdate time.Time       `label:"Keyring Updated At" pfset:"nobody" pfget:"user" pfcol:"keyring_update_at"`
 	VerifyCode    string          `label:"Verification Code" pfset:"nobody" pfget:"user" pfcol:"verify_token"`
 	Verified      bool            `label:"Verified" pfset:"nobody" pfget:"user" pfcol:"verified"`
+	BounceCount   int             `label:"Bounces" pfset:"nobody" pfget:"user" pfcol:"bounce_count"`
+	BounceLast    time.Time       `label:"Last Bounce" pfset:"nobody" pfget:"user" pfcol:"bounce_last"`
+	BounceStatus  string          `label:"Bounce Status" pfset:"nobody" pfget:"user" pfcol:"bounce_status"`
+	MLDisabled    bool            `label:"List Delivery Disabled" pfset:"nobody" pfget:"user" pfcol:"ml_disabled"`
 	Groups        []PfGroupMember /* Used by List() */
 }
 
@@ -73,7 +77,8 @@ func (uem *PfUserEmail) FetchGroups(ctx PfCtx) (err error) {
 
 func (uem *PfUserEmail) List(ctx PfCtx, user PfUser) (emails []PfUserEmail, err error) {
 	q := "SELECT member, email, descr, pgpkey_id, pgpkey_expire, keyring, " +
-		"keyring_update_at, verify_token, verified " +
+		"keyring_update_at, verify_token, verified, " +
+		"bounce_count, bounce_last, bounce_status, ml_disabled " +
 		"FROM member_email " +
 		"INNER JOIN member ON member_email.member = member.ident " +
 		"WHERE member = $1 "
@@ -97,7 +102,8 @@ func (uem *PfUserEmail) List(ctx PfCtx, user PfUser) (emails []PfUserEmail, err
 			&em.FullName,
 			&em.PgpKeyID, &em.PgpKeyExpire,
 			&em.Keyring, &em.KeyringUpdate,
-			&em.VerifyCode, &em.Verified)
+			&em.VerifyCode, &em.Verified,
+			&em.BounceCount, &em.BounceLast, &em.BounceStatus, &em.MLDisabled)
 		if err != nil {
 			emails = nil
 			return
@@ -243,6 +249,34 @@ func user_email_remove(ctx PfCtx, args []string) (err error) {
 	return
 }
 
+func user_email_bounce_reset(ctx PfCtx, args []string) (err error) {
+	err = ctx.SelectEmail(args[0])
+	if err != nil {
+		return
+	}
+
+	email := ctx.SelectedEmail()
+
+	q := "UPDATE member_email " +
+		"SET bounce_count = 0, " +
+		"bounce_status = '', " +
+		"ml_disabled = FALSE " +
+		"WHERE member = $1 " +
+		"AND email = $2"
+
+	err = DB.Exec(ctx,
+		"Reset bounces of email $2 of member $1",
+		1, q,
+		email.Member, email.Email)
+	if err != nil {
+		err = errors.New("Could not reset bounces")
+	} else {
+		ctx.OutLn("Bounces reset, list delivery enabled")
+	}
+
+	return
+}
+
 func user_email_list(ctx PfCtx, args []string) (err error) {
 	var tue PfUserEmail
 	var emails []PfUserEmail
@@ -555,6 +589,7 @@ func user_email_menu(ctx PfCtx, args []string) (err error) {
 		{"pgp_add", user_email_pgp_add, 2, 2, []string{"email", "keyring#file"}, PERM_USER, "Add PGP Key"},
 		{"pgp_get", user_email_pgp_get, 1, 1, []string{"email"}, PERM_USER, "Get PGP Key"},
 		{"pgp_check", user_email_pgp_check, 0, 0, nil, PERM_SYS_ADMIN, "Check all PGP Keys"},
+		{"bounce_reset", user_email_bounce_reset, 1, 1, []string{"email"}, PERM_USER, "Reset bounces and re-enable list delivery"},
 		{"member", user_email_group_menu, 0, -1, nil, PERM_USER, "Member commands"},
 	})
 
@@ -5,7 +5,11 @@ import (
 )
 
 func userevent(ctx PfCtx, event string) {
-	ident := ctx.TheUser().GetUserName()
+	userevent_user(ctx, ctx.TheUser().GetUserName(), event)
+}
+
+/* For events where the user is not logged in (yet) */
+func userevent_user(ctx PfCtx, ident string, event string) {
 	ip := ctx.GetClientIP()
 	remote := ctx.GetRemote()
 	ua_full, ua_browser, ua_os := ctx.GetUserAgent()
@@ -0,0 +1,254 @@
+package pitchfork
+
+/*
+ * Per-account lockout
+ *
+ * IPtrk limits attempts per IP, this limits attempts per account,
+ * thus also when an attacker rotates IPs:
+ *  - after lockout_delay failures every attempt has to wait
+ *    twice as long as the previous one
+ *  - after lockout_max failures the account is locked for
+ *    lockout_minutes, the user is mailed a one-time unlock link
+ *
+ * A successful login, a password change, the unlock link or a
+ * sysadmin ('user password resetcount') clears the lockout.
+ */
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+/* Upper bound of the delay between attempts */
+const LOCKOUT_DELAY_MAX = 5 * time.Minute
+
+type PfLockedUser struct {
+	UserName    string
+	Attempts    int
+	LockedUntil time.Time
+}
+
+/* How long to wait after the given number of failed attempts */
+func lockout_delay(attempts int) (delay time.Duration) {
+	if attempts < Config.Lockout_delay {
+		return 0
+	}
+
+	n := attempts - Config.Lockout_delay
+	if n > 16 {
+		return LOCKOUT_DELAY_MAX
+	}
+
+	delay = time.Second * time.Duration(math.Pow(2, float64(n)))
+	if delay > LOCKOUT_DELAY_MAX {
+		delay = LOCKOUT_DELAY_MAX
+	}
+
+	return
+}
+
+/* Is the account locked or does the next attempt have to wait? */
+func user_lockout_check(username string) (err error) {
+	var attempts int
+	var locked bool
+	var since float64
+
+	q := "SELECT login_attempts, " +
+		"COALESCE(locked_until > NOW(), FALSE), " +
+		"COALESCE(EXTRACT(EPOCH FROM NOW() - login_failed), -1) " +
+		"FROM member " +
+		"WHERE ident = $1"
+	err = DB.QueryRow(q, username).Scan(&attempts, &locked, &since)
+	if err != nil {
+		return
+	}
+
+	if locked {
+		err = errors.New("Too many failed login attempts, this account is temporarily locked, see your email to unlock it")
+		return
+	}
+
+	/* No failures */
+	if since < 0 {
+		return
+	}
+
+	wait := lockout_delay(attempts).Seconds() - since
+	if wait > 0 {
+		err = errors.New("Too many failed login attempts, please wait " + strconv.Itoa(int(math.Ceil(wait))) + " seconds before trying again")
+		return
+	}
+
+	return
+}
+
+/* Count a failed attempt, locking the account when there are too many */
+func (user *PfUserS) lockout_fail(ctx PfCtx) {
+	var pw PfPass
+	var attempts int
+
+	q := "UPDATE member " +
+		"SET login_attempts = login_attempts + 1, " +
+		"login_failed = NOW() " +
+		"WHERE ident = $1 " +
+		"RETURNING login_attempts"
+	err := DB.QueryRowA(ctx,
+		"Login attempt failed for user $1",
+		q, user.UserName).Scan(&attempts)
+	if err != nil {
+		Errf("Updating login_attempts failed: %s", err)
+		return
+	}
+
+	if attempts < Config.Lockout_max {
+		return
+	}
+
+	token, err := pw.GenRandHex(32)
+	if err != nil {
+		return
+	}
+
+	mins := Config.Lockout_minutes
+
+	q = "UPDATE member " +
+		"SET locked_until = NOW() + INTERVAL '" + strconv.Itoa(mins) + " minutes', " +
+		"unlock_token = $2 " +
+		"WHERE ident = $1"
+	err = DB.Exec(ctx,
+		"Locked account $1",
+		1, q, user.UserName, pw.SOTPHash(token))
+	if err != nil {
+		Errf("Locking account %s failed: %s", user.UserName, err.Error())
+		return
+	}
+
+	userevent_user(ctx, user.UserName, "account_locked")
+
+	email, err := user.GetPriEmail(ctx, false)
+	if err != nil {
+		Errf("No email to send unlock link for %s: %s", user.UserName, err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"IP":      ctx.GetClientIP().String(),
+		"Minutes": mins,
+		"URL":     System_Get().PublicURL + "/unlock/?username=" + user.UserName + "&token=" + token,
+	}
+
+	Mail_Template(ctx, email, "account_locked", "Account locked", data)
+}
+
+/* Clear the failed attempts and lockout */
+func user_lockout_clear(ctx PfCtx, username string) (err error) {
+	q := "UPDATE member " +
+		"SET login_attempts = 0, " +
+		"login_failed = NULL, " +
+		"locked_until = NULL, " +
+		"unlock_token = NULL " +
+		"WHERE ident = $1"
+	err = DB.Exec(ctx,
+		"Cleared login attempts of $1",
+		1, q, username)
+	return
+}
+
+/*
+ * Use a mailed single-use token
+ *
+ * The query has to match the user ($1) and the hashed token ($2)
+ * and make sure that the token can not match again.
+ */
+func user_mailtoken_use(ctx PfCtx, failmsg string, audittxt string, q string, username string, token string) (err error) {
+	var pw PfPass
+
+	/* Same error for all failures, as for password recovery */
+	failerr := errors.New(failmsg)
+
+	/* Count attempts, guessing tokens is recovery too */
+	ip := ctx.GetClientIP().String()
+	if Iptrk_hit(IPTRK_RECOVER, ip) {
+		err = errors.New("Too many recovery attempts from IP: " + ip)
+		return
+	}
+
+	if token == "" {
+		return failerr
+	}
+
+	err = DB.Exec(ctx, audittxt, 1, q, username, pw.SOTPHash(token))
+	if err != nil {
+		return failerr
+	}
+
+	return
+}
+
+/* Unlock using the token from the mail */
+func User_Unlock(ctx PfCtx, username string, token string) (err error) {
+	q := "UPDATE member " +
+		"SET login_attempts = 0, " +
+		"login_failed = NULL, " +
+		"locked_until = NULL, " +
+		"unlock_token = NULL " +
+		"WHERE ident = $1 " +
+		"AND unlock_token = $2"
+	err = user_mailtoken_use(ctx,
+		"Invalid or already used unlock link",
+		"Unlocked account $1 using the mailed token",
+		q, username, token)
+	if err != nil {
+		return
+	}
+
+	userevent_user(ctx, username, "account_unlocked")
+	return
+}
+
+/* Accounts that have failed attempts, for the sysadmin */
+func User_LockedList() (users []PfLockedUser, err error) {
+	q := "SELECT ident, login_attempts, " +
+		"CASE WHEN locked_until > NOW() THEN locked_until END " +
+		"FROM member " +
+		"WHERE login_attempts > 0 " +
+		"ORDER BY login_attempts DESC, ident"
+	rows, err := DB.Query(q)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var u PfLockedUser
+		var locked pq.NullTime
+
+		err = rows.Scan(&u.UserName, &u.Attempts, &locked)
+		if err != nil {
+			return
+		}
+
+		if locked.Valid {
+			u.LockedUntil = locked.Time
+		}
+
+		users = append(users, u)
+	}
+
+	return
+}
+
+func user_pw_unlock(ctx PfCtx, args []string) (err error) {
+	err = User_Unlock(ctx, args[0], args[1])
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Account unlocked")
+	return
+}
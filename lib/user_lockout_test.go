@@ -0,0 +1,38 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run Lockout -v
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockout_Delay(t *testing.T) {
+	Config.Lockout_delay = 2
+	defer func() {
+		Config.Lockout_delay = 0
+	}()
+
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 1 * time.Second},
+		{3, 2 * time.Second},
+		{4, 4 * time.Second},
+		{10, 256 * time.Second},
+		{11, LOCKOUT_DELAY_MAX},
+		{1000, LOCKOUT_DELAY_MAX},
+	}
+
+	for _, tt := range tests {
+		d := lockout_delay(tt.attempts)
+		if d != tt.delay {
+			t.Errorf("Delay after %d attempts is %s, expected %s", tt.attempts, d, tt.delay)
+		}
+	}
+}
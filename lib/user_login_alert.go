@@ -0,0 +1,301 @@
+package pitchfork
+
+/*
+ * New device and network login alerts
+ *
+ * Each successful login is compared against the logins of the user
+ * (userevents) in the last LOGIN_HISTORY_DAYS. When the browser/OS
+ * combination or the network has not been seen before, the user is
+ * mailed, and when login_alert_admin is configured, the admins of
+ * their groups too.
+ *
+ * Without geolocation, the network is the /16 (IPv4) or /32 (IPv6)
+ * the IP is in, roughly a provider or region.
+ *
+ * The mail has a "this wasn't me" link, which revokes all sessions
+ * of the user and requires a new password (see User_LoginNotMe).
+ */
+
+import (
+	"net"
+	"strconv"
+)
+
+/* How far back logins count as known */
+const LOGIN_HISTORY_DAYS = 180
+
+/* Network prefix lengths */
+const (
+	LOGIN_NET_V4 = 16
+	LOGIN_NET_V6 = 32
+)
+
+/* How long the "this wasn't me" link can be used */
+const LOGIN_ALERT_DAYS = 7
+
+/* The network an IP is in, empty when it is not an IP */
+func login_network(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+
+	if v4 := addr.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(LOGIN_NET_V4, 32)), Mask: net.CIDRMask(LOGIN_NET_V4, 32)}).String()
+	}
+
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(LOGIN_NET_V6, 128)), Mask: net.CIDRMask(LOGIN_NET_V6, 128)}).String()
+}
+
+type login_seen struct {
+	browser string
+	os      string
+	ip      string
+}
+
+/* Compare a login against the earlier ones */
+func login_compare(history []login_seen, cur login_seen) (newdev bool, newnet bool) {
+	/* Nothing to compare with, eg the first login */
+	if len(history) == 0 {
+		return
+	}
+
+	newdev = true
+	newnet = true
+
+	curnet := login_network(cur.ip)
+
+	for _, h := range history {
+		if h.browser == cur.browser && h.os == cur.os {
+			newdev = false
+		}
+
+		if login_network(h.ip) == curnet {
+			newnet = false
+		}
+	}
+
+	return
+}
+
+/*
+ * Check a successful login, to be called before
+ * the login itself is recorded as a userevent
+ */
+func login_alert_check(ctx PfCtx, username string) {
+	var history []login_seen
+
+	q := "SELECT browser, os, ip " +
+		"FROM userevents " +
+		"WHERE ident = $1 " +
+		"AND event IN ('login', 'login_device') " +
+		"AND entered > NOW() - INTERVAL '" + strconv.Itoa(LOGIN_HISTORY_DAYS) + " days'"
+	rows, err := DB.Query(q, username)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var h login_seen
+
+		err = rows.Scan(&h.browser, &h.os, &h.ip)
+		if err != nil {
+			return
+		}
+
+		history = append(history, h)
+	}
+
+	_, browser, os := ctx.GetUserAgent()
+	cur := login_seen{browser, os, ctx.GetClientIP().String()}
+
+	newdev, newnet := login_compare(history, cur)
+	if !newdev && !newnet {
+		return
+	}
+
+	err = login_alert(ctx, username, cur, newdev, newnet)
+	if err != nil {
+		Errf("Login alert for %s failed: %s", username, err.Error())
+	}
+}
+
+/* Record and mail the alert */
+func login_alert(ctx PfCtx, username string, cur login_seen, newdev bool, newnet bool) (err error) {
+	var pw PfPass
+
+	token, err := pw.GenRandHex(32)
+	if err != nil {
+		return
+	}
+
+	q := "INSERT INTO login_alert " +
+		"(member, token, ip, browser, os) " +
+		"VALUES($1, $2, $3, $4, $5)"
+	err = DB.ExecNA(1, q, username, pw.SOTPHash(token), cur.ip, cur.browser, cur.os)
+	if err != nil {
+		return
+	}
+
+	if newdev {
+		userevent_user(ctx, username, "login_new_device")
+	}
+
+	if newnet {
+		userevent_user(ctx, username, "login_new_network")
+	}
+
+	user := ctx.NewUser()
+	user.SetUserName(username)
+
+	email, err := user.GetPriEmail(ctx, false)
+	if err != nil {
+		return
+	}
+
+	data := map[string]interface{}{
+		"Member":     username,
+		"IP":         cur.ip,
+		"Network":    login_network(cur.ip),
+		"Browser":    cur.browser,
+		"OS":         cur.os,
+		"NewDevice":  newdev,
+		"NewNetwork": newnet,
+		"URL":        System_Get().PublicURL + "/notme/?username=" + username + "&token=" + token,
+	}
+
+	err = Mail_Template(ctx, email, "login_new", "New login to your account", data)
+	if err != nil || !Config.LoginAlertAdmin {
+		return
+	}
+
+	admins, err := login_alert_admins(username)
+	if err != nil {
+		return
+	}
+
+	for _, a := range admins {
+		Mail_Template(ctx, a, "login_new_admin", "New login of a group member", data)
+	}
+
+	return
+}
+
+/* The admins of the groups of the user, with the address they use for that group */
+func login_alert_admins(username string) (admins []PfUserEmail, err error) {
+	q := "SELECT DISTINCT ON (adm.member) adm.member, m.descr, adm.email " +
+		"FROM member_trustgroup mt " +
+		"INNER JOIN member_trustgroup adm ON (adm.trustgroup = mt.trustgroup AND adm.admin) " +
+		"INNER JOIN member m ON (m.ident = adm.member) " +
+		"WHERE mt.member = $1 " +
+		"AND adm.member <> $1 " +
+		"ORDER BY adm.member"
+	rows, err := DB.Query(q, username)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var a PfUserEmail
+
+		err = rows.Scan(&a.Member, &a.FullName, &a.Email)
+		if err != nil {
+			return
+		}
+
+		admins = append(admins, a)
+	}
+
+	return
+}
+
+/*
+ * The user did not recognize the login
+ *
+ * All sessions, personal access tokens and OAuth2 authorizations
+ * are revoked and the password is cleared,
+ * the returned recovery token sets a new one
+ * ('user password recover').
+ */
+func User_LoginNotMe(ctx PfCtx, username string, token string) (rectoken string, err error) {
+	var pw PfPass
+
+	q := "UPDATE login_alert " +
+		"SET used = TRUE " +
+		"WHERE member = $1 " +
+		"AND token = $2 " +
+		"AND NOT used " +
+		"AND entered > NOW() - INTERVAL '" + strconv.Itoa(LOGIN_ALERT_DAYS) + " days'"
+	err = user_mailtoken_use(ctx,
+		"Invalid, expired or already used link",
+		"Login of $1 reported as not theirs",
+		q, username, token)
+	if err != nil {
+		return
+	}
+
+	err = user_revoke_access(ctx, username)
+	if err != nil {
+		return
+	}
+
+	q = "UPDATE member " +
+		"SET password = '' " +
+		"WHERE ident = $1"
+	err = DB.Exec(ctx,
+		"Cleared password of $1 after a login that was not theirs",
+		1, q, username)
+	if err != nil {
+		return
+	}
+
+	rectoken, err = pw.GenRandHex(16)
+	if err != nil {
+		return
+	}
+
+	user := ctx.NewUser()
+	user.SetUserName(username)
+
+	err = user.SetRecoverToken(ctx, rectoken)
+	if err != nil {
+		rectoken = ""
+		return
+	}
+
+	userevent_user(ctx, username, "login_notme")
+	return
+}
+
+/* Revoke everything that gives access to the account, except the password */
+func user_revoke_access(ctx PfCtx, username string) (err error) {
+	/* Nobody is logged in here, thus all sessions */
+	_, err = UserSession_RevokeAll(ctx, username)
+	if err != nil {
+		return
+	}
+
+	/* API access */
+	err = UserToken_RevokeAll(ctx, username)
+	if err != nil {
+		return
+	}
+
+	err = OAuth2_ConsentRevokeAll(ctx, username)
+	return
+}
+
+func user_pw_notme(ctx PfCtx, args []string) (err error) {
+	rectoken, err := User_LoginNotMe(ctx, args[0], args[1])
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("All sessions and API access have been revoked and the password has been cleared")
+	ctx.OutLn("Set a new password with: user password recover %s %s <password>", args[0], rectoken)
+	return
+}
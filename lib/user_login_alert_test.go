@@ -0,0 +1,109 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run LoginAlert -v
+ */
+
+import (
+	"testing"
+)
+
+func TestLoginAlert_Network(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":        "192.0.0.0/16",
+		"192.0.200.9":      "192.0.0.0/16",
+		"2001:db8:1::1":    "2001:db8::/32",
+		"::ffff:192.0.2.1": "192.0.0.0/16",
+		"garbage":          "",
+	}
+
+	for ip, exp := range tests {
+		got := login_network(ip)
+		if got != exp {
+			t.Errorf("Network of %s is %q, expected %q", ip, got, exp)
+		}
+	}
+}
+
+func TestLoginAlert_Compare(t *testing.T) {
+	history := []login_seen{
+		{"Firefox", "Linux", "192.0.2.1"},
+		{"Safari", "iOS", "198.51.100.7"},
+	}
+
+	tests := []struct {
+		cur    login_seen
+		newdev bool
+		newnet bool
+	}{
+		{login_seen{"Firefox", "Linux", "192.0.99.1"}, false, false},
+		{login_seen{"Chrome", "Linux", "192.0.2.1"}, true, false},
+		{login_seen{"Safari", "iOS", "203.0.113.5"}, false, true},
+		{login_seen{"Firefox", "iOS", "2001:db8::1"}, true, true},
+	}
+
+	for _, tt := range tests {
+		newdev, newnet := login_compare(history, tt.cur)
+		if newdev != tt.newdev || newnet != tt.newnet {
+			t.Errorf("Login %v: new device %t network %t, expected %t %t", tt.cur, newdev, newnet, tt.newdev, tt.newnet)
+		}
+	}
+
+	/* The first login has nothing to compare with */
+	newdev, newnet := login_compare(nil, history[0])
+	if newdev || newnet {
+		t.Errorf("First login raised an alert")
+	}
+}
+
+/* Requires the test database, like the IPtrk tests */
+func TestLoginAlert_RevokeAccess(t *testing.T) {
+	username := "notmetest"
+	client_id := "notmetest-client"
+
+	cleanup := func() {
+		DB.ExecNA(-1, "DELETE FROM member WHERE ident = $1", username)
+		DB.ExecNA(-1, "DELETE FROM oauth2_client WHERE client_id = $1", client_id)
+	}
+
+	cleanup()
+	defer cleanup()
+
+	fixtures := []struct {
+		q    string
+		args []interface{}
+	}{
+		{"INSERT INTO member (ident, descr, uuid) VALUES($1, 'Not Me', '00000000-0000-4000-8000-00000000bad1')", []interface{}{username}},
+		{"INSERT INTO oauth2_client (client_id) VALUES($1)", []interface{}{client_id}},
+		{"INSERT INTO oauth2_consent (member, client_id, scope) VALUES($1, $2, 'openid')", []interface{}{username, client_id}},
+		{"INSERT INTO oauth2_refresh (token, family, member, client_id, scope, expires) VALUES('notmetest', 'notmetest', $1, $2, 'openid', NOW() + INTERVAL '1 day')", []interface{}{username, client_id}},
+		{"INSERT INTO user_token (member, name, token, scope) VALUES($1, 'test', 'notmetest', 'user')", []interface{}{username}},
+	}
+
+	for _, f := range fixtures {
+		err := DB.ExecNA(1, f.q, f.args...)
+		if err != nil {
+			t.Fatalf("Fixture %q failed: %s", f.q, err.Error())
+		}
+	}
+
+	ctx := NewPfCtx(nil, nil, nil, nil, nil)
+
+	err := user_revoke_access(ctx, username)
+	if err != nil {
+		t.Fatalf("Revoking failed: %s", err.Error())
+	}
+
+	for _, table := range []string{"user_token", "oauth2_consent", "oauth2_refresh"} {
+		var cnt int
+
+		err = DB.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE member = $1", username).Scan(&cnt)
+		if err != nil {
+			t.Fatalf("Counting %s failed: %s", table, err.Error())
+		}
+
+		if cnt != 0 {
+			t.Errorf("%d rows left in %s", cnt, table)
+		}
+	}
+}
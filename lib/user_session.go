@@ -0,0 +1,247 @@
+package pitchfork
+
+/*
+ * Session Registry
+ *
+ * Session tokens (JWTs) are renewed while in use, each renewal
+ * retains the jti of the token from the login, thus the jti
+ * identifies the session.
+ *
+ * Revoking a session invalidates its jti in the jwt_invalidated
+ * table (see jwt_invalid.go), which is checked, and cached, when
+ * a session token is used. As tokens of a revoked session can't be
+ * renewed, the entry is only needed till the last token expires.
+ *
+ * Sessions that have not been renewed in TOKEN_EXPIRATIONMINUTES
+ * have expired and are removed.
+ */
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+type PfSession struct {
+	Id       string
+	IP       string
+	Browser  string
+	OS       string
+	Entered  time.Time
+	LastSeen time.Time
+	LastIP   string
+	Current  bool /* The session used for the request */
+}
+
+/* Still active sessions, others have expired */
+var session_active = "last_seen > NOW() - INTERVAL '" + strconv.Itoa(TOKEN_EXPIRATIONMINUTES) + " minutes'"
+
+/* The key in jwt_invalidated, distinct from the tokens themselves */
+func session_key(id string) string {
+	return "session:" + id
+}
+
+/* Record a new session, returns the jti */
+func session_new(ctx PfCtx, username string) (id string, err error) {
+	var pw PfPass
+
+	/* Cleanup */
+	q := "DELETE FROM user_session " +
+		"WHERE NOT " + session_active
+	err = DB.ExecNA(-1, q)
+	if err != nil {
+		return
+	}
+
+	id, err = pw.GenRandHex(16)
+	if err != nil {
+		return
+	}
+
+	ip := ctx.GetClientIP().String()
+	ua_full, ua_browser, ua_os := ctx.GetUserAgent()
+
+	q = "INSERT INTO user_session " +
+		"(id, member, ip, browser, os, fullua, last_seen, last_ip) " +
+		"VALUES($1, $2, $3, $4, $5, $6, NOW(), $3)"
+	err = DB.ExecNA(1, q, id, username, ip, ua_browser, ua_os, ua_full)
+	if err != nil {
+		id = ""
+	}
+
+	return
+}
+
+/* The session is still in use, called when its token is renewed */
+func session_seen(ctx PfCtx, id string) (err error) {
+	q := "UPDATE user_session " +
+		"SET last_seen = NOW(), last_ip = $2 " +
+		"WHERE id = $1"
+	err = DB.ExecNA(1, q, id, ctx.GetClientIP().String())
+	if err == ErrNoRows {
+		err = errors.New("Session has expired")
+	}
+
+	return
+}
+
+/* Has the session been revoked? */
+func session_revoked(id string) bool {
+	claims := &JWTClaims{}
+	claims.ExpiresAt = time.Now().Add(time.Minute * TOKEN_EXPIRATIONMINUTES).Unix()
+
+	return Jwt_isinvalidated(session_key(id), claims)
+}
+
+/* End a session, no new tokens can be created for it */
+func session_end(id string) {
+	claims := &JWTClaims{}
+	claims.ExpiresAt = time.Now().Add(time.Minute * TOKEN_EXPIRATIONMINUTES).Unix()
+
+	Jwt_invalidate(session_key(id), claims)
+
+	q := "DELETE FROM user_session " +
+		"WHERE id = $1"
+	DB.ExecNA(-1, q, id)
+}
+
+func UserSession_List(ctx PfCtx, username string) (sessions []PfSession, err error) {
+	q := "SELECT id, ip, browser, os, entered, last_seen, last_ip " +
+		"FROM user_session " +
+		"WHERE member = $1 " +
+		"AND " + session_active + " " +
+		"ORDER BY last_seen DESC"
+	rows, err := DB.Query(q, username)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	cur := ctx.GetSession()
+
+	for rows.Next() {
+		var s PfSession
+
+		err = rows.Scan(&s.Id, &s.IP, &s.Browser, &s.OS, &s.Entered, &s.LastSeen, &s.LastIP)
+		if err != nil {
+			return
+		}
+
+		s.Current = s.Id == cur
+		sessions = append(sessions, s)
+	}
+
+	return
+}
+
+func UserSession_Revoke(ctx PfCtx, username string, id string) (err error) {
+	q := "DELETE FROM user_session " +
+		"WHERE member = $1 " +
+		"AND id = $2"
+	err = DB.Exec(ctx,
+		"Revoked session $2 of $1",
+		1, q, username, id)
+	if err == ErrNoRows {
+		err = errors.New("Unknown session")
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	session_end(id)
+	userevent_user(ctx, username, "session_revoke")
+	return
+}
+
+/* Revoke all sessions of the user, except the one making the request */
+func UserSession_RevokeAll(ctx PfCtx, username string) (count int, err error) {
+	sessions, err := UserSession_List(ctx, username)
+	if err != nil {
+		return
+	}
+
+	for _, s := range sessions {
+		if s.Current {
+			continue
+		}
+
+		err = UserSession_Revoke(ctx, username, s.Id)
+		if err != nil {
+			return
+		}
+
+		count++
+	}
+
+	return
+}
+
+func user_session_list(ctx PfCtx, args []string) (err error) {
+	sessions, err := UserSession_List(ctx, ctx.SelectedUser().GetUserName())
+	if err != nil {
+		return
+	}
+
+	if len(sessions) == 0 {
+		ctx.OutLn("No active sessions")
+		return
+	}
+
+	for _, s := range sessions {
+		cur := ""
+		if s.Current {
+			cur = " [current]"
+		}
+
+		ctx.OutLn("%s %s/%s from %s, started %s, last seen %s from %s%s", s.Id, s.Browser, s.OS, s.IP, Fmt_Time(s.Entered), Fmt_Time(s.LastSeen), s.LastIP, cur)
+	}
+
+	return
+}
+
+func user_session_revoke(ctx PfCtx, args []string) (err error) {
+	err = UserSession_Revoke(ctx, ctx.SelectedUser().GetUserName(), args[1])
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Session revoked")
+	return
+}
+
+func user_session_revoke_all(ctx PfCtx, args []string) (err error) {
+	count, err := UserSession_RevokeAll(ctx, ctx.SelectedUser().GetUserName())
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Revoked " + strconv.Itoa(count) + " sessions")
+	return
+}
+
+func user_session_menu(ctx PfCtx, args []string) (err error) {
+	perms := PERM_USER_SELF
+
+	menu := NewPfMenu([]PfMEntry{
+		{"list", user_session_list, 1, 1, []string{"username"}, perms, "List active sessions"},
+		{"revoke", user_session_revoke, 2, 2, []string{"username", "session"}, perms, "Revoke a session"},
+		{"revoke-all", user_session_revoke_all, 1, 1, []string{"username"}, perms, "Revoke all sessions, except the current one"},
+	})
+
+	if len(args) >= 2 {
+		/* Check if we have perms for this user */
+		err = ctx.SelectUser(args[1], perms)
+		if err != nil {
+			return
+		}
+	} else {
+		/* Nothing selected */
+		ctx.SelectUser("", PERM_NONE)
+	}
+
+	err = ctx.Menu(args, menu)
+	return
+}
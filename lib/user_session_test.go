@@ -0,0 +1,163 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run UserSession -v
+ */
+
+import (
+	"testing"
+	"time"
+)
+
+/* Seed the invalidation cache, so that no database is needed */
+func usersession_test_cache(tok string, isvalid bool) {
+	claims := &JWTClaims{}
+	claims.ExpiresAt = time.Now().Add(time.Minute * TOKEN_EXPIRATIONMINUTES).Unix()
+
+	jwtinv_mutex.Lock()
+	jwtinv_cache_del(tok)
+	jwtinv_cache_add(tok, isvalid, claims)
+	jwtinv_mutex.Unlock()
+}
+
+func usersession_test_uncache(tok string) {
+	jwtinv_mutex.Lock()
+	jwtinv_cache_del(tok)
+	jwtinv_mutex.Unlock()
+}
+
+func TestUserSession_Revoked(t *testing.T) {
+	file := jwtkey_test_key(t)
+	Config.Token_prv = file
+	Config.Token_pub = &file.PublicKey
+
+	/* Only the configured key */
+	jwtkeys = nil
+	jwtkeys_loaded = time.Time{}
+
+	id := "0123456789abcdef"
+	other := "fedcba9876543210"
+
+	defer usersession_test_uncache(session_key(id))
+	defer usersession_test_uncache(session_key(other))
+
+	usersession_test_cache(session_key(id), true)
+	usersession_test_cache(session_key(other), true)
+
+	if session_revoked(id) {
+		t.Errorf("Active session %q is revoked", id)
+	}
+
+	/* A token of the session */
+	claims := &SessionClaims{}
+	claims.Id = id
+	tok, err := Token_New("websession", "jdoe", TOKEN_EXPIRATIONMINUTES, claims).Sign()
+	if err != nil {
+		t.Fatalf("Signing failed: %s", err.Error())
+	}
+
+	defer usersession_test_uncache(tok)
+	usersession_test_cache(tok, true)
+
+	/* Revoking the session, not the token */
+	usersession_test_cache(session_key(id), false)
+
+	if !session_revoked(id) {
+		t.Errorf("Revoked session %q is not revoked", id)
+	}
+
+	if session_revoked(other) {
+		t.Errorf("Session %q is revoked with %q", other, id)
+	}
+
+	/* Refused before the user is looked up */
+	ctx := &PfCtxS{}
+
+	_, err = ctx.LoginToken(tok)
+	if err == nil || err.Error() != "Session has been revoked" {
+		t.Errorf("Login with the token of a revoked session returned %v", err)
+	}
+
+	if ctx.IsLoggedIn() || ctx.GetToken() != "" {
+		t.Errorf("Logged in with the token of a revoked session")
+	}
+}
+
+func TestUserSession_RevokeAll(t *testing.T) {
+	username := "sesstest"
+
+	cleanup := func() {
+		DB.ExecNA(-1, "DELETE FROM user_session WHERE member = $1", username)
+		DB.ExecNA(-1, "DELETE FROM member WHERE ident = $1", username)
+	}
+
+	cleanup()
+	defer cleanup()
+
+	err := DB.ExecNA(1, "INSERT INTO member (ident, descr, uuid) VALUES($1, 'Session Test', '00000000-0000-4000-8000-00000005e551')", username)
+	if err != nil {
+		t.Fatalf("Member fixture failed: %s", err.Error())
+	}
+
+	ctx := testingctx()
+
+	user := ctx.NewUser()
+	err = user.fetch(ctx, username)
+	if err != nil {
+		t.Fatalf("Fetching user failed: %s", err.Error())
+	}
+	ctx.Become(user)
+
+	/* A new session */
+	err = ctx.NewToken()
+	if err != nil {
+		t.Fatalf("NewToken failed: %s", err.Error())
+	}
+
+	cur := ctx.GetSession()
+	if cur == "" {
+		t.Fatalf("No session for the new token")
+	}
+
+	/* Renewal keeps the session */
+	err = ctx.NewToken()
+	if err != nil {
+		t.Fatalf("Renewing the token failed: %s", err.Error())
+	}
+
+	if ctx.GetSession() != cur {
+		t.Errorf("Renewal changed the session from %q to %q", cur, ctx.GetSession())
+	}
+
+	/* Another browser */
+	other, err := session_new(testingctx(), username)
+	if err != nil {
+		t.Fatalf("Second session failed: %s", err.Error())
+	}
+
+	count, err := UserSession_RevokeAll(ctx, username)
+	if err != nil {
+		t.Fatalf("Revoking all sessions failed: %s", err.Error())
+	}
+
+	if count != 1 {
+		t.Errorf("Revoked %d sessions instead of 1", count)
+	}
+
+	if !session_revoked(other) {
+		t.Errorf("Other session %q is not revoked", other)
+	}
+
+	if session_revoked(cur) {
+		t.Errorf("Current session %q is revoked", cur)
+	}
+
+	/* The current token still logs in */
+	ctx2 := testingctx()
+	_, err = ctx2.LoginToken(ctx.GetToken())
+	if err != nil {
+		t.Errorf("Login with the current token failed: %s", err.Error())
+	} else if ctx2.GetSession() != cur {
+		t.Errorf("Login gave session %q instead of %q", ctx2.GetSession(), cur)
+	}
+}
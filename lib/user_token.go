@@ -0,0 +1,293 @@
+package pitchfork
+
+/*
+ * Personal Access Tokens
+ *
+ * Long-lived, named tokens for automation (cron jobs, scripts, tcli)
+ * that are accepted as a bearer token on /api.
+ *
+ * Like OAuth2 access tokens they are limited to a scope (see scope.go).
+ * Only the hash of a token is stored, it is shown once when created.
+ *
+ * Use is tracked: the last time and IP are stored with the token,
+ * use from a new IP is logged as a userevent.
+ */
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+/* Makes tokens recognizable, for us and for secret scanners */
+const USER_TOKEN_PREFIX = "pat_"
+
+type PfUserToken struct {
+	Id       int
+	Name     string
+	Scope    string
+	Entered  time.Time
+	Expires  time.Time /* Zero when it does not expire */
+	LastUsed time.Time
+	LastIP   string
+}
+
+/* Is it a personal access token (and not a JWT)? */
+func UserToken_Is(tok string) bool {
+	return strings.HasPrefix(tok, USER_TOKEN_PREFIX)
+}
+
+func user_token_hash(tok string) string {
+	var pw PfPass
+	return pw.SOTPHash(strings.TrimPrefix(tok, USER_TOKEN_PREFIX))
+}
+
+func UserToken_List(username string) (toks []PfUserToken, err error) {
+	q := "SELECT id, name, scope, entered, expires, last_used, last_ip " +
+		"FROM user_token " +
+		"WHERE member = $1 " +
+		"ORDER BY name"
+	rows, err := DB.Query(q, username)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var t PfUserToken
+		var expires, last_used pq.NullTime
+
+		err = rows.Scan(&t.Id, &t.Name, &t.Scope, &t.Entered, &expires, &last_used, &t.LastIP)
+		if err != nil {
+			return
+		}
+
+		if expires.Valid {
+			t.Expires = expires.Time
+		}
+
+		if last_used.Valid {
+			t.LastUsed = last_used.Time
+		}
+
+		toks = append(toks, t)
+	}
+
+	return
+}
+
+/* Create a token, days of 0 means it does not expire */
+func UserToken_Create(ctx PfCtx, username string, name string, scope string, days int) (tok string, err error) {
+	var pw PfPass
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		err = errors.New("A token needs a name")
+		return
+	}
+
+	scope = strings.Join(strings.Fields(scope), " ")
+	if scope == "" {
+		err = errors.New("A token needs a scope")
+		return
+	}
+
+	err = Scope_Valid(scope)
+	if err != nil {
+		return
+	}
+
+	if OAuth2_HasScope(scope, SCOPE_SESSION) {
+		err = errors.New("Scope " + SCOPE_SESSION + " is only for logging in")
+		return
+	}
+
+	if days < 0 {
+		err = errors.New("Invalid number of days")
+		return
+	}
+
+	rnd, err := pw.GenRandHex(32)
+	if err != nil {
+		return
+	}
+
+	tok = USER_TOKEN_PREFIX + rnd
+
+	var expires interface{}
+	if days > 0 {
+		expires = time.Now().UTC().Add(time.Hour * 24 * time.Duration(days))
+	}
+
+	q := "INSERT INTO user_token " +
+		"(member, name, token, scope, expires) " +
+		"VALUES($1, $2, $3, $4, $5)"
+	err = DB.Exec(ctx,
+		"Created personal access token $2 with scope $4",
+		1, q, username, name, user_token_hash(tok), scope, expires)
+	if err != nil {
+		if DB_IsPQErrorConstraint(err) {
+			err = errors.New("A token named " + name + " already exists")
+		}
+		tok = ""
+		return
+	}
+
+	userevent_user(ctx, username, "token_create")
+	return
+}
+
+func UserToken_Revoke(ctx PfCtx, username string, id int) (err error) {
+	q := "DELETE FROM user_token " +
+		"WHERE member = $1 " +
+		"AND id = $2"
+	err = DB.Exec(ctx,
+		"Revoked personal access token $2",
+		1, q, username, id)
+	if err == ErrNoRows {
+		err = errors.New("Unknown token")
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	userevent_user(ctx, username, "token_revoke")
+	return
+}
+
+/* Revoke all personal access tokens of the user */
+func UserToken_RevokeAll(ctx PfCtx, username string) (err error) {
+	q := "DELETE FROM user_token " +
+		"WHERE member = $1"
+	err = DB.Exec(ctx,
+		"Revoked all personal access tokens of $1",
+		-1, q, username)
+	return
+}
+
+/* Authenticate using a personal access token */
+func (ctx *PfCtxS) LoginPAT(tok string) (err error) {
+	var id int
+	var username, scope, last_ip string
+
+	ctx.token = ""
+
+	q := "SELECT id, member, scope, last_ip " +
+		"FROM user_token " +
+		"WHERE token = $1 " +
+		"AND (expires IS NULL OR expires > NOW())"
+	err = DB.QueryRow(q, user_token_hash(tok)).Scan(&id, &username, &scope, &last_ip)
+	if err == ErrNoRows {
+		err = errors.New("Invalid or expired token")
+		return
+	} else if err != nil {
+		return
+	}
+
+	err = ctx.login_scoped(username, scope, tok)
+	if err != nil {
+		return
+	}
+
+	ip := ctx.GetClientIP().String()
+
+	q = "UPDATE user_token " +
+		"SET last_used = NOW(), last_ip = $2 " +
+		"WHERE id = $1"
+	err = DB.ExecNActx(ctx, 1, q, id, ip)
+	if err != nil {
+		return
+	}
+
+	/* Every call would flood the events, thus only new locations */
+	if ip != last_ip {
+		userevent(ctx, "token_used")
+	}
+
+	return
+}
+
+func user_token_create(ctx PfCtx, args []string) (err error) {
+	days := 0
+
+	if len(args) > 3 && args[3] != "" {
+		days, err = strconv.Atoi(args[3])
+		if err != nil {
+			err = errors.New("Invalid number of days")
+			return
+		}
+	}
+
+	tok, err := UserToken_Create(ctx, ctx.SelectedUser().GetUserName(), args[1], args[2], days)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Token: %s", tok)
+	ctx.OutLn("Store it safely, it can not be shown again")
+	return
+}
+
+func user_token_list(ctx PfCtx, args []string) (err error) {
+	toks, err := UserToken_List(ctx.SelectedUser().GetUserName())
+	if err != nil {
+		return
+	}
+
+	if len(toks) == 0 {
+		ctx.OutLn("No personal access tokens")
+		return
+	}
+
+	for _, t := range toks {
+		ctx.OutLn("%d %s (%s) created %s, expires %s, last used %s from %s", t.Id, t.Name, t.Scope, Fmt_Time(t.Entered), Fmt_Time(t.Expires), Fmt_Time(t.LastUsed), t.LastIP)
+	}
+
+	return
+}
+
+func user_token_revoke(ctx PfCtx, args []string) (err error) {
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		err = errors.New("Invalid token id")
+		return
+	}
+
+	err = UserToken_Revoke(ctx, ctx.SelectedUser().GetUserName(), id)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Token revoked")
+	return
+}
+
+func user_token_menu(ctx PfCtx, args []string) (err error) {
+	perms := PERM_USER_SELF
+
+	menu := NewPfMenu([]PfMEntry{
+		{"create", user_token_create, 3, 4, []string{"username", "name", "scope", "days#int"}, perms, "Create a personal access token, valid for days (0 or empty for no expiry)"},
+		{"list", user_token_list, 1, 1, []string{"username"}, perms, "List personal access tokens"},
+		{"revoke", user_token_revoke, 2, 2, []string{"username", "id#int"}, perms, "Revoke a personal access token"},
+	})
+
+	if len(args) >= 2 {
+		/* Check if we have perms for this user */
+		err = ctx.SelectUser(args[1], perms)
+		if err != nil {
+			return
+		}
+	} else {
+		/* Nothing selected */
+		ctx.SelectUser("", PERM_NONE)
+	}
+
+	err = ctx.Menu(args, menu)
+	return
+}
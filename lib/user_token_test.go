@@ -0,0 +1,39 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run UserToken -v
+ */
+
+import (
+	"testing"
+)
+
+func TestUserToken_Is(t *testing.T) {
+	tsts := []struct {
+		tok string
+		ok  bool
+	}{
+		{USER_TOKEN_PREFIX + "0123456789abcdef", true},
+		{"eyJhbGciOiJFUzUxMiIsInR5cCI6IkpXVCJ9.e30.sig", false},
+		{"", false},
+	}
+
+	for _, tst := range tsts {
+		if UserToken_Is(tst.tok) != tst.ok {
+			t.Errorf("UserToken_Is(%q) != %v", tst.tok, tst.ok)
+		}
+	}
+}
+
+func TestUserToken_Hash(t *testing.T) {
+	a := user_token_hash(USER_TOKEN_PREFIX + "0123456789abcdef")
+	b := user_token_hash(USER_TOKEN_PREFIX + "0123456789abcdee")
+
+	if a == b {
+		t.Errorf("Different tokens have the same hash")
+	}
+
+	if a == USER_TOKEN_PREFIX+"0123456789abcdef" {
+		t.Errorf("Token is not hashed")
+	}
+}
@@ -0,0 +1,735 @@
+package pitchfork
+
+/*
+ * WebAuthn (FIDO2) second factor
+ *
+ * Credentials are stored in second_factors with type WEBAUTHN:
+ *   credential	= the credential ID (base64url)
+ *   key	= the COSE public key (base64url)
+ *   counter	= the signature counter of the authenticator
+ *
+ * The challenge of a ceremony is kept in a short-lived token that
+ * is handed to the browser with the options and returned with the
+ * response, thus no server side state is needed.
+ *
+ * Attestation is not verified ("none" conveyance), the credential
+ * is bound to the user by the password check preceding registration.
+ */
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/url"
+	"strings"
+)
+
+/* How long a ceremony may take */
+const WEBAUTHN_TIMEOUT = 5
+
+/* Authenticator data flags */
+const (
+	WEBAUTHN_FLAG_UP = 0x01 /* User Present */
+	WEBAUTHN_FLAG_UV = 0x04 /* User Verified */
+	WEBAUTHN_FLAG_AT = 0x40 /* Attested credential data included */
+)
+
+/* COSE algorithms we accept */
+const (
+	COSE_ALG_ES256 = -7
+	COSE_ALG_EDDSA = -8
+	COSE_ALG_RS256 = -257
+)
+
+type WebAuthnClaims struct {
+	JWTClaims
+	Challenge string `json:"wa_challenge"`
+	Ceremony  string `json:"wa_ceremony"`
+}
+
+/* The response of the browser, binary fields are base64url encoded */
+type PfWebAuthnResponse struct {
+	Token             string `json:"token"`
+	Id                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject,omitempty"`
+	AuthenticatorData string `json:"authenticatorData,omitempty"`
+	Signature         string `json:"signature,omitempty"`
+}
+
+type webauthn_clientdata struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type webauthn_authdata struct {
+	RPIdHash []byte
+	Flags    byte
+	Counter  uint32
+	CredId   []byte
+	PubKey   []byte /* COSE encoded */
+}
+
+type webauthn_cred struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+func webauthn_b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+/* Browsers use unpadded base64url, be lenient about padding */
+func webauthn_unb64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+/* The Relying Party ID and origin, derived from the public URL */
+func webauthn_rp() (rpid string, origin string) {
+	u, err := url.Parse(System_Get().PublicURL)
+	if err != nil {
+		return
+	}
+
+	return u.Hostname(), u.Scheme + "://" + u.Host
+}
+
+/* Parse authenticator data, with the attested credential when present */
+func webauthn_parse_authdata(data []byte) (ad webauthn_authdata, err error) {
+	if len(data) < 37 {
+		err = errors.New("Authenticator data too short")
+		return
+	}
+
+	ad.RPIdHash = data[:32]
+	ad.Flags = data[32]
+	ad.Counter = binary.BigEndian.Uint32(data[33:37])
+
+	if ad.Flags&WEBAUTHN_FLAG_AT == 0 {
+		return
+	}
+
+	/* AAGUID (16) + credential ID length (2) */
+	rest := data[37:]
+	if len(rest) < 18 {
+		err = errors.New("Attested credential data too short")
+		return
+	}
+
+	l := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < l {
+		err = errors.New("Credential ID truncated")
+		return
+	}
+
+	ad.CredId = rest[:l]
+	rest = rest[l:]
+
+	/* The COSE key is followed by optional extensions */
+	_, ext, err := cbor_decode(rest)
+	if err != nil {
+		return
+	}
+
+	ad.PubKey = rest[:len(rest)-len(ext)]
+	return
+}
+
+func webauthn_cose_int(m map[interface{}]interface{}, k int64) (int64, bool) {
+	v, ok := m[k].(int64)
+	return v, ok
+}
+
+func webauthn_cose_bytes(m map[interface{}]interface{}, k int64) []byte {
+	v, _ := m[k].([]byte)
+	return v
+}
+
+/* Convert a COSE key to a public key */
+func webauthn_cose_key(cose []byte) (alg int64, pub crypto.PublicKey, err error) {
+	v, _, err := cbor_decode(cose)
+	if err != nil {
+		return
+	}
+
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		err = errors.New("COSE key is not a map")
+		return
+	}
+
+	kty, _ := webauthn_cose_int(m, 1)
+	alg, _ = webauthn_cose_int(m, 3)
+
+	switch {
+	case kty == 2 && alg == COSE_ALG_ES256:
+		crv, _ := webauthn_cose_int(m, -1)
+		x := webauthn_cose_bytes(m, -2)
+		y := webauthn_cose_bytes(m, -3)
+
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			err = errors.New("Invalid EC2 COSE key")
+			return
+		}
+
+		k := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !k.Curve.IsOnCurve(k.X, k.Y) {
+			err = errors.New("EC2 COSE key not on curve")
+			return
+		}
+		pub = k
+
+	case kty == 1 && alg == COSE_ALG_EDDSA:
+		crv, _ := webauthn_cose_int(m, -1)
+		x := webauthn_cose_bytes(m, -2)
+
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			err = errors.New("Invalid OKP COSE key")
+			return
+		}
+		pub = ed25519.PublicKey(x)
+
+	case kty == 3 && alg == COSE_ALG_RS256:
+		n := webauthn_cose_bytes(m, -1)
+		e := webauthn_cose_bytes(m, -2)
+
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			err = errors.New("Invalid RSA COSE key")
+			return
+		}
+		pub = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	default:
+		err = errors.New("Unsupported COSE key type/algorithm")
+	}
+
+	return
+}
+
+/* Verify a signature made with a COSE key */
+func webauthn_verify_sig(cose []byte, data []byte, sig []byte) (err error) {
+	alg, pub, err := webauthn_cose_key(cose)
+	if err != nil {
+		return
+	}
+
+	ok := false
+
+	switch alg {
+	case COSE_ALG_ES256:
+		h := sha256.Sum256(data)
+		ok = ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), h[:], sig)
+
+	case COSE_ALG_EDDSA:
+		ok = ed25519.Verify(pub.(ed25519.PublicKey), data, sig)
+
+	case COSE_ALG_RS256:
+		h := sha256.Sum256(data)
+		ok = rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, h[:], sig) == nil
+	}
+
+	if !ok {
+		err = errors.New("Invalid WebAuthn signature")
+	}
+
+	return
+}
+
+/* Check the client data of a ceremony, returns the raw JSON for hashing */
+func webauthn_check_clientdata(b64 string, ctype string, challenge string, origin string) (raw []byte, err error) {
+	raw, err = webauthn_unb64(b64)
+	if err != nil {
+		return
+	}
+
+	var cd webauthn_clientdata
+
+	err = json.Unmarshal(raw, &cd)
+	if err != nil {
+		return
+	}
+
+	if cd.Type != ctype {
+		err = errors.New("Unexpected WebAuthn ceremony " + cd.Type)
+		return
+	}
+
+	if cd.Challenge != challenge {
+		err = errors.New("WebAuthn challenge mismatch")
+		return
+	}
+
+	if cd.Origin != origin {
+		err = errors.New("WebAuthn origin mismatch: " + cd.Origin)
+		return
+	}
+
+	return
+}
+
+func webauthn_check_rp(ad webauthn_authdata, rpid string) (err error) {
+	h := sha256.Sum256([]byte(rpid))
+	if !bytes.Equal(ad.RPIdHash, h[:]) {
+		err = errors.New("WebAuthn RP ID mismatch")
+		return
+	}
+
+	if ad.Flags&WEBAUTHN_FLAG_UP == 0 {
+		err = errors.New("WebAuthn user not present")
+		return
+	}
+
+	return
+}
+
+/* Verify a registration, returns the new credential */
+func webauthn_verify_register(rpid string, origin string, challenge string, resp PfWebAuthnResponse) (credid []byte, pubkey []byte, counter uint32, err error) {
+	_, err = webauthn_check_clientdata(resp.ClientDataJSON, "webauthn.create", challenge, origin)
+	if err != nil {
+		return
+	}
+
+	att, err := webauthn_unb64(resp.AttestationObject)
+	if err != nil {
+		return
+	}
+
+	v, _, err := cbor_decode(att)
+	if err != nil {
+		return
+	}
+
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		err = errors.New("Attestation object is not a map")
+		return
+	}
+
+	raw, ok := m["authData"].([]byte)
+	if !ok {
+		err = errors.New("Attestation object without authData")
+		return
+	}
+
+	ad, err := webauthn_parse_authdata(raw)
+	if err != nil {
+		return
+	}
+
+	err = webauthn_check_rp(ad, rpid)
+	if err != nil {
+		return
+	}
+
+	if ad.CredId == nil {
+		err = errors.New("No credential in attestation")
+		return
+	}
+
+	/* Make sure we can use the key later */
+	_, _, err = webauthn_cose_key(ad.PubKey)
+	if err != nil {
+		return
+	}
+
+	return ad.CredId, ad.PubKey, ad.Counter, nil
+}
+
+/* Verify an assertion against a stored credential, returns the new counter */
+func webauthn_verify_assert(rpid string, origin string, challenge string, pubkey []byte, counter uint32, resp PfWebAuthnResponse) (newcounter uint32, err error) {
+	cdraw, err := webauthn_check_clientdata(resp.ClientDataJSON, "webauthn.get", challenge, origin)
+	if err != nil {
+		return
+	}
+
+	raw, err := webauthn_unb64(resp.AuthenticatorData)
+	if err != nil {
+		return
+	}
+
+	ad, err := webauthn_parse_authdata(raw)
+	if err != nil {
+		return
+	}
+
+	err = webauthn_check_rp(ad, rpid)
+	if err != nil {
+		return
+	}
+
+	sig, err := webauthn_unb64(resp.Signature)
+	if err != nil {
+		return
+	}
+
+	/* The signature covers authData || SHA256(clientDataJSON) */
+	h := sha256.Sum256(cdraw)
+	err = webauthn_verify_sig(pubkey, append(append([]byte{}, raw...), h[:]...), sig)
+	if err != nil {
+		return
+	}
+
+	/* A counter that does not increase indicates a cloned authenticator */
+	if (ad.Counter != 0 || counter != 0) && ad.Counter <= counter {
+		err = errors.New("WebAuthn signature counter did not increase")
+		return
+	}
+
+	newcounter = ad.Counter
+	return
+}
+
+/* A challenge token for a ceremony of a user */
+func webauthn_challenge(username string, ceremony string) (challenge string, tok string, err error) {
+	var pw PfPass
+
+	rnd, err := pw.GenRandHex(32)
+	if err != nil {
+		return
+	}
+
+	/* The challenge is opaque to the browser */
+	challenge = webauthn_b64([]byte(rnd))
+
+	claims := &WebAuthnClaims{Challenge: challenge, Ceremony: ceremony}
+	token := Token_New("webauthn", username, WEBAUTHN_TIMEOUT, claims)
+	tok, err = token.Sign()
+	return
+}
+
+/* Check the token returned with a response, returns the challenge */
+func webauthn_token(username string, ceremony string, tok string) (challenge string, claims *WebAuthnClaims, err error) {
+	claims = &WebAuthnClaims{}
+
+	_, err = Token_Parse(tok, "webauthn", claims)
+	if err != nil {
+		return
+	}
+
+	if claims.Subject != username || claims.Ceremony != ceremony {
+		err = errors.New("WebAuthn token does not match")
+		return
+	}
+
+	challenge = claims.Challenge
+	return
+}
+
+func webauthn_response(in string) (resp PfWebAuthnResponse, err error) {
+	err = json.Unmarshal([]byte(in), &resp)
+	if err != nil {
+		err = errors.New("Invalid WebAuthn response")
+	}
+
+	return
+}
+
+/* The registered credentials of a user, for exclude/allow lists */
+func webauthn_creds(username string, activeonly bool) (creds []webauthn_cred) {
+	creds = []webauthn_cred{}
+
+	q := "SELECT credential " +
+		"FROM second_factors " +
+		"WHERE member = $1 " +
+		"AND type = 'WEBAUTHN' " +
+		"AND credential IS NOT NULL"
+
+	if activeonly {
+		q += " AND active"
+	}
+
+	rows, err := DB.Query(q, username)
+	if err != nil {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+
+		err = rows.Scan(&id)
+		if err != nil {
+			return
+		}
+
+		creds = append(creds, webauthn_cred{"public-key", id})
+	}
+
+	return
+}
+
+/* Options for navigator.credentials.create() */
+func WebAuthn_RegisterOptions(user PfUser) (options string, err error) {
+	challenge, tok, err := webauthn_challenge(user.GetUserName(), "create")
+	if err != nil {
+		return
+	}
+
+	sys := System_Get()
+	rpid, _ := webauthn_rp()
+
+	o := map[string]interface{}{
+		"token": tok,
+		"publicKey": map[string]interface{}{
+			"challenge": challenge,
+			"rp":        map[string]string{"id": rpid, "name": sys.Name},
+			"user": map[string]string{
+				"id":          webauthn_b64([]byte(user.GetUserName())),
+				"name":        user.GetUserName(),
+				"displayName": user.GetFullName(),
+			},
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": COSE_ALG_ES256},
+				{"type": "public-key", "alg": COSE_ALG_EDDSA},
+				{"type": "public-key", "alg": COSE_ALG_RS256},
+			},
+			"timeout":            WEBAUTHN_TIMEOUT * 60 * 1000,
+			"attestation":        "none",
+			"excludeCredentials": webauthn_creds(user.GetUserName(), false),
+		},
+	}
+
+	b, err := json.Marshal(o)
+	options = string(b)
+	return
+}
+
+/* Options for navigator.credentials.get() */
+func WebAuthn_LoginOptions(user PfUser) (options string, err error) {
+	creds := webauthn_creds(user.GetUserName(), true)
+	if len(creds) == 0 {
+		err = errors.New("No WebAuthn credentials configured")
+		return
+	}
+
+	options, err = webauthn_login_options(user.GetUserName(), creds)
+	return
+}
+
+func webauthn_login_options(username string, creds []webauthn_cred) (options string, err error) {
+	challenge, tok, err := webauthn_challenge(username, "get")
+	if err != nil {
+		return
+	}
+
+	rpid, _ := webauthn_rp()
+
+	o := map[string]interface{}{
+		"token": tok,
+		"publicKey": map[string]interface{}{
+			"challenge":        challenge,
+			"rpId":             rpid,
+			"timeout":          WEBAUTHN_TIMEOUT * 60 * 1000,
+			"allowCredentials": creds,
+			"userVerification": "discouraged",
+		},
+	}
+
+	b, err := json.Marshal(o)
+	options = string(b)
+	return
+}
+
+/*
+ * A decoy credential for unknown users, or users without WebAuthn
+ *
+ * Derived from the username with the system secret, thus
+ * repeated requests, to any node, return the same credential.
+ */
+func webauthn_decoy_creds(username string) (creds []webauthn_cred, err error) {
+	/* 64 bytes, like the credential IDs of most security keys */
+	var id []byte
+	for _, part := range []string{"1", "2"} {
+		var mac []byte
+
+		mac, err = System_HMAC("webauthn-decoy", part+":"+strings.ToLower(username))
+		if err != nil {
+			return
+		}
+
+		id = append(id, mac...)
+	}
+
+	creds = []webauthn_cred{{"public-key", webauthn_b64(id)}}
+	return
+}
+
+/* Verify a registration response and store the credential */
+func WebAuthn_Register(ctx PfCtx, user PfUser, descr string, response string) (id int, err error) {
+	resp, err := webauthn_response(response)
+	if err != nil {
+		return
+	}
+
+	challenge, claims, err := webauthn_token(user.GetUserName(), "create", resp.Token)
+	if err != nil {
+		return
+	}
+
+	rpid, origin := webauthn_rp()
+
+	credid, pubkey, counter, err := webauthn_verify_register(rpid, origin, challenge, resp)
+	if err != nil {
+		return
+	}
+
+	/* Single use */
+	Jwt_invalidate(resp.Token, claims)
+
+	/* The ceremony proves possession, thus it is active right away */
+	q := "INSERT INTO second_factors " +
+		"(member, type, descr, entered, active, key, counter, credential) " +
+		"VALUES($1, 'WEBAUTHN', $2, NOW(), 't', $3, $4, $5) " +
+		"RETURNING id"
+	err = DB.QueryRowA(ctx,
+		"Add 2FA Token WEBAUTHN: $2",
+		q,
+		user.GetUserName(), descr, webauthn_b64(pubkey), int64(counter), webauthn_b64(credid)).Scan(&id)
+	if err != nil {
+		err = errors.New("Could not add 2FA Token")
+		return
+	}
+
+	return
+}
+
+/*
+ * Verify an assertion for a stored credential
+ *
+ * ok is false when the assertion is for another credential,
+ * err is set when it is for this one but not valid.
+ */
+func (user *PfUserS) webauthn_assert(ctx PfCtx, t_id int, t_cred string, t_key string, t_counter int64, twofactor string) (ok bool, err error) {
+	resp, err := webauthn_response(twofactor)
+	if err != nil {
+		return
+	}
+
+	if resp.Id != t_cred {
+		return
+	}
+
+	ok = true
+
+	challenge, claims, err := webauthn_token(user.GetUserName(), "get", resp.Token)
+	if err != nil {
+		return
+	}
+
+	pubkey, err := webauthn_unb64(t_key)
+	if err != nil {
+		return
+	}
+
+	rpid, origin := webauthn_rp()
+
+	counter, err := webauthn_verify_assert(rpid, origin, challenge, pubkey, uint32(t_counter), resp)
+	if err != nil {
+		return
+	}
+
+	/* Single use */
+	Jwt_invalidate(resp.Token, claims)
+
+	q := "UPDATE second_factors " +
+		"SET counter = $2 " +
+		"WHERE id = $1"
+	err = DB.Exec(ctx,
+		"Updated WebAuthn counter for 2FA $1",
+		1, q,
+		t_id, int64(counter))
+	return
+}
+
+func user_2fa_webauthn_begin(ctx PfCtx, args []string) (err error) {
+	/* username := args[0] */
+	pw := args[1]
+
+	user := ctx.SelectedUser()
+
+	/* SysAdmins can bypass the password check */
+	if !ctx.TheUser().IsSysAdmin() {
+		err = user.Verify_Password(ctx, pw)
+		if err != nil {
+			return
+		}
+	}
+
+	options, err := WebAuthn_RegisterOptions(user)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("%s", options)
+	return
+}
+
+func user_2fa_webauthn_finish(ctx PfCtx, args []string) (err error) {
+	/* username := args[0] */
+	descr := args[1]
+	response := args[2]
+
+	user := ctx.SelectedUser()
+
+	id, err := WebAuthn_Register(ctx, user, descr, response)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("Name: %s", descr)
+	ctx.OutLn("Token Type: %s", "WEBAUTHN")
+	ctx.OutLn("ID: %d", id)
+	return
+}
+
+/*
+ * Unauthenticated, the options are needed to log in
+ *
+ * Unknown users, and users without WebAuthn, get options for a
+ * decoy credential, thus the answer does not tell who exists.
+ */
+func system_webauthn_login(ctx PfCtx, args []string) (err error) {
+	username := args[0]
+
+	/* Count it as a login attempt, limiting enumeration */
+	ip := ctx.GetClientIP().String()
+	if Iptrk_count(ip) {
+		err = errors.New("Too many login attempts from IP: " + ip)
+		return
+	}
+
+	var creds []webauthn_cred
+
+	user := ctx.NewUser()
+	if user.fetch(ctx, username) == nil {
+		username = user.GetUserName()
+		creds = webauthn_creds(username, true)
+	}
+
+	if len(creds) == 0 {
+		creds, err = webauthn_decoy_creds(username)
+		if err != nil {
+			return
+		}
+	}
+
+	options, err := webauthn_login_options(username, creds)
+	if err != nil {
+		return
+	}
+
+	ctx.OutLn("%s", options)
+	return
+}
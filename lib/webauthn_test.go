@@ -0,0 +1,271 @@
+package pitchfork
+
+/*
+ * $ go test trident.li/pitchfork/lib -run WebAuthn -v
+ *
+ * A software authenticator performs the ceremonies.
+ */
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+const wa_test_rpid = "test.example.net"
+const wa_test_origin = "https://test.example.net"
+
+/* Just enough CBOR encoding for the software authenticator */
+func wa_test_cbor_head(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+}
+
+func wa_test_cbor(v interface{}) (out []byte) {
+	switch t := v.(type) {
+	case int:
+		if t >= 0 {
+			return wa_test_cbor_head(0, t)
+		}
+		return wa_test_cbor_head(1, -1-t)
+
+	case []byte:
+		return append(wa_test_cbor_head(2, len(t)), t...)
+
+	case string:
+		return append(wa_test_cbor_head(3, len(t)), t...)
+
+	case [][2]interface{}:
+		/* Map with ordered keys */
+		out = wa_test_cbor_head(5, len(t))
+		for _, kv := range t {
+			out = append(out, wa_test_cbor(kv[0])...)
+			out = append(out, wa_test_cbor(kv[1])...)
+		}
+		return
+	}
+
+	panic("unsupported type")
+}
+
+type wa_test_authenticator struct {
+	credid  []byte
+	ec      *ecdsa.PrivateKey
+	ed      ed25519.PrivateKey
+	counter uint32
+}
+
+func (a *wa_test_authenticator) cose() []byte {
+	if a.ed != nil {
+		return wa_test_cbor([][2]interface{}{
+			{1, 1}, {3, COSE_ALG_EDDSA}, {-1, 6}, {-2, []byte(a.ed.Public().(ed25519.PublicKey))},
+		})
+	}
+
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.ec.X.FillBytes(x)
+	a.ec.Y.FillBytes(y)
+
+	return wa_test_cbor([][2]interface{}{
+		{1, 2}, {3, COSE_ALG_ES256}, {-1, 1}, {-2, x}, {-3, y},
+	})
+}
+
+func (a *wa_test_authenticator) authdata(rpid string, attested bool) []byte {
+	h := sha256.Sum256([]byte(rpid))
+
+	flags := byte(WEBAUTHN_FLAG_UP)
+	if attested {
+		flags |= WEBAUTHN_FLAG_AT
+	}
+
+	ad := append(h[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(ad[33:], a.counter)
+
+	if attested {
+		ad = append(ad, make([]byte, 16)...)
+		ad = append(ad, byte(len(a.credid)>>8), byte(len(a.credid)))
+		ad = append(ad, a.credid...)
+		ad = append(ad, a.cose()...)
+	}
+
+	return ad
+}
+
+func wa_test_clientdata(ctype string, challenge string, origin string) []byte {
+	cd, _ := json.Marshal(webauthn_clientdata{ctype, challenge, origin})
+	return cd
+}
+
+func (a *wa_test_authenticator) create(challenge string) (resp PfWebAuthnResponse) {
+	att := wa_test_cbor([][2]interface{}{
+		{"fmt", "none"},
+		{"attStmt", [][2]interface{}{}},
+		{"authData", a.authdata(wa_test_rpid, true)},
+	})
+
+	resp.Id = webauthn_b64(a.credid)
+	resp.ClientDataJSON = webauthn_b64(wa_test_clientdata("webauthn.create", challenge, wa_test_origin))
+	resp.AttestationObject = webauthn_b64(att)
+	return
+}
+
+func (a *wa_test_authenticator) get(challenge string, origin string) (resp PfWebAuthnResponse) {
+	a.counter++
+
+	ad := a.authdata(wa_test_rpid, false)
+	cd := wa_test_clientdata("webauthn.get", challenge, origin)
+	h := sha256.Sum256(cd)
+	signed := append(append([]byte{}, ad...), h[:]...)
+
+	var sig []byte
+	if a.ed != nil {
+		sig = ed25519.Sign(a.ed, signed)
+	} else {
+		dgst := sha256.Sum256(signed)
+		sig, _ = ecdsa.SignASN1(rand.Reader, a.ec, dgst[:])
+	}
+
+	resp.Id = webauthn_b64(a.credid)
+	resp.ClientDataJSON = webauthn_b64(cd)
+	resp.AuthenticatorData = webauthn_b64(ad)
+	resp.Signature = webauthn_b64(sig)
+	return
+}
+
+func TestWebAuthn_CBOR(t *testing.T) {
+	data := wa_test_cbor([][2]interface{}{{"a", -300}, {1, []byte{1, 2}}})
+	data = append(data, 0xf5)
+
+	v, rest, err := cbor_decode(data)
+	if err != nil {
+		t.Fatalf("Decoding failed: %s", err.Error())
+	}
+
+	m := v.(map[interface{}]interface{})
+	if m["a"] != int64(-300) || len(m[int64(1)].([]byte)) != 2 {
+		t.Errorf("Unexpected map %#v", m)
+	}
+
+	v, _, err = cbor_decode(rest)
+	if err != nil || v != true {
+		t.Errorf("Expected true, got %v %v", v, err)
+	}
+
+	/* Truncated */
+	_, _, err = cbor_decode(data[:len(data)-3])
+	if err == nil {
+		t.Errorf("Truncated data accepted")
+	}
+}
+
+func wa_test_ceremonies(t *testing.T, a *wa_test_authenticator) {
+	credid, pubkey, counter, err := webauthn_verify_register(wa_test_rpid, wa_test_origin, "chal1", a.create("chal1"))
+	if err != nil {
+		t.Fatalf("Registration failed: %s", err.Error())
+	}
+
+	if webauthn_b64(credid) != webauthn_b64(a.credid) || counter != 0 {
+		t.Errorf("Unexpected credential %x %d", credid, counter)
+	}
+
+	/* Challenge from another ceremony */
+	_, _, _, err = webauthn_verify_register(wa_test_rpid, wa_test_origin, "chal2", a.create("chal1"))
+	if err == nil {
+		t.Errorf("Registration with wrong challenge accepted")
+	}
+
+	resp := a.get("chal3", wa_test_origin)
+	counter, err = webauthn_verify_assert(wa_test_rpid, wa_test_origin, "chal3", pubkey, counter, resp)
+	if err != nil {
+		t.Fatalf("Assertion failed: %s", err.Error())
+	}
+
+	if counter != 1 {
+		t.Errorf("Counter not updated: %d", counter)
+	}
+
+	/* Replay, the counter does not increase */
+	_, err = webauthn_verify_assert(wa_test_rpid, wa_test_origin, "chal3", pubkey, counter, resp)
+	if err == nil {
+		t.Errorf("Replayed assertion accepted")
+	}
+
+	/* Phishing site */
+	resp = a.get("chal4", "https://test.example.net.evil.example")
+	_, err = webauthn_verify_assert(wa_test_rpid, wa_test_origin, "chal4", pubkey, counter, resp)
+	if err == nil {
+		t.Errorf("Assertion for another origin accepted")
+	}
+
+	/* Tampered authenticator data */
+	resp = a.get("chal5", wa_test_origin)
+	ad, _ := webauthn_unb64(resp.AuthenticatorData)
+	ad[36]++
+	resp.AuthenticatorData = webauthn_b64(ad)
+	_, err = webauthn_verify_assert(wa_test_rpid, wa_test_origin, "chal5", pubkey, counter, resp)
+	if err == nil {
+		t.Errorf("Tampered assertion accepted")
+	}
+}
+
+func TestWebAuthn_ES256(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Key generation failed: %s", err.Error())
+	}
+
+	wa_test_ceremonies(t, &wa_test_authenticator{credid: []byte("credential-es256"), ec: k})
+}
+
+func TestWebAuthn_EdDSA(t *testing.T) {
+	_, k, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Key generation failed: %s", err.Error())
+	}
+
+	wa_test_ceremonies(t, &wa_test_authenticator{credid: []byte("credential-eddsa"), ed: k})
+}
+
+func TestWebAuthn_Decoy(t *testing.T) {
+	system_cached.Name = "Test"
+	system_cached.Secret = "decoy-test-secret"
+
+	a, err := webauthn_decoy_creds("decoyuser")
+	if err != nil {
+		t.Fatalf("Decoy failed: %s", err.Error())
+	}
+
+	b, _ := webauthn_decoy_creds("DecoyUser")
+	c, _ := webauthn_decoy_creds("otheruser")
+
+	if len(a) != 1 || a[0].Type != "public-key" {
+		t.Fatalf("Unexpected decoy %+v", a)
+	}
+
+	/* Stable, otherwise repeated requests reveal the decoy */
+	if a[0].Id != b[0].Id {
+		t.Errorf("Decoy differs for the same user: %s vs %s", a[0].Id, b[0].Id)
+	}
+
+	if a[0].Id == c[0].Id {
+		t.Errorf("Decoy is the same for different users")
+	}
+
+	id, err := webauthn_unb64(a[0].Id)
+	if err != nil || len(id) != 64 {
+		t.Errorf("Decoy id is not 64 bytes of base64url: %s", a[0].Id)
+	}
+}
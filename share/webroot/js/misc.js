@@ -151,3 +151,33 @@ function fmt_number(x)
 	x = Math.floor(x);
 	return x.toLocaleString();
 }
+
+/* Count down the time left of the SysAdmin elevation */
+function sysadmin_countdown_tick(el, end)
+{
+	var left = Math.floor((end - Date.now()) / 1000);
+
+	if (left <= 0)
+	{
+		el.textContent = "expired";
+		return;
+	}
+
+	var s = left % 60;
+	el.textContent = Math.floor(left / 60) + ":" + (s < 10 ? "0" : "") + s;
+
+	setTimeout(function() { sysadmin_countdown_tick(el, end); }, 1000);
+}
+
+function sysadmin_countdown()
+{
+	var els = document.getElementsByClassName("sysadmin_countdown");
+
+	for (var i = 0; i < els.length; i++)
+	{
+		var end = Date.now() + (parseInt(els[i].dataset.left) * 1000);
+		sysadmin_countdown_tick(els[i], end);
+	}
+}
+
+document.addEventListener("DOMContentLoaded", function(event) { sysadmin_countdown(); });
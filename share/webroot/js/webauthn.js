@@ -0,0 +1,162 @@
+"use strict";
+
+/*
+ * WebAuthn (FIDO2) security keys
+ *
+ * The server provides the options with binary fields base64url
+ * encoded, the response is returned the same way as JSON.
+ */
+
+function webauthn_unb64(s)
+{
+	s = s.replace(/-/g, "+").replace(/_/g, "/");
+	while (s.length % 4)
+	{
+		s += "=";
+	}
+
+	return Uint8Array.from(atob(s), function(c) { return c.charCodeAt(0); });
+}
+
+function webauthn_b64(buf)
+{
+	var s = String.fromCharCode.apply(null, new Uint8Array(buf));
+	return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function webauthn_creds(list)
+{
+	return (list || []).map(function(c)
+	{
+		return { type: c.type, id: webauthn_unb64(c.id) };
+	});
+}
+
+function webauthn_error(msg)
+{
+	var e = document.getElementById("webauthn_error");
+	if (e)
+	{
+		e.textContent = msg;
+		e.style.display = "block";
+	}
+	else
+	{
+		alert(msg);
+	}
+}
+
+/* Forms can have an element named 'submit' hiding the method */
+function webauthn_submit(form)
+{
+	HTMLFormElement.prototype.submit.call(form);
+}
+
+function webauthn_register(btn)
+{
+	var o = JSON.parse(btn.getAttribute("data-options"));
+	var pk = o.publicKey;
+
+	pk.challenge = webauthn_unb64(pk.challenge);
+	pk.user.id = webauthn_unb64(pk.user.id);
+	pk.excludeCredentials = webauthn_creds(pk.excludeCredentials);
+
+	navigator.credentials.create({ publicKey: pk }).then(function(cred)
+	{
+		document.getElementById("webauthn_response").value = JSON.stringify({
+			token: o.token,
+			id: webauthn_b64(cred.rawId),
+			clientDataJSON: webauthn_b64(cred.response.clientDataJSON),
+			attestationObject: webauthn_b64(cred.response.attestationObject)
+		});
+
+		webauthn_submit(btn.form);
+	}).catch(function(err)
+	{
+		webauthn_error("Security key registration failed: " + err);
+	});
+}
+
+function webauthn_login(form)
+{
+	var fd = new FormData(form);
+	fd.set("webauthn", "options");
+
+	var x = new XMLHttpRequest();
+	x.open("POST", form.action);
+	x.onload = function()
+	{
+		var o;
+
+		try
+		{
+			o = JSON.parse(x.response);
+		}
+		catch (e)
+		{
+			webauthn_error("Could not retrieve security key options");
+			return;
+		}
+
+		if (o.Status)
+		{
+			webauthn_error(o.Message);
+			return;
+		}
+
+		var pk = o.publicKey;
+		pk.challenge = webauthn_unb64(pk.challenge);
+		pk.allowCredentials = webauthn_creds(pk.allowCredentials);
+
+		navigator.credentials.get({ publicKey: pk }).then(function(cred)
+		{
+			form.elements["twofactor"].value = JSON.stringify({
+				token: o.token,
+				id: webauthn_b64(cred.rawId),
+				clientDataJSON: webauthn_b64(cred.response.clientDataJSON),
+				authenticatorData: webauthn_b64(cred.response.authenticatorData),
+				signature: webauthn_b64(cred.response.signature)
+			});
+
+			webauthn_submit(form);
+		}).catch(function(err)
+		{
+			webauthn_error("Security key authentication failed: " + err);
+		});
+	};
+	x.send(fd);
+}
+
+window.addEventListener("load", function()
+{
+	if (!window.PublicKeyCredential)
+	{
+		return;
+	}
+
+	/* Registration page */
+	var reg = document.getElementById("webauthn_register");
+	if (reg)
+	{
+		reg.addEventListener("click", function(ev)
+		{
+			ev.preventDefault();
+			webauthn_register(reg);
+		});
+	}
+
+	/* Login page: offer the security key next to the code */
+	var tf = document.querySelector("input[name=twofactor]");
+	if (tf && tf.form)
+	{
+		var btn = document.createElement("button");
+		btn.type = "button";
+		btn.textContent = "Use Security Key";
+		btn.addEventListener("click", function()
+		{
+			webauthn_login(tf.form);
+		});
+
+		tf.parentNode.insertBefore(btn, tf.nextSibling);
+	}
+});
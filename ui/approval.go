@@ -0,0 +1,57 @@
+package pitchforkui
+
+import (
+	pf "trident.li/pitchfork/lib"
+)
+
+/* Requests for commands that need a second SysAdmin */
+func h_system_approval(cui PfUI) {
+	var err error
+	var msg string
+	var output string
+
+	if cui.IsPOST() {
+		button, _ := cui.FormValue("button")
+
+		switch button {
+		case "Approve":
+			msg, err = cui.HandleCmd("system approval approve", []string{""})
+			break
+
+		case "Reject":
+			msg, err = cui.HandleCmd("system approval reject", []string{""})
+			break
+
+		case "Output":
+			/* Shown once, thus not as a message */
+			output, err = cui.HandleCmd("system approval output", []string{""})
+			break
+		}
+	}
+
+	approvals, err2 := pf.Approval_List(true)
+	if err == nil && err2 != nil {
+		err = err2
+	}
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else {
+		/* Success */
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Approvals []pf.PfApproval
+		Output    string
+		Message   string
+		Error     string
+	}
+
+	p := Page{cui.Page_def(), approvals, output, msg, errmsg}
+	cui.Page_show("system/approval.tmpl", p)
+}
@@ -0,0 +1,384 @@
+package pitchforkui
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"trident.li/keyval"
+	pf "trident.li/pitchfork/lib"
+)
+
+type CalEvent struct {
+	cui        PfUI
+	Title      string    `label:"Title" pfreq:"yes" hint:"Short title of the event"`
+	Starts     time.Time `label:"Starts" pfreq:"yes" hint:"When the event starts (UTC)"`
+	Ends       time.Time `label:"Ends" pfreq:"yes" hint:"When the event ends (UTC)"`
+	Location   string    `label:"Location" hint:"Where the event takes place"`
+	Recurrence string    `label:"Repeats" hint:"How often the event repeats" options:"GetRecurrenceOpts"`
+	Descr      string    `label:"Description" pftype:"text" hint:"Details about the event"`
+	Message    string    `label:"Change Message" hint:"Short description of the change"`
+	Button     string    `label:"Save Event" pftype:"submit"`
+}
+
+func NewCalEvent(cui PfUI) (ev *CalEvent) {
+	now := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+	return &CalEvent{cui, "", now, now.Add(time.Hour), "", "none", "", "", ""}
+}
+
+func (ev *CalEvent) GetRecurrenceOpts(obj interface{}) (kvs keyval.KeyVals, err error) {
+	return pf.Calendar_RecurrenceTypes(), nil
+}
+
+func (ev *CalEvent) ObjectContext() (obj interface{}) {
+	return ev.cui
+}
+
+func calendar_cmdpfx(cui PfUI) string {
+	return "group calendar " + cui.SelectedGroup().GetGroupName()
+}
+
+func h_calendar_list(cui PfUI) {
+	events, err := pf.Calendar_Upcoming(cui)
+	if err != nil {
+		H_errmsg(cui, err)
+		return
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		GroupName string
+		Events    []pf.PfCalendarEvent
+	}
+
+	menu := NewPfUIMenu([]PfUIMentry{
+		{"add/", "Add Event", PERM_GROUP_CALENDAR, h_calendar_add, nil},
+		{"feed/", "Calendar Feed", PERM_GROUP_CALENDAR, h_calendar_feed, nil},
+		{"import/", "Import", PERM_GROUP_ADMIN, h_calendar_import, nil},
+	})
+
+	cui.SetPageMenu(&menu)
+
+	p := Page{cui.Page_def(), cui.SelectedGroup().GetGroupName(), events}
+	cui.Page_show("calendar/list.tmpl", p)
+}
+
+func h_calendar_add(cui PfUI) {
+	cmd := calendar_cmdpfx(cui) + " add"
+	arg := []string{"", "", "", "", "", ""}
+
+	msg, err := cui.HandleCmd(cmd, arg)
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else if msg != "" {
+		/* Success */
+		cui.SetRedirect("../", StatusSeeOther)
+		return
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Opt     *CalEvent
+		Message string
+		Error   string
+	}
+
+	opt := NewCalEvent(cui)
+	p := Page{cui.Page_def(), opt, msg, errmsg}
+	cui.Page_show("calendar/edit.tmpl", p)
+}
+
+func h_calendar_read(cui PfUI) {
+	var ev pf.PfCalendarEvent
+
+	err := ev.Fetch(cui, cui.GetSubPath(), cui.GetArg("rev"))
+	if err != nil {
+		H_errmsg(cui, err)
+		return
+	}
+
+	next_s, next_e := ev.Next(time.Now().UTC())
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Event     pf.PfCalendarEvent
+		NextStart time.Time
+		NextEnd   time.Time
+	}
+
+	p := Page{cui.Page_def(), ev, next_s, next_e}
+	cui.Page_show("calendar/read.tmpl", p)
+}
+
+func h_calendar_edit(cui PfUI) {
+	var ev pf.PfCalendarEvent
+
+	id := cui.GetSubPath()
+
+	cmd := calendar_cmdpfx(cui) + " update"
+	arg := []string{id, "", "", "", "", "", "", ""}
+
+	msg, err := cui.HandleCmd(cmd, arg)
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else if msg != "" {
+		/* Success */
+		cui.SetRedirect("./", StatusSeeOther)
+		return
+	}
+
+	err = ev.Fetch(cui, id, "")
+	if err != nil {
+		H_errmsg(cui, err)
+		return
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Opt     *CalEvent
+		Message string
+		Error   string
+	}
+
+	opt := &CalEvent{cui, ev.Title, ev.Starts, ev.Ends, ev.Location, ev.Recurrence, ev.Descr, "", ""}
+	p := Page{cui.Page_def(), opt, msg, errmsg}
+	cui.Page_show("calendar/edit.tmpl", p)
+}
+
+func h_calendar_history(cui PfUI) {
+	revs, err := pf.Calendar_RevisionList(cui, cui.GetSubPath())
+	if err != nil {
+		H_errmsg(cui, err)
+		return
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Revs []pf.PfCalendarRev
+	}
+
+	p := Page{cui.Page_def(), revs}
+	cui.Page_show("calendar/history.tmpl", p)
+}
+
+func h_calendar_delete(cui PfUI) {
+	type del struct {
+		Confirm bool   `label:"Confirm Deletion" pfreq:"yes"`
+		Button  string `label:"Delete Event" pftype:"submit" htmlclass:"deny"`
+		Message string /* Used by pfform() */
+		Error   string /* Used by pfform() */
+	}
+
+	d := del{false, "", "", ""}
+
+	if cui.IsPOST() {
+		confirmed, err := cui.FormValue("confirm")
+		if err != nil || confirmed != "on" {
+			d.Error = "Did not confirm"
+		} else {
+			cmd := calendar_cmdpfx(cui) + " delete"
+			arg := []string{cui.GetSubPath()}
+
+			_, err = cui.HandleCmd(cmd, arg)
+			if err != nil {
+				d.Error = err.Error()
+			} else {
+				cui.SetRedirect("../", StatusSeeOther)
+				return
+			}
+		}
+	}
+
+	type Page struct {
+		*PfPage
+		Delete del
+	}
+
+	p := Page{cui.Page_def(), d}
+	cui.Page_show("calendar/delete.tmpl", p)
+}
+
+func h_calendar_feed(cui PfUI) {
+	var msg = ""
+	var errmsg = ""
+	var err error
+
+	type feed struct {
+		Action string `label:"feed" pftype:"hidden"`
+		Button string `label:"Create new Feed URL" pftype:"submit"`
+	}
+
+	type revoke struct {
+		Action string `label:"feed_revoke" pftype:"hidden"`
+		Button string `label:"Revoke Feed URL" pftype:"submit" htmlclass:"deny"`
+	}
+
+	if cui.IsPOST() {
+		action, err1 := cui.FormValue("action")
+		if err1 != nil {
+			action = "invalid"
+		}
+
+		switch action {
+		case "feed", "feed_revoke":
+			msg, err = cui.HandleCmd(calendar_cmdpfx(cui)+" "+action, []string{})
+			if err != nil {
+				errmsg = err.Error()
+			}
+			break
+
+		default:
+			errmsg = "Invalid input"
+			break
+		}
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Feed    feed
+		Revoke  revoke
+		Message string
+		Error   string
+	}
+
+	p := Page{cui.Page_def(), feed{"feed", ""}, revoke{"feed_revoke", ""}, msg, errmsg}
+	cui.Page_show("calendar/feed.tmpl", p)
+}
+
+func h_calendar_import(cui PfUI) {
+	cmd := calendar_cmdpfx(cui) + " import"
+	arg := []string{""}
+
+	msg, err := cui.HandleCmd(cmd, arg)
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	}
+
+	type imp struct {
+		ICS    string `label:"iCalendar File" pfreq:"yes" pftype:"file" hint:"The .ics file to import events from"`
+		Button string `label:"Import" pftype:"submit"`
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Opt     imp
+		Message string
+		Error   string
+	}
+
+	p := Page{cui.Page_def(), imp{}, msg, errmsg}
+	cui.Page_show("calendar/import.tmpl", p)
+}
+
+/* /ical/<token>.ics -- fetched by calendar clients, thus no login */
+func h_calendar_ical(cui PfUI) {
+	path := cui.GetPath()
+
+	if len(path) != 1 || !strings.HasSuffix(path[0], ".ics") {
+		H_error(cui, StatusNotFound)
+		return
+	}
+
+	tok := strings.TrimSuffix(path[0], ".ics")
+
+	err := pf.Calendar_FeedSelect(cui, tok)
+	if err != nil {
+		cui.Errf("Calendar feed: %s", err.Error())
+		H_error(cui, StatusNotFound)
+		return
+	}
+
+	ics, err := pf.Calendar_ICS(cui)
+	if err != nil {
+		H_error(cui, StatusInternalServerError)
+		return
+	}
+
+	cui.SetContentType("text/calendar")
+	cui.SetFileName(cui.SelectedGroup().GetGroupName() + ".ics")
+	cui.SetExpires(15)
+	cui.SetRaw([]byte(ics))
+}
+
+func h_calendar(cui PfUI) {
+	path := cui.GetPath()
+
+	if len(path) == 0 || path[0] == "" {
+		h_calendar_list(cui)
+		return
+	}
+
+	switch path[0] {
+	case "add":
+		cui.AddCrumb(path[0], "Add Event", "Add Calendar Event")
+		cui.SetPageMenu(nil)
+		h_calendar_add(cui)
+		return
+
+	case "feed":
+		cui.AddCrumb(path[0], "Calendar Feed", "Personal Calendar Feed")
+		cui.SetPageMenu(nil)
+		h_calendar_feed(cui)
+		return
+
+	case "import":
+		if !cui.IAmGroupAdmin() {
+			H_NoAccess(cui)
+			return
+		}
+
+		cui.AddCrumb(path[0], "Import", "Import iCalendar File")
+		cui.SetPageMenu(nil)
+		h_calendar_import(cui)
+		return
+	}
+
+	/* Event ID */
+	_, err := strconv.Atoi(path[0])
+	if err != nil {
+		H_error(cui, StatusNotFound)
+		return
+	}
+
+	var ev pf.PfCalendarEvent
+	err = ev.Fetch(cui, path[0], "")
+	if err != nil {
+		cui.Err("Calendar: " + err.Error())
+		H_error(cui, StatusNotFound)
+		return
+	}
+
+	cui.AddCrumb(path[0], ev.Title, ev.Title)
+
+	/* The event we are working on */
+	cui.SetSubPath(path[0])
+	cui.SetPath(path[1:])
+
+	menu := NewPfUIMenu([]PfUIMentry{
+		{"", "", PERM_GROUP_CALENDAR, h_calendar_read, nil},
+		{"edit", "Edit", PERM_GROUP_CALENDAR, h_calendar_edit, nil},
+		{"history", "History", PERM_GROUP_CALENDAR, h_calendar_history, nil},
+		{"delete", "Delete", PERM_GROUP_CALENDAR, h_calendar_delete, nil},
+	})
+
+	cui.UIMenu(menu)
+}
@@ -1,6 +1,8 @@
 package pitchforkui
 
 import (
+	"strings"
+
 	pf "trident.li/pitchfork/lib"
 )
 
@@ -8,11 +10,39 @@ import (
 func h_api(cui PfUI) {
 	var err error
 
+	/* Count API requests */
+	ip := cui.GetClientIP().String()
+	if pf.Iptrk_hit(pf.IPTRK_API, ip) {
+		cui.SetStatus(StatusTooManyRequests)
+		cui.OutLn("An error occured: Too many API requests from IP: %s", ip)
+		return
+	}
+
 	/* Force bearer auth */
 	if cui.GetToken() == "" {
 		cui.SetBearerAuth(true)
 	}
 
+	/* Not a session, maybe a personal or OAuth2 access token (limited by its scope) */
+	if !cui.IsLoggedIn() {
+		ah := cui.GetHTTPHeader("Authorization")
+		if len(ah) > 7 && strings.ToUpper(ah[0:7]) == "BEARER " {
+			tok := ah[7:]
+			if pf.UserToken_Is(tok) {
+				err = cui.LoginPAT(tok)
+			} else {
+				err = cui.LoginOAuth(tok)
+			}
+
+			if err != nil {
+				cui.SetHeader("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+				cui.SetStatus(StatusUnauthorized)
+				cui.OutLn("An error occured: %s", err.Error())
+				return
+			}
+		}
+	}
+
 	/* Run the command */
 	err = cui.Cmd(cui.GetPath())
 
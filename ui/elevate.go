@@ -0,0 +1,46 @@
+package pitchforkui
+
+import (
+	pf "trident.li/pitchfork/lib"
+)
+
+/* Become a SysAdmin for a limited time, after entering the password and 2FA code again */
+func h_elevate(cui PfUI) {
+	var err error
+	var msg string
+
+	type ElevateForm struct {
+		Password  string `label:"Password" hint:"Your password" pfreq:"yes" pftype:"password"`
+		TwoFactor string `label:"Two Factor Code" hint:"Two Factor Token (if configured)" placeholder:"314159"`
+		Button    string `label:"Become SysAdmin" pftype:"submit"`
+	}
+
+	if cui.IsPOST() {
+		msg, err = cui.HandleCmd("system elevate", []string{"", ""})
+		if err == nil {
+			cui.SetRedirect("/system/", StatusSeeOther)
+			return
+		}
+	}
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else {
+		/* Success */
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Form    *ElevateForm
+		Minutes int
+		Message string
+		Error   string
+	}
+
+	p := Page{cui.Page_def(), &ElevateForm{}, pf.Config.SysAdmin_mins, msg, errmsg}
+	cui.Page_show("misc/elevate.tmpl", p)
+}
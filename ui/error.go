@@ -15,6 +15,7 @@ const (
 	StatusUnauthorized        = http.StatusUnauthorized        /* 401 */
 	StatusForbidden           = http.StatusForbidden           /* 403 */
 	StatusNotFound            = http.StatusNotFound            /* 404*/
+	StatusTooManyRequests     = http.StatusTooManyRequests     /* 429 */
 	StatusInternalServerError = http.StatusInternalServerError /* 500 */
 	StatusNotImplemented      = http.StatusNotImplemented      /* 501 */
 	StatusServiceUnavailable  = http.StatusServiceUnavailable  /* 503 */
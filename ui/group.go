@@ -466,7 +466,7 @@ func h_group(cui PfUI) {
 		{"file", "Files", PERM_GROUP_FILE, h_group_file, nil},
 		{"contacts", "Contacts", PERM_GROUP_MEMBER, h_group_contacts, nil},
 		{"cmd", "Commands", PERM_GROUP_ADMIN | PERM_HIDDEN | PERM_NOCRUMB, h_group_cmd, nil},
-		// TODO: {"calendar", "Calendar", PERM_GROUP_CALENDAR, h_calendar},
+		{"calendar", "Calendar", PERM_GROUP_CALENDAR, h_calendar, nil},
 	})
 
 	cui.UIMenu(menu)
@@ -0,0 +1,71 @@
+package pitchforkui
+
+import (
+	"trident.li/keyval"
+	pf "trident.li/pitchfork/lib"
+)
+
+type ImpersonateForm struct {
+	UserName string `label:"Username" pfcol:"username" pfreq:"yes" hint:"The user to view the system as"`
+	Write    string `label:"Mode" pfreq:"yes" hint:"Read-only refuses all changes, only allow changes when needed" options:"GetWriteOpts"`
+	Reason   string `label:"Reason" pfreq:"yes" hint:"Why, eg the ticket number, shown to the user afterwards"`
+	Button   string `label:"Impersonate" pftype:"submit"`
+}
+
+func (f *ImpersonateForm) GetWriteOpts(obj interface{}) (kvs keyval.KeyVals, err error) {
+	kvs.Add("no", "Read-only")
+	kvs.Add("yes", "Allow changes")
+	return
+}
+
+/* Sysadmin: start impersonating a user, and the recent impersonations */
+func h_system_impersonate(cui PfUI) {
+	var err error
+	var msg string
+
+	if cui.IsPOST() {
+		write, _ := cui.FormValue("write")
+		msg, err = cui.HandleCmd("system impersonate start", []string{"", pf.NormalizeBoolean(write), ""})
+		if err == nil {
+			cui.SetRedirect("/user/"+cui.TheUser().GetUserName()+"/", StatusSeeOther)
+			return
+		}
+	}
+
+	ims, err2 := pf.Impersonate_List()
+	if err == nil && err2 != nil {
+		err = err2
+	}
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else {
+		/* Success */
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Impersonations []pf.PfImpersonation
+		Form           *ImpersonateForm
+		Message        string
+		Error          string
+	}
+
+	p := Page{cui.Page_def(), ims, &ImpersonateForm{Write: "no"}, msg, errmsg}
+	cui.Page_show("system/impersonate.tmpl", p)
+}
+
+/* Stop impersonating, from the banner */
+func h_impersonate(cui PfUI) {
+	_, err := cui.HandleCmd("system impersonate stop", []string{})
+	if err != nil {
+		H_errtxt(cui, err.Error())
+		return
+	}
+
+	cui.SetRedirect("/", StatusSeeOther)
+}
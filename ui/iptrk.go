@@ -9,13 +9,41 @@ func h_iptrk(cui PfUI) {
 	var msg string
 
 	if cui.GetMethod() == "POST" {
-		cmd := "system iptrk remove"
-		arg := []string{""}
+		button, _ := cui.FormValue("button")
 
-		_, err = cui.HandleCmd(cmd, arg)
+		switch button {
+		case "Unlock":
+			_, err = cui.HandleCmd("user password resetcount", []string{""})
+			break
+
+		case "Allow":
+			_, err = cui.HandleCmd("system iptrk allow add", []string{"", ""})
+			break
+
+		case "Track":
+			_, err = cui.HandleCmd("system iptrk allow remove", []string{""})
+			break
+
+		default:
+			cmd := "system iptrk remove"
+			arg := []string{"", ""}
+
+			_, err = cui.HandleCmd(cmd, arg)
+			break
+		}
+	}
+
+	users, err3 := pf.User_LockedList()
+	if err == nil && err3 != nil {
+		err = err3
+	}
+
+	allows, err4 := pf.IPtrk_AllowList()
+	if err == nil && err4 != nil {
+		err = err4
 	}
 
-	ts, err2 := pf.IPtrk_List(cui)
+	ts, err2 := pf.IPtrk_List(cui, "")
 
 	if err2 == pf.ErrNoRows {
 		msg = "Currently there are no entries"
@@ -38,11 +66,13 @@ func h_iptrk(cui PfUI) {
 	/* Output the page */
 	type Page struct {
 		*PfPage
-		Entries []pf.IPtrkEntry
-		Message string
-		Error   string
+		Entries  []pf.IPtrkEntry
+		Accounts []pf.PfLockedUser
+		Allows   []pf.IPtrkAllow
+		Message  string
+		Error    string
 	}
 
-	p := Page{cui.Page_def(), ts, msg, errmsg}
+	p := Page{cui.Page_def(), ts, users, allows, msg, errmsg}
 	cui.Page_show("system/iptrk.tmpl", p)
 }
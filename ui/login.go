@@ -18,6 +18,13 @@ type PfLoginPage struct {
 }
 
 func h_login(cui PfUI) {
+	/* The login page asks for the WebAuthn options of the user */
+	wa, _ := cui.FormValue("webauthn")
+	if wa == "options" && cui.IsPOST() {
+		h_login_webauthn(cui)
+		return
+	}
+
 	cui.SetStatus(StatusUnauthorized)
 
 	cmd := "system login"
@@ -38,6 +45,19 @@ func h_login(cui PfUI) {
 	h_loginui(cui, msg, err)
 }
 
+func h_login_webauthn(cui PfUI) {
+	cmd := "system webauthn_login"
+	arg := []string{""}
+
+	options, err := cui.HandleCmd(cmd, arg)
+	if err != nil {
+		cui.JSONAnswer("error", err.Error())
+		return
+	}
+
+	cui.SetJSON([]byte(options))
+}
+
 func h_relogin(cui PfUI, msg string) {
 	h_loginui(cui, msg, nil)
 }
@@ -73,6 +93,7 @@ func h_loginui(cui PfUI, msg string, err error) {
 
 	l := login{Required: r, Comeback: comeback, Cookies: c, Message: msg, Error: errmsg}
 	p := PfLoginPage{cui.Page_def(), l}
+	p.AddJS("webauthn")
 
 	var pp interface{}
 
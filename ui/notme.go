@@ -0,0 +1,82 @@
+package pitchforkui
+
+import (
+	pf "trident.li/pitchfork/lib"
+)
+
+/*
+ * Report a login as not ours, using the link from the new login mail
+ *
+ * This revokes all sessions and clears the password,
+ * after which a new password is set with the recovery token.
+ */
+func h_notme(cui PfUI) {
+	var err error
+	var msg string
+
+	type NotMeForm struct {
+		UserName string `label:"Username" pfcol:"username" pftype:"hidden"`
+		Token    string `label:"Token" pfcol:"token" pftype:"hidden"`
+		Button   string `label:"This wasn't me" pftype:"submit"`
+	}
+
+	type RecoverForm struct {
+		UserName string `label:"Username" pfcol:"username" pftype:"hidden"`
+		Token    string `label:"Token" pfcol:"token" pftype:"hidden"`
+		Password string `label:"New Password" pfcol:"password" pftype:"password"`
+		Button   string `label:"Set Password" pftype:"submit"`
+	}
+
+	/* From the link in the mail */
+	username := cui.GetArg("username")
+	token := cui.GetArg("token")
+
+	var recover *RecoverForm
+
+	if cui.IsPOST() {
+		username, _ = cui.FormValue("username")
+		token, _ = cui.FormValue("token")
+
+		_, pw_set := cui.FormValue("password")
+		if pw_set == nil {
+			/* Second step: the new password */
+			msg, err = cui.HandleCmd("user password recover", []string{"", "", ""})
+			if err == nil {
+				h_relogin(cui, "Your password has been changed, you can log in again")
+				return
+			}
+
+			recover = &RecoverForm{UserName: username, Token: token}
+		} else {
+			/* First step: revoke everything */
+			var rectoken string
+
+			rectoken, err = pf.User_LoginNotMe(cui, username, token)
+			if err == nil {
+				msg = "All sessions and API access of your account have been revoked, please choose a new password"
+				recover = &RecoverForm{UserName: username, Token: rectoken}
+			}
+		}
+	}
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else {
+		/* Success */
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Form    *NotMeForm
+		Recover *RecoverForm
+		Message string
+		Error   string
+	}
+
+	p := Page{cui.Page_def(), &NotMeForm{UserName: username, Token: token}, recover, msg, errmsg}
+	cui.Page_show("misc/notme.tmpl", p)
+}
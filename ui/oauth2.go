@@ -1,8 +1,12 @@
 package pitchforkui
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 	pf "trident.li/pitchfork/lib"
@@ -45,6 +49,55 @@ func oauth2_check_redir(redir string, errs *[]string) (u *url.URL, v url.Values)
 	return
 }
 
+/* Get an optional POST/GET parameter */
+func oauth2_getopt(cui PfUI, varname string) (val string) {
+	val = cui.GetArg(varname)
+	if val == "" {
+		val, _ = cui.FormValueNoCSRF(varname)
+	}
+
+	return strings.TrimSpace(val)
+}
+
+/* Error response of the token endpoints (RFC6749 5.2) */
+func oauth2_error(cui PfUI, status int, code string, desc string) {
+	var oe struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+	}
+
+	oe.Error = code
+	oe.Description = desc
+
+	txt, err := json.Marshal(oe)
+	if err != nil {
+		msgs := []string{"JSON encoding failed"}
+		H_errmsgs(cui, msgs)
+		return
+	}
+
+	cui.SetStatus(status)
+	cui.SetJSON(txt)
+}
+
+/* Send the response back to the client, implicit flows use the fragment */
+func oauth2_redirect(cui PfUI, u *url.URL, v url.Values, params url.Values, fragment bool) {
+	if fragment {
+		u.Fragment = ""
+		cui.SetRedirect(u.String()+"#"+params.Encode(), StatusFound)
+		return
+	}
+
+	for key, vals := range params {
+		for _, val := range vals {
+			v.Add(key, val)
+		}
+	}
+
+	u.RawQuery = v.Encode()
+	cui.SetRedirect(u.String(), StatusFound)
+}
+
 /* Authorization code endpoint */
 func oauth2_authorize(cui PfUI) {
 	var o pf.OAuth_Auth
@@ -54,6 +107,15 @@ func oauth2_authorize(cui PfUI) {
 	o.ClientID = oauth2_get(cui, &errs, "client_id")
 	o.Redirect = oauth2_get(cui, &errs, "redirect_uri")
 	o.Scope = oauth2_get(cui, &errs, "scope")
+	o.Nonce = oauth2_getopt(cui, "nonce")
+	o.CodeChallenge = oauth2_getopt(cui, "code_challenge")
+	o.CodeMethod = oauth2_getopt(cui, "code_challenge_method")
+	state := oauth2_getopt(cui, "state")
+
+	/* The order of the response types does not matter */
+	rtypes := strings.Fields(o.RType)
+	sort.Strings(rtypes)
+	o.RType = strings.Join(rtypes, " ")
 
 	/* Check validity */
 	switch o.RType {
@@ -63,6 +125,17 @@ func oauth2_authorize(cui PfUI) {
 	case "token":
 		break
 
+	case "id_token", "id_token token":
+		/* Implicit OpenID Connect flow */
+		if !pf.OAuth2_HasScope(o.Scope, pf.OIDC_SCOPE) {
+			errs = append(errs, "response_type "+o.RType+" requires the "+pf.OIDC_SCOPE+" scope")
+		}
+
+		if o.Nonce == "" {
+			errs = append(errs, "response_type "+o.RType+" requires a nonce")
+		}
+		break
+
 	case "":
 		/* handled by oauth2_get() */
 		break
@@ -74,18 +147,72 @@ func oauth2_authorize(cui PfUI) {
 
 	u, v := oauth2_check_redir(o.Redirect, &errs)
 
+	/* Only registered clients, and only to their own redirect URIs */
+	client, err := pf.OAuth2_ClientGet(o.ClientID)
+	if err == nil {
+		err = client.CheckRedirect(o.Redirect)
+	}
+
+	if err != nil && o.ClientID != "" {
+		errs = append(errs, err.Error())
+	}
+
 	if errs != nil {
 		H_errmsgs(cui, errs)
 		return
 	}
 
+	o.Client = client.Descr
+
+	/* Everything except the code flow returns in the fragment */
+	fragment := o.RType != "code"
+
+	params := url.Values{}
+	if state != "" {
+		params.Set("state", state)
+	}
+
+	/* The redirect is trusted now, thus errors go back to the client */
+	err = client.CheckScope(o.Scope)
+	if err == nil && pf.OAuth2_HasScope(o.Scope, pf.SCOPE_SESSION) {
+		err = errors.New("Scope " + pf.SCOPE_SESSION + " is only for the device grant")
+	}
+
+	if err != nil {
+		params.Set("error", "invalid_scope")
+		params.Set("error_description", err.Error())
+		oauth2_redirect(cui, u, v, params, fragment)
+		return
+	}
+
+	/* Public clients can't authenticate, PKCE binds the code to them */
+	if o.CodeChallenge != "" || (o.RType == "code" && !client.Confidential) {
+		o.CodeMethod, err = pf.OAuth2_PKCECheck(o.CodeChallenge, o.CodeMethod)
+		if err != nil {
+			params.Set("error", "invalid_request")
+			params.Set("error_description", "PKCE: "+err.Error())
+			oauth2_redirect(cui, u, v, params, fragment)
+			return
+		}
+	}
+
+	prompt := oauth2_getopt(cui, "prompt")
+
 	/* Not Logged in? Send to login page so they auth first */
 	if !cui.IsLoggedIn() {
+		if prompt == "none" {
+			params.Set("error", "login_required")
+			oauth2_redirect(cui, u, v, params, fragment)
+			return
+		}
+
 		/* h_login sets a 'comeback' url */
 		h_login(cui)
 		return
 	}
 
+	username := cui.TheUser().GetUserName()
+
 	/* Is it a POST? */
 	if cui.IsPOST() {
 		/* Check if Authorize or Deny */
@@ -98,44 +225,32 @@ func oauth2_authorize(cui PfUI) {
 
 		switch but {
 		case "Authorize":
-			var tok string
-			tok, err = pf.OAuth2_AuthToken_New(cui, o)
+			err = pf.OAuth2_ConsentAdd(cui, username, o.ClientID, o.Scope)
 			if err != nil {
-				errs = append(errs, "Could not generate Token")
+				cui.Errf("OAuth2 Consent: %s", err.Error())
+				errs = append(errs, "Could not record authorization")
 				H_errmsgs(cui, errs)
 				return
 			}
 
-			switch o.RType {
-			case "code":
-				v.Add("code", tok)
-				u.RawQuery = v.Encode()
-				url := u.String()
-				cui.SetRedirect(url, StatusFound)
-				return
-
-			case "token":
-				v.Add("access_token", tok)
-				u.RawQuery = v.Encode()
-				url := u.String()
-				cui.SetRedirect(url, StatusFound)
-				return
-
-			default:
-				break
-			}
-
-			/* Can't get here due to check above */
-			H_error(cui, StatusInternalServerError)
+			oauth2_authorize_issue(cui, o, u, v, params, fragment)
 			return
 
 		case "Deny":
-			url := o.Redirect
-			cui.SetRedirect(url, StatusFound)
+			params.Set("error", "access_denied")
+			oauth2_redirect(cui, u, v, params, fragment)
 			return
 		}
 
 		/* Not a valid button, try again */
+	} else if prompt != "consent" && pf.OAuth2_HasConsent(username, o.ClientID, o.Scope) {
+		/* Authorized before, no need to ask again */
+		oauth2_authorize_issue(cui, o, u, v, params, fragment)
+		return
+	} else if prompt == "none" {
+		params.Set("error", "consent_required")
+		oauth2_redirect(cui, u, v, params, fragment)
+		return
 	}
 
 	/* Show OAuth2 Authorize page */
@@ -148,82 +263,642 @@ func oauth2_authorize(cui PfUI) {
 	cui.Page_show("oauth2/authorize.tmpl", p)
 }
 
+/* The user authorized the client, send it what it asked for */
+func oauth2_authorize_issue(cui PfUI, o pf.OAuth_Auth, u *url.URL, v url.Values, params url.Values, fragment bool) {
+	var tok string
+	var err error
+
+	switch o.RType {
+	case "code":
+		tok, err = pf.OAuth2_AuthToken_New(cui, o)
+		if err != nil {
+			break
+		}
+
+		params.Set("code", tok)
+		break
+
+	case "token", "id_token token":
+		tok, err = pf.OAuth2_AccessToken_New(cui, o.ClientID, o.Scope)
+		if err != nil {
+			break
+		}
+
+		params.Set("access_token", tok)
+		params.Set("token_type", "Bearer")
+		params.Set("expires_in", strconv.Itoa(pf.TOKEN_EXPIRATIONMINUTES*60))
+		params.Set("scope", o.Scope)
+		break
+	}
+
+	if err == nil && strings.HasPrefix(o.RType, "id_token") {
+		var idtok string
+		idtok, err = pf.OIDC_IDToken(cui, cui.TheUser(), o.ClientID, o.Scope, o.Nonce, tok)
+		if err == nil {
+			params.Set("id_token", idtok)
+		}
+	}
+
+	if err != nil {
+		cui.Errf("OAuth2 Authorize: %s", err.Error())
+		H_errmsgs(cui, []string{"Could not generate Token"})
+		return
+	}
+
+	oauth2_redirect(cui, u, v, params, fragment)
+}
+
+/* The client credentials, from the form or HTTP Basic authentication (client_secret_basic) */
+func oauth2_client_auth(cui PfUI) (client_id string, secret string) {
+	client_id = oauth2_getopt(cui, "client_id")
+	secret = oauth2_getopt(cui, "client_secret")
+
+	ah := cui.GetHTTPHeader("Authorization")
+	if len(ah) > 6 && strings.ToUpper(ah[0:6]) == "BASIC " {
+		cred, err := base64.StdEncoding.DecodeString(ah[6:])
+		if err == nil {
+			c := strings.SplitN(string(cred), ":", 2)
+			client_id, _ = url.QueryUnescape(c[0])
+			if len(c) == 2 {
+				secret, _ = url.QueryUnescape(c[1])
+			}
+		}
+	}
+
+	return
+}
+
+/* Authenticate the client at the token, revocation and introspection endpoints */
+func oauth2_client_check(cui PfUI) (client pf.PfOAuth2Client, ok bool) {
+	client_id, secret := oauth2_client_auth(cui)
+	if client_id == "" {
+		oauth2_error(cui, StatusBadRequest, "invalid_request", "Missing client_id")
+		return
+	}
+
+	/* Confidential clients authenticate with their secret */
+	client, err := pf.OAuth2_ClientGet(client_id)
+	if err == nil {
+		err = client.CheckSecret(secret)
+	}
+
+	if err != nil {
+		cui.SetHeader("WWW-Authenticate", "Basic realm=\"OAuth2\"")
+		oauth2_error(cui, StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+
+	ok = true
+	return
+}
+
 /* Access token endpoint */
 func oauth2_token(cui PfUI) {
 	var errs []string
 
-	client_id := oauth2_get(cui, &errs, "client_id")
 	grant_type := oauth2_get(cui, &errs, "grant_type")
+	if len(errs) != 0 {
+		oauth2_error(cui, StatusBadRequest, "invalid_request", strings.Join(errs, ", "))
+		return
+	}
+
+	client, ok := oauth2_client_check(cui)
+	if !ok {
+		return
+	}
+
+	/* Grant Type */
+	switch grant_type {
+	case "authorization_code":
+		oauth2_token_code(cui, client)
+		return
+
+	case "refresh_token":
+		oauth2_token_refresh(cui, client)
+		return
+
+	case pf.OAUTH2_GRANT_DEVICE:
+		oauth2_token_device(cui, client)
+		return
+	}
+
+	oauth2_error(cui, StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type "+grant_type)
+}
+
+/* Exchange an authorization code */
+func oauth2_token_code(cui PfUI, client pf.PfOAuth2Client) {
+	var errs []string
+
 	redirect := oauth2_get(cui, &errs, "redirect_uri")
 	code := oauth2_get(cui, &errs, "code")
-
-	/*
-	 * We do not check the client_secret as authentication
-	 * happens using tokens, the one in 'code'
-	 * client_secret := oauth2_get(cui, &errs, "client_secret")
-	 */
+	verifier := oauth2_getopt(cui, "code_verifier")
 
 	/* Check redirect URL */
 	oauth2_check_redir(redirect, &errs)
 
+	if len(errs) != 0 {
+		oauth2_error(cui, StatusBadRequest, "invalid_request", strings.Join(errs, ", "))
+		return
+	}
+
 	/* Check the code */
 	claims, err := pf.OAuth2_AuthToken_Check(code)
+	if err != nil {
+		oauth2_error(cui, StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	/* Who they claim they are and where they want to go */
+	if claims.ClientID != client.ClientID {
+		oauth2_error(cui, StatusBadRequest, "invalid_grant", "Mismatching client_id")
+		return
+	}
 
+	if claims.Redirect != redirect {
+		oauth2_error(cui, StatusBadRequest, "invalid_grant", "Mismatching redirect_uri")
+		return
+	}
+
+	/* The code is only useful for the one that requested it */
+	err = pf.OAuth2_PKCEVerify(claims, verifier)
 	if err != nil {
-		errs = append(errs, err.Error())
+		oauth2_error(cui, StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	/* Codes can only be used once, also when exchanged concurrently */
+	err = pf.Jwt_invalidate_once(code, claims)
+	if err != nil {
+		oauth2_error(cui, StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	/* The user who authorized the code, who might have changed their mind */
+	username := claims.Subject
+
+	err = pf.OAuth2_ConsentUse(username, client.ClientID)
+	if err != nil {
+		oauth2_error(cui, StatusBadRequest, "invalid_grant", err.Error())
+		return
 	}
 
+	oauth2_token_issue(cui, client, username, claims.Scope, claims.Nonce, "")
+}
+
+/* Rotate a refresh token */
+func oauth2_token_refresh(cui PfUI, client pf.PfOAuth2Client) {
+	var errs []string
+
+	rtok := oauth2_get(cui, &errs, "refresh_token")
 	if len(errs) != 0 {
-		H_errmsgs(cui, errs)
+		oauth2_error(cui, StatusBadRequest, "invalid_request", strings.Join(errs, ", "))
 		return
 	}
 
-	/* Who they claim they are */
-	if claims.ClientID != client_id {
-		errs = append(errs, "Mismatching client_id")
-		H_errmsgs(cui, errs)
+	username, scope, family, err := pf.OAuth2_RefreshUse(client.ClientID, rtok)
+	if err != nil {
+		oauth2_error(cui, StatusBadRequest, "invalid_grant", err.Error())
 		return
 	}
 
-	/* Scope */
-	scope := claims.Scope
+	/* The scope can be narrowed, not extended (RFC6749 6) */
+	req := oauth2_getopt(cui, "scope")
+	if req != "" {
+		for _, s := range strings.Fields(req) {
+			if !pf.OAuth2_HasScope(scope, s) {
+				oauth2_error(cui, StatusBadRequest, "invalid_scope", "Scope "+s+" was not granted")
+				return
+			}
+		}
 
-	/* Grant Type */
-	switch grant_type {
-	case "authorization_code":
-		var at struct {
-			Access_token string `json:"access_token"`
-			Token_type   string `json:"token_type"`
-			Scope        string `json:"scope"`
-			Info         struct {
-				Name string `json:"name"`
-			} `json:"info"`
+		scope = strings.Join(strings.Fields(req), " ")
+	}
+
+	oauth2_token_issue(cui, client, username, scope, "", family)
+}
+
+/* Poll for the result of a device authorization (RFC8628 3.4) */
+func oauth2_token_device(cui PfUI, client pf.PfOAuth2Client) {
+	var errs []string
+
+	device_code := oauth2_get(cui, &errs, "device_code")
+	if len(errs) != 0 {
+		oauth2_error(cui, StatusBadRequest, "invalid_request", strings.Join(errs, ", "))
+		return
+	}
+
+	username, scope, err := pf.OAuth2_DevicePoll(client.ClientID, device_code)
+	switch err {
+	case nil:
+		break
+
+	case pf.ErrOAuth2DevicePending, pf.ErrOAuth2DeviceSlowDown, pf.ErrOAuth2DeviceDenied, pf.ErrOAuth2DeviceExpired:
+		oauth2_error(cui, StatusBadRequest, err.Error(), "")
+		return
+
+	default:
+		oauth2_error(cui, StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	if scope != pf.SCOPE_SESSION {
+		oauth2_token_issue(cui, client, username, scope, "", "")
+		return
+	}
+
+	/* A login, eg by tcli, the session token is renewed when used */
+	var at struct {
+		Access_token string `json:"access_token"`
+		Token_type   string `json:"token_type"`
+		Expires_in   int    `json:"expires_in"`
+		Scope        string `json:"scope"`
+	}
+
+	tok, err := pf.OAuth2_DeviceSession(cui, username)
+	if err != nil {
+		cui.Errf("OAuth2 device session for %s: %s", username, err.Error())
+		oauth2_error(cui, StatusInternalServerError, "server_error", "Could not generate Token")
+		return
+	}
+
+	at.Access_token = tok
+	at.Token_type = "Bearer"
+	at.Expires_in = pf.TOKEN_EXPIRATIONMINUTES * 60
+	at.Scope = scope
+
+	txt, err := json.Marshal(at)
+	if err != nil {
+		msgs := []string{"JSON encoding failed"}
+		H_errmsgs(cui, msgs)
+		return
+	}
+
+	cui.SetHeader("Pragma", "no-cache")
+	cui.SetJSON(txt)
+}
+
+/* The token response, with a new refresh token for the family */
+func oauth2_token_issue(cui PfUI, client pf.PfOAuth2Client, username string, scope string, nonce string, family string) {
+	var at struct {
+		Access_token  string `json:"access_token"`
+		Token_type    string `json:"token_type"`
+		Expires_in    int    `json:"expires_in"`
+		Refresh_token string `json:"refresh_token"`
+		Scope         string `json:"scope"`
+		Id_token      string `json:"id_token,omitempty"`
+		Info          struct {
+			Name string `json:"name"`
+		} `json:"info"`
+	}
+
+	/* A new grant starts a new family */
+	if family == "" {
+		var err error
+		family, err = pf.OAuth2_RefreshFamily()
+		if err != nil {
+			oauth2_error(cui, StatusInternalServerError, "server_error", "Could not generate Token")
+			return
 		}
+	}
 
-		var tok string
-		tok, err = pf.OAuth2_AccessToken_New(cui, client_id, scope)
+	tok, err := pf.OAuth2_AccessToken_NewUser(username, client.ClientID, scope, family)
+	if err != nil {
+		oauth2_error(cui, StatusInternalServerError, "server_error", "Could not generate Token")
+		return
+	}
+
+	rtok, err := pf.OAuth2_RefreshNew(username, client.ClientID, scope, family)
+	if err != nil {
+		cui.Errf("OAuth2 refresh token for %s: %s", username, err.Error())
+		oauth2_error(cui, StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
 
-		at.Access_token = tok
-		at.Token_type = "bearer"
-		at.Scope = scope
-		at.Info.Name = "Trident/Pitchfork"
+	at.Access_token = tok
+	at.Token_type = "Bearer"
+	at.Expires_in = pf.TOKEN_EXPIRATIONMINUTES * 60
+	at.Refresh_token = rtok
+	at.Scope = scope
+	at.Info.Name = "Trident/Pitchfork"
+
+	if pf.OAuth2_HasScope(scope, pf.OIDC_SCOPE) {
+		err = cui.SelectUser(username, PERM_NONE)
+		if err == nil {
+			at.Id_token, err = pf.OIDC_IDToken(cui, cui.SelectedUser(), client.ClientID, scope, nonce, tok)
+		}
 
-		txt, err := json.Marshal(at)
 		if err != nil {
-			msgs := []string{"JSON encoding failed"}
-			H_errmsgs(cui, msgs)
+			cui.Errf("OAuth2 id_token for %s: %s", username, err.Error())
+			oauth2_error(cui, StatusInternalServerError, "server_error", "Could not generate id_token")
 			return
 		}
+	}
+
+	txt, err := json.Marshal(at)
+	if err != nil {
+		msgs := []string{"JSON encoding failed"}
+		H_errmsgs(cui, msgs)
+		return
+	}
+
+	cui.SetHeader("Pragma", "no-cache")
+	cui.SetJSON(txt)
+}
 
-		cui.SetJSON(txt)
+/* Token Revocation (RFC7009) */
+func oauth2_revoke(cui PfUI) {
+	var errs []string
+
+	if !cui.IsPOST() {
+		oauth2_error(cui, StatusBadRequest, "invalid_request", "Only POST supported")
 		return
+	}
 
-	case "token":
+	tok := oauth2_get(cui, &errs, "token")
+	hint := oauth2_getopt(cui, "token_type_hint")
+
+	if len(errs) != 0 {
+		oauth2_error(cui, StatusBadRequest, "invalid_request", strings.Join(errs, ", "))
+		return
+	}
+
+	client, ok := oauth2_client_check(cui)
+	if !ok {
+		return
+	}
+
+	/*
+	 * Invalid tokens, or tokens of other clients, do not cause
+	 * an error, the client can't do anything about it (RFC7009 2.2)
+	 */
+	var err error
+	if hint == "refresh_token" {
+		err = pf.OAuth2_RefreshRevoke(client.ClientID, tok)
+	} else {
+		err = pf.OAuth2_AccessToken_Revoke(client.ClientID, tok)
+		if err != nil {
+			err = pf.OAuth2_RefreshRevoke(client.ClientID, tok)
+		}
+	}
+
+	if err != nil {
+		cui.Dbgf("OAuth2 revoke for %s: %s", client.ClientID, err.Error())
+	}
+
+	cui.SetJSON([]byte("{}"))
+}
+
+/* Token Introspection (RFC7662), for resource servers */
+func oauth2_introspect(cui PfUI) {
+	var errs []string
+
+	if !cui.IsPOST() {
+		oauth2_error(cui, StatusBadRequest, "invalid_request", "Only POST supported")
+		return
+	}
+
+	tok := oauth2_get(cui, &errs, "token")
+	hint := oauth2_getopt(cui, "token_type_hint")
+
+	if len(errs) != 0 {
+		oauth2_error(cui, StatusBadRequest, "invalid_request", strings.Join(errs, ", "))
+		return
+	}
+
+	client, ok := oauth2_client_check(cui)
+	if !ok {
+		return
+	}
+
+	/* Public clients could be anybody */
+	if !client.Confidential {
+		oauth2_error(cui, StatusUnauthorized, "invalid_client", "Introspection requires a confidential client")
+		return
+	}
+
+	txt, err := json.Marshal(pf.OAuth2_Introspect(tok, hint))
+	if err != nil {
+		msgs := []string{"JSON encoding failed"}
+		H_errmsgs(cui, msgs)
+		return
+	}
+
+	cui.SetJSON(txt)
+}
+
+/* Device Authorization Endpoint (RFC8628 3.1) */
+func oauth2_device_authorization(cui PfUI) {
+	var errs []string
+
+	if !cui.IsPOST() {
+		oauth2_error(cui, StatusBadRequest, "invalid_request", "Only POST supported")
+		return
+	}
+
+	scope := oauth2_get(cui, &errs, "scope")
+	if len(errs) != 0 {
+		oauth2_error(cui, StatusBadRequest, "invalid_request", strings.Join(errs, ", "))
+		return
+	}
+
+	client, ok := oauth2_client_check(cui)
+	if !ok {
+		return
+	}
+
+	scope = strings.Join(strings.Fields(scope), " ")
+
+	err := client.CheckScope(scope)
+	if err == nil && pf.OAuth2_HasScope(scope, pf.SCOPE_SESSION) && scope != pf.SCOPE_SESSION {
+		err = errors.New("Scope " + pf.SCOPE_SESSION + " can not be combined with other scopes")
+	}
+
+	if err != nil {
+		oauth2_error(cui, StatusBadRequest, "invalid_scope", err.Error())
+		return
+	}
+
+	device_code, user_code, err := pf.OAuth2_DeviceNew(client.ClientID, scope)
+	if err != nil {
+		cui.Errf("OAuth2 device authorization for %s: %s", client.ClientID, err.Error())
+		oauth2_error(cui, StatusInternalServerError, "server_error", "Could not start device authorization")
+		return
+	}
+
+	var da struct {
+		Device_code               string `json:"device_code"`
+		User_code                 string `json:"user_code"`
+		Verification_uri          string `json:"verification_uri"`
+		Verification_uri_complete string `json:"verification_uri_complete"`
+		Expires_in                int    `json:"expires_in"`
+		Interval                  int    `json:"interval"`
+	}
+
+	da.Device_code = device_code
+	da.User_code = user_code
+	da.Verification_uri = pf.OIDC_Issuer() + "/oauth2/device"
+	da.Verification_uri_complete = da.Verification_uri + "?user_code=" + url.QueryEscape(user_code)
+	da.Expires_in = pf.OAUTH2_DEVICE_MINUTES * 60
+	da.Interval = pf.OAUTH2_DEVICE_INTERVAL
+
+	txt, err := json.Marshal(da)
+	if err != nil {
+		msgs := []string{"JSON encoding failed"}
+		H_errmsgs(cui, msgs)
 		return
+	}
+
+	cui.SetHeader("Pragma", "no-cache")
+	cui.SetJSON(txt)
+}
+
+/* Device verification page, where the user enters the code from the device */
+func oauth2_device(cui PfUI) {
+	var err error
+	var msg string
 
-	case "password":
+	/* Not Logged in? Send to login page so they auth first */
+	if !cui.IsLoggedIn() {
+		/* h_login sets a 'comeback' url */
+		h_login(cui)
 		return
 	}
+
+	type CodeForm struct {
+		UserCode string `label:"Code" pfcol:"user_code" pfreq:"yes" hint:"The code shown on your device"`
+		Button   string `label:"Continue" pftype:"submit"`
+	}
+
+	type ApproveForm struct {
+		Client   string `label:"Application" pfset:"nobody" pfget:"none"`
+		ClientID string `label:"Client ID" pfset:"nobody" pfget:"none"`
+		Scope    string `label:"Scope" pfset:"nobody" pfget:"none"`
+		UserCode string `label:"Code" pfcol:"user_code" pftype:"hidden"`
+		Auth     string `label:"Authorize" pftype:"submit"`
+		Deny     string `label:"Deny" pftype:"submit" htmlclass:"deny"`
+	}
+
+	user_code := oauth2_getopt(cui, "user_code")
+
+	var approve *ApproveForm
+
+	if cui.IsPOST() {
+		button, _ := cui.FormValue("button")
+
+		switch button {
+		case "Authorize", "Deny":
+			err = pf.OAuth2_DeviceDecide(cui, user_code, button == "Authorize")
+			if err == nil {
+				if button == "Authorize" {
+					msg = "Authorized, you can continue on your device"
+				} else {
+					msg = "Denied, your device will not get access"
+				}
+			}
+
+			user_code = ""
+			break
+		}
+	}
+
+	if user_code != "" {
+		var d pf.PfOAuth2Device
+
+		d, err = pf.OAuth2_DeviceGet(user_code)
+		if err == nil {
+			approve = &ApproveForm{Client: d.Descr, ClientID: d.ClientID, Scope: d.Scope, UserCode: d.UserCode}
+		}
+	}
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else {
+		/* Success */
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Form    *CodeForm
+		Approve *ApproveForm
+		Message string
+		Error   string
+	}
+
+	p := Page{cui.Page_def(), &CodeForm{}, approve, msg, errmsg}
+	cui.Page_show("oauth2/device.tmpl", p)
+}
+
+/* OpenID Connect UserInfo Endpoint, authenticated by the access token */
+func oauth2_userinfo(cui PfUI) {
+	tok := ""
+
+	ah := cui.GetHTTPHeader("Authorization")
+	if len(ah) > 7 && strings.ToUpper(ah[0:7]) == "BEARER " {
+		tok = strings.TrimSpace(ah[7:])
+	} else {
+		tok = oauth2_getopt(cui, "access_token")
+	}
+
+	claims, err := pf.OAuth2_AccessToken_Check(tok)
+	if err != nil {
+		cui.SetHeader("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+		oauth2_error(cui, StatusUnauthorized, "invalid_token", err.Error())
+		return
+	}
+
+	if !pf.OAuth2_HasScope(claims.Scope, pf.OIDC_SCOPE) {
+		cui.SetHeader("WWW-Authenticate", "Bearer error=\"insufficient_scope\"")
+		oauth2_error(cui, StatusForbidden, "insufficient_scope", "The "+pf.OIDC_SCOPE+" scope is required")
+		return
+	}
+
+	err = cui.SelectUser(claims.Subject, PERM_NONE)
+	if err != nil {
+		cui.SetHeader("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+		oauth2_error(cui, StatusUnauthorized, "invalid_token", "Unknown user")
+		return
+	}
+
+	info := pf.OIDC_UserInfo(cui, cui.SelectedUser(), claims.Scope)
+
+	txt, err := json.Marshal(info)
+	if err != nil {
+		msgs := []string{"JSON encoding failed"}
+		H_errmsgs(cui, msgs)
+		return
+	}
+
+	cui.SetHeader("Access-Control-Allow-Origin", "*")
+	cui.SetJSON(txt)
+}
+
+/* JSON Web Key Set with the keys that sign the id_tokens, including the previous ones */
+func oauth2_jwks(cui PfUI) {
+	var jwks struct {
+		Keys []pf.OIDC_JWK `json:"keys"`
+	}
+
+	jwks.Keys = pf.OIDC_GetJWKS()
+	if len(jwks.Keys) == 0 {
+		cui.Errf("OAuth2 JWKS: no JWT keys")
+		H_error(cui, StatusInternalServerError)
+		return
+	}
+
+	txt, err := json.Marshal(jwks)
+	if err != nil {
+		msgs := []string{"JSON encoding failed"}
+		H_errmsgs(cui, msgs)
+		return
+	}
+
+	cui.SetHeader("Access-Control-Allow-Origin", "*")
+	cui.SetContentType("application/jwk-set+json")
+	cui.SetRaw(txt)
 }
 
 /* Information Endpoint */
@@ -282,6 +957,12 @@ func h_oauth(cui PfUI) {
 		{"authorize", "Authorize", PERM_NONE | PERM_HIDDEN | PERM_NOCRUMB, oauth2_authorize, nil},
 		{"token", "Token", PERM_NONE | PERM_HIDDEN | PERM_NOCRUMB, oauth2_token, nil},
 		{"info", "Info", PERM_NONE | PERM_HIDDEN | PERM_NOCRUMB, oauth2_info, nil},
+		{"userinfo", "UserInfo", PERM_NONE | PERM_HIDDEN | PERM_NOCRUMB, oauth2_userinfo, nil},
+		{"jwks", "JWKS", PERM_NONE | PERM_HIDDEN | PERM_NOCRUMB, oauth2_jwks, nil},
+		{"revoke", "Revoke", PERM_NONE | PERM_HIDDEN | PERM_NOCRUMB, oauth2_revoke, nil},
+		{"introspect", "Introspect", PERM_NONE | PERM_HIDDEN | PERM_NOCRUMB, oauth2_introspect, nil},
+		{"device_authorization", "Device Authorization", PERM_NONE | PERM_HIDDEN | PERM_NOCRUMB, oauth2_device_authorization, nil},
+		{"device", "Connect a Device", PERM_NONE | PERM_HIDDEN, oauth2_device, nil},
 	})
 
 	cui.SetExpired()
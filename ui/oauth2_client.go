@@ -0,0 +1,126 @@
+package pitchforkui
+
+import (
+	"trident.li/keyval"
+	pf "trident.li/pitchfork/lib"
+)
+
+type OAuth2ClientForm struct {
+	ClientID     string `label:"Client ID" pfcol:"client_id" pfreq:"yes" hint:"Identifier of the client, eg wiki"`
+	Descr        string `label:"Description" pfreq:"yes" hint:"Shown to users when they authorize the client"`
+	Confidential string `label:"Type" pfreq:"yes" hint:"Confidential clients (web servers) can keep a secret, public clients (apps) can not" options:"GetConfidentialOpts"`
+	Button       string `label:"Add Client" pftype:"submit"`
+}
+
+func (cf *OAuth2ClientForm) GetConfidentialOpts(obj interface{}) (kvs keyval.KeyVals, err error) {
+	kvs.Add("yes", "Confidential")
+	kvs.Add("no", "Public")
+	return
+}
+
+/* Sysadmin management of the OAuth2 client registry */
+func h_system_oauth2(cui PfUI) {
+	var err error
+	var msg string
+
+	if cui.IsPOST() {
+		button, _ := cui.FormValue("button")
+
+		switch button {
+		case "Add Client":
+			confidential, _ := cui.FormValue("confidential")
+			msg, err = cui.HandleCmd("system oauth2 add", []string{"", "", pf.NormalizeBoolean(confidential)})
+			break
+
+		case "Remove":
+			msg, err = cui.HandleCmd("system oauth2 remove", []string{""})
+			break
+
+		case "New Secret":
+			msg, err = cui.HandleCmd("system oauth2 secret", []string{""})
+			break
+
+		case "Add Redirect":
+			msg, err = cui.HandleCmd("system oauth2 redirect_add", []string{"", ""})
+			break
+
+		case "Remove Redirect":
+			msg, err = cui.HandleCmd("system oauth2 redirect_remove", []string{"", ""})
+			break
+
+		case "Set Scopes":
+			msg, err = cui.HandleCmd("system oauth2 scopes", []string{"", ""})
+			break
+
+		default:
+			H_errtxt(cui, "Unknown action")
+			return
+		}
+	}
+
+	clients, err2 := pf.OAuth2_ClientList()
+	if err == nil && err2 != nil {
+		err = err2
+	}
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else {
+		/* Success */
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Clients []pf.PfOAuth2Client
+		Form    *OAuth2ClientForm
+		Message string
+		Error   string
+	}
+
+	p := Page{cui.Page_def(), clients, &OAuth2ClientForm{Confidential: "yes"}, msg, errmsg}
+	cui.Page_show("system/oauth2.tmpl", p)
+}
+
+/* The clients a user authorized */
+func h_user_oauth2(cui PfUI) {
+	var err error
+	var msg string
+
+	user := cui.SelectedUser()
+
+	if cui.IsPOST() {
+		cmd := "user oauth2 revoke"
+		arg := []string{user.GetUserName(), ""}
+
+		msg, err = cui.HandleCmd(cmd, arg)
+	}
+
+	consents, err2 := pf.OAuth2_ConsentList(user.GetUserName())
+	if err == nil && err2 != nil {
+		err = err2
+	}
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else {
+		/* Success */
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Consents []pf.PfOAuth2Consent
+		Message  string
+		Error    string
+	}
+
+	p := Page{cui.Page_def(), consents, msg, errmsg}
+	cui.Page_show("user/oauth2.tmpl", p)
+}
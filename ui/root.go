@@ -107,6 +107,9 @@ func (o *PfRootUIS) H_root(w http.ResponseWriter, r *http.Request) {
 		/* Choice files */
 		{"robots.txt", "", PERM_NONE | PERM_NOSUBS, h_robots, nil},
 
+		/* Calendar feeds, authenticated by the token in the URL */
+		{"ical", "", PERM_NONE | PERM_HIDDEN, h_calendar_ical, nil},
+
 		/* QR Codes */
 		{"qr", "", PERM_USER, h_qr, nil},
 
@@ -119,8 +122,13 @@ func (o *PfRootUIS) H_root(w http.ResponseWriter, r *http.Request) {
 		{"search", "Search", PERM_USER | PERM_HIDDEN, h_search, nil},
 		{"cli", "CLI", PERM_CLI, h_cli, nil},
 		{"api", "", PERM_LOOPBACK | PERM_API, h_api, nil},
-		{"oauth2", "OAuth2", PERM_USER, h_oauth, nil},
+		/* OAuth2 clients talk to the token endpoints without a session */
+		{"oauth2", "OAuth2", PERM_OAUTH, h_oauth, nil},
 		{"login", "Login", PERM_NONE | PERM_USER | PERM_NOSUBS, h_login, nil},
+		{"unlock", "", PERM_NONE | PERM_HIDDEN | PERM_NOSUBS, h_unlock, nil},
+		{"notme", "", PERM_NONE | PERM_HIDDEN | PERM_NOSUBS, h_notme, nil},
+		{"elevate", "", PERM_SYS_ADMIN_CAN | PERM_HIDDEN | PERM_NOSUBS, h_elevate, nil},
+		{"impersonate", "", PERM_USER | PERM_HIDDEN | PERM_NOSUBS, h_impersonate, nil},
 		{"logout", "Logout", PERM_NONE | PERM_USER | PERM_HIDDEN | PERM_NOSUBS, h_logout, nil},
 	})
 
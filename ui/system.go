@@ -111,6 +111,9 @@ func h_system(cui PfUI) {
 		{"report", "Report", PERM_SYS_ADMIN, h_system_report, nil},
 		{"settings", "Settings", PERM_SYS_ADMIN, h_system_settings, nil},
 		{"iptrk", "IPtrk", PERM_SYS_ADMIN, h_iptrk, nil},
+		{"oauth2", "OAuth2 Clients", PERM_SYS_ADMIN, h_system_oauth2, nil},
+		{"approval", "Approvals", PERM_SYS_ADMIN, h_system_approval, nil},
+		{"impersonate", "Impersonate", PERM_SYS_ADMIN, h_system_impersonate, nil},
 	})
 
 	cui.UIMenu(menu)
@@ -144,6 +144,9 @@ type PfPage struct {
 	PublicURL        string
 	PeopleDomain     string
 	RenderStamp      string
+	SysAdminLeft     int    /* Seconds left of the SysAdmin elevation */
+	Impersonator     string /* SysAdmin viewing as TheUser */
+	ImpersonateWrite bool   /* The impersonation may make changes */
 	UI               PfUI
 }
 
@@ -852,6 +855,12 @@ func (cui *PfUIS) Page_def() (p *PfPage) {
 		UI:               cui,
 	}
 
+	if cui.IsSysAdmin() {
+		p.SysAdminLeft = int(time.Until(cui.SysAdminUntil()).Seconds())
+	}
+
+	p.Impersonator, p.ImpersonateWrite = cui.Impersonator()
+
 	/*
 	 * Enable Misc + Search Javascript
 	 * Search also works fine when javascript is disabled
@@ -1433,6 +1442,9 @@ func (cui *PfUIS) InitToken() {
 			/* Valid token */
 			cui.token_exp = expsoon
 
+			/* Every request of an impersonation is audited */
+			pf.Impersonate_Audit(cui, cui.GetMethod()+" "+cui.GetFullPath())
+
 			/* Check if we need to swap SysAdmin mode */
 			xtra := cui.r.URL.Query().Get("xtra")
 			switch xtra {
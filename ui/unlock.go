@@ -0,0 +1,48 @@
+package pitchforkui
+
+/* Unlock an account that was locked after too many failed logins, using the mailed link */
+func h_unlock(cui PfUI) {
+	var err error
+	var msg string
+
+	type UnlockForm struct {
+		UserName string `label:"Username" pfcol:"username" pftype:"hidden"`
+		Token    string `label:"Token" pfcol:"token" pftype:"hidden"`
+		Button   string `label:"Unlock Account" pftype:"submit"`
+	}
+
+	/* From the link in the mail */
+	username := cui.GetArg("username")
+	token := cui.GetArg("token")
+
+	if cui.IsPOST() {
+		username, _ = cui.FormValue("username")
+		token, _ = cui.FormValue("token")
+
+		msg, err = cui.HandleCmd("user password unlock", []string{"", ""})
+		if err == nil {
+			h_relogin(cui, "Your account has been unlocked, you can log in again")
+			return
+		}
+	}
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else {
+		/* Success */
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Form    *UnlockForm
+		Message string
+		Error   string
+	}
+
+	p := Page{cui.Page_def(), &UnlockForm{UserName: username, Token: token}, msg, errmsg}
+	cui.Page_show("misc/unlock.tmpl", p)
+}
@@ -534,6 +534,9 @@ func h_user(cui PfUI) {
 		{"password", "Password", PERM_USER_SELF, h_user_password, nil},
 		{"2fa", "2FA Tokens", PERM_USER_SELF, h_user_2fa, nil},
 		{"email", "Email", PERM_USER_SELF, h_user_email, nil},
+		{"oauth2", "Applications", PERM_USER_SELF, h_user_oauth2, nil},
+		{"token", "Access Tokens", PERM_USER_SELF, h_user_token, nil},
+		{"session", "Sessions", PERM_USER_SELF, h_user_session, nil},
 		{"pgp_keys", "Download All PGP Keys", PERM_USER_SELF, h_user_pgp_keys, nil},
 		{"image.png", "", PERM_USER_VIEW, h_user_image, nil},
 		{"log", "Audit Log", PERM_USER_SELF, h_user_log, nil},
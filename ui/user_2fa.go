@@ -21,16 +21,38 @@ func NewTFATok(cui PfUI) (tok *TFATok) {
 }
 
 func (tok *TFATok) GetTypeOpts(obj interface{}) (kvs keyval.KeyVals, err error) {
-	return pf.TwoFactorTypes(), nil
+	/* Recovery codes are generated separately */
+	for _, kv := range pf.TwoFactorTypes() {
+		if kv.Key.(string) == "RECOVERY" {
+			continue
+		}
+
+		kvs.Add(kv.Key, kv.Value)
+	}
+
+	return
 }
 
 func (tok *TFATok) ObjectContext() (obj interface{}) {
 	return tok.cui
 }
 
+type TFARecovery struct {
+	cui         PfUI
+	CurPassword string `label:"Current Password" pfreq:"yes" hint:"Your current password" pftype:"password"`
+	Button      string `label:"Generate" pftype:"submit"`
+}
+
+func (rec *TFARecovery) ObjectContext() (obj interface{}) {
+	return rec.cui
+}
+
 func h_user_2fa_list(cui PfUI) {
+	var tokens []pf.PfUser2FA
+	var recovery int
+
 	user := cui.SelectedUser()
-	tokens, err := user.Fetch2FA()
+	all, err := user.Fetch2FA()
 
 	var errmsg = ""
 
@@ -38,21 +60,32 @@ func h_user_2fa_list(cui PfUI) {
 		/* Failed */
 		errmsg = err.Error()
 	} else {
-		/* Success */
+		/* Success, recovery codes are only counted */
+		for _, t := range all {
+			if t.Type == "RECOVERY" {
+				recovery++
+				continue
+			}
+
+			tokens = append(tokens, t)
+		}
 	}
 
 	/* Output the page */
 	type Page struct {
 		*PfPage
-		Tok     *TFATok
-		Tokens  []pf.PfUser2FA
-		Message string
-		Error   string
-		PWRules string
+		Tok      *TFATok
+		Tokens   []pf.PfUser2FA
+		Recovery int
+		Rec      *TFARecovery
+		Message  string
+		Error    string
+		PWRules  string
 	}
 
 	tok := NewTFATok(cui)
-	p := Page{cui.Page_def(), tok, tokens, "", errmsg, ""}
+	rec := &TFARecovery{cui: cui}
+	p := Page{cui.Page_def(), tok, tokens, recovery, rec, "", errmsg, ""}
 	cui.Page_show("user/2fa/list.tmpl", p)
 }
 
@@ -64,6 +97,13 @@ func h_user_2fa_add(cui PfUI) {
 
 	user := cui.SelectedUser()
 
+	/* Security keys are registered by the browser */
+	ttype, _ := cui.FormValue("type")
+	if cui.IsPOST() && strings.ToUpper(ttype) == "WEBAUTHN" {
+		h_user_2fa_webauthn(cui)
+		return
+	}
+
 	if cui.IsPOST() {
 		cmd := "user 2fa add"
 		arg := []string{user.GetUserName(), "", "", ""}
@@ -109,6 +149,90 @@ func h_user_2fa_add(cui PfUI) {
 	cui.Page_show("user/2fa/create.tmpl", p)
 }
 
+/* Start of a WebAuthn registration, the browser talks to the security key */
+func h_user_2fa_webauthn(cui PfUI) {
+	user := cui.SelectedUser()
+
+	cmd := "user 2fa webauthn_begin"
+	arg := []string{user.GetUserName(), ""}
+
+	options, err := cui.HandleCmd(cmd, arg)
+
+	errmsg := ""
+	if err != nil {
+		errmsg = err.Error()
+	}
+
+	descr, _ := cui.FormValue("descr")
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		User    pf.PfUser
+		Descr   string
+		Options string
+		Error   string
+	}
+
+	p := Page{cui.Page_def(), user, descr, strings.TrimSpace(options), errmsg}
+	p.AddJS("webauthn")
+	cui.Page_show("user/2fa/webauthn.tmpl", p)
+}
+
+/* The response of the browser to the registration */
+func h_user_2fa_webauthn_finish(cui PfUI) {
+	errmsg := ""
+
+	user := cui.SelectedUser()
+
+	cmd := "user 2fa webauthn_finish"
+	arg := []string{user.GetUserName(), "", ""}
+
+	msg, err := cui.HandleCmd(cmd, arg)
+	if err != nil {
+		errmsg = err.Error()
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		User    pf.PfUser
+		Message string
+		Error   string
+		QR      string
+	}
+
+	p := Page{cui.Page_def(), user, msg, errmsg, ""}
+	cui.Page_show("user/2fa/create.tmpl", p)
+}
+
+/* A new batch of recovery codes, shown once */
+func h_user_2fa_recovery(cui PfUI) {
+	errmsg := ""
+
+	user := cui.SelectedUser()
+
+	cmd := "user 2fa recovery generate"
+	arg := []string{user.GetUserName(), ""}
+
+	msg, err := cui.HandleCmd(cmd, arg)
+	if err != nil {
+		errmsg = err.Error()
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		User    pf.PfUser
+		Message string
+		Error   string
+		QR      string
+	}
+
+	p := Page{cui.Page_def(), user, msg, errmsg, ""}
+	cui.Page_show("user/2fa/create.tmpl", p)
+}
+
 func user_2fa_mod(cui PfUI, how string) (err error) {
 	user := cui.SelectedUser()
 	token := cui.SelectedUser2FA()
@@ -133,6 +257,16 @@ func h_user_2fa(cui PfUI) {
 		return
 	}
 
+	if err == nil && button == "Register" {
+		h_user_2fa_webauthn_finish(cui)
+		return
+	}
+
+	if err == nil && button == "Generate" {
+		h_user_2fa_recovery(cui)
+		return
+	}
+
 	path := cui.GetPath()
 
 	/* No token selected? */
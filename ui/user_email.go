@@ -173,6 +173,16 @@ func h_user_email_verify(cui PfUI) (err error) {
 	return
 }
 
+func h_user_email_bounce_reset(cui PfUI) (err error) {
+	email := cui.SelectedEmail()
+
+	cmd := "user email bounce_reset"
+	arg := []string{email.Email}
+
+	_, err = cui.HandleCmd(cmd, arg)
+	return
+}
+
 func h_user_email_confirmform(cui PfUI) (err error) {
 	cmd := "user email confirm"
 	arg := []string{""}
@@ -282,6 +292,10 @@ func h_user_email_edit(cui PfUI) {
 			}
 			break
 
+		case "bounce_reset":
+			err = h_user_email_bounce_reset(cui)
+			break
+
 		case "uploadkey":
 			err = h_user_email_upload_key(cui)
 
@@ -0,0 +1,56 @@
+package pitchforkui
+
+import (
+	pf "trident.li/pitchfork/lib"
+)
+
+/* Active sessions of a user */
+func h_user_session(cui PfUI) {
+	var err error
+	var msg string
+
+	user := cui.SelectedUser()
+
+	if cui.IsPOST() {
+		button, _ := cui.FormValue("button")
+
+		switch button {
+		case "Revoke":
+			msg, err = cui.HandleCmd("user session revoke", []string{user.GetUserName(), ""})
+			break
+
+		case "Revoke All Other Sessions":
+			msg, err = cui.HandleCmd("user session revoke-all", []string{user.GetUserName()})
+			break
+
+		default:
+			H_errtxt(cui, "Unknown action")
+			return
+		}
+	}
+
+	sessions, err2 := pf.UserSession_List(cui, user.GetUserName())
+	if err == nil && err2 != nil {
+		err = err2
+	}
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else {
+		/* Success */
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Sessions []pf.PfSession
+		Message  string
+		Error    string
+	}
+
+	p := Page{cui.Page_def(), sessions, msg, errmsg}
+	cui.Page_show("user/session.tmpl", p)
+}
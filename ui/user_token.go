@@ -0,0 +1,65 @@
+package pitchforkui
+
+import (
+	pf "trident.li/pitchfork/lib"
+)
+
+type UserTokenForm struct {
+	Name   string `label:"Name" pfreq:"yes" hint:"What the token is used for, eg backup cron job"`
+	Scope  string `label:"Scope" pfreq:"yes" hint:"Space separated scopes from the list below"`
+	Days   string `label:"Expires" hint:"Number of days the token is valid, empty for no expiry"`
+	Button string `label:"Create Token" pftype:"submit"`
+}
+
+/* Personal access tokens of a user */
+func h_user_token(cui PfUI) {
+	var err error
+	var msg string
+
+	user := cui.SelectedUser()
+
+	if cui.IsPOST() {
+		button, _ := cui.FormValue("button")
+
+		switch button {
+		case "Create Token":
+			msg, err = cui.HandleCmd("user token create", []string{user.GetUserName(), "", "", ""})
+			break
+
+		case "Revoke":
+			msg, err = cui.HandleCmd("user token revoke", []string{user.GetUserName(), ""})
+			break
+
+		default:
+			H_errtxt(cui, "Unknown action")
+			return
+		}
+	}
+
+	toks, err2 := pf.UserToken_List(user.GetUserName())
+	if err == nil && err2 != nil {
+		err = err2
+	}
+
+	var errmsg = ""
+
+	if err != nil {
+		/* Failed */
+		errmsg = err.Error()
+	} else {
+		/* Success */
+	}
+
+	/* Output the page */
+	type Page struct {
+		*PfPage
+		Tokens  []pf.PfUserToken
+		Scopes  []pf.PfScope
+		Form    *UserTokenForm
+		Message string
+		Error   string
+	}
+
+	p := Page{cui.Page_def(), toks, pf.Scope_List(), &UserTokenForm{}, msg, errmsg}
+	cui.Page_show("user/token.tmpl", p)
+}
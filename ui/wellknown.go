@@ -28,6 +28,13 @@ func h_wellknown(cui PfUI) {
 		}
 		break
 
+	case "openid-configuration":
+		if pf.System_Get().OAuthEnabled {
+			h_openid_configuration(cui)
+			return
+		}
+		break
+
 	default:
 		break
 	}
@@ -35,6 +42,19 @@ func h_wellknown(cui PfUI) {
 	H_error(cui, StatusNotFound)
 }
 
+/* OpenID Connect Discovery */
+func h_openid_configuration(cui PfUI) {
+	txt, err := json.Marshal(pf.OIDC_GetDiscovery())
+	if err != nil {
+		msgs := []string{"JSON encoding failed"}
+		H_errmsgs(cui, msgs)
+		return
+	}
+
+	cui.SetHeader("Access-Control-Allow-Origin", "*")
+	cui.SetJSON(txt)
+}
+
 func h_webfinger(cui PfUI) {
 	var err error
 	var username string
@@ -120,7 +140,7 @@ func h_webfinger(cui PfUI) {
 
 	if rel == spec {
 		jl.Rel = spec
-		jl.Href = pf.System_Get().PublicURL + "/oauth2/"
+		jl.Href = pf.OIDC_Issuer()
 		j.Links = append(j.Links, jl)
 	}
 